@@ -0,0 +1,104 @@
+package clock
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// Frequency is the rate at which mtime advances, in ticks per second.
+const Frequency = 10_000_000
+
+// Clock is the time base behind mtime and the time CSR, counted in ticks of Frequency.
+type Clock interface {
+	Now() uint64
+	Set(t uint64)
+
+	Save(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+// Wall follows the host clock. Guest-visible time only moves when Sample is
+// called, so every value the guest can observe is known to the caller.
+type Wall struct {
+	start time.Time
+	base  uint64
+	now   uint64
+}
+
+func NewWall() *Wall {
+	return &Wall{start: time.Now()}
+}
+
+func (c *Wall) Now() uint64 {
+	return c.now
+}
+
+// Sample reads the host clock and returns the new time.
+func (c *Wall) Sample() uint64 {
+	c.now = c.base + uint64(time.Since(c.start)/(time.Second/Frequency))
+	return c.now
+}
+
+func (c *Wall) Set(t uint64) {
+	c.start = time.Now()
+	c.base = t
+	c.now = t
+}
+
+func (c *Wall) Save(w io.Writer) error {
+	return binary.Write(w, binary.LittleEndian, c.now)
+}
+
+func (c *Wall) Restore(r io.Reader) error {
+	var t uint64
+	if err := binary.Read(r, binary.LittleEndian, &t); err != nil {
+		return err
+	}
+	c.Set(t)
+	return nil
+}
+
+// Virtual derives time from the number of retired instructions, one tick
+// every Ratio instructions, so that a run is independent of host speed.
+type Virtual struct {
+	Ratio uint64
+
+	instret func() uint64
+	skipped uint64 // ticks added by Advance
+}
+
+func NewVirtual(ratio uint64, instret func() uint64) *Virtual {
+	return &Virtual{Ratio: ratio, instret: instret}
+}
+
+func (c *Virtual) Now() uint64 {
+	return c.instret()/c.Ratio + c.skipped
+}
+
+// Advance fast-forwards the clock to t, if t lies in the future.
+func (c *Virtual) Advance(t uint64) {
+	if now := c.Now(); t > now {
+		c.skipped += t - now
+	}
+}
+
+// Set makes Now return t, or the closest value that does not require
+// the clock to run backwards.
+func (c *Virtual) Set(t uint64) {
+	c.skipped = 0
+	c.Advance(t)
+}
+
+func (c *Virtual) Save(w io.Writer) error {
+	return binary.Write(w, binary.LittleEndian, c.Now())
+}
+
+func (c *Virtual) Restore(r io.Reader) error {
+	var t uint64
+	if err := binary.Read(r, binary.LittleEndian, &t); err != nil {
+		return err
+	}
+	c.Set(t)
+	return nil
+}
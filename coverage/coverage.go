@@ -0,0 +1,282 @@
+package coverage
+
+import (
+	"bufio"
+	"debug/dwarf"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"goemu/disasm"
+	"io"
+	"sort"
+)
+
+const (
+	pageSize  = 4096
+	pageInsts = pageSize / 4
+)
+
+// Collector records how many times each instruction of a hart retired and
+// how many times each conditional branch was taken. It is not safe for
+// concurrent use: every hart has a collector of its own, merged once they
+// stop.
+type Collector struct {
+	pages map[uint64]*page
+	last  *page
+}
+
+type page struct {
+	number uint64
+	hits   [pageInsts]uint64
+	taken  [pageInsts]uint64
+}
+
+func New() *Collector {
+	return &Collector{pages: make(map[uint64]*page)}
+}
+
+func (c *Collector) page(pc uint64) *page {
+	number := pc / pageSize
+	p := c.last
+	if p == nil || p.number != number {
+		if p = c.pages[number]; p == nil {
+			p = &page{number: number}
+			c.pages[number] = p
+		}
+		c.last = p
+	}
+	return p
+}
+
+// Executed counts a retirement of the instruction at pc.
+func (c *Collector) Executed(pc uint64) {
+	c.page(pc).hits[pc%pageSize/4]++
+}
+
+// Branch records which way the conditional branch at pc went.
+func (c *Collector) Branch(pc uint64, taken bool) {
+	if taken {
+		c.page(pc).taken[pc%pageSize/4]++
+	}
+}
+
+// Count returns how many times the instruction at pc retired and, for a
+// branch, how many of those it was taken.
+func (c *Collector) Count(pc uint64) (hits, taken uint64) {
+	p := c.pages[pc/pageSize]
+	if p == nil {
+		return 0, 0
+	}
+	return p.hits[pc%pageSize/4], p.taken[pc%pageSize/4]
+}
+
+// Merge adds the counts of another collector to c.
+func (c *Collector) Merge(other *Collector) {
+	for number, o := range other.pages {
+		p := c.page(number * pageSize)
+		for i := range o.hits {
+			p.hits[i] += o.hits[i]
+			p.taken[i] += o.taken[i]
+		}
+	}
+}
+
+// Region is code loaded at Addr, which the exports walk instruction by
+// instruction, executed or not.
+type Region struct {
+	Addr uint64
+	Data []byte
+}
+
+func (r Region) inst(addr uint64) uint64 {
+	return uint64(binary.LittleEndian.Uint32(r.Data[addr-r.Addr:]))
+}
+
+func isBranch(inst uint64) bool {
+	return inst&0x7F == 0b1100011
+}
+
+// WriteBitmap writes one bit per instruction of each region in turn, set if
+// the instruction retired, the first instruction in the low bit of a byte.
+func (c *Collector) WriteBitmap(w io.Writer, code []Region) error {
+	for _, r := range code {
+		bits := make([]byte, (len(r.Data)/4+7)/8)
+		for i := 0; i+4 <= len(r.Data); i += 4 {
+			if hits, _ := c.Count(r.Addr + uint64(i)); hits != 0 {
+				bits[i/32] |= 1 << (i / 4 % 8)
+			}
+		}
+		if _, err := w.Write(bits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteReport disassembles the regions, with how many times each instruction
+// retired, or - if it never did, which way the branches went and the symbols
+// as labels, and ends with a summary.
+func (c *Collector) WriteReport(w io.Writer, code []Region, symbols []elf.Symbol) error {
+	labels := make(map[uint64][]string)
+	for _, s := range symbols {
+		if s.Name != "" && s.Section != elf.SHN_UNDEF && elf.ST_TYPE(s.Info) != elf.STT_SECTION && elf.ST_TYPE(s.Info) != elf.STT_FILE {
+			labels[s.Value] = append(labels[s.Value], s.Name)
+		}
+	}
+	bw := bufio.NewWriter(w)
+	var insts, executed, directions, taken uint64
+	for _, r := range code {
+		for addr := r.Addr; addr+4 <= r.Addr+uint64(len(r.Data)); addr += 4 {
+			names := labels[addr]
+			sort.Strings(names)
+			for _, name := range names {
+				fmt.Fprintf(bw, "%s:\n", name)
+			}
+			inst := r.inst(addr)
+			hits, t := c.Count(addr)
+			count := "-"
+			if insts++; hits != 0 {
+				executed++
+				count = fmt.Sprint(hits)
+			}
+			fmt.Fprintf(bw, "%12s  %x:  %08x  %s", count, addr, inst, disasm.Disassemble(addr, inst))
+			if isBranch(inst) {
+				directions += 2
+				if t != 0 {
+					taken++
+				}
+				if hits-t != 0 {
+					taken++
+				}
+				fmt.Fprintf(bw, "  (taken %d, not taken %d)", t, hits-t)
+			}
+			fmt.Fprintln(bw)
+		}
+	}
+	fmt.Fprintf(bw, "%d of %d instructions executed, %d of %d branch directions taken\n", executed, insts, taken, directions)
+	return bw.Flush()
+}
+
+// Line maps the instructions in [Addr, End) to a line of a source file.
+type Line struct {
+	Addr, End uint64
+	File      string
+	Line      int
+}
+
+// Lines reads the line tables of the DWARF data of a program.
+func Lines(d *dwarf.Data) ([]Line, error) {
+	var lines []Line
+	r := d.Reader()
+	for {
+		cu, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if cu == nil {
+			return lines, nil
+		}
+		r.SkipChildren()
+		if cu.Tag != dwarf.TagCompileUnit {
+			continue
+		}
+		lr, err := d.LineReader(cu)
+		if err != nil {
+			return nil, err
+		}
+		if lr == nil {
+			continue
+		}
+		var prev dwarf.LineEntry
+		for {
+			var e dwarf.LineEntry
+			if err = lr.Next(&e); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			if prev.File != nil && !prev.EndSequence && e.Address > prev.Address {
+				lines = append(lines, Line{Addr: prev.Address, End: e.Address, File: prev.File.Name, Line: prev.Line})
+			}
+			prev = e
+		}
+	}
+}
+
+// WriteLcov writes the coverage of the source lines in lcov tracefile format:
+// how many times the most executed instruction of a line retired, and for
+// each branch instruction of the line how many times it was taken and not.
+// Branches are found in the regions, outside them lines only get hits.
+func (c *Collector) WriteLcov(w io.Writer, lines []Line, code []Region) error {
+	if len(lines) == 0 {
+		return errors.New("no line table to map instructions to source lines")
+	}
+	type branch struct{ hits, taken uint64 }
+	type line struct {
+		hits     uint64
+		branches []branch
+	}
+	files := make(map[string]map[int]*line)
+	for _, l := range lines {
+		if files[l.File] == nil {
+			files[l.File] = make(map[int]*line)
+		}
+		cov := files[l.File][l.Line]
+		if cov == nil {
+			cov = &line{}
+			files[l.File][l.Line] = cov
+		}
+		for addr := l.Addr; addr+4 <= l.End; addr += 4 {
+			hits, taken := c.Count(addr)
+			if hits > cov.hits {
+				cov.hits = hits
+			}
+			for _, r := range code {
+				if addr >= r.Addr && addr+4 <= r.Addr+uint64(len(r.Data)) && isBranch(r.inst(addr)) {
+					cov.branches = append(cov.branches, branch{hits, taken})
+				}
+			}
+		}
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		numbers := make([]int, 0, len(files[name]))
+		for n := range files[name] {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		fmt.Fprintf(bw, "TN:\nSF:%s\n", name)
+		var found, hit, brFound, brHit int
+		for _, n := range numbers {
+			for i, b := range files[name][n].branches {
+				for j, count := range []uint64{b.taken, b.hits - b.taken} {
+					brFound++
+					if b.hits == 0 {
+						fmt.Fprintf(bw, "BRDA:%d,%d,%d,-\n", n, i, j)
+						continue
+					}
+					if count != 0 {
+						brHit++
+					}
+					fmt.Fprintf(bw, "BRDA:%d,%d,%d,%d\n", n, i, j, count)
+				}
+			}
+		}
+		for _, n := range numbers {
+			found++
+			if files[name][n].hits != 0 {
+				hit++
+			}
+			fmt.Fprintf(bw, "DA:%d,%d\n", n, files[name][n].hits)
+		}
+		fmt.Fprintf(bw, "LF:%d\nLH:%d\nBRF:%d\nBRH:%d\nend_of_record\n", found, hit, brFound, brHit)
+	}
+	return bw.Flush()
+}
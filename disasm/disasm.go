@@ -0,0 +1,171 @@
+package disasm
+
+import "fmt"
+
+// Regs are the ABI names of the integer registers.
+var Regs = [32]string{
+	"zero", "ra", "sp", "gp", "tp", "t0", "t1", "t2",
+	"s0", "s1", "a0", "a1", "a2", "a3", "a4", "a5",
+	"a6", "a7", "s2", "s3", "s4", "s5", "s6", "s7",
+	"s8", "s9", "s10", "s11", "t3", "t4", "t5", "t6",
+}
+
+var (
+	loads   = [8]string{"lb", "lh", "lw", "ld", "lbu", "lhu", "lwu", ""}
+	stores  = [8]string{"sb", "sh", "sw", "sd", "", "", "", ""}
+	branch  = [8]string{"beq", "bne", "", "", "blt", "bge", "bltu", "bgeu"}
+	opImm   = [8]string{"addi", "slli", "slti", "sltiu", "xori", "srli", "ori", "andi"}
+	op      = [8]string{"add", "sll", "slt", "sltu", "xor", "srl", "or", "and"}
+	muldiv  = [8]string{"mul", "mulh", "mulhsu", "mulhu", "div", "divu", "rem", "remu"}
+	opW     = [8]string{"addw", "sllw", "", "", "", "srlw", "", ""}
+	muldivW = [8]string{"mulw", "", "", "", "divw", "divuw", "remw", "remuw"}
+	csrs    = [8]string{"", "csrrw", "csrrs", "csrrc", "", "csrrwi", "csrrsi", "csrrci"}
+	amos    = map[uint64]string{
+		0x00: "amoadd", 0x01: "amoswap", 0x02: "lr", 0x03: "sc", 0x04: "amoxor",
+		0x08: "amoor", 0x0C: "amoand", 0x10: "amomin", 0x14: "amomax",
+		0x18: "amominu", 0x1C: "amomaxu",
+	}
+)
+
+// Disassemble returns the assembly of the 32-bit instruction inst at pc,
+// without pseudo-instructions, with jump and branch targets as absolute
+// addresses. Instructions it does not know come out as a .word directive.
+func Disassemble(pc, inst uint64) string {
+	rd, rs1, rs2 := Regs[inst>>7&0x1F], Regs[inst>>15&0x1F], Regs[inst>>20&0x1F]
+	funct3, funct7 := inst>>12&0x7, inst>>25
+	immI := int64(int32(inst)) >> 20
+	immS := int64(int32(inst&0xFE000000))>>20 | int64(inst>>7&0x1F)
+	immB := int64(int32(inst&0x80000000))>>19 | int64(inst&0x80<<4|inst>>20&0x7E0|inst>>7&0x1E)
+	immJ := int64(int32(inst&0x80000000))>>11 | int64(inst&0xFF000|inst>>9&0x800|inst>>20&0x7FE)
+	immU := int64(int32(inst)) >> 12 & 0xFFFFF
+
+	name := ""
+	switch inst & 0x7F {
+	case 0b0000011:
+		if name = loads[funct3]; name != "" {
+			return fmt.Sprintf("%s %s, %d(%s)", name, rd, immI, rs1)
+		}
+	case 0b0100011:
+		if name = stores[funct3]; name != "" {
+			return fmt.Sprintf("%s %s, %d(%s)", name, rs2, immS, rs1)
+		}
+	case 0b0001111:
+		switch funct3 {
+		case 0b000:
+			return "fence " + fenceSet(inst>>24&0xF) + ", " + fenceSet(inst>>20&0xF)
+		case 0b001:
+			return "fence.i"
+		}
+	case 0b0010011:
+		name = opImm[funct3]
+		switch {
+		case funct3 == 0b001 && funct7>>1 == 0, funct3 == 0b101 && funct7>>1 == 0:
+			return fmt.Sprintf("%s %s, %s, %d", name, rd, rs1, inst>>20&0x3F)
+		case funct3 == 0b101 && funct7>>1 == 0b010000:
+			return fmt.Sprintf("srai %s, %s, %d", rd, rs1, inst>>20&0x3F)
+		case funct3 != 0b001 && funct3 != 0b101:
+			return fmt.Sprintf("%s %s, %s, %d", name, rd, rs1, immI)
+		}
+		name = ""
+	case 0b0011011:
+		switch {
+		case funct3 == 0b000:
+			return fmt.Sprintf("addiw %s, %s, %d", rd, rs1, immI)
+		case funct3 == 0b001 && funct7 == 0:
+			return fmt.Sprintf("slliw %s, %s, %d", rd, rs1, inst>>20&0x1F)
+		case funct3 == 0b101 && funct7 == 0:
+			return fmt.Sprintf("srliw %s, %s, %d", rd, rs1, inst>>20&0x1F)
+		case funct3 == 0b101 && funct7 == 0b0100000:
+			return fmt.Sprintf("sraiw %s, %s, %d", rd, rs1, inst>>20&0x1F)
+		}
+	case 0b0110011:
+		switch {
+		case funct7 == 0:
+			name = op[funct3]
+		case funct7 == 1:
+			name = muldiv[funct3]
+		case funct7 == 0b0100000 && funct3 == 0b000:
+			name = "sub"
+		case funct7 == 0b0100000 && funct3 == 0b101:
+			name = "sra"
+		}
+	case 0b0111011:
+		switch {
+		case funct7 == 0:
+			name = opW[funct3]
+		case funct7 == 1:
+			name = muldivW[funct3]
+		case funct7 == 0b0100000 && funct3 == 0b000:
+			name = "subw"
+		case funct7 == 0b0100000 && funct3 == 0b101:
+			name = "sraw"
+		}
+	case 0b0110111:
+		return fmt.Sprintf("lui %s, %#x", rd, immU)
+	case 0b0010111:
+		return fmt.Sprintf("auipc %s, %#x", rd, immU)
+	case 0b1100011:
+		if name = branch[funct3]; name != "" {
+			return fmt.Sprintf("%s %s, %s, %#x", name, rs1, rs2, pc+uint64(immB))
+		}
+	case 0b1101111:
+		return fmt.Sprintf("jal %s, %#x", rd, pc+uint64(immJ))
+	case 0b1100111:
+		if funct3 == 0 {
+			return fmt.Sprintf("jalr %s, %d(%s)", rd, immI, rs1)
+		}
+	case 0b0101111:
+		if amo, ok := amos[funct7>>2]; ok && (funct3 == 0b010 || funct3 == 0b011) {
+			width := ".w"
+			if funct3 == 0b011 {
+				width = ".d"
+			}
+			order := [4]string{"", ".rl", ".aq", ".aqrl"}[funct7&0b11]
+			if amo == "lr" {
+				return fmt.Sprintf("lr%s%s %s, (%s)", width, order, rd, rs1)
+			}
+			return fmt.Sprintf("%s%s%s %s, %s, (%s)", amo, width, order, rd, rs2, rs1)
+		}
+	case 0b1110011:
+		if funct3 == 0 {
+			switch inst >> 7 {
+			case 0:
+				return "ecall"
+			case 0x2000:
+				return "ebreak"
+			case 0x204000:
+				return "sret"
+			case 0x604000:
+				return "mret"
+			case 0x20A000:
+				return "wfi"
+			}
+			if funct7 == 0b0001001 && inst>>7&0x1F == 0 {
+				return fmt.Sprintf("sfence.vma %s, %s", rs1, rs2)
+			}
+		} else if name = csrs[funct3]; name != "" {
+			if funct3&0b100 != 0 {
+				return fmt.Sprintf("%s %s, %#x, %d", name, rd, inst>>20, inst>>15&0x1F)
+			}
+			return fmt.Sprintf("%s %s, %#x, %s", name, rd, inst>>20, rs1)
+		}
+	}
+	if name != "" {
+		return fmt.Sprintf("%s %s, %s, %s", name, rd, rs1, rs2)
+	}
+	return fmt.Sprintf(".word %#08x", inst)
+}
+
+// fenceSet names the predecessor or successor set of a fence.
+func fenceSet(bits uint64) string {
+	s := ""
+	for i, c := range "iorw" {
+		if bits&(8>>i) != 0 {
+			s += string(c)
+		}
+	}
+	if s == "" {
+		return "0"
+	}
+	return s
+}
@@ -0,0 +1,73 @@
+package ether
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Backend carries Ethernet frames between a network device and whatever the
+// guest is connected to.
+type Backend interface {
+	// Send transmits a frame from the guest.
+	Send(frame []byte) error
+	// Frames delivers the frames addressed to the guest.
+	Frames() <-chan []byte
+	Close() error
+}
+
+// Addr is a MAC address.
+type Addr [6]byte
+
+var Broadcast = Addr{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+func ParseAddr(s string) (Addr, error) {
+	var a Addr
+	if _, err := fmt.Sscanf(s, "%02x:%02x:%02x:%02x:%02x:%02x", &a[0], &a[1], &a[2], &a[3], &a[4], &a[5]); err != nil {
+		return a, fmt.Errorf("invalid MAC address: %s", s)
+	}
+	return a, nil
+}
+
+func (a Addr) String() string {
+	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", a[0], a[1], a[2], a[3], a[4], a[5])
+}
+
+// Multicast reports whether a is a group address, which includes broadcast.
+func (a Addr) Multicast() bool {
+	return a[0]&1 == 1
+}
+
+// Frame layout.
+const (
+	HeaderSize = 14
+	MaxFrame   = 1514 // largest frame without the FCS
+	TypeIPv4   = 0x0800
+	TypeARP    = 0x0806
+)
+
+// Dst returns the destination address of frame, which must hold a header.
+func Dst(frame []byte) (a Addr) {
+	copy(a[:], frame[0:6])
+	return
+}
+
+// Src returns the source address of frame, which must hold a header.
+func Src(frame []byte) (a Addr) {
+	copy(a[:], frame[6:12])
+	return
+}
+
+// Type returns the EtherType of frame, which must hold a header.
+func Type(frame []byte) uint16 {
+	return binary.BigEndian.Uint16(frame[12:])
+}
+
+// NewFrame builds a frame around payload.
+func NewFrame(dst, src Addr, typ uint16, payload []byte) []byte {
+	frame := make([]byte, HeaderSize+len(payload))
+	copy(frame[0:], dst[:])
+	copy(frame[6:], src[:])
+	binary.BigEndian.PutUint16(frame[12:], typ)
+	copy(frame[HeaderSize:], payload)
+	return frame
+}
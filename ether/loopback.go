@@ -0,0 +1,231 @@
+package ether
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// The loopback network, laid out like QEMU's user networking so guest
+// configurations carry over.
+var (
+	GatewayAddr = Addr{0x52, 0x55, 0x0A, 0x00, 0x02, 0x02}
+	GatewayIP   = [4]byte{10, 0, 2, 2}
+	GuestIP     = [4]byte{10, 0, 2, 15}
+	Netmask     = [4]byte{255, 255, 255, 0}
+)
+
+const (
+	ipHeaderSize  = 20
+	udpHeaderSize = 8
+	protoICMP     = 1
+	protoUDP      = 17
+
+	arpRequest = 1
+	arpReply   = 2
+
+	icmpEchoReply   = 0
+	icmpEchoRequest = 8
+
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+	dhcpCookie     = 0x63825363
+	dhcpLease      = 86400 // seconds
+
+	// DHCP message types
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpAck      = 5
+
+	// DHCP options
+	dhcpOptSubnet   = 1
+	dhcpOptRouter   = 3
+	dhcpOptLease    = 51
+	dhcpOptType     = 53
+	dhcpOptServerID = 54
+	dhcpOptEnd      = 255
+)
+
+// Loopback is a network with nothing on it but a gateway, which answers ARP
+// requests and pings for its address and hands the guest its address over
+// DHCP. Everything else the guest sends is dropped.
+type Loopback struct {
+	mu     sync.Mutex
+	rx     chan []byte
+	closed bool
+}
+
+func NewLoopback() *Loopback {
+	return &Loopback{rx: make(chan []byte, portQueue)}
+}
+
+func (l *Loopback) Frames() <-chan []byte {
+	return l.rx
+}
+
+func (l *Loopback) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		l.closed = true
+		close(l.rx)
+	}
+	return nil
+}
+
+func (l *Loopback) Send(frame []byte) error {
+	if len(frame) < HeaderSize {
+		return nil
+	}
+	var reply []byte
+	switch Type(frame) {
+	case TypeARP:
+		reply = l.arp(frame)
+	case TypeIPv4:
+		reply = l.ipv4(frame)
+	}
+	if reply == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		select {
+		case l.rx <- reply:
+		default:
+		}
+	}
+	return nil
+}
+
+func (l *Loopback) arp(frame []byte) []byte {
+	p := frame[HeaderSize:]
+	if len(p) < 28 || binary.BigEndian.Uint16(p[0:]) != 1 || binary.BigEndian.Uint16(p[2:]) != TypeIPv4 ||
+		binary.BigEndian.Uint16(p[6:]) != arpRequest || [4]byte(p[24:28]) != GatewayIP {
+		return nil
+	}
+	reply := make([]byte, 28)
+	copy(reply, p[:6]) // hardware and protocol type and sizes
+	binary.BigEndian.PutUint16(reply[6:], arpReply)
+	copy(reply[8:], GatewayAddr[:])
+	copy(reply[14:], GatewayIP[:])
+	copy(reply[18:], p[8:18]) // the sender becomes the target
+	return NewFrame(Src(frame), GatewayAddr, TypeARP, reply)
+}
+
+func (l *Loopback) ipv4(frame []byte) []byte {
+	p := frame[HeaderSize:]
+	if len(p) < ipHeaderSize || p[0]>>4 != 4 {
+		return nil
+	}
+	ihl := int(p[0]&0xF) * 4
+	total := int(binary.BigEndian.Uint16(p[2:]))
+	if ihl < ipHeaderSize || total < ihl || total > len(p) {
+		return nil
+	}
+	dst := [4]byte(p[16:20])
+	payload := p[ihl:total]
+	switch {
+	case p[9] == protoICMP && dst == GatewayIP:
+		if len(payload) < 8 || payload[0] != icmpEchoRequest {
+			return nil
+		}
+		echo := append([]byte(nil), payload...)
+		echo[0] = icmpEchoReply
+		binary.BigEndian.PutUint16(echo[2:], 0)
+		binary.BigEndian.PutUint16(echo[2:], checksum(echo))
+		return NewFrame(Src(frame), GatewayAddr, TypeIPv4, ipPacket(GatewayIP, [4]byte(p[12:16]), protoICMP, echo))
+	case p[9] == protoUDP && len(payload) >= udpHeaderSize && binary.BigEndian.Uint16(payload[2:]) == dhcpServerPort:
+		reply := l.dhcp(payload[udpHeaderSize:])
+		if reply == nil {
+			return nil
+		}
+		udp := make([]byte, udpHeaderSize+len(reply))
+		binary.BigEndian.PutUint16(udp[0:], dhcpServerPort)
+		binary.BigEndian.PutUint16(udp[2:], dhcpClientPort)
+		binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+		copy(udp[udpHeaderSize:], reply) // a zero checksum means none over IPv4
+		return NewFrame(Broadcast, GatewayAddr, TypeIPv4, ipPacket(GatewayIP, [4]byte{255, 255, 255, 255}, protoUDP, udp))
+	}
+	return nil
+}
+
+// dhcp answers a discover with an offer and a request with an ack, always
+// for GuestIP.
+func (l *Loopback) dhcp(msg []byte) []byte {
+	if len(msg) < 240 || msg[0] != 1 || binary.BigEndian.Uint32(msg[236:]) != dhcpCookie {
+		return nil
+	}
+	var typ uint8
+	for opts := msg[240:]; len(opts) >= 2 && opts[0] != dhcpOptEnd; {
+		if opts[0] == 0 { // padding
+			opts = opts[1:]
+			continue
+		}
+		n := int(opts[1])
+		if len(opts) < 2+n {
+			break
+		}
+		if opts[0] == dhcpOptType && n == 1 {
+			typ = opts[2]
+		}
+		opts = opts[2+n:]
+	}
+	switch typ {
+	case dhcpDiscover:
+		typ = dhcpOffer
+	case dhcpRequest:
+		typ = dhcpAck
+	default:
+		return nil
+	}
+	reply := make([]byte, 240, 300)
+	reply[0] = 2 // BOOTREPLY
+	copy(reply[1:3], msg[1:3])
+	copy(reply[4:8], msg[4:8])     // transaction id
+	copy(reply[10:12], msg[10:12]) // flags
+	copy(reply[16:20], GuestIP[:])
+	copy(reply[20:24], GatewayIP[:])
+	copy(reply[28:44], msg[28:44]) // client hardware address
+	binary.BigEndian.PutUint32(reply[236:], dhcpCookie)
+	var lease [4]byte
+	binary.BigEndian.PutUint32(lease[:], dhcpLease)
+	reply = append(reply, dhcpOptType, 1, typ)
+	reply = append(reply, dhcpOptServerID, 4)
+	reply = append(reply, GatewayIP[:]...)
+	reply = append(reply, dhcpOptLease, 4)
+	reply = append(reply, lease[:]...)
+	reply = append(reply, dhcpOptSubnet, 4)
+	reply = append(reply, Netmask[:]...)
+	reply = append(reply, dhcpOptRouter, 4)
+	reply = append(reply, GatewayIP[:]...)
+	return append(reply, dhcpOptEnd)
+}
+
+func ipPacket(src, dst [4]byte, proto uint8, payload []byte) []byte {
+	p := make([]byte, ipHeaderSize+len(payload))
+	p[0] = 0x45 // version 4, no options
+	binary.BigEndian.PutUint16(p[2:], uint16(len(p)))
+	p[8] = 64 // TTL
+	p[9] = proto
+	copy(p[12:], src[:])
+	copy(p[16:], dst[:])
+	binary.BigEndian.PutUint16(p[10:], checksum(p[:ipHeaderSize]))
+	copy(p[ipHeaderSize:], payload)
+	return p
+}
+
+// checksum is the Internet checksum of b.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,49 @@
+package ether
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// pcap file format, microsecond timestamps and Ethernet link type.
+const (
+	pcapMagic    = 0xA1B2C3D4
+	pcapSnapLen  = 65535
+	pcapEthernet = 1
+)
+
+// Pcap writes frames to a capture file readable by tcpdump and Wireshark.
+type Pcap struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewPcap writes the file header to w.
+func NewPcap(w io.Writer) (*Pcap, error) {
+	header := []any{uint32(pcapMagic), uint16(2), uint16(4), int32(0), uint32(0), uint32(pcapSnapLen), uint32(pcapEthernet)}
+	for _, v := range header {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return nil, err
+		}
+	}
+	return &Pcap{w: w}, nil
+}
+
+// Write adds frame to the capture, stamped with the host time.
+func (p *Pcap) Write(frame []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	n := len(frame)
+	if n > pcapSnapLen {
+		n = pcapSnapLen
+	}
+	record := []uint32{uint32(now.Unix()), uint32(now.Nanosecond() / 1000), uint32(n), uint32(len(frame))}
+	if err := binary.Write(p.w, binary.LittleEndian, record); err != nil {
+		return err
+	}
+	_, err := p.w.Write(frame[:n])
+	return err
+}
@@ -0,0 +1,237 @@
+package ether
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+const portQueue = 64 // frames buffered per port before they are dropped
+
+// On a stream socket every frame is preceded by its length as a big-endian
+// uint32, the same framing QEMU uses for its stream network backend.
+func readFrame(r io.Reader) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	if n < HeaderSize || n > 65535 {
+		return nil, fmt.Errorf("invalid frame size: %d", n)
+	}
+	frame := make([]byte, n)
+	_, err := io.ReadFull(r, frame)
+	return frame, err
+}
+
+func writeFrame(w io.Writer, frame []byte) error {
+	buf := make([]byte, 4+len(frame))
+	binary.BigEndian.PutUint32(buf, uint32(len(frame)))
+	copy(buf[4:], frame)
+	_, err := w.Write(buf)
+	return err
+}
+
+// Switch is a learning Ethernet switch. Devices in the same process plug into
+// it with Port, other goemu instances connect to it over a Unix socket.
+type Switch struct {
+	mu    sync.Mutex
+	ports map[*port]bool
+	table map[Addr]*port // where each source address was last seen
+	l     net.Listener
+}
+
+type port struct {
+	sw *Switch
+	rx chan []byte
+}
+
+func NewSwitch() *Switch {
+	return &Switch{ports: make(map[*port]bool), table: make(map[Addr]*port)}
+}
+
+func (s *Switch) newPort() *port {
+	p := &port{sw: s, rx: make(chan []byte, portQueue)}
+	s.mu.Lock()
+	s.ports[p] = true
+	s.mu.Unlock()
+	return p
+}
+
+func (s *Switch) remove(p *port) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ports[p] {
+		return
+	}
+	delete(s.ports, p)
+	for a, q := range s.table {
+		if q == p {
+			delete(s.table, a)
+		}
+	}
+	close(p.rx)
+}
+
+// forward passes a frame that arrived on from to the port its destination
+// was seen on, or to every other port if that is not known.
+func (s *Switch) forward(from *port, frame []byte) {
+	if len(frame) < HeaderSize {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ports[from] {
+		return
+	}
+	if src := Src(frame); !src.Multicast() {
+		s.table[src] = from
+	}
+	if to, ok := s.table[Dst(frame)]; ok {
+		if to != from {
+			to.send(frame)
+		}
+		return
+	}
+	for p := range s.ports {
+		if p != from {
+			p.send(frame)
+		}
+	}
+}
+
+func (p *port) send(frame []byte) {
+	select {
+	case p.rx <- frame:
+	default: // the port is congested, drop the frame like a real switch
+	}
+}
+
+func (p *port) Send(frame []byte) error {
+	p.sw.forward(p, frame)
+	return nil
+}
+
+func (p *port) Frames() <-chan []byte {
+	return p.rx
+}
+
+func (p *port) Close() error {
+	p.sw.remove(p)
+	return nil
+}
+
+// Port plugs a new device into the switch.
+func (s *Switch) Port() Backend {
+	return s.newPort()
+}
+
+// Listen accepts connections from other instances on a Unix socket at path,
+// replacing a stale one.
+func (s *Switch) Listen(path string) error {
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	s.l = l
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return nil
+}
+
+// serve connects a remote instance to a port of its own.
+func (s *Switch) serve(conn net.Conn) {
+	p := s.newPort()
+	go func() {
+		for frame := range p.rx {
+			if writeFrame(conn, frame) != nil {
+				break
+			}
+		}
+		conn.Close()
+	}()
+	for {
+		frame, err := readFrame(conn)
+		if err != nil {
+			break
+		}
+		s.forward(p, frame)
+	}
+	s.remove(p)
+	conn.Close()
+}
+
+func (s *Switch) Close() error {
+	if s.l == nil {
+		return nil
+	}
+	return s.l.Close()
+}
+
+// remote is a connection to a switch in another instance.
+type remote struct {
+	mu   sync.Mutex
+	conn net.Conn
+	rx   chan []byte
+}
+
+// DialSwitch connects to a switch listening on a Unix socket at path.
+func DialSwitch(path string) (Backend, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	r := &remote{conn: conn, rx: make(chan []byte, portQueue)}
+	go func() {
+		defer close(r.rx)
+		for {
+			frame, err := readFrame(conn)
+			if err != nil {
+				return
+			}
+			select {
+			case r.rx <- frame:
+			default:
+			}
+		}
+	}()
+	return r, nil
+}
+
+func (r *remote) Send(frame []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	writeFrame(r.conn, frame) // frames are lost once the switch is gone, as on a pulled cable
+	return nil
+}
+
+func (r *remote) Frames() <-chan []byte {
+	return r.rx
+}
+
+func (r *remote) Close() error {
+	return r.conn.Close()
+}
+
+// JoinSwitch connects to the switch at path, or starts serving one there if
+// no other instance does yet.
+func JoinSwitch(path string) (Backend, error) {
+	if b, err := DialSwitch(path); err == nil {
+		return b, nil
+	}
+	s := NewSwitch()
+	if err := s.Listen(path); err != nil {
+		return nil, err
+	}
+	return s.Port(), nil
+}
@@ -0,0 +1,437 @@
+package gdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"goemu/runtime"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Register numbers used by GDB for RISC-V when no target description is sent.
+const (
+	RegPc      = 32
+	RegCsrBase = 65
+)
+
+// Command is a monitor command, run with "monitor <name> <args>" from GDB.
+type Command func(args []string, out io.Writer) error
+
+// Server speaks the GDB remote serial protocol over a single connection,
+// including the reverse execution packets backed by a runtime.Timeline.
+type Server struct {
+	Monitor map[string]Command
+
+	cpu         *runtime.CPU
+	tl          *runtime.Timeline
+	breakpoints map[uint64]bool
+
+	conn    net.Conn
+	packets chan string
+	stop    chan struct{} // interrupt requests (Ctrl-C) from GDB
+}
+
+func NewServer(cpu *runtime.CPU, tl *runtime.Timeline) *Server {
+	s := &Server{
+		cpu:         cpu,
+		tl:          tl,
+		breakpoints: make(map[uint64]bool),
+	}
+	s.Monitor = map[string]Command{
+		"help":    s.help,
+		"instret": s.instret,
+		"seek":    s.seek,
+		"savevm":  s.savevm,
+	}
+	if cpu.Bus.Framebuffer != nil {
+		s.Monitor["screendump"] = s.screendump
+	}
+	return s
+}
+
+// ListenAndServe waits for GDB to connect on addr and serves the session
+// until GDB detaches or kills the target.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	fmt.Printf("gdb: waiting for connection on %s\n", l.Addr())
+	if s.conn, err = l.Accept(); err != nil {
+		return err
+	}
+	defer s.conn.Close()
+	s.packets = make(chan string)
+	s.stop = make(chan struct{}, 1)
+	go s.readPackets()
+
+	for pkt := range s.packets {
+		reply, done, err := s.handle(pkt)
+		if err != nil {
+			return err
+		}
+		if err = s.send(reply); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+	return nil
+}
+
+// readPackets acknowledges every packet from GDB and hands it to the serving loop.
+func (s *Server) readPackets() {
+	defer close(s.packets)
+	r := bufio.NewReader(s.conn)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		switch b {
+		case 0x03:
+			select {
+			case s.stop <- struct{}{}:
+			default:
+			}
+			continue
+		case '$':
+		default:
+			continue // acks and noise
+		}
+		data, err := r.ReadString('#')
+		if err != nil {
+			return
+		}
+		sum := make([]byte, 2)
+		if _, err = io.ReadFull(r, sum); err != nil {
+			return
+		}
+		if _, err = s.conn.Write([]byte{'+'}); err != nil {
+			return
+		}
+		s.packets <- strings.TrimSuffix(data, "#")
+	}
+}
+
+func (s *Server) send(data string) error {
+	sum := uint8(0)
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	_, err := fmt.Fprintf(s.conn, "$%s#%02x", data, sum)
+	return err
+}
+
+func (s *Server) handle(pkt string) (reply string, done bool, err error) {
+	if pkt == "" {
+		return "", false, nil
+	}
+	switch pkt[0] {
+	case '?':
+		return "S05", false, nil
+	case 'g':
+		var sb strings.Builder
+		for _, r := range s.cpu.Regs {
+			sb.WriteString(encodeReg(r))
+		}
+		sb.WriteString(encodeReg(s.cpu.Pc))
+		return sb.String(), false, nil
+	case 'G':
+		data, err := hex.DecodeString(pkt[1:])
+		if err != nil || len(data) < 8*33 {
+			return "E01", false, nil
+		}
+		for i := 0; i < 32; i++ {
+			s.cpu.Regs[i] = binary.LittleEndian.Uint64(data[i*8:])
+		}
+		s.cpu.Regs[0] = 0
+		s.cpu.Pc = binary.LittleEndian.Uint64(data[32*8:])
+		return s.written()
+	case 'p':
+		n, err := strconv.ParseUint(pkt[1:], 16, 64)
+		if err != nil {
+			return "E01", false, nil
+		}
+		v, ok := s.readReg(n)
+		if !ok {
+			return "E01", false, nil
+		}
+		return encodeReg(v), false, nil
+	case 'P':
+		n, v, ok := strings.Cut(pkt[1:], "=")
+		reg, err1 := strconv.ParseUint(n, 16, 64)
+		data, err2 := hex.DecodeString(v)
+		if !ok || err1 != nil || err2 != nil || len(data) != 8 || !s.writeReg(reg, binary.LittleEndian.Uint64(data)) {
+			return "E01", false, nil
+		}
+		return s.written()
+	case 'm':
+		addr, length, ok := parseAddrLen(pkt[1:])
+		if !ok {
+			return "E01", false, nil
+		}
+		// only RAM: reading a device register could pop a FIFO or claim an
+		// interrupt behind the guest's back
+		if length > uint64(len(s.cpu.Bus.Mem.Data)) {
+			return "E14", false, nil
+		}
+		buf := make([]byte, length)
+		if _, err := s.cpu.Bus.Mem.ReadAt(buf, int64(addr)); err != nil {
+			return "E14", false, nil
+		}
+		return hex.EncodeToString(buf), false, nil
+	case 'M':
+		head, v, _ := strings.Cut(pkt[1:], ":")
+		addr, length, ok := parseAddrLen(head)
+		data, err := hex.DecodeString(v)
+		if !ok || err != nil || uint64(len(data)) != length {
+			return "E01", false, nil
+		}
+		// only RAM, and all of it or nothing, for the same reason as m
+		if _, err = s.cpu.Bus.Mem.WriteAt(data, int64(addr)); err != nil {
+			return "E14", false, nil
+		}
+		return s.written()
+	case 'Z', 'z':
+		kind, rest, _ := strings.Cut(pkt[1:], ",")
+		addr, _, ok := parseAddrLen(rest)
+		if kind != "0" || !ok {
+			return "", false, nil
+		}
+		if pkt[0] == 'Z' {
+			s.breakpoints[addr] = true
+		} else {
+			delete(s.breakpoints, addr)
+		}
+		return "OK", false, nil
+	case 's':
+		return s.stopReply(s.tl.Step()), false, nil
+	case 'c':
+		return s.stopReply(s.cont()), false, nil
+	case 'b':
+		switch pkt {
+		case "bs":
+			return s.stopReply(s.tl.StepBack()), false, nil
+		case "bc":
+			return s.stopReply(s.tl.ContinueBack(s.hitBreakpoint)), false, nil
+		}
+	case 'H':
+		return "OK", false, nil
+	case 'D':
+		return "OK", true, nil
+	case 'k':
+		return "", true, nil
+	case 'q':
+		return s.query(pkt)
+	}
+	return "", false, nil
+}
+
+func (s *Server) query(pkt string) (string, bool, error) {
+	switch {
+	case strings.HasPrefix(pkt, "qSupported"):
+		return "PacketSize=4000;ReverseStep+;ReverseContinue+", false, nil
+	case pkt == "qAttached":
+		return "1", false, nil
+	case pkt == "qfThreadInfo":
+		return "m1", false, nil
+	case pkt == "qsThreadInfo":
+		return "l", false, nil
+	case pkt == "qC":
+		return "QC1", false, nil
+	case strings.HasPrefix(pkt, "qRcmd,"):
+		cmd, err := hex.DecodeString(pkt[len("qRcmd,"):])
+		if err != nil {
+			return "E01", false, nil
+		}
+		return s.monitor(string(cmd))
+	}
+	return "", false, nil
+}
+
+// cont runs until a breakpoint is reached or GDB interrupts the target.
+func (s *Server) cont() error {
+	for i := 0; ; i++ {
+		if err := s.tl.Step(); err != nil {
+			return err
+		}
+		if s.hitBreakpoint(s.cpu) {
+			return nil
+		}
+		if i%runtime.PollInterval == 0 {
+			select {
+			case <-s.stop:
+				return nil
+			default:
+			}
+		}
+	}
+}
+
+func (s *Server) hitBreakpoint(cpu *runtime.CPU) bool {
+	return s.breakpoints[cpu.Pc]
+}
+
+// written replies to a write to registers or memory, which starts a new
+// history: the checkpoints before it would replay without the write.
+func (s *Server) written() (string, bool, error) {
+	if err := s.tl.Reset(); err != nil {
+		return "", false, err
+	}
+	return "OK", false, nil
+}
+
+func (s *Server) stopReply(err error) string {
+	switch {
+	case err == nil:
+		return "S05"
+	case errors.Is(err, runtime.ErrHistoryStart):
+		return "T05replaylog:begin;"
+	case errors.Is(err, io.EOF):
+		return "W00"
+	default:
+		fmt.Printf("gdb: %v\n", err)
+		return "S04"
+	}
+}
+
+func (s *Server) readReg(n uint64) (uint64, bool) {
+	switch {
+	case n < 32:
+		return s.cpu.Regs[n], true
+	case n == RegPc:
+		return s.cpu.Pc, true
+	case n >= RegCsrBase && n < RegCsrBase+runtime.CsrNum:
+		v, err := s.cpu.ReadCsr(n - RegCsrBase)
+		return v, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func (s *Server) writeReg(n, v uint64) bool {
+	switch {
+	case n == 0:
+	case n < 32:
+		s.cpu.Regs[n] = v
+	case n == RegPc:
+		s.cpu.Pc = v
+	case n >= RegCsrBase && n < RegCsrBase+runtime.CsrNum:
+		return s.cpu.WriteCsr(n-RegCsrBase, v) == nil
+	default:
+		return false
+	}
+	return true
+}
+
+func (s *Server) monitor(line string) (string, bool, error) {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		args = []string{"help"}
+	}
+	var out strings.Builder
+	cmd, ok := s.Monitor[args[0]]
+	if !ok {
+		fmt.Fprintf(&out, "unknown command: %s\n", args[0])
+	} else if err := cmd(args[1:], &out); err != nil {
+		fmt.Fprintf(&out, "%s: %v\n", args[0], err)
+	}
+	if out.Len() > 0 {
+		if err := s.send("O" + hex.EncodeToString([]byte(out.String()))); err != nil {
+			return "", false, err
+		}
+	}
+	return "OK", false, nil
+}
+
+func (s *Server) help(args []string, out io.Writer) error {
+	fmt.Fprintln(out, "help                show this message")
+	fmt.Fprintln(out, "instret             print the number of retired instructions")
+	fmt.Fprintln(out, "seek <instret>      move execution to any point in its history")
+	fmt.Fprintln(out, "savevm <file>       save a snapshot of the machine")
+	if s.Monitor["screendump"] != nil {
+		fmt.Fprintln(out, "screendump <file>   save the framebuffer as a PNG image")
+	}
+	return nil
+}
+
+func (s *Server) instret(args []string, out io.Writer) error {
+	fmt.Fprintf(out, "%d\n", s.cpu.Instret)
+	return nil
+}
+
+func (s *Server) seek(args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("usage: seek <instret>")
+	}
+	n, err := strconv.ParseUint(args[0], 0, 64)
+	if err != nil {
+		return err
+	}
+	if err = s.tl.Seek(n); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "pc %#x at instret %d\n", s.cpu.Pc, s.cpu.Instret)
+	return nil
+}
+
+func (s *Server) savevm(args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("usage: savevm <file>")
+	}
+	f, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	if err = s.cpu.SaveSnapshot(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *Server) screendump(args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("usage: screendump <file>")
+	}
+	f, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	if err = s.cpu.Bus.Framebuffer.WritePNG(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func encodeReg(v uint64) string {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return hex.EncodeToString(b[:])
+}
+
+func parseAddrLen(s string) (addr, length uint64, ok bool) {
+	a, l, found := strings.Cut(s, ",")
+	addr, err := strconv.ParseUint(a, 16, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if !found {
+		return addr, 0, true
+	}
+	length, err = strconv.ParseUint(l, 16, 64)
+	if err != nil || length > 0x10000 {
+		return 0, 0, false
+	}
+	return addr, length, true
+}
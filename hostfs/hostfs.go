@@ -0,0 +1,61 @@
+package hostfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Root returns the absolute path of dir with symlinks resolved, in the form
+// Resolve expects.
+func Root(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(dir)
+}
+
+// Resolve maps a guest path onto the host directory root. Relative paths are
+// taken from root too, and neither ".." nor symlinks may lead out of it.
+// Access outside of root fails with fs.ErrPermission.
+func Resolve(root, name string) (string, error) {
+	return resolve(root, filepath.Join(root, filepath.Clean("/"+name)), 0)
+}
+
+// maxLinks is how many dangling symlinks resolve follows, as Linux does.
+const maxLinks = 40
+
+func resolve(root, full string, links int) (string, error) {
+	real, err := filepath.EvalSymlinks(full)
+	if errors.Is(err, fs.ErrNotExist) {
+		// the file may be about to be created, so check its directory instead
+		dir, err := filepath.EvalSymlinks(filepath.Dir(full))
+		if err != nil {
+			return "", err
+		}
+		real = filepath.Join(dir, filepath.Base(full))
+		// unless it is a dangling symlink, which creating the file follows
+		if fi, err := os.Lstat(real); err == nil && fi.Mode()&fs.ModeSymlink != 0 {
+			if links == maxLinks {
+				return "", fs.ErrPermission
+			}
+			target, err := os.Readlink(real)
+			if err != nil {
+				return "", err
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(dir, target)
+			}
+			return resolve(root, filepath.Clean(target), links+1)
+		}
+	} else if err != nil {
+		return "", err
+	}
+	if real != root && !strings.HasPrefix(real, root+string(filepath.Separator)) {
+		return "", fs.ErrPermission
+	}
+	return real, nil
+}
@@ -0,0 +1,50 @@
+package hostio
+
+import "os"
+
+const ptyQueue = 256 // writes buffered while nothing drains the terminal
+
+// Pty is a pseudo-terminal the user attaches to with a terminal program, for
+// example screen. Output is dropped rather than blocking the guest while the
+// terminal's buffer is full.
+type Pty struct {
+	Name string // path of the terminal to attach to
+
+	master *os.File
+	slave  *os.File // kept open so that the master survives detaching
+	out    chan []byte
+}
+
+func OpenPty() (*Pty, error) {
+	master, slave, err := openPty()
+	if err != nil {
+		return nil, err
+	}
+	p := &Pty{Name: slave.Name(), master: master, slave: slave, out: make(chan []byte, ptyQueue)}
+	go func() {
+		for b := range p.out {
+			if _, err := master.Write(b); err != nil {
+				return
+			}
+		}
+	}()
+	return p, nil
+}
+
+func (p *Pty) Read(b []byte) (int, error) {
+	return p.master.Read(b)
+}
+
+func (p *Pty) Write(b []byte) (int, error) {
+	select {
+	case p.out <- append([]byte(nil), b...):
+	default:
+	}
+	return len(b), nil
+}
+
+func (p *Pty) Close() error {
+	close(p.out)
+	p.slave.Close()
+	return p.master.Close()
+}
@@ -0,0 +1,104 @@
+package hostio
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+// Socket is a byte stream served on a Unix socket, for device backends that
+// talk to a host program. One client is connected at a time; a new client
+// replaces the previous one. Writes are dropped while no client is connected,
+// and reads block until a client sends something.
+type Socket struct {
+	l    net.Listener
+	data chan []byte
+	done chan struct{} // closed once the listener is gone
+	rest []byte        // part of a chunk that did not fit into the last Read
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// ListenUnix creates the socket at path, replacing a stale one.
+func ListenUnix(path string) (*Socket, error) {
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	s := &Socket{l: l, data: make(chan []byte, 16), done: make(chan struct{})}
+	go s.accept()
+	return s, nil
+}
+
+func (s *Socket) accept() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			close(s.done)
+			return
+		}
+		s.mu.Lock()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.conn = conn
+		s.mu.Unlock()
+		go s.receive(conn)
+	}
+}
+
+func (s *Socket) receive(conn net.Conn) {
+	for {
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		if n > 0 {
+			select {
+			case s.data <- buf[:n]:
+			case <-s.done:
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Read returns data sent by the clients, in the order it arrived.
+func (s *Socket) Read(p []byte) (int, error) {
+	if len(s.rest) == 0 {
+		select {
+		case s.rest = <-s.data:
+		case <-s.done:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, s.rest)
+	s.rest = s.rest[n:]
+	return n, nil
+}
+
+func (s *Socket) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return len(p), nil
+	}
+	if _, err := s.conn.Write(p); err != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return len(p), nil
+}
+
+func (s *Socket) Close() error {
+	s.mu.Lock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.mu.Unlock()
+	return s.l.Close()
+}
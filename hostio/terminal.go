@@ -0,0 +1,74 @@
+package hostio
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// Escape is the key that starts a command on the terminal, Ctrl-A. It is
+// followed by x to quit, or by a second Ctrl-A to send one to the guest.
+const Escape = 0x01
+
+// Terminal is the host terminal in raw mode, so that every key goes to the
+// guest as typed. Quit is closed when the user types the quit sequence.
+type Terminal struct {
+	Quit chan struct{}
+
+	in      *os.File
+	out     io.Writer
+	saved   any // terminal state to restore, nil if in is not a terminal
+	escaped bool
+	once    sync.Once
+}
+
+// OpenTerminal switches standard input to raw mode if it is a terminal.
+func OpenTerminal() *Terminal {
+	t := &Terminal{Quit: make(chan struct{}), in: os.Stdin, out: os.Stdout}
+	if saved, err := makeRaw(t.in.Fd(), true); err == nil {
+		t.saved = saved
+	}
+	return t
+}
+
+// Read returns the keys typed, with escape sequences taken out.
+func (t *Terminal) Read(p []byte) (int, error) {
+	for {
+		buf := make([]byte, len(p))
+		n, err := t.in.Read(buf)
+		out := 0
+		for _, b := range buf[:n] {
+			switch {
+			case t.escaped && (b == 'x' || b == 'X'):
+				t.once.Do(func() { close(t.Quit) })
+				return out, io.EOF
+			case t.escaped:
+				t.escaped = false
+				p[out] = b
+				out++
+			case b == Escape:
+				t.escaped = true
+			default:
+				p[out] = b
+				out++
+			}
+		}
+		if out > 0 || err != nil {
+			return out, err
+		}
+	}
+}
+
+func (t *Terminal) Write(p []byte) (int, error) {
+	return t.out.Write(p)
+}
+
+// Close puts the terminal back into the mode it was found in.
+func (t *Terminal) Close() error {
+	if t.saved == nil {
+		return nil
+	}
+	saved := t.saved
+	t.saved = nil
+	return restore(t.in.Fd(), saved)
+}
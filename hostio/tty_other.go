@@ -0,0 +1,22 @@
+//go:build !linux
+
+package hostio
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoTerminal = errors.New("terminal control is not supported on this host")
+
+func makeRaw(fd uintptr, output bool) (any, error) {
+	return nil, errNoTerminal
+}
+
+func restore(fd uintptr, saved any) error {
+	return errNoTerminal
+}
+
+func openPty() (master, slave *os.File, err error) {
+	return nil, nil, errNoTerminal
+}
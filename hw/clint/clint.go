@@ -0,0 +1,127 @@
+package clint
+
+import (
+	"encoding/binary"
+	"fmt"
+	"goemu/clock"
+	"io"
+)
+
+// CLINT (core-local interruptor) registers, laid out like the SiFive CLINT.
+const (
+	Base = 0x2000000
+	Size = 0x10000
+	End  = Base + Size - 1
+
+	Msip     = 0x0000 // machine software interrupt pending, 4 bytes per hart
+	Mtimecmp = 0x4000 // machine timer compare, 8 bytes per hart
+	Mtime    = 0xBFF8 // machine time
+)
+
+type Clint struct {
+	Clock clock.Clock
+
+	msip     []uint32
+	mtimecmp []uint64
+}
+
+// NewClint returns a CLINT for the given number of harts.
+func NewClint(c clock.Clock, harts int) *Clint {
+	cl := &Clint{Clock: c, msip: make([]uint32, harts), mtimecmp: make([]uint64, harts)}
+	for i := range cl.mtimecmp {
+		cl.mtimecmp[i] = ^uint64(0)
+	}
+	return cl
+}
+
+// Harts returns the number of harts the CLINT serves.
+func (c *Clint) Harts() int {
+	return len(c.msip)
+}
+
+func (c *Clint) Check(bytes uint64) error {
+	switch bytes {
+	case 4, 8:
+		return nil
+	default:
+		return fmt.Errorf("invalid data bytes: %d", bytes)
+	}
+}
+
+func (c *Clint) Load(addr, bytes uint64) (uint64, error) {
+	if err := c.Check(bytes); err != nil {
+		return 0, err
+	}
+	offset := addr - Base
+	var reg uint64
+	switch {
+	case offset < Msip+4*uint64(len(c.msip)):
+		reg = uint64(c.msip[offset/4])
+		if bytes == 8 && offset/4+1 < uint64(len(c.msip)) {
+			reg |= uint64(c.msip[offset/4+1]) << 32
+		}
+		return reg, nil
+	case offset >= Mtimecmp && offset < Mtimecmp+8*uint64(len(c.mtimecmp)):
+		reg = c.mtimecmp[(offset-Mtimecmp)/8]
+	case offset&^0b111 == Mtime:
+		reg = c.Clock.Now()
+	}
+	if bytes == 4 {
+		return (reg >> ((offset & 0b100) * 8)) & 0xFFFFFFFF, nil
+	}
+	return reg, nil
+}
+
+func (c *Clint) Store(addr, bytes, data uint64) error {
+	if err := c.Check(bytes); err != nil {
+		return err
+	}
+	offset := addr - Base
+	switch {
+	case offset < Msip+4*uint64(len(c.msip)):
+		c.msip[offset/4] = uint32(data & 1)
+		if bytes == 8 && offset/4+1 < uint64(len(c.msip)) {
+			c.msip[offset/4+1] = uint32(data >> 32 & 1)
+		}
+	case offset >= Mtimecmp && offset < Mtimecmp+8*uint64(len(c.mtimecmp)):
+		reg := &c.mtimecmp[(offset-Mtimecmp)/8]
+		if bytes == 4 {
+			shift := (offset & 0b100) * 8
+			*reg = *reg&^(0xFFFFFFFF<<shift) | (data&0xFFFFFFFF)<<shift
+		} else {
+			*reg = data
+		}
+	}
+	// mtime is kept by the clock and cannot be written
+	return nil
+}
+
+// Pending reports the software and timer interrupt lines of a hart.
+func (c *Clint) Pending(hart int) (msip, mtip bool) {
+	return c.msip[hart] != 0, c.Clock.Now() >= c.mtimecmp[hart]
+}
+
+// Deadline returns the time at which the timer interrupt of a hart fires.
+func (c *Clint) Deadline(hart int) uint64 {
+	return c.mtimecmp[hart]
+}
+
+func (c *Clint) Save(w io.Writer) error {
+	if err := binary.Write(w, binary.LittleEndian, c.msip); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, c.mtimecmp); err != nil {
+		return err
+	}
+	return c.Clock.Save(w)
+}
+
+func (c *Clint) Restore(r io.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, c.msip); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.LittleEndian, c.mtimecmp); err != nil {
+		return err
+	}
+	return c.Clock.Restore(r)
+}
@@ -0,0 +1,157 @@
+package fb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"sync"
+)
+
+// The framebuffer is a linear array of pixels in guest physical memory, as
+// described by a simple-framebuffer device tree node.
+const DefaultBase = 0x28000000
+
+// Format is a pixel format, named as in the simple-framebuffer binding.
+type Format string
+
+const (
+	A8R8G8B8 Format = "a8r8g8b8"
+	X8R8G8B8 Format = "x8r8g8b8"
+	A8B8G8R8 Format = "a8b8g8r8"
+	X8B8G8R8 Format = "x8b8g8r8"
+	R5G6B5   Format = "r5g6b5"
+)
+
+// BytesPerPixel returns the size of a pixel, or 0 for an unknown format.
+func (f Format) BytesPerPixel() int {
+	switch f {
+	case A8R8G8B8, X8R8G8B8, A8B8G8R8, X8B8G8R8:
+		return 4
+	case R5G6B5:
+		return 2
+	}
+	return 0
+}
+
+type Framebuffer struct {
+	Base   uint64
+	Width  int
+	Height int
+	Stride int // bytes per line
+	Format Format
+
+	mu   sync.Mutex // the display is read from other goroutines
+	data []byte
+}
+
+func NewFramebuffer(base uint64, width, height int, format Format) (*Framebuffer, error) {
+	bpp := format.BytesPerPixel()
+	if bpp == 0 {
+		return nil, fmt.Errorf("invalid pixel format: %s", format)
+	}
+	if width <= 0 || height <= 0 || width > 8192 || height > 8192 {
+		return nil, fmt.Errorf("invalid resolution: %dx%d", width, height)
+	}
+	return &Framebuffer{
+		Base:   base,
+		Width:  width,
+		Height: height,
+		Stride: width * bpp,
+		Format: format,
+		data:   make([]byte, width*height*bpp),
+	}, nil
+}
+
+// Size is the number of bytes the framebuffer occupies on the bus.
+func (f *Framebuffer) Size() uint64 {
+	return uint64(len(f.data))
+}
+
+func (f *Framebuffer) Contains(addr uint64) bool {
+	return addr >= f.Base && addr-f.Base < f.Size()
+}
+
+func (f *Framebuffer) Load(addr, bytes uint64) (uint64, error) {
+	offset := addr - f.Base
+	if bytes > 8 || offset+bytes > f.Size() {
+		return 0, fmt.Errorf("invalid framebuffer access: %x", addr)
+	}
+	var buf [8]byte
+	f.mu.Lock()
+	copy(buf[:bytes], f.data[offset:])
+	f.mu.Unlock()
+	return binary.LittleEndian.Uint64(buf[:]), nil
+}
+
+func (f *Framebuffer) Store(addr, bytes, data uint64) error {
+	offset := addr - f.Base
+	if bytes > 8 || offset+bytes > f.Size() {
+		return fmt.Errorf("invalid framebuffer access: %x", addr)
+	}
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], data)
+	f.mu.Lock()
+	copy(f.data[offset:offset+bytes], buf[:])
+	f.mu.Unlock()
+	return nil
+}
+
+// Image returns a copy of the current frame.
+func (f *Framebuffer) Image() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, f.Width, f.Height))
+	bpp := f.Format.BytesPerPixel()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for y := 0; y < f.Height; y++ {
+		line := f.data[y*f.Stride:]
+		for x := 0; x < f.Width; x++ {
+			p := line[x*bpp:]
+			var r, g, b uint8
+			switch f.Format {
+			case A8R8G8B8, X8R8G8B8:
+				b, g, r = p[0], p[1], p[2]
+			case A8B8G8R8, X8B8G8R8:
+				r, g, b = p[0], p[1], p[2]
+			case R5G6B5:
+				v := binary.LittleEndian.Uint16(p)
+				r, g, b = uint8(v>>11)<<3, uint8(v>>5)<<2, uint8(v)<<3
+			}
+			i := img.PixOffset(x, y)
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = r, g, b, 0xFF
+		}
+	}
+	return img
+}
+
+// WritePNG encodes the current frame as a PNG image.
+func (f *Framebuffer) WritePNG(w io.Writer) error {
+	return png.Encode(w, f.Image())
+}
+
+// Save writes the geometry and the pixels.
+func (f *Framebuffer) Save(w io.Writer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	geometry := []uint32{uint32(f.Width), uint32(f.Height), uint32(f.Format.BytesPerPixel())}
+	if err := binary.Write(w, binary.LittleEndian, geometry); err != nil {
+		return err
+	}
+	_, err := w.Write(f.data)
+	return err
+}
+
+func (f *Framebuffer) Restore(r io.Reader) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var geometry [3]uint32
+	if err := binary.Read(r, binary.LittleEndian, &geometry); err != nil {
+		return err
+	}
+	if geometry != [3]uint32{uint32(f.Width), uint32(f.Height), uint32(f.Format.BytesPerPixel())} {
+		return fmt.Errorf("framebuffer geometry mismatch: %dx%dx%d", geometry[0], geometry[1], geometry[2])
+	}
+	_, err := io.ReadFull(r, f.data)
+	return err
+}
@@ -0,0 +1,145 @@
+package fdt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+)
+
+// Flattened device tree blob layout, version 17.
+const (
+	Magic      = 0xD00DFEED
+	Version    = 17
+	headerSize = 40
+
+	tokenBeginNode = 1
+	tokenEndNode   = 2
+	tokenProp      = 3
+	tokenEnd       = 9
+)
+
+// Node is a device tree node. Properties keep the order they were set in.
+type Node struct {
+	Name     string
+	Props    []Prop
+	Children []*Node
+}
+
+type Prop struct {
+	Name  string
+	Value []byte
+}
+
+func NewNode(name string) *Node {
+	return &Node{Name: name}
+}
+
+// Add appends a child node and returns it.
+func (n *Node) Add(name string) *Node {
+	child := NewNode(name)
+	n.Children = append(n.Children, child)
+	return child
+}
+
+// Child returns the child called name, or nil.
+func (n *Node) Child(name string) *Node {
+	for _, c := range n.Children {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Set sets a property to a raw value, replacing an earlier one.
+func (n *Node) Set(name string, value []byte) {
+	for i := range n.Props {
+		if n.Props[i].Name == name {
+			n.Props[i].Value = value
+			return
+		}
+	}
+	n.Props = append(n.Props, Prop{name, value})
+}
+
+// Flag sets a property without a value.
+func (n *Node) Flag(name string) {
+	n.Set(name, nil)
+}
+
+// String sets a string or string list property.
+func (n *Node) String(name string, values ...string) {
+	n.Set(name, []byte(strings.Join(values, "\x00")+"\x00"))
+}
+
+// Cells sets a property to a list of 32-bit cells.
+func (n *Node) Cells(name string, values ...uint32) {
+	value := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(value[4*i:], v)
+	}
+	n.Set(name, value)
+}
+
+// Reg sets reg to address and size pairs of two cells each.
+func (n *Node) Reg(pairs ...uint64) {
+	cells := make([]uint32, 0, 2*len(pairs))
+	for _, v := range pairs {
+		cells = append(cells, uint32(v>>32), uint32(v))
+	}
+	n.Cells("reg", cells...)
+}
+
+// Marshal encodes the tree rooted at root as a blob, with bootCPU as the
+// physical ID of the boot CPU.
+func Marshal(root *Node, bootCPU uint32) []byte {
+	var structure, strs bytes.Buffer
+	offsets := make(map[string]uint32)
+	token := func(t uint32) {
+		binary.Write(&structure, binary.BigEndian, t)
+	}
+	pad := func() {
+		for structure.Len()%4 != 0 {
+			structure.WriteByte(0)
+		}
+	}
+	var walk func(n *Node)
+	walk = func(n *Node) {
+		token(tokenBeginNode)
+		structure.WriteString(n.Name)
+		structure.WriteByte(0)
+		pad()
+		for _, p := range n.Props {
+			off, ok := offsets[p.Name]
+			if !ok {
+				off = uint32(strs.Len())
+				offsets[p.Name] = off
+				strs.WriteString(p.Name)
+				strs.WriteByte(0)
+			}
+			token(tokenProp)
+			token(uint32(len(p.Value)))
+			token(off)
+			structure.Write(p.Value)
+			pad()
+		}
+		for _, c := range n.Children {
+			walk(c)
+		}
+		token(tokenEndNode)
+	}
+	walk(root)
+	token(tokenEnd)
+
+	const rsvmapSize = 16 // a single terminating entry
+	structOff := uint32(headerSize + rsvmapSize)
+	stringsOff := structOff + uint32(structure.Len())
+	total := stringsOff + uint32(strs.Len())
+	var blob bytes.Buffer
+	header := []uint32{Magic, total, structOff, stringsOff, headerSize, Version, 16, bootCPU, uint32(strs.Len()), uint32(structure.Len())}
+	binary.Write(&blob, binary.BigEndian, header)
+	blob.Write(make([]byte, rsvmapSize))
+	blob.Write(structure.Bytes())
+	blob.Write(strs.Bytes())
+	return blob.Bytes()
+}
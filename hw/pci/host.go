@@ -0,0 +1,194 @@
+package pci
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Generic PCI Express host bridge with ECAM configuration space for bus 0,
+// described by a pci-host-ecam-generic device tree node. INTA to INTD are
+// swizzled by device number onto PLIC sources Irq to Irq+3. Those are the
+// only interrupts: there is no MSI controller for messages to target, so
+// devices offer no MSI or MSI-X capability.
+const (
+	EcamBase = 0x30000000
+	EcamSize = 0x100000 // 32 devices of 8 functions
+	IOBase   = 0x03000000
+	IOSize   = 0x10000
+	MemBase  = 0x40000000
+	MemSize  = 0x40000000
+	Irq      = 32
+
+	Devices = 32
+	Pins    = 4
+
+	ioStart = 0x1000 // I/O space below is left to legacy devices
+)
+
+// Host is the host bridge and bus 0 behind it. Device 0 is the bridge itself.
+type Host struct {
+	fns   []*Function  // by device number
+	lines [Pins]uint32 // devices asserting each INTx line
+	irq   func(source int, high bool)
+}
+
+// NewHost returns a bridge raising INTx through irq.
+func NewHost(irq func(source int, high bool)) *Host {
+	h := &Host{irq: irq}
+	bridge := NewFunction(0x1B36, 0x0008, 0x060000, 0) // a PCIe host bridge
+	bridge.config[InterruptPin] = 0
+	h.fns = append(h.fns, bridge)
+	return h
+}
+
+// IrqOf returns the PLIC source the interrupt pin (1 for INTA) of device
+// dev is routed to.
+func IrqOf(dev, pin int) int {
+	return Irq + (dev+pin-1)%Pins
+}
+
+// Plug attaches f as the next device on the bus and returns its number.
+func (h *Host) Plug(f *Function) (int, error) {
+	dev := len(h.fns)
+	if dev == Devices {
+		return 0, errors.New("no free pci slot")
+	}
+	source := IrqOf(dev, int(f.config[InterruptPin]))
+	f.intx = func(high bool) {
+		// the devices sharing a line assert it together
+		line := &h.lines[source-Irq]
+		if high {
+			*line |= 1 << dev
+		} else {
+			*line &^= 1 << dev
+		}
+		h.irq(source, *line != 0)
+	}
+	h.fns = append(h.fns, f)
+	return dev, nil
+}
+
+// Functions returns the functions on the bus by device number.
+func (h *Host) Functions() []*Function {
+	return h.fns
+}
+
+// Assign places every BAR in the windows and enables the devices, the way
+// firmware would before handing over to the kernel.
+func (h *Host) Assign() error {
+	mem, port := uint64(MemBase), uint64(ioStart)
+	for dev, f := range h.fns {
+		for i, b := range f.bars {
+			if b.size == 0 {
+				continue
+			}
+			next, limit := &mem, uint64(MemBase+MemSize)
+			if b.io {
+				next, limit = &port, IOSize
+			}
+			base := (*next + b.size - 1) &^ (b.size - 1)
+			if base+b.size > limit {
+				return fmt.Errorf("pci window exhausted: device %d bar %d", dev, i)
+			}
+			f.ConfigStore(uint64(Bar0+4*i), 4, base)
+			*next = base + b.size
+		}
+		f.ConfigStore(Command, 2, CommandIO|CommandMemory|CommandMaster)
+		if pin := f.config[InterruptPin]; pin != 0 {
+			f.ConfigStore(InterruptLine, 1, uint64(IrqOf(dev, int(pin))))
+		}
+	}
+	return nil
+}
+
+func (h *Host) Contains(addr uint64) bool {
+	return addr >= EcamBase && addr < EcamBase+EcamSize ||
+		addr >= IOBase && addr < IOBase+IOSize ||
+		addr >= MemBase && addr < MemBase+MemSize
+}
+
+// function returns the function and register an ECAM address refers to.
+func (h *Host) function(addr uint64) (*Function, uint64) {
+	offset := addr - EcamBase
+	dev, fn := int(offset>>15), offset>>12&7
+	if fn != 0 || dev >= len(h.fns) {
+		return nil, 0
+	}
+	return h.fns[dev], offset & (ConfigSize - 1)
+}
+
+// region returns the BAR mapping addr, if any.
+func (h *Host) region(addr uint64) (Region, uint64, bool) {
+	io := addr < MemBase
+	if io {
+		addr -= IOBase
+	}
+	for _, f := range h.fns {
+		if r, offset, ok := f.decode(addr, io); ok {
+			return r, offset, true
+		}
+	}
+	return nil, 0, false
+}
+
+// Load reads configuration space or a BAR. Reads nothing answers return all
+// ones, as a master abort does.
+func (h *Host) Load(addr, bytes uint64) (uint64, error) {
+	switch bytes {
+	case 1, 2, 4, 8:
+	default:
+		return 0, fmt.Errorf("invalid data bytes: %d", bytes)
+	}
+	none := ^uint64(0) >> (64 - 8*bytes)
+	if addr < EcamBase+EcamSize && addr >= EcamBase {
+		f, reg := h.function(addr)
+		if f == nil {
+			return none, nil
+		}
+		return f.ConfigLoad(reg, bytes), nil
+	}
+	r, offset, ok := h.region(addr)
+	if !ok {
+		return none, nil
+	}
+	return r.Load(offset, bytes)
+}
+
+func (h *Host) Store(addr, bytes, data uint64) error {
+	switch bytes {
+	case 1, 2, 4, 8:
+	default:
+		return fmt.Errorf("invalid data bytes: %d", bytes)
+	}
+	if addr < EcamBase+EcamSize && addr >= EcamBase {
+		if f, reg := h.function(addr); f != nil {
+			f.ConfigStore(reg, bytes, data)
+		}
+		return nil
+	}
+	r, offset, ok := h.region(addr)
+	if !ok {
+		return nil
+	}
+	return r.Store(offset, bytes, data)
+}
+
+// Save writes the configuration space of every function.
+func (h *Host) Save(w io.Writer) error {
+	for _, f := range h.fns {
+		if err := f.Save(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Host) Restore(r io.Reader) error {
+	for _, f := range h.fns {
+		if err := f.Restore(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
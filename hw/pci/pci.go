@@ -0,0 +1,202 @@
+package pci
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Type 0 configuration header.
+const (
+	ConfigSize = 0x1000 // PCI Express extended configuration space
+
+	VendorID        = 0x00
+	DeviceID        = 0x02
+	Command         = 0x04
+	Status          = 0x06
+	Revision        = 0x08
+	Class           = 0x09 // programming interface, subclass and class
+	HeaderType      = 0x0E
+	Bar0            = 0x10
+	SubsystemVendor = 0x2C
+	SubsystemID     = 0x2E
+	CapabilityList  = 0x34
+	InterruptLine   = 0x3C
+	InterruptPin    = 0x3D
+
+	Bars     = 6
+	capStart = 0x40
+)
+
+// Command and status bits.
+const (
+	CommandIO          = 0x001
+	CommandMemory      = 0x002
+	CommandMaster      = 0x004
+	CommandIntxDisable = 0x400
+
+	StatusIntx    = 0x08
+	StatusCapList = 0x10
+)
+
+// Capability IDs.
+const (
+	CapVendor = 0x09
+)
+
+const barIO = 0x1 // the BAR is in I/O space
+
+// Region is what a BAR maps. Offsets are relative to the start of the BAR.
+type Region interface {
+	Load(offset, bytes uint64) (uint64, error)
+	Store(offset, bytes, data uint64) error
+}
+
+type bar struct {
+	size   uint64
+	io     bool
+	region Region
+}
+
+// Function is the configuration space of a PCI function, with the BARs and
+// the interrupt of the device behind it.
+type Function struct {
+	config  [ConfigSize]byte
+	wmask   [ConfigSize]byte // bits software may change
+	bars    [Bars]bar
+	capEnd  int  // where the next capability goes
+	lastCap int  // offset of the last capability, 0 if none
+	level   bool // state of the device's interrupt
+
+	intx func(high bool)
+}
+
+func NewFunction(vendor, device uint16, class uint32, revision uint8) *Function {
+	f := &Function{capEnd: capStart}
+	f.Set16(VendorID, vendor)
+	f.Set16(DeviceID, device)
+	f.Set32(Revision, class<<8|uint32(revision))
+	f.config[InterruptPin] = 1 // INTA
+	f.wmask[Command] = CommandIO | CommandMemory | CommandMaster
+	f.wmask[Command+1] = CommandIntxDisable >> 8
+	f.wmask[InterruptLine] = 0xFF
+	return f
+}
+
+func (f *Function) Set16(offset int, v uint16) {
+	binary.LittleEndian.PutUint16(f.config[offset:], v)
+}
+
+func (f *Function) Set32(offset int, v uint32) {
+	binary.LittleEndian.PutUint32(f.config[offset:], v)
+}
+
+func (f *Function) get16(offset int) uint16 {
+	return binary.LittleEndian.Uint16(f.config[offset:])
+}
+
+func (f *Function) get32(offset int) uint32 {
+	return binary.LittleEndian.Uint32(f.config[offset:])
+}
+
+// AddBar maps region through BAR i, a 32-bit BAR of size bytes, a power of
+// two. Software sizes and places it by writing to it.
+func (f *Function) AddBar(i int, size uint64, io bool, region Region) {
+	f.bars[i] = bar{size, io, region}
+	mask := ^uint32(size-1) &^ 0xF
+	if io {
+		mask = ^uint32(size-1) &^ 0x3
+		f.config[Bar0+4*i] = barIO
+	}
+	binary.LittleEndian.PutUint32(f.wmask[Bar0+4*i:], mask)
+}
+
+// AddCapability appends a capability with the given body, which follows the
+// ID and next pointer, and returns its offset.
+func (f *Function) AddCapability(id uint8, body []byte) int {
+	offset := f.capEnd
+	f.config[offset] = id
+	copy(f.config[offset+2:], body)
+	if f.lastCap == 0 {
+		f.config[CapabilityList] = uint8(offset)
+	} else {
+		f.config[f.lastCap+1] = uint8(offset)
+	}
+	f.config[Status] |= StatusCapList
+	f.lastCap = offset
+	f.capEnd = (offset + 2 + len(body) + 3) &^ 3
+	return offset
+}
+
+// SetIrq drives the INTx interrupt of the device.
+func (f *Function) SetIrq(high bool) {
+	f.level = high
+	f.updateIntx()
+}
+
+func (f *Function) updateIntx() {
+	if f.level {
+		f.config[Status] |= StatusIntx
+	} else {
+		f.config[Status] &^= StatusIntx
+	}
+	if f.intx != nil {
+		f.intx(f.level && f.get16(Command)&CommandIntxDisable == 0)
+	}
+}
+
+func (f *Function) ConfigLoad(offset, bytes uint64) uint64 {
+	if offset+bytes > ConfigSize {
+		return 0
+	}
+	var buf [8]byte
+	copy(buf[:bytes], f.config[offset:])
+	return binary.LittleEndian.Uint64(buf[:])
+}
+
+func (f *Function) ConfigStore(offset, bytes, data uint64) {
+	if offset+bytes > ConfigSize {
+		return
+	}
+	for i := uint64(0); i < bytes; i++ {
+		m := f.wmask[offset+i]
+		f.config[offset+i] = f.config[offset+i]&^m | uint8(data>>(8*i))&m
+	}
+	f.updateIntx()
+}
+
+// decode returns the region mapping addr in memory or I/O space, if any.
+func (f *Function) decode(addr uint64, io bool) (Region, uint64, bool) {
+	command := f.get16(Command)
+	if io && command&CommandIO == 0 || !io && command&CommandMemory == 0 {
+		return nil, 0, false
+	}
+	for i, b := range f.bars {
+		if b.size == 0 || b.io != io {
+			continue
+		}
+		base := uint64(f.get32(Bar0+4*i) & binary.LittleEndian.Uint32(f.wmask[Bar0+4*i:]))
+		if base != 0 && addr >= base && addr-base < b.size {
+			return b.region, addr - base, true
+		}
+	}
+	return nil, 0, false
+}
+
+func (f *Function) Save(w io.Writer) error {
+	_, err := w.Write(f.config[:])
+	return err
+}
+
+func (f *Function) Restore(r io.Reader) error {
+	var config [ConfigSize]byte
+	if _, err := io.ReadFull(r, config[:]); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(config[:]) != f.get32(VendorID) {
+		return fmt.Errorf("pci function mismatch: %x", binary.LittleEndian.Uint32(config[:]))
+	}
+	f.config = config
+	f.updateIntx()
+	return nil
+}
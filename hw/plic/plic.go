@@ -0,0 +1,200 @@
+package plic
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// PLIC (platform-level interrupt controller) registers, laid out like the
+// SiFive PLIC. Each hart has two contexts, 2*hart for Machine level and
+// 2*hart+1 for Supervisor level.
+const (
+	Base = 0x0C000000
+	Size = 0x4000000
+	End  = Base + Size - 1
+
+	Sources = 64 // interrupt source 0 does not exist
+
+	Priority      = 0x000000 // 4 bytes per source
+	Pending       = 0x001000 // 1 bit per source
+	Enable        = 0x002000 // 1 bit per source, per context
+	EnableStride  = 0x80
+	Threshold     = 0x200000 // per context
+	Claim         = 0x200004 // claim and complete, per context
+	ContextStride = 0x1000
+	MaxPriority   = 7
+)
+
+const sourceBitsMask = Sources - 1
+
+type Plic struct {
+	priority  [Sources]uint32
+	level     uint64 // lines currently raised by devices
+	pending   uint64
+	claimed   uint64 // claimed and not yet completed
+	enable    []uint64
+	threshold []uint32
+}
+
+// NewPlic returns a PLIC for the given number of harts.
+func NewPlic(harts int) *Plic {
+	return &Plic{
+		enable:    make([]uint64, 2*harts),
+		threshold: make([]uint32, 2*harts),
+	}
+}
+
+// SetLevel drives the interrupt line of source irq. Interrupts are level
+// triggered: a raised line becomes pending again when it is completed.
+func (p *Plic) SetLevel(irq int, high bool) {
+	bit := uint64(1) << (irq & sourceBitsMask)
+	if !high {
+		p.level &^= bit
+		return
+	}
+	p.level |= bit
+	if p.claimed&bit == 0 {
+		p.pending |= bit
+	}
+}
+
+// Interrupting reports whether context ctx has an enabled pending interrupt
+// above its threshold.
+func (p *Plic) Interrupting(ctx int) bool {
+	return p.best(ctx) != 0
+}
+
+// best returns the enabled pending source with the highest priority, the
+// lowest numbered one on ties.
+func (p *Plic) best(ctx int) int {
+	candidates := p.pending & p.enable[ctx]
+	if candidates == 0 {
+		return 0
+	}
+	best, prio := 0, p.threshold[ctx]
+	for i := 1; i < Sources; i++ {
+		if candidates&(1<<i) != 0 && p.priority[i] > prio {
+			best, prio = i, p.priority[i]
+		}
+	}
+	return best
+}
+
+func (p *Plic) Check(bytes uint64) error {
+	if bytes != 4 {
+		return fmt.Errorf("invalid data bytes: %d", bytes)
+	}
+	return nil
+}
+
+func (p *Plic) Load(addr, bytes uint64) (uint64, error) {
+	if err := p.Check(bytes); err != nil {
+		return 0, err
+	}
+	offset := addr - Base
+	switch {
+	case offset < Pending:
+		return uint64(p.priority[(offset/4)&sourceBitsMask]), nil
+	case offset < Enable:
+		return p.word(p.pending, offset-Pending), nil
+	case offset < Threshold:
+		ctx, reg := (offset-Enable)/EnableStride, (offset-Enable)%EnableStride
+		if ctx >= uint64(len(p.enable)) {
+			return 0, nil
+		}
+		return p.word(p.enable[ctx], reg), nil
+	default:
+		ctx, reg := (offset-Threshold)/ContextStride, (offset-Threshold)%ContextStride
+		if ctx >= uint64(len(p.threshold)) {
+			return 0, nil
+		}
+		switch reg {
+		case 0:
+			return uint64(p.threshold[ctx]), nil
+		case 4:
+			return uint64(p.claim(int(ctx))), nil
+		}
+		return 0, nil
+	}
+}
+
+func (p *Plic) Store(addr, bytes, data uint64) error {
+	if err := p.Check(bytes); err != nil {
+		return err
+	}
+	offset := addr - Base
+	switch {
+	case offset < Pending:
+		if irq := (offset / 4) & sourceBitsMask; irq != 0 {
+			p.priority[irq] = uint32(data) & MaxPriority
+		}
+	case offset < Enable:
+		// pending bits are read-only
+	case offset < Threshold:
+		ctx, reg := (offset-Enable)/EnableStride, (offset-Enable)%EnableStride
+		if ctx < uint64(len(p.enable)) && (reg == 0 || reg == 4) {
+			shift := reg * 8
+			p.enable[ctx] = p.enable[ctx]&^(0xFFFFFFFF<<shift) | (data&0xFFFFFFFF)<<shift
+			p.enable[ctx] &^= 1 // source 0 is reserved
+		}
+	default:
+		ctx, reg := (offset-Threshold)/ContextStride, (offset-Threshold)%ContextStride
+		if ctx >= uint64(len(p.threshold)) {
+			return nil
+		}
+		switch reg {
+		case 0:
+			p.threshold[ctx] = uint32(data) & MaxPriority
+		case 4:
+			p.complete(int(data))
+		}
+	}
+	return nil
+}
+
+func (p *Plic) word(bits, reg uint64) uint64 {
+	if reg != 0 && reg != 4 {
+		return 0
+	}
+	return (bits >> (reg * 8)) & 0xFFFFFFFF
+}
+
+func (p *Plic) claim(ctx int) int {
+	irq := p.best(ctx)
+	if irq != 0 {
+		p.pending &^= 1 << irq
+		p.claimed |= 1 << irq
+	}
+	return irq
+}
+
+func (p *Plic) complete(irq int) {
+	bit := uint64(1) << (irq & sourceBitsMask)
+	p.claimed &^= bit
+	if p.level&bit != 0 {
+		p.pending |= bit
+	}
+}
+
+func (p *Plic) state() []any {
+	return []any{&p.priority, &p.level, &p.pending, &p.claimed, p.enable, p.threshold}
+}
+
+func (p *Plic) Save(w io.Writer) error {
+	for _, v := range p.state() {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Plic) Restore(r io.Reader) error {
+	for _, v := range p.state() {
+		if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package rtc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"goemu/clock"
+	"io"
+)
+
+// Goldfish RTC registers. Time is counted in nanoseconds since the Unix epoch.
+const (
+	DefaultBase = 0x101000
+	Size        = 0x1000
+	Irq         = 11
+
+	TimeLow        = 0x00 // reading it latches TimeHigh
+	TimeHigh       = 0x04
+	AlarmLow       = 0x08 // writing it arms the alarm
+	AlarmHigh      = 0x0C
+	IrqEnabled     = 0x10
+	ClearAlarm     = 0x14
+	AlarmStatus    = 0x18
+	ClearInterrupt = 0x1C
+)
+
+const nsPerTick = 1_000_000_000 / clock.Frequency
+
+// Rtc is a Goldfish real-time clock. It runs off mtime, offset by Epoch, so
+// it stays deterministic wherever mtime does.
+type Rtc struct {
+	Base  uint64
+	Epoch uint64 // time at mtime 0
+
+	mtime func() uint64
+	irq   func(high bool)
+
+	timeHigh   uint32 // latched by reading TimeLow
+	alarm      uint64
+	alarmHigh  uint32 // written before AlarmLow
+	armed      bool
+	irqEnabled bool
+	pending    bool
+}
+
+// NewRtc maps the clock at base, raising irq when the alarm fires.
+func NewRtc(base, epoch uint64, mtime func() uint64, irq func(high bool)) *Rtc {
+	return &Rtc{Base: base, Epoch: epoch, mtime: mtime, irq: irq}
+}
+
+// Now returns the current time.
+func (r *Rtc) Now() uint64 {
+	return r.Epoch + r.mtime()*nsPerTick
+}
+
+// Update fires the alarm once its time has come.
+func (r *Rtc) Update() {
+	if r.armed && r.Now() >= r.alarm {
+		r.armed = false
+		r.pending = true
+		r.updateIrq()
+	}
+}
+
+// Deadline returns the mtime at which the alarm fires, or ^0 if it is not armed.
+func (r *Rtc) Deadline() uint64 {
+	if !r.armed {
+		return ^uint64(0)
+	}
+	if r.alarm <= r.Epoch {
+		return 0
+	}
+	return (r.alarm - r.Epoch + nsPerTick - 1) / nsPerTick
+}
+
+func (r *Rtc) updateIrq() {
+	r.irq(r.pending && r.irqEnabled)
+}
+
+func (r *Rtc) Load(addr, bytes uint64) (uint64, error) {
+	if bytes != 4 {
+		return 0, fmt.Errorf("invalid data bytes: %d", bytes)
+	}
+	switch addr - r.Base {
+	case TimeLow:
+		now := r.Now()
+		r.timeHigh = uint32(now >> 32)
+		return now & 0xFFFFFFFF, nil
+	case TimeHigh:
+		return uint64(r.timeHigh), nil
+	case AlarmLow:
+		return r.alarm & 0xFFFFFFFF, nil
+	case AlarmHigh:
+		return r.alarm >> 32, nil
+	case IrqEnabled:
+		if r.irqEnabled {
+			return 1, nil
+		}
+	case AlarmStatus:
+		if r.armed {
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func (r *Rtc) Store(addr, bytes, data uint64) error {
+	if bytes != 4 {
+		return fmt.Errorf("invalid data bytes: %d", bytes)
+	}
+	v := uint32(data)
+	switch addr - r.Base {
+	case TimeHigh: // written before TimeLow
+		r.timeHigh = v
+	case TimeLow:
+		r.Epoch = uint64(r.timeHigh)<<32 | uint64(v) - r.mtime()*nsPerTick
+	case AlarmHigh:
+		r.alarmHigh = v
+	case AlarmLow:
+		r.alarm = uint64(r.alarmHigh)<<32 | uint64(v)
+		r.armed = true
+		r.Update()
+	case IrqEnabled:
+		r.irqEnabled = v&1 == 1
+		r.updateIrq()
+	case ClearAlarm:
+		r.armed = false
+	case ClearInterrupt:
+		r.pending = false
+		r.updateIrq()
+	}
+	return nil
+}
+
+func (r *Rtc) Save(w io.Writer) error {
+	regs := []any{r.Epoch, r.timeHigh, r.alarm, r.alarmHigh, r.armed, r.irqEnabled, r.pending}
+	for _, v := range regs {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Rtc) Restore(rd io.Reader) error {
+	regs := []any{&r.Epoch, &r.timeHigh, &r.alarm, &r.alarmHigh, &r.armed, &r.irqEnabled, &r.pending}
+	for _, v := range regs {
+		if err := binary.Read(rd, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	r.updateIrq()
+	return nil
+}
@@ -2,7 +2,9 @@ package uart
 
 import (
 	"bufio"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"sync"
@@ -16,66 +18,212 @@ const (
 	End  = Base + Size - 1
 
 	Irq = 10 // UartInterrupt Request
+	Max = 8  // further UARTs follow the first one every Size bytes
 
-	Rhr           = 0b000 // receive holding register (for input bytes)
-	Thr           = 0b000 // transmit holding register (for output bytes)
-	Ier           = 0b001 // interrupt enable register
-	IerRxEnable   = 1 << 0
-	IerTxEnable   = 1 << 1
-	Fcr           = 0b010 // FIFO control register
-	FcrFifoEnable = 1 << 0
-	FcrFifoClear  = 3 << 1 // clear the content of the two FIFOs
-	Isr           = 0b010  // interrupt status register
-	Lcr           = 0b011  // line control register
-	LcrEightBits  = 3 << 0
-	LcrBaudLatch  = 1 << 7 // special mode to set baud rate
-	Mcr           = 0b100
-	Lsr           = 0b101
-	LsrRxReady    = 1 << 0 // input is waiting to be read from RHR
-	LsrTxIdle     = 1 << 5 // THR can accept another character to send
+	Rhr            = 0b000 // receive holding register (for input bytes)
+	Thr            = 0b000 // transmit holding register (for output bytes)
+	Dll            = 0b000 // divisor latch, low byte (when LcrBaudLatch is set)
+	Ier            = 0b001 // interrupt enable register
+	Dlm            = 0b001 // divisor latch, high byte (when LcrBaudLatch is set)
+	IerRxEnable    = 1 << 0
+	IerTxEnable    = 1 << 1
+	IerLineStatus  = 1 << 2
+	IerModemStatus = 1 << 3
+	Fcr            = 0b010 // FIFO control register
+	FcrFifoEnable  = 1 << 0
+	FcrFifoClear   = 3 << 1 // clear the content of the two FIFOs
+	FcrRxClear     = 1 << 1
+	FcrTxClear     = 1 << 2
+	FcrTrigger     = 3 << 6 // receive FIFO level that raises an interrupt
+	Isr            = 0b010  // interrupt status register
+	IsrNone        = 0b0001 // no interrupt pending
+	IsrLineStatus  = 0b0110
+	IsrRxData      = 0b0100
+	IsrTimeout     = 0b1100 // data below the trigger level is waiting
+	IsrTxEmpty     = 0b0010
+	IsrModemStatus = 0b0000
+	IsrFifo        = 3 << 6 // the FIFOs are enabled
+	Lcr            = 0b011  // line control register
+	LcrEightBits   = 3 << 0
+	LcrBaudLatch   = 1 << 7 // special mode to set baud rate
+	Mcr            = 0b100  // modem control register
+	McrDtr         = 1 << 0
+	McrRts         = 1 << 1
+	McrOut1        = 1 << 2
+	McrOut2        = 1 << 3
+	McrLoop        = 1 << 4 // transmitted bytes are received again
+	Lsr            = 0b101  // line status register
+	LsrRxReady     = 1 << 0 // input is waiting to be read from RHR
+	LsrOverrun     = 1 << 1
+	LsrParity      = 1 << 2
+	LsrFraming     = 1 << 3
+	LsrBreak       = 1 << 4
+	LsrTxIdle      = 1 << 5 // THR can accept another character to send
+	LsrTxEmpty     = 1 << 6 // THR and the shift register are empty
+	LsrFifoError   = 1 << 7
+	Msr            = 0b110 // modem status register
+	MsrDeltaCts    = 1 << 0
+	MsrDeltaDsr    = 1 << 1
+	MsrTrailingRi  = 1 << 2
+	MsrDeltaDcd    = 1 << 3
+	MsrCts         = 1 << 4
+	MsrDsr         = 1 << 5
+	MsrRi          = 1 << 6
+	MsrDcd         = 1 << 7
+	Scr            = 0b111 // scratch register
+
+	FifoSize = 16
+)
+
+const (
+	lsrErrors = LsrOverrun | LsrParity | LsrFraming | LsrBreak
+	msrDeltas = MsrDeltaCts | MsrDeltaDsr | MsrTrailingRi | MsrDeltaDcd
+	msrHost   = MsrCts | MsrDsr | MsrDcd // the host end is always connected
 )
 
 // 268435456
 
 const BufferMaxSize = 32
 
+// IrqOf returns the interrupt request of the i-th UART.
+func IrqOf(i int) int {
+	if i == 0 {
+		return Irq
+	}
+	return Irq + 1 + i // the RTC sits in between
+}
+
+// Uart is a 16550A. Transmission completes instantly, so the transmit FIFO
+// never holds more than the byte being written. Output is buffered by line
+// until Flush.
 type Uart struct {
-	Regs [Size]uint8
+	Base uint64
+	Out  io.Writer
+	In   io.Reader       // host input, read from the first Poll on (nil disables input)
+	Irq  func(high bool) // drives the interrupt line when set
 	buf  strings.Builder
 
-	in *bufio.Reader
+	rx    chan uint8 // bytes read from the host, waiting for Poll
+	start sync.Once
 
-	loadEnable chan struct{}
-	mu         sync.Mutex
+	mu     sync.Mutex
+	rxFifo []uint8
+	ier    uint8
+	fcr    uint8
+	lcr    uint8
+	mcr    uint8
+	lsr    uint8 // only the error bits, the others follow the FIFOs
+	msr    uint8
+	scr    uint8
+	dll    uint8
+	dlm    uint8
+	thri   bool // a THR empty interrupt is pending
 }
 
-func NewUart() *Uart {
-	u := new(Uart)
-	u.Regs[Lsr] |= LsrTxIdle
-	u.in = bufio.NewReader(os.Stdin)
-
-	go u.InputHandler()
-
+func NewUart(base uint64) *Uart {
+	u := &Uart{Base: base}
+	u.Out = os.Stdout
+	u.In = os.Stdin
+	u.rx = make(chan uint8, BufferMaxSize)
+	u.msr = msrHost
 	return u
 }
 
+// InputHandler reads host input in the background. The bytes only become
+// visible to the guest when Poll is called, so that their arrival can be
+// pinned to an instruction boundary.
 func (u *Uart) InputHandler() {
-	defer func() {
-		if err := recover(); err != nil {
-			fmt.Println(err)
-		}
-	}()
+	in := bufio.NewReader(u.In)
 	for {
-		b, err := u.in.ReadByte()
+		b, err := in.ReadByte()
 		if err != nil {
-			panic(err)
+			return // the host closed its end, the line stays quiet
+		}
+		u.rx <- b
+	}
+}
+
+// Poll moves the next pending input byte into the receive FIFO if it has
+// room, and returns the byte it delivered. Input from the host is ignored
+// in loopback mode.
+func (u *Uart) Poll() (uint8, bool) {
+	u.start.Do(func() {
+		if u.In != nil {
+			go u.InputHandler()
 		}
+	})
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.mcr&McrLoop != 0 || len(u.rxFifo) >= u.capacity() {
+		return 0, false
+	}
+	select {
+	case b := <-u.rx:
+		u.receive(b)
+		return b, true
+	default:
+		return 0, false
+	}
+}
 
-		<-u.loadEnable // fixme: unknown output
-		u.mu.Lock()
-		u.Regs[Rhr] = b
-		u.Regs[Lsr] |= LsrRxReady
-		u.mu.Unlock()
+// Receive places b into the receive FIFO, as if it had just arrived on the line.
+func (u *Uart) Receive(b uint8) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.receive(b)
+}
+
+func (u *Uart) receive(b uint8) {
+	if len(u.rxFifo) >= u.capacity() {
+		u.lsr |= LsrOverrun
+	} else {
+		u.rxFifo = append(u.rxFifo, b)
+	}
+	u.updateIrq()
+}
+
+// capacity is the depth of the receive FIFO, a single holding register
+// while the FIFOs are disabled.
+func (u *Uart) capacity() int {
+	if u.fcr&FcrFifoEnable == 0 {
+		return 1
+	}
+	return FifoSize
+}
+
+// trigger is the receive FIFO level that raises a data interrupt.
+func (u *Uart) trigger() int {
+	if u.fcr&FcrFifoEnable == 0 {
+		return 1
+	}
+	return [4]int{1, 4, 8, 14}[u.fcr>>6]
+}
+
+// isr returns the highest priority interrupt pending. Data below the
+// trigger level is reported as a character timeout straight away.
+func (u *Uart) isr() uint8 {
+	id := uint8(IsrNone)
+	switch {
+	case u.ier&IerLineStatus != 0 && u.lsr&lsrErrors != 0:
+		id = IsrLineStatus
+	case u.ier&IerRxEnable != 0 && len(u.rxFifo) >= u.trigger():
+		id = IsrRxData
+	case u.ier&IerRxEnable != 0 && len(u.rxFifo) > 0:
+		id = IsrTimeout
+	case u.ier&IerTxEnable != 0 && u.thri:
+		id = IsrTxEmpty
+	case u.ier&IerModemStatus != 0 && u.msr&msrDeltas != 0:
+		id = IsrModemStatus
+	}
+	if u.fcr&FcrFifoEnable != 0 {
+		id |= IsrFifo
+	}
+	return id
+}
+
+func (u *Uart) updateIrq() {
+	if u.Irq != nil {
+		u.Irq(u.isr()&IsrNone == 0)
 	}
 }
 
@@ -92,16 +240,51 @@ func (u *Uart) Load(addr, bytes uint64) (uint64, error) {
 	}
 	u.mu.Lock()
 	defer u.mu.Unlock()
-	switch addr - Base {
+	latch := u.lcr&LcrBaudLatch != 0
+	var v uint8
+	switch (addr - u.Base) & 0b111 {
 	case Rhr:
-		u.Regs[Lsr] &= ^uint8(LsrRxReady)
-		if u.Regs[Lsr]&LsrRxReady == 1 {
-			u.loadEnable <- struct{}{}
+		if latch {
+			v = u.dll
+		} else if len(u.rxFifo) > 0 {
+			v = u.rxFifo[0]
+			u.rxFifo = u.rxFifo[1:]
+			u.updateIrq()
 		}
-		return uint64(u.Regs[Rhr]), nil
-	default:
-		return uint64(u.Regs[addr-Base]), nil
+	case Ier:
+		if latch {
+			v = u.dlm
+		} else {
+			v = u.ier
+		}
+	case Isr:
+		v = u.isr()
+		if v&^IsrFifo == IsrTxEmpty {
+			u.thri = false
+			u.updateIrq()
+		}
+	case Lcr:
+		v = u.lcr
+	case Mcr:
+		v = u.mcr
+	case Lsr:
+		v = u.lsr | LsrTxIdle | LsrTxEmpty
+		if len(u.rxFifo) > 0 {
+			v |= LsrRxReady
+		}
+		if u.lsr&lsrErrors != 0 && u.fcr&FcrFifoEnable != 0 {
+			v |= LsrFifoError
+		}
+		u.lsr &^= lsrErrors
+		u.updateIrq()
+	case Msr:
+		v = u.msr
+		u.msr &^= msrDeltas
+		u.updateIrq()
+	case Scr:
+		v = u.scr
 	}
+	return uint64(v), nil
 }
 
 func (u *Uart) Store(addr, bytes, data uint64) error {
@@ -110,23 +293,161 @@ func (u *Uart) Store(addr, bytes, data uint64) error {
 	}
 	u.mu.Lock()
 	defer u.mu.Unlock()
-	r := rune(data)
-	switch addr - Base {
+	latch := u.lcr&LcrBaudLatch != 0
+	v := uint8(data)
+	switch (addr - u.Base) & 0b111 {
 	case Thr:
-		if _, err := u.buf.WriteRune(r); err != nil {
-			return err
+		if latch {
+			u.dll = v
+			return nil
 		}
-		if r == '\n' || u.buf.Len() >= BufferMaxSize {
-			u.flushBuffer()
+		u.thri = true
+		if u.mcr&McrLoop != 0 {
+			u.receive(v)
+			return nil
+		}
+		u.updateIrq()
+		return u.transmit(v)
+	case Ier:
+		if latch {
+			u.dlm = v
+			return nil
+		}
+		if v&IerTxEnable != 0 && u.ier&IerTxEnable == 0 {
+			u.thri = true // THR is always empty
+		}
+		u.ier = v & 0x0F
+		u.updateIrq()
+	case Fcr:
+		if (v^u.fcr)&FcrFifoEnable != 0 || v&FcrRxClear != 0 {
+			u.rxFifo = nil
+		}
+		u.fcr = v & (FcrFifoEnable | FcrTrigger)
+		u.updateIrq()
+	case Lcr:
+		u.lcr = v
+	case Mcr:
+		u.mcr = v & 0x1F
+		u.updateModem()
+	case Scr:
+		u.scr = v
+	}
+	return nil
+}
+
+func (u *Uart) transmit(b uint8) error {
+	if err := u.buf.WriteByte(b); err != nil {
+		return err
+	}
+	if b == '\n' || u.buf.Len() >= BufferMaxSize {
+		u.flushBuffer()
+	}
+	return nil
+}
+
+// updateModem derives the modem inputs from the outputs in loopback mode,
+// noting which of them changed.
+func (u *Uart) updateModem() {
+	status := uint8(msrHost)
+	if u.mcr&McrLoop != 0 {
+		status = 0
+		for _, m := range [][2]uint8{{McrRts, MsrCts}, {McrDtr, MsrDsr}, {McrOut1, MsrRi}, {McrOut2, MsrDcd}} {
+			if u.mcr&m[0] != 0 {
+				status |= m[1]
+			}
 		}
-		return nil
-	default:
-		u.Regs[addr-Base] = uint8(data)
-		return nil
 	}
+	changed := (u.msr ^ status) &^ msrDeltas
+	deltas := u.msr & msrDeltas
+	if changed&MsrCts != 0 {
+		deltas |= MsrDeltaCts
+	}
+	if changed&MsrDsr != 0 {
+		deltas |= MsrDeltaDsr
+	}
+	if changed&MsrRi != 0 && status&MsrRi == 0 {
+		deltas |= MsrTrailingRi
+	}
+	if changed&MsrDcd != 0 {
+		deltas |= MsrDeltaDcd
+	}
+	u.msr = status | deltas
+	u.updateIrq()
+}
+
+// Flush writes out what the guest sent since the last line break.
+func (u *Uart) Flush() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.flushBuffer()
 }
 
 func (u *Uart) flushBuffer() {
-	fmt.Print(u.buf.String())
+	if u.buf.Len() == 0 {
+		return
+	}
+	if u.Out != nil {
+		io.WriteString(u.Out, u.buf.String())
+	}
 	u.buf.Reset()
 }
+
+func (u *Uart) regs() []*uint8 {
+	return []*uint8{&u.ier, &u.fcr, &u.lcr, &u.mcr, &u.lsr, &u.msr, &u.scr, &u.dll, &u.dlm}
+}
+
+// Save writes the registers, the receive FIFO and any output still waiting
+// to be flushed.
+func (u *Uart) Save(w io.Writer) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, r := range u.regs() {
+		if err := binary.Write(w, binary.LittleEndian, *r); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(w, binary.LittleEndian, u.thri); err != nil {
+		return err
+	}
+	for _, b := range [][]byte{u.rxFifo, []byte(u.buf.String())} {
+		if err := binary.Write(w, binary.LittleEndian, uint32(len(b))); err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *Uart) Restore(r io.Reader) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, reg := range u.regs() {
+		if err := binary.Read(r, binary.LittleEndian, reg); err != nil {
+			return err
+		}
+	}
+	if err := binary.Read(r, binary.LittleEndian, &u.thri); err != nil {
+		return err
+	}
+	var bufs [2][]byte
+	for i, limit := range []uint32{FifoSize, 4 * BufferMaxSize} {
+		var n uint32
+		if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+			return err
+		}
+		if n > limit {
+			return fmt.Errorf("invalid buffer size: %d", n)
+		}
+		bufs[i] = make([]byte, n)
+		if _, err := io.ReadFull(r, bufs[i]); err != nil {
+			return err
+		}
+	}
+	u.rxFifo = bufs[0]
+	u.buf.Reset()
+	u.buf.Write(bufs[1])
+	u.updateIrq()
+	return nil
+}
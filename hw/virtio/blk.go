@@ -0,0 +1,275 @@
+package virtio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// Block device constants.
+const (
+	BlkID           = 2
+	SectorSize      = 512
+	BlkFeatureRO    = 1 << 5
+	BlkFeatureFlush = 1 << 9
+
+	blkIn    = 0
+	blkOut   = 1
+	blkFlush = 4
+	blkGetID = 8
+
+	blkOK     = 0
+	blkIOErr  = 1
+	blkUnsupp = 2
+
+	blkHeaderSize = 16
+	blkIDSize     = 20
+)
+
+// BlkOptions controls how the image file is used.
+type BlkOptions struct {
+	ReadOnly    bool // the guest sees a read-only disk
+	CopyOnWrite bool // guest writes are kept in memory and never reach the file
+}
+
+// Blk is a virtio block device backed by a disk image on the host.
+type Blk struct {
+	opts    BlkOptions
+	file    *os.File
+	size    uint64            // in bytes, rounded down to whole sectors
+	overlay map[uint64][]byte // sectors written in copy-on-write mode
+	queues  []*Queue
+}
+
+func NewBlk(name string, opts BlkOptions) (*Blk, error) {
+	flag := os.O_RDWR
+	if opts.ReadOnly || opts.CopyOnWrite {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(name, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Blk{
+		opts:    opts,
+		file:    f,
+		size:    uint64(info.Size()) &^ (SectorSize - 1),
+		overlay: make(map[uint64][]byte),
+	}, nil
+}
+
+// Persistent reports whether guest writes reach the image file.
+func (b *Blk) Persistent() bool {
+	return !b.opts.ReadOnly && !b.opts.CopyOnWrite
+}
+
+func (b *Blk) ID() uint32 {
+	return BlkID
+}
+
+func (b *Blk) Features() uint64 {
+	if b.opts.ReadOnly {
+		return BlkFeatureRO | BlkFeatureFlush
+	}
+	return BlkFeatureFlush
+}
+
+func (b *Blk) NumQueues() int {
+	return 1
+}
+
+// Config holds the capacity in sectors.
+func (b *Blk) Config() []byte {
+	config := make([]byte, 8)
+	binary.LittleEndian.PutUint64(config, b.size/SectorSize)
+	return config
+}
+
+func (b *Blk) Activate(queues []*Queue) error {
+	b.queues = queues
+	return nil
+}
+
+func (b *Blk) Reset() {
+	b.queues = nil
+}
+
+// Notify serves every pending request right away, so that disk I/O completes
+// at a deterministic point of the guest's execution.
+func (b *Blk) Notify(q int) error {
+	queue := b.queues[q]
+	for {
+		c, err := queue.Pop()
+		if err != nil || c == nil {
+			return err
+		}
+		written, err := b.serve(c)
+		if err != nil {
+			return err
+		}
+		if err = queue.Push(c, written); err != nil {
+			return err
+		}
+	}
+}
+
+// serve handles one request: a header, then data buffers, then a status byte.
+func (b *Blk) serve(c *Chain) (uint32, error) {
+	in, err := c.ReadAll()
+	if err != nil {
+		return 0, err
+	}
+	if len(in) < blkHeaderSize || len(c.Out) == 0 {
+		return 0, fmt.Errorf("invalid block request: %d", c.Head)
+	}
+	typ := binary.LittleEndian.Uint32(in[0:])
+	sector := binary.LittleEndian.Uint64(in[8:])
+	data := in[blkHeaderSize:]
+	statusBuf := c.Out[len(c.Out)-1]
+	c.Out = c.Out[:len(c.Out)-1]
+
+	status := uint8(blkOK)
+	written := uint32(0)
+	switch typ {
+	case blkIn:
+		n := c.OutLen()
+		if n > maxChainLen || sector > b.size/SectorSize {
+			status = blkIOErr
+			break
+		}
+		data := make([]byte, n)
+		if err := b.readAt(data, sector*SectorSize); err != nil {
+			status = blkIOErr
+			break
+		}
+		if _, err := c.Write(data); err != nil {
+			return 0, err
+		}
+		written = uint32(n)
+	case blkOut:
+		// whole sectors only, and all of them on the disk
+		n := uint64(len(data))
+		if b.opts.ReadOnly || n%SectorSize != 0 || sector > b.size/SectorSize || n > b.size-sector*SectorSize {
+			status = blkIOErr
+		} else if err := b.writeAt(data, sector*SectorSize); err != nil {
+			status = blkIOErr
+		}
+	case blkFlush:
+		if !b.opts.ReadOnly && !b.opts.CopyOnWrite {
+			if err := b.file.Sync(); err != nil {
+				status = blkIOErr
+			}
+		}
+	case blkGetID:
+		id := make([]byte, blkIDSize)
+		copy(id, "goemu")
+		n, err := c.Write(id)
+		if err != nil {
+			return 0, err
+		}
+		written = uint32(n)
+	default:
+		status = blkUnsupp
+	}
+	if _, err := c.mem.WriteAt([]byte{status}, int64(statusBuf.Addr)); err != nil {
+		return 0, err
+	}
+	return written + 1, nil
+}
+
+func (b *Blk) readAt(data []byte, off uint64) error {
+	if off+uint64(len(data)) > b.size || off+uint64(len(data)) < off {
+		return io.ErrUnexpectedEOF
+	}
+	if len(b.overlay) == 0 {
+		_, err := b.file.ReadAt(data, int64(off))
+		return err
+	}
+	for i := 0; i < len(data); i += SectorSize {
+		sector := (off + uint64(i)) / SectorSize
+		if s, ok := b.overlay[sector]; ok {
+			copy(data[i:], s)
+			continue
+		}
+		end := i + SectorSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if _, err := b.file.ReadAt(data[i:end], int64(off)+int64(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Blk) writeAt(data []byte, off uint64) error {
+	if off+uint64(len(data)) > b.size || off+uint64(len(data)) < off {
+		return io.ErrUnexpectedEOF
+	}
+	if !b.opts.CopyOnWrite {
+		_, err := b.file.WriteAt(data, int64(off))
+		return err
+	}
+	for i := 0; i < len(data); i += SectorSize {
+		sector := make([]byte, SectorSize)
+		copy(sector, data[i:])
+		b.overlay[(off+uint64(i))/SectorSize] = sector
+	}
+	return nil
+}
+
+// Save writes the copy-on-write overlay, since the guest's view of the disk
+// is part of the machine state. The image file itself is not saved.
+func (b *Blk) Save(w io.Writer) error {
+	sectors := make([]uint64, 0, len(b.overlay))
+	for sector := range b.overlay {
+		sectors = append(sectors, sector)
+	}
+	sort.Slice(sectors, func(i, j int) bool { return sectors[i] < sectors[j] })
+	if err := binary.Write(w, binary.LittleEndian, uint64(len(sectors))); err != nil {
+		return err
+	}
+	for _, sector := range sectors {
+		if err := binary.Write(w, binary.LittleEndian, sector); err != nil {
+			return err
+		}
+		if _, err := w.Write(b.overlay[sector]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Blk) Restore(r io.Reader) error {
+	var n uint64
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return err
+	}
+	if n > b.size/SectorSize {
+		return fmt.Errorf("invalid overlay size: %d", n)
+	}
+	b.overlay = make(map[uint64][]byte, n)
+	for i := uint64(0); i < n; i++ {
+		var sector uint64
+		if err := binary.Read(r, binary.LittleEndian, &sector); err != nil {
+			return err
+		}
+		data := make([]byte, SectorSize)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		b.overlay[sector] = data
+	}
+	return nil
+}
+
+func (b *Blk) Close() error {
+	return b.file.Close()
+}
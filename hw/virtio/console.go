@@ -0,0 +1,360 @@
+package virtio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Console device constants.
+const (
+	ConsoleID               = 3
+	ConsoleFeatureMultiport = 1 << 1
+
+	// control messages
+	consoleDeviceReady = 0
+	consoleDeviceAdd   = 1
+	consolePortReady   = 3
+	consoleConsolePort = 4
+	consolePortOpen    = 6
+	consolePortName    = 7
+
+	controlRx = 2
+	controlTx = 3
+
+	controlSize  = 8
+	portRxBuffer = 16 // chunks of host input waiting for Poll
+	portChunk    = 4096
+	maxControl   = 1024 // control messages kept for a guest that does not read them
+)
+
+// Port is one channel of a console device. Guest output is written to Out,
+// and anything read from In is passed to the guest. Either may be nil.
+type Port struct {
+	Name    string
+	Console bool // the port is the guest's system console
+
+	Out io.Writer
+	In  io.Reader
+
+	rx      chan []byte
+	pending []byte // host input that did not fit into the guest's buffer
+	open    bool   // the guest has the port open
+}
+
+// NewPort starts reading in, if any, in the background.
+func NewPort(name string, console bool, in io.Reader, out io.Writer) *Port {
+	p := &Port{Name: name, Console: console, In: in, Out: out}
+	if in != nil {
+		p.rx = make(chan []byte, portRxBuffer)
+		go p.read()
+	}
+	return p
+}
+
+func (p *Port) read() {
+	for {
+		buf := make([]byte, portChunk)
+		n, err := p.In.Read(buf)
+		if n > 0 {
+			p.rx <- buf[:n]
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Console is a virtio console with one port per channel, using the
+// multiport feature when there is more than one.
+type Console struct {
+	ports   []*Port
+	queues  []*Queue
+	control [][]byte // control messages waiting for a guest buffer
+	muted   bool     // drops guest output, see Sender
+}
+
+func NewConsole(ports []*Port) (*Console, error) {
+	if len(ports) == 0 {
+		return nil, errors.New("console without ports")
+	}
+	return &Console{ports: ports}, nil
+}
+
+func (c *Console) ID() uint32 {
+	return ConsoleID
+}
+
+func (c *Console) Features() uint64 {
+	if len(c.ports) > 1 {
+		return ConsoleFeatureMultiport
+	}
+	return 0
+}
+
+// NumQueues counts a receive and a transmit queue per port plus the two
+// control queues, which sit between the queues of ports 0 and 1.
+func (c *Console) NumQueues() int {
+	if len(c.ports) == 1 {
+		return 2
+	}
+	return 2 * (len(c.ports) + 1)
+}
+
+// Config holds cols, rows, max_nr_ports and emerg_wr.
+func (c *Console) Config() []byte {
+	config := make([]byte, 12)
+	binary.LittleEndian.PutUint32(config[4:], uint32(len(c.ports)))
+	return config
+}
+
+func (c *Console) Activate(queues []*Queue) error {
+	c.queues = queues
+	return nil
+}
+
+func (c *Console) Reset() {
+	c.queues = nil
+	c.control = nil
+	for _, p := range c.ports {
+		p.open = false
+	}
+}
+
+// queueOf returns the receive queue of port i; the transmit queue follows it.
+func queueOf(i int) int {
+	if i == 0 {
+		return 0
+	}
+	return 2 + 2*i
+}
+
+func (c *Console) Notify(q int) error {
+	switch {
+	case q == controlRx:
+		return c.flushControl()
+	case q == controlTx:
+		return c.handleControl()
+	case q%2 == 1:
+		port := 0
+		if q > controlTx {
+			port = (q - 3) / 2
+		}
+		return c.transmit(c.ports[port], c.queues[q])
+	}
+	return nil // receive buffers are filled when host input is polled
+}
+
+func (c *Console) Mute(muted bool) {
+	c.muted = muted
+}
+
+// transmit passes guest output on to the host.
+func (c *Console) transmit(p *Port, q *Queue) error {
+	for {
+		chain, err := q.Pop()
+		if err != nil || chain == nil {
+			return err
+		}
+		data, err := chain.ReadAll()
+		if err != nil {
+			return err
+		}
+		if p.Out != nil && !c.muted {
+			if _, err = p.Out.Write(data); err != nil {
+				return err
+			}
+		}
+		if err = q.Push(chain, 0); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Console) handleControl() error {
+	q := c.queues[controlTx]
+	for {
+		chain, err := q.Pop()
+		if err != nil {
+			return err
+		}
+		if chain == nil {
+			return c.flushControl()
+		}
+		msg, err := chain.ReadAll()
+		if err != nil {
+			return err
+		}
+		if err = q.Push(chain, 0); err != nil {
+			return err
+		}
+		if len(msg) < controlSize {
+			continue
+		}
+		id := binary.LittleEndian.Uint32(msg[0:])
+		event := binary.LittleEndian.Uint16(msg[4:])
+		value := binary.LittleEndian.Uint16(msg[6:])
+		switch event {
+		case consoleDeviceReady:
+			if value == 1 {
+				for i := range c.ports {
+					c.sendControl(uint32(i), consoleDeviceAdd, 1, "")
+				}
+			}
+		case consolePortReady:
+			if value != 1 || id >= uint32(len(c.ports)) {
+				continue
+			}
+			p := c.ports[id]
+			if p.Console {
+				c.sendControl(id, consoleConsolePort, 1, "")
+			} else {
+				c.sendControl(id, consolePortName, 1, p.Name)
+			}
+			c.sendControl(id, consolePortOpen, 1, "")
+		case consolePortOpen:
+			if id < uint32(len(c.ports)) {
+				c.ports[id].open = value == 1
+			}
+		}
+	}
+}
+
+func (c *Console) sendControl(id uint32, event, value uint16, name string) {
+	msg := make([]byte, controlSize+len(name))
+	binary.LittleEndian.PutUint32(msg[0:], id)
+	binary.LittleEndian.PutUint16(msg[4:], event)
+	binary.LittleEndian.PutUint16(msg[6:], value)
+	copy(msg[controlSize:], name)
+	if len(c.control) < maxControl {
+		c.control = append(c.control, msg)
+	}
+}
+
+// flushControl hands queued control messages to the guest.
+func (c *Console) flushControl() error {
+	q := c.queues[controlRx]
+	for len(c.control) > 0 {
+		chain, err := q.Pop()
+		if err != nil || chain == nil {
+			return err
+		}
+		n, err := chain.Write(c.control[0])
+		if err != nil {
+			return err
+		}
+		c.control = c.control[1:]
+		if err = q.Push(chain, uint32(n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Poll passes the next chunk of host input to a port that has a receive
+// buffer available, and returns what it delivered.
+func (c *Console) Poll() (int, []byte, bool) {
+	if c.queues == nil {
+		return 0, nil, false
+	}
+	for i, p := range c.ports {
+		if len(p.pending) == 0 && p.rx != nil {
+			select {
+			case p.pending = <-p.rx:
+			default:
+			}
+		}
+		if len(p.pending) == 0 {
+			continue
+		}
+		q := c.queues[queueOf(i)]
+		chain, err := q.Pop()
+		if err != nil || chain == nil {
+			continue
+		}
+		n, err := chain.Write(p.pending)
+		if err != nil {
+			continue
+		}
+		data := p.pending[:n]
+		p.pending = p.pending[n:]
+		if q.Push(chain, uint32(n)) != nil {
+			continue
+		}
+		return i, data, true
+	}
+	return 0, nil, false
+}
+
+// Receive passes data to port i as if it had just arrived from the host.
+func (c *Console) Receive(i int, data []byte) error {
+	if c.queues == nil || i >= len(c.ports) {
+		return fmt.Errorf("invalid console port: %d", i)
+	}
+	q := c.queues[queueOf(i)]
+	chain, err := q.Pop()
+	if err != nil {
+		return err
+	}
+	if chain == nil {
+		return fmt.Errorf("no receive buffer on console port: %d", i)
+	}
+	n, err := chain.Write(data)
+	if err != nil {
+		return err
+	}
+	return q.Push(chain, uint32(n))
+}
+
+// Save writes the open state of the ports and the control messages that
+// have not been delivered yet.
+func (c *Console) Save(w io.Writer) error {
+	for _, p := range c.ports {
+		if err := binary.Write(w, binary.LittleEndian, p.open); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(c.control))); err != nil {
+		return err
+	}
+	for _, msg := range c.control {
+		if err := binary.Write(w, binary.LittleEndian, uint32(len(msg))); err != nil {
+			return err
+		}
+		if _, err := w.Write(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Console) Restore(r io.Reader) error {
+	for _, p := range c.ports {
+		if err := binary.Read(r, binary.LittleEndian, &p.open); err != nil {
+			return err
+		}
+	}
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return err
+	}
+	if n > maxControl {
+		return fmt.Errorf("invalid control message count: %d", n)
+	}
+	c.control = make([][]byte, n)
+	for i := range c.control {
+		var size uint32
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return err
+		}
+		if size > portChunk {
+			return fmt.Errorf("invalid control message size: %d", size)
+		}
+		c.control[i] = make([]byte, size)
+		if _, err := io.ReadFull(r, c.control[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"goemu/input"
+	"io"
+)
+
+// Input device constants.
+const (
+	InputID = 18
+
+	inputEvents = 0
+	inputStatus = 1
+
+	// configuration selectors
+	inputCfgIDName   = 0x01
+	inputCfgIDDevids = 0x03
+	inputCfgEvBits   = 0x11
+	inputCfgAbsInfo  = 0x12
+
+	inputConfigSize = 8 + 128 // select, subsel, size, reserved and the union
+	busVirtual      = 0x06
+)
+
+// Input is a virtio keyboard or tablet. Batches of events come from a script,
+// timed by retired instructions so that runs are reproducible, and from the
+// host, e.g. a VNC client.
+type Input struct {
+	Kind   input.Kind
+	Events <-chan []input.Event // host input, may be nil
+	Script input.Script
+	Now    func() uint64 // retired instructions, which time the script
+
+	queues  []*Queue
+	pending []byte // a batch waiting for event buffers
+	next    int    // next batch of the script
+	sel     uint8
+	subsel  uint8
+}
+
+func NewInput(kind input.Kind, events <-chan []input.Event, script input.Script, now func() uint64) *Input {
+	return &Input{Kind: kind, Events: events, Script: script, Now: now}
+}
+
+func (in *Input) ID() uint32 {
+	return InputID
+}
+
+func (in *Input) Features() uint64 {
+	return 0
+}
+
+func (in *Input) NumQueues() int {
+	return 2
+}
+
+// Config returns what the driver selected by writing select and subsel.
+func (in *Input) Config() []byte {
+	config := make([]byte, inputConfigSize)
+	data := in.configData()
+	config[0], config[1], config[2] = in.sel, in.subsel, uint8(len(data))
+	copy(config[8:], data)
+	return config
+}
+
+func (in *Input) configData() []byte {
+	switch in.sel {
+	case inputCfgIDName:
+		return []byte("goemu " + in.Kind.String())
+	case inputCfgIDDevids:
+		ids := make([]byte, 8)
+		binary.LittleEndian.PutUint16(ids[0:], busVirtual)
+		binary.LittleEndian.PutUint16(ids[4:], uint16(in.Kind)+1) // product
+		binary.LittleEndian.PutUint16(ids[6:], 1)                 // version
+		return ids
+	case inputCfgEvBits:
+		switch {
+		case in.subsel == input.EvKey && in.Kind == input.Keyboard:
+			var codes []uint16
+			for _, code := range input.Keys {
+				codes = append(codes, code)
+			}
+			return bitmap(codes...)
+		case in.subsel == input.EvKey && in.Kind == input.Tablet:
+			return bitmap(input.BtnLeft, input.BtnRight, input.BtnMiddle)
+		case in.subsel == input.EvAbs && in.Kind == input.Tablet:
+			return bitmap(input.AbsX, input.AbsY)
+		case in.subsel == input.EvRel && in.Kind == input.Tablet:
+			return bitmap(input.RelWheel)
+		}
+	case inputCfgAbsInfo:
+		if in.Kind == input.Tablet && (in.subsel == input.AbsX || in.subsel == input.AbsY) {
+			info := make([]byte, 20) // min, max, fuzz, flat and res
+			binary.LittleEndian.PutUint32(info[4:], input.AbsMax)
+			return info
+		}
+	}
+	return nil
+}
+
+// bitmap returns the smallest bitmap with the bits of codes set.
+func bitmap(codes ...uint16) []byte {
+	var top uint16
+	for _, c := range codes {
+		if c > top {
+			top = c
+		}
+	}
+	bits := make([]byte, top/8+1)
+	for _, c := range codes {
+		bits[c/8] |= 1 << (c % 8)
+	}
+	return bits
+}
+
+func (in *Input) WriteConfig(offset uint64, data []byte) {
+	for i, b := range data {
+		switch offset + uint64(i) {
+		case 0:
+			in.sel = b
+		case 1:
+			in.subsel = b
+		}
+	}
+}
+
+func (in *Input) Activate(queues []*Queue) error {
+	in.queues = queues
+	return nil
+}
+
+func (in *Input) Reset() {
+	in.queues = nil
+	in.pending = nil
+	in.sel, in.subsel = 0, 0
+}
+
+// Notify returns the buffers of the status queue, which carries LED updates
+// nobody looks at. Event buffers are filled when input is polled.
+func (in *Input) Notify(q int) error {
+	if q != inputStatus {
+		return nil
+	}
+	status := in.queues[inputStatus]
+	for {
+		chain, err := status.Pop()
+		if err != nil || chain == nil {
+			return err
+		}
+		if err = status.Push(chain, 0); err != nil {
+			return err
+		}
+	}
+}
+
+// Poll passes the next batch that is due, from the script first, to the
+// guest once it has posted a buffer for every event in it.
+func (in *Input) Poll() (int, []byte, bool) {
+	if in.queues == nil {
+		return 0, nil, false
+	}
+	if in.pending == nil {
+		if in.next < len(in.Script) && in.Script[in.next].At <= in.Now() {
+			in.pending = input.Marshal(in.Script[in.next].Events)
+			in.next++
+		} else {
+			select {
+			case events, ok := <-in.Events:
+				if !ok {
+					return 0, nil, false
+				}
+				in.pending = input.Marshal(events)
+			default:
+				return 0, nil, false
+			}
+		}
+	}
+	data := in.pending
+	if err := in.deliver(data); err != nil {
+		return 0, nil, false
+	}
+	in.pending = nil
+	return 0, data, true
+}
+
+// Receive reports a batch of events. A replayed batch that is the next one
+// due in the script takes its place, so the script carries on from there
+// once the replay is over.
+func (in *Input) Receive(_ int, data []byte) error {
+	if err := in.deliver(data); err != nil {
+		return err
+	}
+	if in.next < len(in.Script) && in.Script[in.next].At <= in.Now() && bytes.Equal(data, input.Marshal(in.Script[in.next].Events)) {
+		in.next++
+	}
+	return nil
+}
+
+// deliver writes each event of a batch to a buffer of its own.
+func (in *Input) deliver(data []byte) error {
+	if in.queues == nil {
+		return errors.New("input device is not active")
+	}
+	if len(data)%input.EventSize != 0 {
+		return errors.New("invalid input event batch")
+	}
+	events := in.queues[inputEvents]
+	n, err := events.Available()
+	if err != nil {
+		return err
+	}
+	if n < len(data)/input.EventSize {
+		return errors.New("no event buffer on input device")
+	}
+	for ; len(data) > 0; data = data[input.EventSize:] {
+		chain, err := events.Pop()
+		if err != nil {
+			return err
+		}
+		written, err := chain.Write(data[:input.EventSize])
+		if err != nil {
+			return err
+		}
+		if err = events.Push(chain, uint32(written)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Save writes the configuration selection and how far the script has got.
+func (in *Input) Save(w io.Writer) error {
+	regs := []any{in.sel, in.subsel, uint64(in.next)}
+	for _, v := range regs {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (in *Input) Restore(r io.Reader) error {
+	var next uint64
+	regs := []any{&in.sel, &in.subsel, &next}
+	for _, v := range regs {
+		if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	in.next = int(next)
+	return nil
+}
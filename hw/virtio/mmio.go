@@ -0,0 +1,214 @@
+package virtio
+
+import (
+	"fmt"
+	"io"
+)
+
+// Virtio over MMIO, version 2 (non-legacy) register layout. Transports sit in
+// consecutive slots from Base, slot i raising PLIC source Irq+i.
+const (
+	Base  = 0x10001000
+	Size  = 0x1000
+	Slots = 8
+	End   = Base + Slots*Size - 1
+	Irq   = 1
+
+	MagicValue        = 0x000
+	Version           = 0x004
+	DeviceID          = 0x008
+	VendorID          = 0x00C
+	DeviceFeatures    = 0x010
+	DeviceFeaturesSel = 0x014
+	DriverFeatures    = 0x020
+	DriverFeaturesSel = 0x024
+	QueueSel          = 0x030
+	QueueNumMax       = 0x034
+	QueueNum          = 0x038
+	QueueReady        = 0x044
+	QueueNotify       = 0x050
+	InterruptStatus   = 0x060
+	InterruptACK      = 0x064
+	Status            = 0x070
+	QueueDescLow      = 0x080
+	QueueDescHigh     = 0x084
+	QueueDriverLow    = 0x090
+	QueueDriverHigh   = 0x094
+	QueueDeviceLow    = 0x0A0
+	QueueDeviceHigh   = 0x0A4
+	ConfigGeneration  = 0x0FC
+	Config            = 0x100
+
+	Magic  = 0x74726976 // "virt"
+	Vendor = 0x554D4551 // "QEMU", which some drivers insist on
+	MaxNum = 256        // largest queue the driver may configure
+)
+
+// Device status bits.
+const (
+	StatusAcknowledge = 1
+	StatusDriver      = 2
+	StatusDriverOK    = 4
+	StatusFeaturesOK  = 8
+	StatusNeedsReset  = 64
+	StatusFailed      = 128
+)
+
+// Feature bits shared by all devices.
+const (
+	FeatureVersion1 = 1 << 32
+)
+
+// Interrupt status bits.
+const (
+	InterruptUsedBuffer   = 1
+	InterruptConfigChange = 2
+)
+
+// Device is the part of a virtio device behind the transport.
+type Device interface {
+	ID() uint32
+	Features() uint64
+	NumQueues() int
+	// Config returns the device-specific configuration space.
+	Config() []byte
+	// Activate hands the configured queues to the device once the driver is ready.
+	Activate(queues []*Queue) error
+	// Notify tells the device that queue q has new buffers available.
+	Notify(q int) error
+	Reset()
+}
+
+// Snapshotter is implemented by devices with state of their own to save.
+type Snapshotter interface {
+	Save(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+// ConfigWriter is implemented by devices whose configuration space the
+// driver writes to. Writes are ignored for every other device.
+type ConfigWriter interface {
+	WriteConfig(offset uint64, data []byte)
+}
+
+// Receiver is implemented by devices that take input from the host. The
+// input only reaches the guest when the hart polls for it, so that it can be
+// recorded and replayed like any other asynchronous event.
+type Receiver interface {
+	// Poll delivers the next piece of host input to the guest, if the guest
+	// has room for it, and returns it along with the port it went to.
+	Poll() (port int, data []byte, ok bool)
+	// Receive delivers data to port as if it had just arrived from the host.
+	Receive(port int, data []byte) error
+}
+
+// Sender is implemented by devices that pass guest output on to the host.
+// While muted they drop it instead, so that instructions executed again to
+// reach an earlier point do not repeat it.
+type Sender interface {
+	Mute(muted bool)
+}
+
+// MMIO is the transport of one device slot.
+type MMIO struct {
+	Base uint64
+	transport
+}
+
+// NewMMIO attaches dev at base. The device reaches guest RAM through mem and
+// drives its interrupt line through irq.
+func NewMMIO(base uint64, dev Device, mem Memory, irq func(high bool)) *MMIO {
+	m := &MMIO{Base: base}
+	m.init(dev, mem, irq)
+	return m
+}
+
+func (m *MMIO) Load(addr, bytes uint64) (uint64, error) {
+	offset := addr - m.Base
+	if offset >= Config {
+		return m.loadConfig(offset-Config, bytes)
+	}
+	if bytes != 4 {
+		return 0, fmt.Errorf("invalid data bytes: %d", bytes)
+	}
+	q := m.queue()
+	switch offset {
+	case MagicValue:
+		return Magic, nil
+	case Version:
+		return 2, nil
+	case DeviceID:
+		return uint64(m.Device.ID()), nil
+	case VendorID:
+		return Vendor, nil
+	case DeviceFeatures:
+		return uint64(m.deviceFeatures()), nil
+	case QueueNumMax:
+		if q == nil {
+			return 0, nil
+		}
+		return MaxNum, nil
+	case QueueReady:
+		if q == nil || !q.Ready {
+			return 0, nil
+		}
+		return 1, nil
+	case InterruptStatus:
+		return uint64(m.interruptStatus), nil
+	case Status:
+		return uint64(m.status), nil
+	case ConfigGeneration:
+		return uint64(m.configGeneration), nil
+	}
+	return 0, nil
+}
+
+func (m *MMIO) Store(addr, bytes, data uint64) error {
+	offset := addr - m.Base
+	if offset >= Config {
+		m.storeConfig(offset-Config, bytes, data)
+		return nil
+	}
+	if bytes != 4 {
+		return fmt.Errorf("invalid data bytes: %d", bytes)
+	}
+	v := uint32(data)
+	q := m.queue()
+	switch offset {
+	case DeviceFeaturesSel:
+		m.deviceFeaturesSel = v
+	case DriverFeatures:
+		m.setDriverFeatures(v)
+	case DriverFeaturesSel:
+		m.driverFeaturesSel = v
+	case QueueSel:
+		m.queueSel = v
+	case QueueNum:
+		if q != nil && v <= MaxNum && v&(v-1) == 0 {
+			q.Num = v
+		}
+	case QueueReady:
+		if q != nil {
+			q.Ready = v&1 == 1
+		}
+	case QueueNotify:
+		return m.notify(v)
+	case InterruptACK:
+		m.ack(v)
+	case Status:
+		return m.setStatus(v)
+	case QueueDescLow, QueueDescHigh:
+		if q != nil {
+			q.Desc = setHalf(q.Desc, offset-QueueDescLow, v)
+		}
+	case QueueDriverLow, QueueDriverHigh:
+		if q != nil {
+			q.Avail = setHalf(q.Avail, offset-QueueDriverLow, v)
+		}
+	case QueueDeviceLow, QueueDeviceHigh:
+		if q != nil {
+			q.Used = setHalf(q.Used, offset-QueueDeviceLow, v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package virtio
+
+import (
+	"encoding/binary"
+	"errors"
+	"goemu/ether"
+)
+
+// Network device constants.
+const (
+	NetID            = 1
+	NetFeatureMAC    = 1 << 5
+	NetFeatureStatus = 1 << 16
+	NetLinkUp        = 1
+
+	netRx         = 0
+	netTx         = 1
+	netHeaderSize = 12 // virtio_net_hdr including num_buffers
+)
+
+// Net is a virtio network device whose frames travel through an ether.Backend.
+type Net struct {
+	MAC     ether.Addr
+	Backend ether.Backend
+	Pcap    *ether.Pcap // captures every frame if not nil
+
+	queues  []*Queue
+	pending []byte // a frame waiting for a receive buffer
+	muted   bool   // drops sent frames, see Sender
+}
+
+func NewNet(mac ether.Addr, backend ether.Backend, pcap *ether.Pcap) *Net {
+	return &Net{MAC: mac, Backend: backend, Pcap: pcap}
+}
+
+func (n *Net) ID() uint32 {
+	return NetID
+}
+
+func (n *Net) Features() uint64 {
+	return NetFeatureMAC | NetFeatureStatus
+}
+
+func (n *Net) NumQueues() int {
+	return 2
+}
+
+// Config holds the MAC address and the link status.
+func (n *Net) Config() []byte {
+	config := make([]byte, 8)
+	copy(config, n.MAC[:])
+	binary.LittleEndian.PutUint16(config[6:], NetLinkUp)
+	return config
+}
+
+func (n *Net) Activate(queues []*Queue) error {
+	n.queues = queues
+	return nil
+}
+
+func (n *Net) Reset() {
+	n.queues = nil
+	n.pending = nil
+}
+
+func (n *Net) Notify(q int) error {
+	if q != netTx {
+		return nil // receive buffers are filled when frames are polled
+	}
+	tx := n.queues[netTx]
+	for {
+		chain, err := tx.Pop()
+		if err != nil || chain == nil {
+			return err
+		}
+		data, err := chain.ReadAll()
+		if err != nil {
+			return err
+		}
+		if len(data) > netHeaderSize && !n.muted {
+			frame := data[netHeaderSize:]
+			if err = n.capture(frame); err != nil {
+				return err
+			}
+			if err = n.Backend.Send(frame); err != nil {
+				return err
+			}
+		}
+		if err = tx.Push(chain, 0); err != nil {
+			return err
+		}
+	}
+}
+
+func (n *Net) Mute(muted bool) {
+	n.muted = muted
+}
+
+func (n *Net) capture(frame []byte) error {
+	if n.Pcap == nil {
+		return nil
+	}
+	return n.Pcap.Write(frame)
+}
+
+// Poll passes the next frame from the backend to the guest once it has
+// posted a receive buffer.
+func (n *Net) Poll() (int, []byte, bool) {
+	if n.queues == nil {
+		return 0, nil, false
+	}
+	if n.pending == nil {
+		select {
+		case frame, ok := <-n.Backend.Frames():
+			if !ok {
+				return 0, nil, false
+			}
+			n.pending = frame
+		default:
+			return 0, nil, false
+		}
+	}
+	frame := n.pending
+	if err := n.Receive(0, frame); err != nil {
+		return 0, nil, false
+	}
+	n.pending = nil
+	return 0, frame, true
+}
+
+// Receive hands frame to the guest as if it had just arrived from the backend.
+func (n *Net) Receive(_ int, frame []byte) error {
+	if n.queues == nil {
+		return errors.New("network device is not active")
+	}
+	rx := n.queues[netRx]
+	chain, err := rx.Pop()
+	if err != nil {
+		return err
+	}
+	if chain == nil {
+		return errors.New("no receive buffer on network device")
+	}
+	if err = n.capture(frame); err != nil {
+		return err
+	}
+	data := make([]byte, netHeaderSize+len(frame))
+	binary.LittleEndian.PutUint16(data[10:], 1) // num_buffers
+	copy(data[netHeaderSize:], frame)
+	written, err := chain.Write(data) // frames larger than the buffer are cut short
+	if err != nil {
+		return err
+	}
+	return rx.Push(chain, uint32(written))
+}
+
+func (n *Net) Close() error {
+	return n.Backend.Close()
+}
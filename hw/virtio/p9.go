@@ -0,0 +1,83 @@
+package virtio
+
+import (
+	"encoding/binary"
+	"goemu/p9"
+)
+
+// 9P transport constants.
+const (
+	P9ID              = 9
+	P9FeatureMountTag = 1 << 0
+
+	maxMountTag = 255
+)
+
+// P9 exports a host directory through a 9P server. The guest mounts it by
+// its tag, e.g. mount -t 9p -o trans=virtio,version=9p2000.L tag /mnt.
+type P9 struct {
+	Tag    string
+	Server *p9.Server
+
+	queues []*Queue
+}
+
+func NewP9(tag string, server *p9.Server) *P9 {
+	if len(tag) > maxMountTag {
+		tag = tag[:maxMountTag]
+	}
+	return &P9{Tag: tag, Server: server}
+}
+
+func (p *P9) ID() uint32 {
+	return P9ID
+}
+
+func (p *P9) Features() uint64 {
+	return P9FeatureMountTag
+}
+
+func (p *P9) NumQueues() int {
+	return 1
+}
+
+// Config holds the length of the mount tag and the tag.
+func (p *P9) Config() []byte {
+	config := make([]byte, 2+len(p.Tag))
+	binary.LittleEndian.PutUint16(config, uint16(len(p.Tag)))
+	copy(config[2:], p.Tag)
+	return config
+}
+
+func (p *P9) Activate(queues []*Queue) error {
+	p.queues = queues
+	return nil
+}
+
+func (p *P9) Reset() {
+	p.queues = nil
+	p.Server.Reset()
+}
+
+// Notify serves each request in turn, writing the reply to the writable part
+// of its chain.
+func (p *P9) Notify(q int) error {
+	requests := p.queues[0]
+	for {
+		chain, err := requests.Pop()
+		if err != nil || chain == nil {
+			return err
+		}
+		req, err := chain.ReadAll()
+		if err != nil {
+			return err
+		}
+		written, err := chain.Write(p.Server.Handle(req))
+		if err != nil {
+			return err
+		}
+		if err = requests.Push(chain, uint32(written)); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package virtio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"goemu/hw/pci"
+	"io"
+)
+
+// Virtio over PCI, without the legacy interface. Every structure sits in
+// BAR 0 and is found through a vendor-specific capability.
+const (
+	PCIVendor     = 0x1AF4
+	PCIDeviceBase = 0x1040 // plus the device ID
+	PCISubsystem  = 0x1100
+
+	PCICommon = 0x0000 // offsets in BAR 0
+	PCIISR    = 0x1000
+	PCIDevice = 0x2000
+	PCINotify = 0x3000
+
+	PCINotifyMultiplier = 4 // the notify address of queue q is PCINotify+4*q
+	pciBarSize          = 0x4000
+
+	// capability types
+	pciCapCommon = 1
+	pciCapNotify = 2
+	pciCapISR    = 3
+	pciCapDevice = 4
+
+	// common configuration registers
+	CommonDeviceFeatureSel = 0x00
+	CommonDeviceFeature    = 0x04
+	CommonDriverFeatureSel = 0x08
+	CommonDriverFeature    = 0x0C
+	CommonMSIXConfig       = 0x10
+	CommonNumQueues        = 0x12
+	CommonDeviceStatus     = 0x14
+	CommonConfigGeneration = 0x15
+	CommonQueueSelect      = 0x16
+	CommonQueueSize        = 0x18
+	CommonQueueMSIXVector  = 0x1A
+	CommonQueueEnable      = 0x1C
+	CommonQueueNotifyOff   = 0x1E
+	CommonQueueDesc        = 0x20
+	CommonQueueDriver      = 0x28
+	CommonQueueDevice      = 0x30
+	commonSize             = 0x38
+
+	noVector = 0xFFFF // MSI-X is not offered, drivers fall back to INTx
+)
+
+// pciClass returns the class code a device of the given type is listed with.
+func pciClass(id uint32) uint32 {
+	switch id {
+	case NetID:
+		return 0x020000 // Ethernet controller
+	case BlkID:
+		return 0x010000 // SCSI storage controller
+	case ConsoleID:
+		return 0x078000 // communication controller
+	case P9ID:
+		return 0x018000 // mass storage controller
+	case InputID:
+		return 0x098000 // input device
+	}
+	return 0xFF0000
+}
+
+// PCI is the transport of a device behind the PCI host bridge.
+type PCI struct {
+	Function *pci.Function
+	transport
+}
+
+// NewPCI wraps dev in a PCI function, ready to be plugged into a host bridge.
+// The device reaches guest RAM through mem.
+func NewPCI(dev Device, mem Memory) *PCI {
+	p := &PCI{Function: pci.NewFunction(PCIVendor, PCIDeviceBase+uint16(dev.ID()), pciClass(dev.ID()), 1)}
+	p.init(dev, mem, p.Function.SetIrq)
+	p.Function.Set16(pci.SubsystemVendor, PCIVendor)
+	p.Function.Set16(pci.SubsystemID, PCISubsystem)
+	p.Function.AddBar(0, pciBarSize, false, p)
+	p.addCapability(pciCapCommon, PCICommon, commonSize)
+	p.addCapability(pciCapNotify, PCINotify, uint32(PCINotifyMultiplier*len(p.queues)))
+	p.addCapability(pciCapISR, PCIISR, 1)
+	p.addCapability(pciCapDevice, PCIDevice, 0x1000)
+	return p
+}
+
+// addCapability points the driver at a structure in BAR 0.
+func (p *PCI) addCapability(typ uint8, offset, length uint32) {
+	body := make([]byte, 14)
+	body[0] = 16 // cap_len
+	body[1] = typ
+	binary.LittleEndian.PutUint32(body[6:], offset)
+	binary.LittleEndian.PutUint32(body[10:], length)
+	if typ == pciCapNotify {
+		body[0] = 20
+		body = binary.LittleEndian.AppendUint32(body, PCINotifyMultiplier)
+	}
+	p.Function.AddCapability(pci.CapVendor, body)
+}
+
+// Load reads BAR 0.
+func (p *PCI) Load(offset, bytes uint64) (uint64, error) {
+	switch {
+	case offset < commonSize:
+		return p.loadCommon(offset, bytes), nil
+	case offset == PCIISR:
+		isr := p.interruptStatus
+		p.ack(isr) // reading acknowledges
+		return uint64(isr), nil
+	case offset >= PCIDevice && offset < PCINotify:
+		return p.loadConfig(offset-PCIDevice, bytes)
+	}
+	return 0, nil
+}
+
+func (p *PCI) Store(offset, bytes, data uint64) error {
+	switch {
+	case offset < commonSize:
+		return p.storeCommon(offset, bytes, data)
+	case offset >= PCIDevice && offset < PCINotify:
+		p.storeConfig(offset-PCIDevice, bytes, data)
+	case offset >= PCINotify:
+		return p.notify(uint32((offset - PCINotify) / PCINotifyMultiplier))
+	}
+	return nil
+}
+
+func (p *PCI) loadCommon(offset, bytes uint64) uint64 {
+	q := p.queue()
+	switch offset {
+	case CommonDeviceFeatureSel:
+		return uint64(p.deviceFeaturesSel)
+	case CommonDeviceFeature:
+		return uint64(p.deviceFeatures())
+	case CommonDriverFeatureSel:
+		return uint64(p.driverFeaturesSel)
+	case CommonDriverFeature:
+		if p.driverFeaturesSel > 1 {
+			return 0
+		}
+		return p.driverFeatures >> (32 * p.driverFeaturesSel) & 0xFFFFFFFF
+	case CommonMSIXConfig, CommonQueueMSIXVector:
+		return noVector
+	case CommonNumQueues:
+		return uint64(len(p.queues))
+	case CommonDeviceStatus:
+		return uint64(p.status)
+	case CommonConfigGeneration:
+		return uint64(uint8(p.configGeneration))
+	case CommonQueueSelect:
+		return uint64(p.queueSel)
+	case CommonQueueNotifyOff:
+		return uint64(p.queueSel)
+	}
+	if q == nil {
+		return 0
+	}
+	switch offset &^ 7 {
+	case CommonQueueSize:
+		if q.Num == 0 {
+			return MaxNum
+		}
+		return uint64(q.Num)
+	case CommonQueueEnable:
+		if q.Ready {
+			return 1
+		}
+		return 0
+	case CommonQueueDesc:
+		return half(q.Desc, offset-CommonQueueDesc, bytes)
+	case CommonQueueDriver:
+		return half(q.Avail, offset-CommonQueueDriver, bytes)
+	case CommonQueueDevice:
+		return half(q.Used, offset-CommonQueueDevice, bytes)
+	}
+	return 0
+}
+
+// half returns the part of a 64-bit register a 4 or 8 byte access at offset
+// 0 or 4 covers.
+func half(reg, offset, bytes uint64) uint64 {
+	if bytes == 8 {
+		return reg
+	}
+	return reg >> (8 * offset) & 0xFFFFFFFF
+}
+
+func (p *PCI) storeCommon(offset, bytes, data uint64) error {
+	v := uint32(data)
+	q := p.queue()
+	switch offset {
+	case CommonDeviceFeatureSel:
+		p.deviceFeaturesSel = v
+	case CommonDriverFeatureSel:
+		p.driverFeaturesSel = v
+	case CommonDriverFeature:
+		p.setDriverFeatures(v)
+	case CommonDeviceStatus:
+		return p.setStatus(v & 0xFF)
+	case CommonQueueSelect:
+		p.queueSel = v & 0xFFFF
+	case CommonQueueSize:
+		if q != nil && v <= MaxNum && v&(v-1) == 0 {
+			q.Num = v
+		}
+	case CommonQueueEnable:
+		if q != nil && v&1 == 1 {
+			if q.Num == 0 {
+				q.Num = MaxNum
+			}
+			q.Ready = true
+		}
+	case CommonQueueDesc, CommonQueueDesc + 4, CommonQueueDriver, CommonQueueDriver + 4, CommonQueueDevice, CommonQueueDevice + 4:
+		if q == nil {
+			return nil
+		}
+		reg := &q.Desc
+		switch offset &^ 7 {
+		case CommonQueueDriver:
+			reg = &q.Avail
+		case CommonQueueDevice:
+			reg = &q.Used
+		}
+		if bytes == 8 {
+			*reg = data
+		} else {
+			*reg = setHalf(*reg, offset&4, v)
+		}
+	case CommonMSIXConfig, CommonQueueMSIXVector, CommonNumQueues, CommonConfigGeneration, CommonQueueNotifyOff, CommonDeviceFeature:
+		// read-only, or vectors that are never used
+	default:
+		return fmt.Errorf("invalid virtio-pci register: %x", offset)
+	}
+	return nil
+}
+
+// Restore also brings back the level of the interrupt, which the host bridge
+// does not save.
+func (p *PCI) Restore(r io.Reader) error {
+	if err := p.transport.Restore(r); err != nil {
+		return err
+	}
+	p.irq(p.interruptStatus != 0)
+	return nil
+}
@@ -0,0 +1,211 @@
+package virtio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Memory is the guest RAM devices read and write descriptors and buffers in.
+type Memory interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// Descriptor flags.
+const (
+	DescNext     = 1 // the buffer continues in the next field
+	DescWrite    = 2 // the buffer is write-only for the device
+	DescIndirect = 4 // the buffer contains a list of buffer descriptors
+)
+
+const (
+	descSize    = 16
+	maxChainLen = 64 * 1024 * 1024 // bound on what a single request may gather
+)
+
+// Queue is a split virtqueue set up by the driver.
+type Queue struct {
+	Num   uint32 // number of descriptors, a power of two
+	Ready bool
+	Desc  uint64 // descriptor table
+	Avail uint64 // driver ring
+	Used  uint64 // device ring
+
+	lastAvail uint16 // next entry of the driver ring to take
+	mem       Memory
+	notify    func() // raises the used buffer interrupt
+}
+
+// Buffer is one guest buffer of a descriptor chain.
+type Buffer struct {
+	Addr uint64
+	Len  uint32
+}
+
+// Chain is a request taken from a queue. The device reads the buffers of In
+// and fills the buffers of Out.
+type Chain struct {
+	Head uint16
+	In   []Buffer // readable by the device
+	Out  []Buffer // writable by the device
+
+	mem Memory
+}
+
+// Pop takes the next available descriptor chain, if any.
+func (q *Queue) Pop() (*Chain, error) {
+	if !q.Ready || q.Num == 0 {
+		return nil, nil
+	}
+	idx, err := q.load16(q.Avail + 2)
+	if err != nil {
+		return nil, err
+	}
+	if idx == q.lastAvail {
+		return nil, nil
+	}
+	head, err := q.load16(q.Avail + 4 + 2*uint64(uint32(q.lastAvail)%q.Num))
+	if err != nil {
+		return nil, err
+	}
+	q.lastAvail++
+
+	c := &Chain{Head: head, mem: q.mem}
+	if err = q.walk(c, q.Desc, q.Num, head, true); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Available returns the number of chains the driver has made available that
+// the device has not taken yet.
+func (q *Queue) Available() (int, error) {
+	if !q.Ready || q.Num == 0 {
+		return 0, nil
+	}
+	idx, err := q.load16(q.Avail + 2)
+	if err != nil {
+		return 0, err
+	}
+	return int(idx - q.lastAvail), nil
+}
+
+// walk collects the buffers of the chain starting at descriptor i of the
+// table at addr, following one level of indirect tables.
+func (q *Queue) walk(c *Chain, table uint64, num uint32, i uint16, direct bool) error {
+	for n := uint32(0); ; n++ {
+		if uint32(i) >= num || n >= num {
+			return fmt.Errorf("invalid descriptor chain: %d", c.Head)
+		}
+		var d [descSize]byte
+		if _, err := q.mem.ReadAt(d[:], int64(table+uint64(i)*descSize)); err != nil {
+			return err
+		}
+		addr := binary.LittleEndian.Uint64(d[0:])
+		length := binary.LittleEndian.Uint32(d[8:])
+		flags := binary.LittleEndian.Uint16(d[12:])
+		next := binary.LittleEndian.Uint16(d[14:])
+
+		switch {
+		case flags&DescIndirect != 0 && direct:
+			if err := q.walk(c, addr, length/descSize, 0, false); err != nil {
+				return err
+			}
+		case flags&DescWrite != 0:
+			c.Out = append(c.Out, Buffer{Addr: addr, Len: length})
+		default:
+			if len(c.Out) != 0 {
+				return fmt.Errorf("readable descriptor after writable ones: %d", c.Head)
+			}
+			c.In = append(c.In, Buffer{Addr: addr, Len: length})
+		}
+		if flags&DescNext == 0 {
+			return nil
+		}
+		i = next
+	}
+}
+
+// Push returns a chain to the driver, reporting the number of bytes the
+// device wrote, and raises the interrupt.
+func (q *Queue) Push(c *Chain, written uint32) error {
+	idx, err := q.load16(q.Used + 2)
+	if err != nil {
+		return err
+	}
+	var elem [8]byte
+	binary.LittleEndian.PutUint32(elem[0:], uint32(c.Head))
+	binary.LittleEndian.PutUint32(elem[4:], written)
+	if _, err = q.mem.WriteAt(elem[:], int64(q.Used+4+8*uint64(uint32(idx)%q.Num))); err != nil {
+		return err
+	}
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], idx+1)
+	if _, err = q.mem.WriteAt(b[:], int64(q.Used+2)); err != nil {
+		return err
+	}
+	q.notify()
+	return nil
+}
+
+func (q *Queue) load16(addr uint64) (uint16, error) {
+	var b [2]byte
+	if _, err := q.mem.ReadAt(b[:], int64(addr)); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(b[:]), nil
+}
+
+func (q *Queue) reset() {
+	q.Num, q.Ready, q.Desc, q.Avail, q.Used, q.lastAvail = 0, false, 0, 0, 0, 0
+}
+
+// ReadAll gathers the readable buffers of the chain.
+func (c *Chain) ReadAll() ([]byte, error) {
+	n := 0
+	for _, b := range c.In {
+		n += int(b.Len)
+	}
+	if n > maxChainLen {
+		return nil, fmt.Errorf("descriptor chain too long: %d", n)
+	}
+	data := make([]byte, n)
+	off := 0
+	for _, b := range c.In {
+		if _, err := c.mem.ReadAt(data[off:off+int(b.Len)], int64(b.Addr)); err != nil {
+			return nil, err
+		}
+		off += int(b.Len)
+	}
+	return data, nil
+}
+
+// Write scatters data over the writable buffers of the chain, and returns
+// how much of it fit.
+func (c *Chain) Write(data []byte) (int, error) {
+	n := 0
+	for _, b := range c.Out {
+		if n == len(data) {
+			break
+		}
+		chunk := data[n:]
+		if len(chunk) > int(b.Len) {
+			chunk = chunk[:b.Len]
+		}
+		if _, err := c.mem.WriteAt(chunk, int64(b.Addr)); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+// OutLen is the total size of the writable buffers.
+func (c *Chain) OutLen() int {
+	n := 0
+	for _, b := range c.Out {
+		n += int(b.Len)
+	}
+	return n
+}
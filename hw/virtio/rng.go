@@ -0,0 +1,113 @@
+package virtio
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+)
+
+// Entropy device constants.
+const (
+	RngID = 4
+
+	maxEntropy = 64 * 1024 // bytes handed out per request
+)
+
+// Rng is a virtio entropy device. It draws from the host's cryptographic
+// generator, or from a seeded generator whose state is part of the snapshot
+// so that runs can be reproduced.
+type Rng struct {
+	seeded bool
+	state  uint64 // splitmix64 state of a seeded generator
+	queues []*Queue
+}
+
+func NewRng() *Rng {
+	return &Rng{}
+}
+
+// NewSeededRng returns a device that produces the same bytes for every run
+// started from seed.
+func NewSeededRng(seed uint64) *Rng {
+	return &Rng{seeded: true, state: seed}
+}
+
+func (r *Rng) ID() uint32 {
+	return RngID
+}
+
+func (r *Rng) Features() uint64 {
+	return 0
+}
+
+func (r *Rng) NumQueues() int {
+	return 1
+}
+
+func (r *Rng) Config() []byte {
+	return nil
+}
+
+func (r *Rng) Activate(queues []*Queue) error {
+	r.queues = queues
+	return nil
+}
+
+func (r *Rng) Reset() {
+	r.queues = nil
+}
+
+func (r *Rng) Notify(q int) error {
+	for {
+		chain, err := r.queues[0].Pop()
+		if err != nil || chain == nil {
+			return err
+		}
+		n := chain.OutLen()
+		if n > maxEntropy {
+			n = maxEntropy
+		}
+		data := make([]byte, n)
+		if err = r.read(data); err != nil {
+			return err
+		}
+		written, err := chain.Write(data)
+		if err != nil {
+			return err
+		}
+		if err = r.queues[0].Push(chain, uint32(written)); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *Rng) read(data []byte) error {
+	if !r.seeded {
+		_, err := io.ReadFull(rand.Reader, data)
+		return err
+	}
+	var word [8]byte
+	for i := 0; i < len(data); i += 8 {
+		r.state += 0x9E3779B97F4A7C15
+		z := r.state
+		z = (z ^ z>>30) * 0xBF58476D1CE4E5B9
+		z = (z ^ z>>27) * 0x94D049BB133111EB
+		binary.LittleEndian.PutUint64(word[:], z^z>>31)
+		copy(data[i:], word[:])
+	}
+	return nil
+}
+
+func (r *Rng) Save(w io.Writer) error {
+	if err := binary.Write(w, binary.LittleEndian, r.seeded); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, r.state)
+}
+
+func (r *Rng) Restore(rd io.Reader) error {
+	if err := binary.Read(rd, binary.LittleEndian, &r.seeded); err != nil {
+		return err
+	}
+	return binary.Read(rd, binary.LittleEndian, &r.state)
+}
@@ -0,0 +1,175 @@
+package virtio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// transport is what the MMIO and PCI transports have in common: the device
+// status, feature negotiation, the queues and the interrupt status.
+type transport struct {
+	Device Device
+
+	irq func(high bool)
+
+	status            uint32
+	deviceFeaturesSel uint32
+	driverFeaturesSel uint32
+	driverFeatures    uint64
+	queueSel          uint32
+	interruptStatus   uint32
+	configGeneration  uint32
+	queues            []*Queue
+}
+
+func (t *transport) init(dev Device, mem Memory, irq func(high bool)) {
+	t.Device, t.irq = dev, irq
+	t.queues = make([]*Queue, dev.NumQueues())
+	for i := range t.queues {
+		t.queues[i] = &Queue{mem: mem, notify: func() { t.Interrupt(InterruptUsedBuffer) }}
+	}
+}
+
+// Interrupt sets bits in the interrupt status and raises the line.
+func (t *transport) Interrupt(bits uint32) {
+	t.interruptStatus |= bits
+	t.irq(true)
+}
+
+// ConfigChanged tells the driver that the configuration space was updated.
+func (t *transport) ConfigChanged() {
+	t.configGeneration++
+	t.Interrupt(InterruptConfigChange)
+}
+
+// ack clears bits of the interrupt status, lowering the line once none is left.
+func (t *transport) ack(bits uint32) {
+	t.interruptStatus &^= bits
+	if t.interruptStatus == 0 {
+		t.irq(false)
+	}
+}
+
+// deviceFeatures returns the selected word of the device's features.
+func (t *transport) deviceFeatures() uint32 {
+	features := t.Device.Features() | FeatureVersion1
+	if t.deviceFeaturesSel > 1 {
+		return 0
+	}
+	return uint32(features >> (32 * t.deviceFeaturesSel))
+}
+
+func (t *transport) setDriverFeatures(v uint32) {
+	if t.driverFeaturesSel <= 1 {
+		shift := 32 * t.driverFeaturesSel
+		t.driverFeatures = t.driverFeatures&^(0xFFFFFFFF<<shift) | uint64(v)<<shift
+	}
+}
+
+// notify lets the device serve queue q. A device that fails, as on a
+// malformed descriptor chain, needs a reset by the driver and stops serving
+// until then: what the guest gets wrong must not stop the emulator.
+func (t *transport) notify(q uint32) error {
+	if q < uint32(len(t.queues)) && t.status&StatusDriverOK != 0 && t.status&StatusNeedsReset == 0 {
+		if err := t.Device.Notify(int(q)); err != nil {
+			t.status |= StatusNeedsReset
+			t.Interrupt(InterruptConfigChange)
+		}
+	}
+	return nil
+}
+
+func (t *transport) setStatus(v uint32) error {
+	if v == 0 {
+		t.reset()
+		return nil
+	}
+	old := t.status
+	t.status = v
+	if old&StatusDriverOK == 0 && v&StatusDriverOK != 0 {
+		return t.Device.Activate(t.queues)
+	}
+	return nil
+}
+
+func (t *transport) reset() {
+	t.status, t.deviceFeaturesSel, t.driverFeaturesSel, t.driverFeatures = 0, 0, 0, 0
+	t.queueSel, t.interruptStatus = 0, 0
+	for _, q := range t.queues {
+		q.reset()
+	}
+	t.Device.Reset()
+	t.irq(false)
+}
+
+func (t *transport) queue() *Queue {
+	if t.queueSel >= uint32(len(t.queues)) {
+		return nil
+	}
+	return t.queues[t.queueSel]
+}
+
+func (t *transport) loadConfig(offset, bytes uint64) (uint64, error) {
+	switch bytes {
+	case 1, 2, 4, 8:
+	default:
+		return 0, fmt.Errorf("invalid data bytes: %d", bytes)
+	}
+	config := t.Device.Config()
+	var buf [8]byte
+	if offset < uint64(len(config)) {
+		copy(buf[:bytes], config[offset:])
+	}
+	return binary.LittleEndian.Uint64(buf[:]), nil
+}
+
+func (t *transport) storeConfig(offset, bytes, data uint64) {
+	if w, ok := t.Device.(ConfigWriter); ok && bytes <= 8 {
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], data)
+		w.WriteConfig(offset, buf[:bytes])
+	}
+}
+
+func setHalf(reg, half uint64, v uint32) uint64 {
+	shift := half * 8 // half is 0 or 4
+	return reg&^(0xFFFFFFFF<<shift) | uint64(v)<<shift
+}
+
+func (t *transport) Save(w io.Writer) error {
+	regs := []any{t.status, t.deviceFeaturesSel, t.driverFeaturesSel, t.driverFeatures, t.queueSel, t.interruptStatus, t.configGeneration}
+	for _, q := range t.queues {
+		regs = append(regs, q.Num, q.Ready, q.Desc, q.Avail, q.Used, q.lastAvail)
+	}
+	for _, v := range regs {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	if s, ok := t.Device.(Snapshotter); ok {
+		return s.Save(w)
+	}
+	return nil
+}
+
+func (t *transport) Restore(r io.Reader) error {
+	regs := []any{&t.status, &t.deviceFeaturesSel, &t.driverFeaturesSel, &t.driverFeatures, &t.queueSel, &t.interruptStatus, &t.configGeneration}
+	for _, q := range t.queues {
+		regs = append(regs, &q.Num, &q.Ready, &q.Desc, &q.Avail, &q.Used, &q.lastAvail)
+	}
+	for _, v := range regs {
+		if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	if s, ok := t.Device.(Snapshotter); ok {
+		if err := s.Restore(r); err != nil {
+			return err
+		}
+	}
+	if t.status&StatusDriverOK != 0 {
+		return t.Device.Activate(t.queues)
+	}
+	return nil
+}
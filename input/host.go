@@ -0,0 +1,64 @@
+package input
+
+import "sync"
+
+const hostQueue = 256 // batches kept for a guest that does not read them
+
+// Host turns the key and pointer events of a remote display, such as a VNC
+// client, into batches for a keyboard and a tablet. Its methods may be called
+// from any goroutine; batches are dropped while the guest is not keeping up.
+type Host struct {
+	Keyboard chan []Event
+	Tablet   chan []Event
+	Width    int // size of the screen pointer positions are on
+	Height   int
+
+	mu      sync.Mutex
+	buttons uint8
+}
+
+func NewHost(width, height int) *Host {
+	return &Host{
+		Keyboard: make(chan []Event, hostQueue),
+		Tablet:   make(chan []Event, hostQueue),
+		Width:    width,
+		Height:   height,
+	}
+}
+
+// Key presses or releases the key typing an X11 keysym.
+func (h *Host) Key(down bool, keysym uint32) {
+	if code, ok := Keysym(keysym); ok {
+		send(h.Keyboard, Press(code, down))
+	}
+}
+
+// Pointer moves the tablet and updates the buttons, given as an RFB button
+// mask: left, middle and right, then wheel up and down.
+func (h *Host) Pointer(buttons uint8, x, y int) {
+	h.mu.Lock()
+	changed := h.buttons ^ buttons
+	h.buttons = buttons
+	h.mu.Unlock()
+
+	events := []Event{{EvAbs, AbsX, Scale(x, h.Width)}, {EvAbs, AbsY, Scale(y, h.Height)}}
+	for i, code := range []uint16{BtnLeft, BtnMiddle, BtnRight} {
+		if changed&(1<<i) != 0 {
+			events = append(events, Event{EvKey, code, int32(buttons >> i & 1)})
+		}
+	}
+	if changed&buttons&0x08 != 0 {
+		events = append(events, Event{EvRel, RelWheel, 1})
+	}
+	if changed&buttons&0x10 != 0 {
+		events = append(events, Event{EvRel, RelWheel, -1})
+	}
+	send(h.Tablet, append(events, Sync()))
+}
+
+func send(ch chan []Event, events []Event) {
+	select {
+	case ch <- events:
+	default:
+	}
+}
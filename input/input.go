@@ -0,0 +1,211 @@
+package input
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Event is a Linux input event, the unit virtio-input devices report.
+type Event struct {
+	Type  uint16
+	Code  uint16
+	Value int32
+}
+
+// Event types and codes, as in linux/input-event-codes.h.
+const (
+	EvSyn = 0x00
+	EvKey = 0x01
+	EvRel = 0x02
+	EvAbs = 0x03
+
+	SynReport = 0
+
+	BtnLeft   = 0x110
+	BtnRight  = 0x111
+	BtnMiddle = 0x112
+
+	RelWheel = 0x08
+
+	AbsX   = 0x00
+	AbsY   = 0x01
+	AbsMax = 0x7FFF // both axes of the tablet range over 0..AbsMax
+
+	EventSize = 8
+)
+
+// Kind is the sort of device a batch of events belongs to.
+type Kind int
+
+const (
+	Keyboard Kind = iota
+	Tablet
+)
+
+func (k Kind) String() string {
+	if k == Keyboard {
+		return "keyboard"
+	}
+	return "tablet"
+}
+
+// Sync returns the event that ends a batch.
+func Sync() Event {
+	return Event{EvSyn, SynReport, 0}
+}
+
+// Marshal encodes a batch of events the way a virtio-input device writes them
+// to the guest, one after another.
+func Marshal(events []Event) []byte {
+	data := make([]byte, len(events)*EventSize)
+	for i, e := range events {
+		binary.LittleEndian.PutUint16(data[i*EventSize:], e.Type)
+		binary.LittleEndian.PutUint16(data[i*EventSize+2:], e.Code)
+		binary.LittleEndian.PutUint32(data[i*EventSize+4:], uint32(e.Value))
+	}
+	return data
+}
+
+func Unmarshal(data []byte) ([]Event, error) {
+	if len(data)%EventSize != 0 {
+		return nil, fmt.Errorf("invalid event data length: %d", len(data))
+	}
+	events := make([]Event, len(data)/EventSize)
+	for i := range events {
+		events[i] = Event{
+			Type:  binary.LittleEndian.Uint16(data[i*EventSize:]),
+			Code:  binary.LittleEndian.Uint16(data[i*EventSize+2:]),
+			Value: int32(binary.LittleEndian.Uint32(data[i*EventSize+4:])),
+		}
+	}
+	return events, nil
+}
+
+// Keys maps key names, as in KEY_* without the prefix and in lower case, to
+// their codes.
+var Keys = map[string]uint16{
+	"esc": 1, "1": 2, "2": 3, "3": 4, "4": 5, "5": 6, "6": 7, "7": 8, "8": 9, "9": 10, "0": 11,
+	"minus": 12, "equal": 13, "backspace": 14, "tab": 15,
+	"q": 16, "w": 17, "e": 18, "r": 19, "t": 20, "y": 21, "u": 22, "i": 23, "o": 24, "p": 25,
+	"leftbrace": 26, "rightbrace": 27, "enter": 28, "leftctrl": 29,
+	"a": 30, "s": 31, "d": 32, "f": 33, "g": 34, "h": 35, "j": 36, "k": 37, "l": 38,
+	"semicolon": 39, "apostrophe": 40, "grave": 41, "leftshift": 42, "backslash": 43,
+	"z": 44, "x": 45, "c": 46, "v": 47, "b": 48, "n": 49, "m": 50,
+	"comma": 51, "dot": 52, "slash": 53, "rightshift": 54, "leftalt": 56, "space": 57, "capslock": 58,
+	"f1": 59, "f2": 60, "f3": 61, "f4": 62, "f5": 63, "f6": 64, "f7": 65, "f8": 66, "f9": 67, "f10": 68,
+	"f11": 87, "f12": 88, "rightctrl": 97, "rightalt": 100,
+	"home": 102, "up": 103, "pageup": 104, "left": 105, "right": 106, "end": 107, "down": 108, "pagedown": 109,
+	"insert": 110, "delete": 111, "leftmeta": 125, "rightmeta": 126,
+}
+
+var Buttons = map[string]uint16{
+	"left":   BtnLeft,
+	"right":  BtnRight,
+	"middle": BtnMiddle,
+}
+
+const shiftKey = 42
+
+// char is how a printable ASCII character is typed on a US keyboard.
+type char struct {
+	code  uint16
+	shift bool
+}
+
+var chars = func() map[byte]char {
+	m := map[byte]char{' ': {57, false}, '\n': {28, false}, '\t': {15, false}}
+	for c := byte('a'); c <= 'z'; c++ {
+		m[c] = char{Keys[string(c)], false}
+		m[c-'a'+'A'] = char{Keys[string(c)], true}
+	}
+	for c := byte('0'); c <= '9'; c++ {
+		m[c] = char{Keys[string(c)], false}
+	}
+	pairs := []struct {
+		key            string
+		plain, shifted byte
+	}{
+		{"1", 0, '!'}, {"2", 0, '@'}, {"3", 0, '#'}, {"4", 0, '$'}, {"5", 0, '%'},
+		{"6", 0, '^'}, {"7", 0, '&'}, {"8", 0, '*'}, {"9", 0, '('}, {"0", 0, ')'},
+		{"minus", '-', '_'}, {"equal", '=', '+'}, {"leftbrace", '[', '{'}, {"rightbrace", ']', '}'},
+		{"semicolon", ';', ':'}, {"apostrophe", '\'', '"'}, {"grave", '`', '~'}, {"backslash", '\\', '|'},
+		{"comma", ',', '<'}, {"dot", '.', '>'}, {"slash", '/', '?'},
+	}
+	for _, p := range pairs {
+		if p.plain != 0 {
+			m[p.plain] = char{Keys[p.key], false}
+		}
+		m[p.shifted] = char{Keys[p.key], true}
+	}
+	return m
+}()
+
+// Type returns the batches that type text, pressing shift where needed.
+func Type(text string) ([][]Event, error) {
+	var batches [][]Event
+	for i := 0; i < len(text); i++ {
+		c, ok := chars[text[i]]
+		if !ok {
+			return nil, fmt.Errorf("invalid character to type: %q", text[i])
+		}
+		if c.shift {
+			batches = append(batches, Press(shiftKey, true))
+		}
+		batches = append(batches, Press(c.code, true), Press(c.code, false))
+		if c.shift {
+			batches = append(batches, Press(shiftKey, false))
+		}
+	}
+	return batches, nil
+}
+
+// Press returns the batch that presses or releases a key or button.
+func Press(code uint16, down bool) []Event {
+	var v int32
+	if down {
+		v = 1
+	}
+	return []Event{{EvKey, code, v}, Sync()}
+}
+
+// keysyms maps the X11 keysyms of keys other than printable characters.
+var keysyms = map[uint32]uint16{
+	0xFF08: 14,  // BackSpace
+	0xFF09: 15,  // Tab
+	0xFF0D: 28,  // Return
+	0xFF1B: 1,   // Escape
+	0xFF50: 102, // Home
+	0xFF51: 105, // Left
+	0xFF52: 103, // Up
+	0xFF53: 106, // Right
+	0xFF54: 108, // Down
+	0xFF55: 104, // Prior
+	0xFF56: 109, // Next
+	0xFF57: 107, // End
+	0xFF63: 110, // Insert
+	0xFFE1: 42,  // Shift_L
+	0xFFE2: 54,  // Shift_R
+	0xFFE3: 29,  // Control_L
+	0xFFE4: 97,  // Control_R
+	0xFFE5: 58,  // Caps_Lock
+	0xFFE9: 56,  // Alt_L
+	0xFFEA: 100, // Alt_R
+	0xFFEB: 125, // Super_L
+	0xFFEC: 126, // Super_R
+	0xFFFF: 111, // Delete
+}
+
+// Keysym returns the key an X11 keysym is typed with. Shift is not part of
+// it: clients press and release it as a key of its own.
+func Keysym(sym uint32) (uint16, bool) {
+	if sym >= 0xFFBE && sym <= 0xFFC9 { // F1 to F12
+		return [...]uint16{59, 60, 61, 62, 63, 64, 65, 66, 67, 68, 87, 88}[sym-0xFFBE], true
+	}
+	if code, ok := keysyms[sym]; ok {
+		return code, true
+	}
+	if c, ok := chars[byte(sym)]; ok && sym < 0x80 {
+		return c.code, true
+	}
+	return 0, false
+}
@@ -0,0 +1,164 @@
+package input
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Batch is a group of events reported together, due once the guest has
+// retired At instructions.
+type Batch struct {
+	At     uint64
+	Kind   Kind
+	Events []Event
+}
+
+// Script is timed input in the order it is due.
+type Script []Batch
+
+// ParseScript reads a script with one action per line, each preceded by the
+// number of retired instructions it is due at:
+//
+//	<instret> key <name>...          press the keys in order, release them in reverse
+//	<instret> keydown <name>
+//	<instret> keyup <name>
+//	<instret> type <text>            type the rest of the line
+//	<instret> move <x> <y>           move the tablet to a pixel of a width x height screen
+//	<instret> click [button]         press and release a button, left by default
+//	<instret> buttondown <button>
+//	<instret> buttonup <button>
+//	<instret> scroll <n>             turn the wheel n notches, negative towards the user
+//
+// Blank lines and lines starting with # are skipped. Times must not decrease.
+func ParseScript(r io.Reader, width, height int) (Script, error) {
+	var s Script
+	var last uint64
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		batches, err := parseAction(line, width, height, &last)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		s = append(s, batches...)
+	}
+	return s, scanner.Err()
+}
+
+func parseAction(line string, width, height int, last *uint64) ([]Batch, error) {
+	at, rest, _ := strings.Cut(line, " ")
+	t, err := strconv.ParseUint(at, 0, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time: %s", at)
+	}
+	if t < *last {
+		return nil, fmt.Errorf("time goes backwards: %d", t)
+	}
+	*last = t
+	action, text, _ := strings.Cut(strings.TrimLeft(rest, " "), " ")
+	args := strings.Fields(text)
+
+	var kind Kind
+	var batches [][]Event
+	switch action {
+	case "key", "keydown", "keyup":
+		if len(args) == 0 || action != "key" && len(args) != 1 {
+			return nil, fmt.Errorf("invalid arguments to %s: %q", action, text)
+		}
+		codes := make([]uint16, len(args))
+		for i, name := range args {
+			code, ok := Keys[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown key: %s", name)
+			}
+			codes[i] = code
+		}
+		if action != "keyup" {
+			for _, code := range codes {
+				batches = append(batches, Press(code, true))
+			}
+		}
+		if action != "keydown" {
+			for i := len(codes) - 1; i >= 0; i-- {
+				batches = append(batches, Press(codes[i], false))
+			}
+		}
+	case "type":
+		if batches, err = Type(text); err != nil {
+			return nil, err
+		}
+	case "move":
+		kind = Tablet
+		if len(args) != 2 {
+			return nil, fmt.Errorf("invalid arguments to move: %q", text)
+		}
+		x, errX := strconv.Atoi(args[0])
+		y, errY := strconv.Atoi(args[1])
+		if errX != nil || errY != nil || x < 0 || x >= width || y < 0 || y >= height {
+			return nil, fmt.Errorf("invalid position: %q", text)
+		}
+		batches = append(batches, []Event{{EvAbs, AbsX, Scale(x, width)}, {EvAbs, AbsY, Scale(y, height)}, Sync()})
+	case "click", "buttondown", "buttonup":
+		kind = Tablet
+		if len(args) == 0 && action == "click" {
+			args = []string{"left"}
+		}
+		if len(args) != 1 {
+			return nil, fmt.Errorf("invalid arguments to %s: %q", action, text)
+		}
+		code, ok := Buttons[args[0]]
+		if !ok {
+			return nil, fmt.Errorf("unknown button: %s", args[0])
+		}
+		if action != "buttonup" {
+			batches = append(batches, Press(code, true))
+		}
+		if action != "buttondown" {
+			batches = append(batches, Press(code, false))
+		}
+	case "scroll":
+		kind = Tablet
+		if len(args) != 1 {
+			return nil, fmt.Errorf("invalid arguments to scroll: %q", text)
+		}
+		notches, err := strconv.Atoi(args[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid scroll: %s", args[0])
+		}
+		batches = append(batches, []Event{{EvRel, RelWheel, int32(notches)}, Sync()})
+	default:
+		return nil, fmt.Errorf("unknown action: %s", action)
+	}
+
+	s := make([]Batch, len(batches))
+	for i, events := range batches {
+		s[i] = Batch{At: t, Kind: kind, Events: events}
+	}
+	return s, nil
+}
+
+// For returns the part of the script meant for devices of kind k.
+func (s Script) For(k Kind) Script {
+	var part Script
+	for _, b := range s {
+		if b.Kind == k {
+			part = append(part, b)
+		}
+	}
+	return part
+}
+
+// Scale maps a pixel coordinate on an axis of the given size to the range of
+// the tablet.
+func Scale(v, size int) int32 {
+	if size <= 1 {
+		return 0
+	}
+	return int32(v * AbsMax / (size - 1))
+}
@@ -0,0 +1,203 @@
+package linux
+
+import (
+	"encoding/binary"
+	"errors"
+	"goemu/hostfs"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Flags of openat.
+const (
+	oAccmode   = 0o3
+	oWronly    = 0o1
+	oRdwr      = 0o2
+	oCreat     = 0o100
+	oExcl      = 0o200
+	oTrunc     = 0o1000
+	oAppend    = 0o2000
+	oDirectory = 0o200000
+)
+
+// File types in st_mode.
+const (
+	sIFCHR = 0o020000
+	sIFDIR = 0o040000
+	sIFREG = 0o100000
+	sIFLNK = 0o120000
+)
+
+type file struct {
+	f   *os.File
+	tty bool
+}
+
+// resolve maps a guest path onto the sandbox. The guest's root and working
+// directory are both the sandbox root, and symlinks may not lead out of it.
+func (p *Process) resolve(dirfd int64, name string) (string, int64) {
+	if dirfd != atFdcwd && !strings.HasPrefix(name, "/") {
+		dir, ok := p.files[uint64(dirfd)]
+		if !ok {
+			return "", -ebadf
+		}
+		rel, err := filepath.Rel(p.root, dir.f.Name())
+		if err != nil {
+			return "", -ebadf
+		}
+		name = filepath.Join("/", rel, name)
+	}
+	real, err := hostfs.Resolve(p.root, name)
+	if err != nil {
+		return "", errno(err)
+	}
+	return real, 0
+}
+
+func (p *Process) path(dirfd int64, addr uint64) (string, int64) {
+	name, ok := p.cstring(addr)
+	if !ok {
+		return "", -efault
+	}
+	return p.resolve(dirfd, name)
+}
+
+func (p *Process) openat(dirfd int64, addr, flags, mode uint64) (int64, error) {
+	name, e := p.path(dirfd, addr)
+	if e != 0 {
+		return e, nil
+	}
+	var hostFlags int
+	switch flags & oAccmode {
+	case oWronly:
+		hostFlags = os.O_WRONLY
+	case oRdwr:
+		hostFlags = os.O_RDWR
+	default:
+		hostFlags = os.O_RDONLY
+	}
+	for _, f := range []struct{ guest, host int }{
+		{oCreat, os.O_CREATE},
+		{oExcl, os.O_EXCL},
+		{oTrunc, os.O_TRUNC},
+		{oAppend, os.O_APPEND},
+	} {
+		if flags&uint64(f.guest) != 0 {
+			hostFlags |= f.host
+		}
+	}
+	f, err := os.OpenFile(name, hostFlags, fs.FileMode(mode&0o777))
+	if err != nil {
+		return errno(err), nil
+	}
+	if flags&oDirectory != 0 {
+		if info, err := f.Stat(); err != nil || !info.IsDir() {
+			f.Close()
+			return -enotdir, nil
+		}
+	}
+	fd := uint64(3)
+	for p.files[fd] != nil {
+		fd++
+	}
+	p.files[fd] = &file{f: f}
+	return int64(fd), nil
+}
+
+func (p *Process) fstat(fd, buf uint64) (int64, error) {
+	f, ok := p.files[fd]
+	if !ok {
+		return -ebadf, nil
+	}
+	if f.tty {
+		return p.putStat(buf, nil)
+	}
+	info, err := f.f.Stat()
+	if err != nil {
+		return errno(err), nil
+	}
+	return p.putStat(buf, info)
+}
+
+func (p *Process) newfstatat(dirfd int64, addr, buf, flags uint64) (int64, error) {
+	if flags&atEmptyPath != 0 {
+		if name, ok := p.cstring(addr); ok && name == "" {
+			return p.fstat(uint64(dirfd), buf)
+		}
+	}
+	name, e := p.path(dirfd, addr)
+	if e != 0 {
+		return e, nil
+	}
+	info, err := os.Lstat(name)
+	if err != nil {
+		return errno(err), nil
+	}
+	return p.putStat(buf, info)
+}
+
+func (p *Process) faccessat(dirfd int64, addr uint64) (int64, error) {
+	name, e := p.path(dirfd, addr)
+	if e != 0 {
+		return e, nil
+	}
+	if _, err := os.Stat(name); err != nil {
+		return errno(err), nil
+	}
+	return 0, nil
+}
+
+// putStat writes a struct stat in the riscv64 layout. A nil info describes
+// a terminal.
+func (p *Process) putStat(buf uint64, info fs.FileInfo) (int64, error) {
+	var st [128]byte
+	mode := uint32(sIFCHR | 0o620)
+	var size, mtime uint64
+	if info != nil {
+		mode = uint32(info.Mode().Perm())
+		switch {
+		case info.IsDir():
+			mode |= sIFDIR
+		case info.Mode()&fs.ModeSymlink != 0:
+			mode |= sIFLNK
+		case info.Mode()&fs.ModeCharDevice != 0:
+			mode |= sIFCHR
+		default:
+			mode |= sIFREG
+		}
+		size = uint64(info.Size())
+		mtime = uint64(info.ModTime().Unix())
+	}
+	binary.LittleEndian.PutUint32(st[16:], mode)           // st_mode
+	binary.LittleEndian.PutUint32(st[20:], 1)              // st_nlink
+	binary.LittleEndian.PutUint64(st[48:], size)           // st_size
+	binary.LittleEndian.PutUint32(st[56:], 4096)           // st_blksize
+	binary.LittleEndian.PutUint64(st[64:], (size+511)/512) // st_blocks
+	binary.LittleEndian.PutUint64(st[72:], mtime)          // st_atime
+	binary.LittleEndian.PutUint64(st[88:], mtime)          // st_mtime
+	binary.LittleEndian.PutUint64(st[104:], mtime)         // st_ctime
+	if _, err := p.CPU.Bus.Mem.WriteAt(st[:], int64(buf)); err != nil {
+		return -efault, nil
+	}
+	return 0, nil
+}
+
+// errno converts a host error into a negated guest error number.
+func errno(err error) int64 {
+	var e syscall.Errno
+	switch {
+	case errors.As(err, &e):
+		return -int64(e)
+	case errors.Is(err, fs.ErrNotExist):
+		return -enoent
+	case errors.Is(err, fs.ErrPermission):
+		return -eacces
+	case errors.Is(err, fs.ErrExist):
+		return -eexist
+	default:
+		return -einval
+	}
+}
@@ -0,0 +1,254 @@
+package linux
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"goemu/hostfs"
+	"goemu/loader"
+	"goemu/runtime"
+	"os"
+)
+
+// Address space of an emulated process. The first 64KiB are not mapped, as
+// Linux's default mmap_min_addr, so that NULL pointer accesses fault. The
+// image is loaded at its link address, the heap grows up from its end, and
+// mappings are handed out downwards from below the stack.
+const (
+	MemBase   = 0x10000
+	MemSize   = 512*1024*1024 - MemBase // up to 512MiB
+	StackTop  = MemBase + MemSize
+	StackSize = 8 * 1024 * 1024
+	MmapTop   = StackTop - StackSize
+)
+
+// Auxiliary vector entries.
+const (
+	atNull   = 0
+	atPhdr   = 3
+	atPhent  = 4
+	atPhnum  = 5
+	atPagesz = 6
+	atBase   = 7
+	atFlags  = 8
+	atEntry  = 9
+	atUid    = 11
+	atEuid   = 12
+	atGid    = 13
+	atEgid   = 14
+	atHwcap  = 16
+	atClktck = 17
+	atSecure = 23
+	atRandom = 25
+	atExecfn = 31
+)
+
+// Signals the kernel sends for faults, which kill a process since none can
+// be handled.
+const (
+	SIGILL  = 4
+	SIGTRAP = 5
+	SIGBUS  = 7
+	SIGSEGV = 11
+)
+
+var faultSignals = map[uint64]int{
+	runtime.InstAddrMisaligned:  SIGBUS,
+	runtime.InstAccessFault:     SIGSEGV,
+	runtime.IllegalInst:         SIGILL,
+	runtime.Breakpoint:          SIGTRAP,
+	runtime.LoadAddrMisaligned:  SIGBUS,
+	runtime.LoadAccessFault:     SIGSEGV,
+	runtime.StoreAddrMisaligned: SIGBUS,
+	runtime.StoreAccessFault:    SIGSEGV,
+	runtime.InstPageFault:       SIGSEGV,
+	runtime.LoadPageFault:       SIGSEGV,
+	runtime.StorePageFault:      SIGSEGV,
+}
+
+// SignalError reports a process killed by a signal.
+type SignalError struct {
+	Signal int
+	Pc     uint64
+	Addr   uint64 // the faulting address or instruction, as in mtval
+}
+
+func (e *SignalError) Error() string {
+	return fmt.Sprintf("killed by signal %d at pc %#x (addr %#x)", e.Signal, e.Pc, e.Addr)
+}
+
+// Process runs a statically linked riscv64 Linux executable in User level
+// and services its system calls on the host.
+type Process struct {
+	CPU *runtime.CPU
+
+	root  string // host directory the guest sees as /
+	files map[uint64]*file
+	brk   uint64
+	heap  uint64 // start of the heap
+	mmap  uint64 // lowest address handed out by mmap
+}
+
+// New loads the executable at name, which is resolved on the host, and
+// prepares its initial stack. Files opened by the guest are confined to root.
+func New(name string, args, env []string, root string) (*Process, error) {
+	img, err := loader.Load(name)
+	if err != nil {
+		return nil, err
+	}
+	if root, err = hostfs.Root(root); err != nil {
+		return nil, err
+	}
+
+	cpu := runtime.NewCPU(nil)
+	cpu.Bus.Mem = runtime.NewMemory(MemBase, MemSize)
+	cpu.Bus.Uart.In = nil // stdin belongs to the program's read(0)
+	cpu.Level = runtime.UserMode
+	cpu.Csr[runtime.Mcounteren] = 0xFFFFFFFF // as a kernel lets programs read the counters
+	cpu.Csr[runtime.Scounteren] = 0xFFFFFFFF
+	p := &Process{
+		CPU:   cpu,
+		root:  root,
+		files: stdFiles(),
+		mmap:  MmapTop,
+	}
+	cpu.Handler = p
+
+	for _, s := range img.Segments {
+		if s.Addr < MemBase || s.Addr+s.MemSize > MmapTop {
+			return nil, fmt.Errorf("segment out of range: %x+%x", s.Addr, s.MemSize)
+		}
+		if _, err = cpu.Bus.Mem.WriteAt(s.Data, int64(s.Addr)); err != nil {
+			return nil, err
+		}
+	}
+	p.heap = pageUp(img.End())
+	p.brk = p.heap
+	cpu.Pc = img.Entry
+	if err = p.setupStack(img, append([]string{name}, args...), env); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Run executes the process until it exits and returns its exit status. A
+// process killed by a signal returns a *SignalError.
+func (p *Process) Run() (int, error) {
+	for {
+		if err := p.CPU.StepN(runtime.PollInterval); err != nil {
+			var exit *runtime.ExitError
+			if errors.As(err, &exit) {
+				return exit.Code, nil
+			}
+			return 0, err
+		}
+	}
+}
+
+// HandleTrap turns an ecall from User level into a system call, and a fault
+// into the signal that kills the process.
+func (p *Process) HandleTrap(cpu *runtime.CPU, e *runtime.Exception) (bool, error) {
+	if e.Cause != runtime.EcallFromU {
+		if sig, ok := faultSignals[e.Cause]; ok {
+			return true, &SignalError{Signal: sig, Pc: cpu.Pc, Addr: e.Tval}
+		}
+		return false, fmt.Errorf("unhandled %v at pc %#x", e, cpu.Pc)
+	}
+	ret, err := p.syscall(cpu.Regs[17], cpu.Regs[10:16])
+	if err != nil {
+		return true, err
+	}
+	cpu.Regs[10] = uint64(ret)
+	cpu.Pc += 4
+	return true, nil
+}
+
+// setupStack builds argc, argv, envp and the auxiliary vector at the top of
+// the stack, the way the kernel does on execve.
+func (p *Process) setupStack(img *loader.Image, args, env []string) error {
+	sp := uint64(StackTop)
+	push := func(data []byte) (uint64, error) {
+		sp -= uint64(len(data))
+		_, err := p.CPU.Bus.Mem.WriteAt(data, int64(sp))
+		return sp, err
+	}
+	pushStrings := func(list []string) ([]uint64, error) {
+		addrs := make([]uint64, len(list))
+		for i := len(list) - 1; i >= 0; i-- {
+			addr, err := push(append([]byte(list[i]), 0))
+			if err != nil {
+				return nil, err
+			}
+			addrs[i] = addr
+		}
+		return addrs, nil
+	}
+
+	envAddrs, err := pushStrings(env)
+	if err != nil {
+		return err
+	}
+	argAddrs, err := pushStrings(args)
+	if err != nil {
+		return err
+	}
+	random := make([]byte, 16)
+	if _, err = rand.Read(random); err != nil {
+		return err
+	}
+	randomAddr, err := push(random)
+	if err != nil {
+		return err
+	}
+
+	hwcap := uint64(1<<('I'-'A') | 1<<('M'-'A') | 1<<('A'-'A'))
+	auxv := []uint64{
+		atPhdr, img.Phdr,
+		atPhent, img.Phent,
+		atPhnum, img.Phnum,
+		atPagesz, runtime.PageSize,
+		atBase, 0,
+		atFlags, 0,
+		atEntry, img.Entry,
+		atUid, 0,
+		atEuid, 0,
+		atGid, 0,
+		atEgid, 0,
+		atHwcap, hwcap,
+		atClktck, 100,
+		atSecure, 0,
+		atRandom, randomAddr,
+		atExecfn, argAddrs[0],
+		atNull, 0,
+	}
+	words := []uint64{uint64(len(args))}
+	words = append(words, argAddrs...)
+	words = append(words, 0)
+	words = append(words, envAddrs...)
+	words = append(words, 0)
+	words = append(words, auxv...)
+
+	sp = (sp - uint64(len(words))*8) &^ 0xF
+	buf := make([]byte, len(words)*8)
+	for i, w := range words {
+		binary.LittleEndian.PutUint64(buf[i*8:], w)
+	}
+	if _, err = p.CPU.Bus.Mem.WriteAt(buf, int64(sp)); err != nil {
+		return err
+	}
+	p.CPU.Regs[2] = sp
+	return nil
+}
+
+func pageUp(addr uint64) uint64 {
+	return (addr + runtime.PageSize - 1) &^ (runtime.PageSize - 1)
+}
+
+func stdFiles() map[uint64]*file {
+	return map[uint64]*file{
+		0: {f: os.Stdin, tty: true},
+		1: {f: os.Stdout, tty: true},
+		2: {f: os.Stderr, tty: true},
+	}
+}
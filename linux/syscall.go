@@ -0,0 +1,391 @@
+package linux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"goemu/clock"
+	"goemu/runtime"
+	"io"
+	"os"
+	"time"
+)
+
+// System call numbers from the asm-generic table used by riscv64.
+const (
+	sysGetcwd        = 17
+	sysIoctl         = 29
+	sysFaccessat     = 48
+	sysOpenat        = 56
+	sysClose         = 57
+	sysLseek         = 62
+	sysRead          = 63
+	sysWrite         = 64
+	sysReadv         = 65
+	sysWritev        = 66
+	sysReadlinkat    = 78
+	sysNewfstatat    = 79
+	sysFstat         = 80
+	sysExit          = 93
+	sysExitGroup     = 94
+	sysSetTidAddress = 96
+	sysSetRobustList = 99
+	sysClockGettime  = 113
+	sysRtSigaction   = 134
+	sysRtSigprocmask = 135
+	sysUname         = 160
+	sysGetpid        = 172
+	sysGetppid       = 173
+	sysGetuid        = 174
+	sysGeteuid       = 175
+	sysGetgid        = 176
+	sysGetegid       = 177
+	sysGettid        = 178
+	sysBrk           = 214
+	sysMunmap        = 215
+	sysMmap          = 222
+	sysMprotect      = 226
+	sysMadvise       = 233
+	sysPrlimit64     = 261
+	sysGetrandom     = 278
+)
+
+// Error numbers returned to the guest, negated.
+const (
+	enoent  = 2
+	ebadf   = 9
+	enomem  = 12
+	eacces  = 13
+	efault  = 14
+	eexist  = 17
+	enotdir = 20
+	eisdir  = 21
+	einval  = 22
+	enotty  = 25
+	enosys  = 38
+)
+
+const (
+	atFdcwd     = -100
+	atEmptyPath = 0x1000
+
+	mapFixed     = 0x10
+	mapAnonymous = 0x20
+
+	clockRealtime = 0
+	rlimitStack   = 3
+)
+
+func (p *Process) syscall(num uint64, args []uint64) (int64, error) {
+	switch num {
+	case sysRead:
+		return p.read(args[0], args[1], args[2])
+	case sysWrite:
+		return p.write(args[0], args[1], args[2])
+	case sysReadv, sysWritev:
+		return p.vector(num, args[0], args[1], args[2])
+	case sysOpenat:
+		return p.openat(int64(args[0]), args[1], args[2], args[3])
+	case sysClose:
+		return p.close(args[0]), nil
+	case sysLseek:
+		return p.lseek(args[0], int64(args[1]), int(args[2])), nil
+	case sysFstat:
+		return p.fstat(args[0], args[1])
+	case sysNewfstatat:
+		return p.newfstatat(int64(args[0]), args[1], args[2], args[3])
+	case sysFaccessat:
+		return p.faccessat(int64(args[0]), args[1])
+	case sysReadlinkat:
+		return -enoent, nil
+	case sysGetcwd:
+		return p.getcwd(args[0], args[1])
+	case sysIoctl:
+		return -enotty, nil
+	case sysBrk:
+		return p.setBrk(args[0]), nil
+	case sysMmap:
+		return p.mmapRegion(args[0], args[1], args[3], args[4], int64(args[5]))
+	case sysMunmap:
+		return p.munmap(args[0], args[1]), nil
+	case sysMprotect, sysMadvise:
+		return 0, nil
+	case sysExit, sysExitGroup:
+		return 0, &runtime.ExitError{Code: int(int32(args[0]))}
+	case sysClockGettime:
+		return p.clockGettime(args[0], args[1])
+	case sysGetrandom:
+		return p.getrandom(args[0], args[1])
+	case sysSetTidAddress, sysGetpid, sysGettid:
+		return 1, nil
+	case sysGetppid, sysGetuid, sysGeteuid, sysGetgid, sysGetegid:
+		return 0, nil
+	case sysSetRobustList, sysRtSigaction, sysRtSigprocmask:
+		return 0, nil
+	case sysUname:
+		return p.uname(args[0])
+	case sysPrlimit64:
+		return p.prlimit(args[1], args[3])
+	default:
+		fmt.Fprintf(os.Stderr, "goemu: unimplemented syscall %d\n", num)
+		return -enosys, nil
+	}
+}
+
+func (p *Process) read(fd, buf, count uint64) (int64, error) {
+	f, ok := p.files[fd]
+	if !ok {
+		return -ebadf, nil
+	}
+	if !mapped(buf, count) {
+		return -efault, nil
+	}
+	data := make([]byte, count)
+	n, err := f.f.Read(data)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return errno(err), nil
+	}
+	if _, err = p.CPU.Bus.Mem.WriteAt(data[:n], int64(buf)); err != nil {
+		return -efault, nil
+	}
+	return int64(n), nil
+}
+
+func (p *Process) write(fd, buf, count uint64) (int64, error) {
+	f, ok := p.files[fd]
+	if !ok {
+		return -ebadf, nil
+	}
+	if !mapped(buf, count) {
+		return -efault, nil
+	}
+	data := make([]byte, count)
+	if _, err := p.CPU.Bus.Mem.ReadAt(data, int64(buf)); err != nil {
+		return -efault, nil
+	}
+	n, err := f.f.Write(data)
+	if err != nil {
+		return errno(err), nil
+	}
+	return int64(n), nil
+}
+
+// vector implements readv and writev on top of read and write.
+func (p *Process) vector(num, fd, iov, count uint64) (int64, error) {
+	total := int64(0)
+	for i := uint64(0); i < count; i++ {
+		var vec [16]byte
+		if _, err := p.CPU.Bus.Mem.ReadAt(vec[:], int64(iov+i*16)); err != nil {
+			return -efault, nil
+		}
+		base, length := binary.LittleEndian.Uint64(vec[:]), binary.LittleEndian.Uint64(vec[8:])
+		if length == 0 {
+			continue
+		}
+		var n int64
+		var err error
+		if num == sysReadv {
+			n, err = p.read(fd, base, length)
+		} else {
+			n, err = p.write(fd, base, length)
+		}
+		if err != nil || n < 0 {
+			return n, err
+		}
+		total += n
+		if uint64(n) < length {
+			break
+		}
+	}
+	return total, nil
+}
+
+func (p *Process) close(fd uint64) int64 {
+	f, ok := p.files[fd]
+	if !ok {
+		return -ebadf
+	}
+	delete(p.files, fd)
+	if fd > 2 {
+		f.f.Close()
+	}
+	return 0
+}
+
+func (p *Process) lseek(fd uint64, offset int64, whence int) int64 {
+	f, ok := p.files[fd]
+	if !ok {
+		return -ebadf
+	}
+	n, err := f.f.Seek(offset, whence)
+	if err != nil {
+		return errno(err)
+	}
+	return n
+}
+
+// setBrk moves the program break, which may not run into the mappings.
+func (p *Process) setBrk(addr uint64) int64 {
+	if addr < p.heap || addr > p.mmap {
+		return int64(p.brk)
+	}
+	if addr < p.brk {
+		p.zero(addr, p.brk-addr)
+	}
+	p.brk = addr
+	return int64(p.brk)
+}
+
+func (p *Process) mmapRegion(addr, length, flags, fd uint64, offset int64) (int64, error) {
+	if length == 0 {
+		return -einval, nil
+	}
+	if length > MmapTop-p.heap {
+		return -enomem, nil
+	}
+	length = pageUp(length)
+	if flags&mapFixed != 0 {
+		if addr%runtime.PageSize != 0 || addr < p.heap || addr > MmapTop || length > MmapTop-addr {
+			return -einval, nil
+		}
+	} else {
+		if length > p.mmap-p.brk {
+			return -enomem, nil
+		}
+		p.mmap -= length
+		addr = p.mmap
+	}
+	p.zero(addr, length)
+	if flags&mapAnonymous == 0 {
+		f, ok := p.files[fd]
+		if !ok {
+			return -ebadf, nil
+		}
+		data := make([]byte, length)
+		n, err := f.f.ReadAt(data, offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return errno(err), nil
+		}
+		if _, err = p.CPU.Bus.Mem.WriteAt(data[:n], int64(addr)); err != nil {
+			return -efault, nil
+		}
+	}
+	return int64(addr), nil
+}
+
+// munmap only gives the space back when it is the most recent mapping.
+func (p *Process) munmap(addr, length uint64) int64 {
+	if length > MmapTop-p.heap {
+		return -einval
+	}
+	length = pageUp(length)
+	if addr%runtime.PageSize != 0 || addr < p.heap || addr > MmapTop || length > MmapTop-addr {
+		return -einval
+	}
+	p.zero(addr, length)
+	if addr == p.mmap {
+		p.mmap += length
+	}
+	return 0
+}
+
+func (p *Process) zero(addr, length uint64) {
+	p.CPU.Bus.Mem.WriteAt(make([]byte, length), int64(addr))
+}
+
+func (p *Process) clockGettime(id, tp uint64) (int64, error) {
+	var sec, nsec int64
+	if id == clockRealtime {
+		now := time.Now()
+		sec, nsec = now.Unix(), int64(now.Nanosecond())
+	} else {
+		ticks := p.CPU.Bus.Clint.Clock.Now()
+		sec = int64(ticks / clock.Frequency)
+		nsec = int64(ticks%clock.Frequency) * (1e9 / clock.Frequency)
+	}
+	return p.put(tp, sec, nsec)
+}
+
+func (p *Process) getrandom(buf, length uint64) (int64, error) {
+	if !mapped(buf, length) {
+		return -efault, nil
+	}
+	data := make([]byte, length)
+	if _, err := rand.Read(data); err != nil {
+		return 0, err
+	}
+	if _, err := p.CPU.Bus.Mem.WriteAt(data, int64(buf)); err != nil {
+		return -efault, nil
+	}
+	return int64(length), nil
+}
+
+func (p *Process) uname(buf uint64) (int64, error) {
+	fields := []string{"Linux", "goemu", "6.1.0", "#1 SMP", "riscv64", ""}
+	data := make([]byte, 65*len(fields))
+	for i, f := range fields {
+		copy(data[i*65:], f)
+	}
+	if _, err := p.CPU.Bus.Mem.WriteAt(data, int64(buf)); err != nil {
+		return -efault, nil
+	}
+	return 0, nil
+}
+
+// prlimit reports the stack size and no limit on anything else.
+func (p *Process) prlimit(resource, old uint64) (int64, error) {
+	if old == 0 {
+		return 0, nil
+	}
+	cur := ^uint64(0)
+	if resource == rlimitStack {
+		cur = StackSize
+	}
+	return p.put(old, int64(cur), -1)
+}
+
+func (p *Process) getcwd(buf, size uint64) (int64, error) {
+	if size < 2 {
+		return -einval, nil
+	}
+	if _, err := p.CPU.Bus.Mem.WriteAt([]byte("/\x00"), int64(buf)); err != nil {
+		return -efault, nil
+	}
+	return 2, nil
+}
+
+// mapped reports whether the guest buffer of length bytes at addr lies in its
+// memory, which bounds what the host allocates on the guest's behalf.
+func mapped(addr, length uint64) bool {
+	return addr >= MemBase && length <= MemSize && addr-MemBase <= MemSize-length
+}
+
+// put stores consecutive 64-bit values at addr.
+func (p *Process) put(addr uint64, values ...int64) (int64, error) {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, values); err != nil {
+		return 0, err
+	}
+	if _, err := p.CPU.Bus.Mem.WriteAt(buf.Bytes(), int64(addr)); err != nil {
+		return -efault, nil
+	}
+	return 0, nil
+}
+
+// cstring reads a NUL-terminated string from guest memory.
+func (p *Process) cstring(addr uint64) (string, bool) {
+	var s []byte
+	for len(s) < 4096 {
+		b, err := p.CPU.Bus.Load(addr+uint64(len(s)), 1)
+		if err != nil {
+			return "", false
+		}
+		if b == 0 {
+			return string(s), true
+		}
+		s = append(s, uint8(b))
+	}
+	return "", false
+}
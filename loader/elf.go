@@ -0,0 +1,94 @@
+package loader
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// Segment is a loadable part of an image. Bytes past len(Data) up to
+// MemSize are zero-filled.
+type Segment struct {
+	Addr    uint64 // virtual address
+	Paddr   uint64 // physical (load) address
+	Data    []byte
+	MemSize uint64
+	Flags   elf.ProgFlag
+}
+
+// Image is a parsed riscv64 ELF executable.
+type Image struct {
+	Entry    uint64
+	Segments []Segment
+	Phdr     uint64 // address of the program headers once loaded, 0 if they are not
+	Phent    uint64
+	Phnum    uint64
+	Symbols  []elf.Symbol
+	File     *elf.File
+}
+
+// IsELF reports whether data starts with the ELF magic number.
+func IsELF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(elf.ELFMAG))
+}
+
+func Load(name string) (*Image, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+func Parse(data []byte) (*Image, error) {
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if f.Class != elf.ELFCLASS64 || f.Machine != elf.EM_RISCV {
+		return nil, fmt.Errorf("not a riscv64 executable: %v %v", f.Class, f.Machine)
+	}
+	if f.Type != elf.ET_EXEC {
+		return nil, fmt.Errorf("unsupported ELF type: %v", f.Type)
+	}
+
+	img := &Image{
+		Entry: f.Entry,
+		Phent: uint64(binary.LittleEndian.Uint16(data[0x36:])),
+		Phnum: uint64(len(f.Progs)),
+		File:  f,
+	}
+	phoff := binary.LittleEndian.Uint64(data[0x20:])
+	for _, p := range f.Progs {
+		switch p.Type {
+		case elf.PT_PHDR:
+			img.Phdr = p.Vaddr
+		case elf.PT_LOAD:
+			seg := Segment{Addr: p.Vaddr, Paddr: p.Paddr, Data: make([]byte, p.Filesz), MemSize: p.Memsz, Flags: p.Flags}
+			if _, err = p.ReadAt(seg.Data, 0); err != nil {
+				return nil, err
+			}
+			img.Segments = append(img.Segments, seg)
+			if img.Phdr == 0 && phoff >= p.Off && phoff < p.Off+p.Filesz {
+				img.Phdr = p.Vaddr + phoff - p.Off
+			}
+		}
+	}
+	if syms, err := f.Symbols(); err == nil {
+		img.Symbols = syms
+	}
+	return img, nil
+}
+
+// End returns the address just past the highest segment.
+func (img *Image) End() uint64 {
+	end := uint64(0)
+	for _, s := range img.Segments {
+		if s.Addr+s.MemSize > end {
+			end = s.Addr + s.MemSize
+		}
+	}
+	return end
+}
@@ -1,33 +1,770 @@
 package main
 
 import (
+	"debug/elf"
+	"errors"
+	"flag"
 	"fmt"
+	"goemu/clock"
 	"goemu/config"
+	"goemu/coverage"
+	"goemu/ether"
+	"goemu/gdb"
+	"goemu/hostio"
+	"goemu/hw/fb"
+	"goemu/hw/rtc"
+	"goemu/hw/virtio"
+	"goemu/input"
+	"goemu/linux"
+	"goemu/loader"
+	"goemu/p9"
+	"goemu/profile"
+	"goemu/replay"
 	"goemu/runtime"
+	"goemu/semihost"
+	"goemu/vnc"
+	"io"
 	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
+var (
+	restore     = flag.String("restore", "", "restore the machine from a snapshot file instead of loading an image")
+	snapshot    = flag.String("snapshot", "", "save the machine to a snapshot file")
+	snapshotAt  = flag.Uint64("snapshot-at", 0, "take the snapshot after this many instructions instead of on exit")
+	record      = flag.String("record", "", "record asynchronous input to a log file")
+	replayLog   = flag.String("replay", "", "replay asynchronous input from a log file")
+	gdbAddr     = flag.String("gdb", "", "wait for a GDB connection on this address, e.g. localhost:1234")
+	checkpoint  = flag.Uint64("checkpoint", 1_000_000, "instructions between two reverse execution checkpoints")
+	user        = flag.Bool("user", false, "run a static riscv64 Linux executable in user mode, passing the remaining arguments to it")
+	semihosted  = flag.Bool("semihost", false, "serve semihosting calls, passing the remaining arguments as the command line")
+	sandbox     = flag.String("sandbox", ".", "host directory the user mode or semihosted program sees as its root")
+	icount      = flag.Uint64("icount", 0, "derive time from the instruction count, advancing mtime once every N instructions (0 follows the host clock)")
+	bootargs    = flag.String("append", "", "kernel command line passed in the device tree")
+	rtcBase     = flag.Uint64("rtc-base", rtc.DefaultBase, "address of the Goldfish RTC")
+	display     = flag.String("framebuffer", "", "add a framebuffer, as WIDTHxHEIGHT[,format][,base=addr] with format one of a8r8g8b8, x8r8g8b8, a8b8g8r8, x8b8g8r8 or r5g6b5")
+	screendump  = flag.String("screendump", "", "save the framebuffer as a PNG image on exit")
+	vncAddr     = flag.String("vnc", "", "serve the framebuffer over VNC on this address, e.g. localhost:5900")
+	inputs      = flag.Bool("input", false, "attach a virtio keyboard and tablet, driven by the VNC client if there is one")
+	inputScript = flag.String("input-script", "", "feed the virtio keyboard and tablet from a script of timed input, which implies -input")
+	virtioPCI   = flag.Bool("virtio-pci", false, "put the virtio devices on the PCI bus instead of virtio-mmio slots, interrupting through INTx only")
+	harts       = flag.Int("smp", 1, "number of harts")
+	parallel    = flag.Bool("smp-parallel", false, "run each hart on a goroutine of its own, which is faster but not reproducible")
+	quantum     = flag.Uint64("quantum", runtime.DefaultQuantum, "instructions a hart runs before the next one takes over, without -smp-parallel")
+	reference   = flag.Bool("reference", false, "run the simple interpreter instead of translated blocks, to check them against")
+	stats       = flag.Bool("stats", false, "print retired instructions, wall time, MIPS and traps taken on exit")
+	profileOut  = flag.String("profile", "", "write a pprof profile of where the guest spends its time to this file on exit")
+	profileRate = flag.Uint64("profile-period", 10000, "instructions between two samples of -profile")
+	stacks      = flag.Bool("profile-stacks", false, "sample call stacks for -profile by walking the frame pointer chain, which needs code built with -fno-omit-frame-pointer")
+	symbols     = flag.String("symbols", "", "ELF file whose symbols and debug information describe the guest code for -profile and -coverage, the executable itself with -user")
+	coverOut    = flag.String("coverage", "", "write which guest instructions retired to this file on exit")
+	coverFormat = flag.String("coverage-format", "report", "format of -coverage: report, a disassembly with execution counts, lcov, mapped to source lines with the DWARF of -symbols, or bitmap, a bit per instruction")
+	rng         = flag.Bool("rng", false, "attach a virtio entropy device")
+	rngSeed     = flag.Uint64("rng-seed", 0, "seed of the entropy device when the run has to be reproducible (-icount, -record or -replay)")
+	drives      listFlag
+	vports      listFlag
+	netdevs     listFlag
+	serials     listFlag
+	shares      listFlag
+)
+
+func init() {
+	flag.Var(&drives, "drive", "attach a virtio block device backed by a disk image, as file[,ro][,cow] (repeatable)")
+	flag.Var(&vports, "vport", "add a virtio console port, as name=console, name=file:path or name=unix:path (repeatable)")
+	flag.Var(&serials, "serial", "connect the next UART to stdio (raw terminal, Ctrl-A x quits), pty, unix:path, file:path or none (repeatable)")
+	flag.Var(&shares, "share", "export a host directory over virtio-9p, as dir[,tag=name][,ro] with the tag defaulting to share0, share1... (repeatable)")
+	flag.Var(&netdevs, "netdev", "attach a virtio network device, as user or switch:path, followed by [,mac=addr][,pcap=file] (repeatable)")
+}
+
 func main() {
-	args := os.Args
-	if len(args) != 2 {
-		fmt.Printf("usage: goemu <filepath>")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: goemu [options] <filepath>\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "       goemu -semihost [options] <filepath> [args...]\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "       goemu -user [options] <filepath> [args...]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *user && flag.NArg() > 0 {
+		os.Exit(runUser())
+	}
+	if flag.NArg() != 1 && !(*semihosted && flag.NArg() > 1) && (flag.NArg() != 0 || *restore == "") {
+		flag.Usage()
 		return
 	}
 
-	code, err := os.ReadFile(args[1])
-	if err != nil {
+	var code []uint8
+	if flag.NArg() > 0 {
+		var err error
+		if code, err = os.ReadFile(flag.Arg(0)); err != nil {
+			panic(err)
+		}
+	}
+
+	if *harts < 1 || *harts > runtime.MaxHarts {
+		panic(fmt.Sprintf("-smp takes 1 to %d harts", runtime.MaxHarts))
+	}
+	if *harts > 1 && (*gdbAddr != "" || *snapshotAt != 0) {
+		panic("-gdb and -snapshot-at need a single hart")
+	}
+	m := runtime.NewMachine(code, *harts)
+	m.Quantum, m.Parallel = *quantum, *parallel
+	prof := newProfiler()
+	for _, h := range m.Harts {
+		h.Reference = *reference
+		h.Profiler = prof
+		h.Coverage = newCoverage()
+	}
+	cpu := m.Harts[0]
+	if *icount != 0 {
+		cpu.Bus.Clint.Clock = clock.NewVirtual(*icount, func() uint64 { return cpu.Instret })
+	}
+	cpu.Bus.Rtc.Base = *rtcBase
+	if *display != "" {
+		f, err := newFramebuffer(*display)
+		if err != nil {
+			panic(err)
+		}
+		cpu.Bus.Framebuffer = f
+	}
+	var server *vnc.Server
+	if *vncAddr != "" {
+		if cpu.Bus.Framebuffer == nil {
+			panic("-vnc needs a -framebuffer")
+		}
+		server = vnc.NewServer("goemu", cpu.Bus.Framebuffer)
+	}
+	var quit atomic.Bool
+	var closers []io.Closer // backends to shut down on exit, the terminal in particular
+	for i, spec := range serials {
+		closer, err := attachSerial(cpu, i, spec, &quit)
+		if err != nil {
+			panic(err)
+		}
+		if closer != nil {
+			closers = append(closers, closer)
+		}
+	}
+	if *rng {
+		dev := virtio.NewRng()
+		if *icount != 0 || *record != "" || *replayLog != "" {
+			dev = virtio.NewSeededRng(*rngSeed)
+		}
+		if err := addVirtio(cpu, dev); err != nil {
+			panic(err)
+		}
+	}
+	for _, spec := range drives {
+		if err := attachDrive(cpu, spec); err != nil {
+			panic(err)
+		}
+	}
+	if len(vports) > 0 {
+		if err := attachConsole(cpu, vports); err != nil {
+			panic(err)
+		}
+	}
+	for i, spec := range netdevs {
+		if err := attachNetdev(cpu, i, spec); err != nil {
+			panic(err)
+		}
+	}
+	for i, spec := range shares {
+		if err := attachShare(cpu, i, spec); err != nil {
+			panic(err)
+		}
+	}
+	if *inputs || *inputScript != "" {
+		if err := attachInput(cpu, *inputScript, server); err != nil {
+			panic(err)
+		}
+	}
+	if server != nil {
+		if _, err := server.Listen(*vncAddr); err != nil {
+			panic(err)
+		}
+	}
+	if *semihosted {
+		h, err := semihost.New(*sandbox, strings.Join(flag.Args(), " "))
+		if err != nil {
+			panic(err)
+		}
+		cpu.Handler = h
+		cpu.Bus.Uart.In = nil // the program reads stdin through semihosting
+	}
+	if *restore != "" {
+		if err := restoreSnapshot(m, *restore); err != nil {
+			panic(err)
+		}
+	} else if err := m.LoadDeviceTree(*bootargs); err != nil {
 		panic(err)
 	}
 
-	cpu := runtime.NewCPU(code)
+	if *record != "" {
+		f, err := os.Create(*record)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		rec, err := replay.NewRecorder(f)
+		if err != nil {
+			panic(err)
+		}
+		if err = cpu.StartRecording(rec); err != nil {
+			panic(err)
+		}
+	}
+	if *replayLog != "" {
+		f, err := os.Open(*replayLog)
+		if err != nil {
+			panic(err)
+		}
+		cpu.Player, err = replay.NewPlayer(f)
+		f.Close()
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if *gdbAddr != "" {
+		tl, err := runtime.NewTimeline(cpu, *checkpoint)
+		if err != nil {
+			panic(err)
+		}
+		if err = gdb.NewServer(cpu, tl).ListenAndServe(*gdbAddr); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	status := 0
+	start, restored := time.Now(), retired(m.Harts)
+	if err := run(m, &quit); err != nil {
+		var exit *runtime.ExitError
+		if !errors.As(err, &exit) {
+			panic(err)
+		}
+		status = exit.Code
+	}
+	if *stats {
+		printStats(m.Harts, restored, time.Since(start))
+	}
+	if prof != nil {
+		if err := writeProfile(prof, *symbols); err != nil {
+			panic(err)
+		}
+	}
+	if *coverOut != "" {
+		image := []coverage.Region{{Addr: config.KernelBase, Data: code}}
+		if err := writeCoverage(m.Harts, image, *symbols); err != nil {
+			panic(err)
+		}
+	}
+
+	if *snapshot != "" && *snapshotAt == 0 {
+		if err := saveSnapshot(m, *snapshot); err != nil {
+			panic(err)
+		}
+	}
+	for _, u := range cpu.Bus.Uarts {
+		u.Flush()
+	}
+	if *screendump != "" && cpu.Bus.Framebuffer != nil {
+		if err := writeScreendump(cpu.Bus.Framebuffer, *screendump); err != nil {
+			panic(err)
+		}
+	}
+	for _, c := range closers {
+		c.Close()
+	}
+	if status != 0 {
+		os.Exit(status)
+	}
+}
 
-	for cpu.Pc < config.KernelEnd {
-		inst, err := cpu.Fetch()
+func runUser() int {
+	p, err := linux.New(flag.Arg(0), flag.Args()[1:], nil, *sandbox)
+	if err != nil {
+		panic(err)
+	}
+	if *icount != 0 {
+		p.CPU.Bus.Clint.Clock = clock.NewVirtual(*icount, func() uint64 { return p.CPU.Instret })
+	}
+	p.CPU.Reference = *reference
+	p.CPU.Profiler = newProfiler()
+	p.CPU.Coverage = newCoverage()
+	start := time.Now()
+	code, err := p.Run()
+	var sig *linux.SignalError
+	if errors.As(err, &sig) {
+		fmt.Fprintln(os.Stderr, err)
+		code = 128 + sig.Signal // as a shell reports it
+	} else if err != nil {
+		panic(err)
+	}
+	if *stats {
+		printStats([]*runtime.CPU{p.CPU}, 0, time.Since(start))
+	}
+	name := *symbols
+	if name == "" {
+		name = flag.Arg(0)
+	}
+	if p.CPU.Profiler != nil {
+		if err = writeProfile(p.CPU.Profiler, name); err != nil {
+			panic(err)
+		}
+	}
+	if p.CPU.Coverage != nil {
+		img, err := loader.Load(flag.Arg(0))
 		if err != nil {
 			panic(err)
 		}
-		if err = cpu.Execute(inst); err != nil {
+		var text []coverage.Region
+		for _, s := range img.Segments {
+			if s.Flags&elf.PF_X != 0 {
+				text = append(text, coverage.Region{Addr: s.Addr, Data: s.Data})
+			}
+		}
+		if err = writeCoverage([]*runtime.CPU{p.CPU}, text, name); err != nil {
 			panic(err)
 		}
 	}
+	return code
+}
+
+// newProfiler returns the profiler -profile asks for, or nil.
+func newProfiler() *profile.Profiler {
+	if *profileOut == "" {
+		return nil
+	}
+	if *profileRate == 0 {
+		panic("-profile-period must be positive")
+	}
+	return profile.New(*profileRate, *stacks)
+}
+
+// writeProfile saves the guest profile to -profile, naming functions after
+// the symbols of the ELF file called symbols if there is one.
+func writeProfile(p *profile.Profiler, symbols string) error {
+	var syms []elf.Symbol
+	if symbols != "" {
+		img, err := loader.Load(symbols)
+		if err != nil {
+			return err
+		}
+		syms = img.Symbols
+	}
+	f, err := os.Create(*profileOut)
+	if err != nil {
+		return err
+	}
+	if err = p.Write(f, symbols, syms); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// newCoverage returns a collector for a hart if -coverage asks for one, or
+// nil.
+func newCoverage() *coverage.Collector {
+	if *coverOut == "" {
+		return nil
+	}
+	switch *coverFormat {
+	case "lcov":
+		if *symbols == "" && !*user {
+			panic("-coverage-format lcov needs -symbols")
+		}
+		return coverage.New()
+	case "report", "bitmap":
+		return coverage.New()
+	}
+	panic(fmt.Sprintf("unknown -coverage-format: %s", *coverFormat))
+}
+
+// writeCoverage merges the coverage of the harts and saves it to -coverage,
+// walking the code in the regions and describing it with the ELF file called
+// symbols if there is one.
+func writeCoverage(harts []*runtime.CPU, code []coverage.Region, symbols string) error {
+	c := coverage.New()
+	for _, h := range harts {
+		c.Merge(h.Coverage)
+	}
+	var img *loader.Image
+	if symbols != "" {
+		var err error
+		if img, err = loader.Load(symbols); err != nil {
+			return err
+		}
+	}
+	f, err := os.Create(*coverOut)
+	if err != nil {
+		return err
+	}
+	switch *coverFormat {
+	case "report":
+		var syms []elf.Symbol
+		if img != nil {
+			syms = img.Symbols
+		}
+		err = c.WriteReport(f, code, syms)
+	case "lcov":
+		err = writeLcov(f, c, img, code)
+	case "bitmap":
+		err = c.WriteBitmap(f, code)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeLcov maps the coverage to source lines with the DWARF of img.
+func writeLcov(w io.Writer, c *coverage.Collector, img *loader.Image, code []coverage.Region) error {
+	if img == nil {
+		return errors.New("lcov coverage needs -symbols")
+	}
+	d, err := img.File.DWARF()
+	if err != nil {
+		return err
+	}
+	lines, err := coverage.Lines(d)
+	if err != nil {
+		return err
+	}
+	return c.WriteLcov(w, lines, code)
+}
+
+// retired sums the instructions the harts retired.
+func retired(harts []*runtime.CPU) uint64 {
+	var n uint64
+	for _, h := range harts {
+		n += h.Instret
+	}
+	return n
+}
+
+// printStats reports on stderr how much the harts ran since they had retired
+// base instructions, and how fast.
+func printStats(harts []*runtime.CPU, base uint64, wall time.Duration) {
+	instret, traps := retired(harts)-base, uint64(0)
+	for _, h := range harts {
+		traps += h.Traps
+	}
+	fmt.Fprintf(os.Stderr, "goemu: %d instructions in %v, %.1f MIPS, %d traps taken\n",
+		instret, wall.Round(time.Millisecond), float64(instret)/wall.Seconds()/1e6, traps)
+}
+
+// listFlag collects the values of a flag given several times.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// attachSerial connects the i-th UART, adding it if needed, to the backend in
+// spec. The raw terminal sets quit once the user types the quit sequence.
+func attachSerial(cpu *runtime.CPU, i int, spec string, quit *atomic.Bool) (io.Closer, error) {
+	u := cpu.Bus.Uart
+	if i > 0 {
+		var err error
+		if u, err = cpu.Bus.AddUart(); err != nil {
+			return nil, err
+		}
+	}
+	kind, path, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "stdio":
+		t := hostio.OpenTerminal()
+		go func() {
+			<-t.Quit
+			quit.Store(true)
+		}()
+		u.In, u.Out = t, t
+		return t, nil
+	case "pty":
+		p, err := hostio.OpenPty()
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(os.Stderr, "goemu: serial%d is on %s\n", i, p.Name)
+		u.In, u.Out = p, p
+		return p, nil
+	case "unix":
+		s, err := hostio.ListenUnix(path)
+		if err != nil {
+			return nil, err
+		}
+		u.In, u.Out = s, s
+		return s, nil
+	case "file":
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		u.In, u.Out = nil, f
+		return f, nil
+	case "none":
+		u.In, u.Out = nil, nil
+		return nil, nil
+	}
+	return nil, fmt.Errorf("invalid serial backend: %s", spec)
+}
+
+func newFramebuffer(spec string) (*fb.Framebuffer, error) {
+	fields := strings.Split(spec, ",")
+	var width, height int
+	if _, err := fmt.Sscanf(fields[0], "%dx%d", &width, &height); err != nil {
+		return nil, fmt.Errorf("invalid resolution: %s", fields[0])
+	}
+	format, base := fb.X8R8G8B8, uint64(fb.DefaultBase)
+	for _, opt := range fields[1:] {
+		if v, ok := strings.CutPrefix(opt, "base="); ok {
+			var err error
+			if base, err = strconv.ParseUint(v, 0, 64); err != nil {
+				return nil, err
+			}
+		} else {
+			format = fb.Format(opt)
+		}
+	}
+	return fb.NewFramebuffer(base, width, height, format)
+}
+
+func writeScreendump(f *fb.Framebuffer, name string) error {
+	out, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err = f.WritePNG(out); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func attachShare(cpu *runtime.CPU, i int, spec string) error {
+	fields := strings.Split(spec, ",")
+	tag, readOnly := fmt.Sprintf("share%d", i), false
+	for _, opt := range fields[1:] {
+		if v, ok := strings.CutPrefix(opt, "tag="); ok && v != "" {
+			tag = v
+		} else if opt == "ro" {
+			readOnly = true
+		} else {
+			return fmt.Errorf("invalid share option: %s", opt)
+		}
+	}
+	server, err := p9.NewServer(fields[0], readOnly)
+	if err != nil {
+		return err
+	}
+	err = addVirtio(cpu, virtio.NewP9(tag, server))
+	return err
+}
+
+// addVirtio attaches dev through the transport chosen by -virtio-pci.
+func addVirtio(cpu *runtime.CPU, dev virtio.Device) error {
+	if *virtioPCI {
+		_, err := cpu.Bus.AddVirtioPCI(dev)
+		return err
+	}
+	_, err := cpu.Bus.AddVirtio(dev)
+	return err
+}
+
+// attachInput adds a keyboard and a tablet, fed from the script in file, if
+// any, and from the clients of server, if any.
+func attachInput(cpu *runtime.CPU, file string, server *vnc.Server) error {
+	width, height := input.AbsMax+1, input.AbsMax+1
+	if f := cpu.Bus.Framebuffer; f != nil {
+		width, height = f.Width, f.Height
+	}
+	var script input.Script
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		script, err = input.ParseScript(f, width, height)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	var keyboard, tablet chan []input.Event
+	if server != nil {
+		host := input.NewHost(width, height)
+		server.Input = host
+		keyboard, tablet = host.Keyboard, host.Tablet
+	}
+	now := func() uint64 { return cpu.Instret }
+	if err := addVirtio(cpu, virtio.NewInput(input.Keyboard, keyboard, script.For(input.Keyboard), now)); err != nil {
+		return err
+	}
+	err := addVirtio(cpu, virtio.NewInput(input.Tablet, tablet, script.For(input.Tablet), now))
+	return err
+}
+
+func attachDrive(cpu *runtime.CPU, spec string) error {
+	fields := strings.Split(spec, ",")
+	var opts virtio.BlkOptions
+	for _, opt := range fields[1:] {
+		switch opt {
+		case "ro":
+			opts.ReadOnly = true
+		case "cow":
+			opts.CopyOnWrite = true
+		default:
+			return fmt.Errorf("invalid drive option: %s", opt)
+		}
+	}
+	blk, err := virtio.NewBlk(fields[0], opts)
+	if err != nil {
+		return err
+	}
+	err = addVirtio(cpu, blk)
+	return err
+}
+
+// attachConsole adds a virtio console with one port per spec. A console port
+// takes over standard input from the UART.
+func attachConsole(cpu *runtime.CPU, specs []string) error {
+	var ports []*virtio.Port
+	for _, spec := range specs {
+		name, backend, ok := strings.Cut(spec, "=")
+		if !ok {
+			return fmt.Errorf("invalid port: %s", spec)
+		}
+		kind, arg, _ := strings.Cut(backend, ":")
+		switch kind {
+		case "console":
+			cpu.Bus.Uart.In = nil
+			ports = append(ports, virtio.NewPort(name, true, os.Stdin, os.Stdout))
+		case "file":
+			f, err := os.Create(arg)
+			if err != nil {
+				return err
+			}
+			ports = append(ports, virtio.NewPort(name, false, nil, f))
+		case "unix":
+			s, err := hostio.ListenUnix(arg)
+			if err != nil {
+				return err
+			}
+			ports = append(ports, virtio.NewPort(name, false, s, s))
+		default:
+			return fmt.Errorf("invalid port backend: %s", backend)
+		}
+	}
+	console, err := virtio.NewConsole(ports)
+	if err != nil {
+		return err
+	}
+	err = addVirtio(cpu, console)
+	return err
+}
+
+// attachNetdev adds the i-th network device. The user backend is a network
+// of its own with a gateway answering ARP, ping and DHCP; switch joins the
+// switch served on a Unix socket, starting one there if there is none yet.
+func attachNetdev(cpu *runtime.CPU, i int, spec string) error {
+	fields := strings.Split(spec, ",")
+	mac := ether.Addr{0x52, 0x54, 0x00, 0x12, 0x34, 0x56 + uint8(i)}
+	var pcap *ether.Pcap
+	for _, opt := range fields[1:] {
+		key, value, _ := strings.Cut(opt, "=")
+		switch key {
+		case "mac":
+			var err error
+			if mac, err = ether.ParseAddr(value); err != nil {
+				return err
+			}
+		case "pcap":
+			f, err := os.Create(value)
+			if err != nil {
+				return err
+			}
+			if pcap, err = ether.NewPcap(f); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("invalid netdev option: %s", opt)
+		}
+	}
+	var backend ether.Backend
+	kind, path, _ := strings.Cut(fields[0], ":")
+	switch kind {
+	case "user":
+		backend = ether.NewLoopback()
+	case "switch":
+		var err error
+		if backend, err = ether.JoinSwitch(path); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid netdev backend: %s", fields[0])
+	}
+	err := addVirtio(cpu, virtio.NewNet(mac, backend, pcap))
+	return err
+}
+
+// run executes the machine until the guest is done or the user quits. A
+// single hart is stepped here so that the snapshot can be taken at the exact
+// instruction.
+func run(m *runtime.Machine, quit *atomic.Bool) error {
+	if len(m.Harts) > 1 {
+		return m.Run(quit.Load)
+	}
+	cpu := m.Harts[0]
+	for !quit.Load() {
+		n := uint64(runtime.PollInterval)
+		if *snapshot != "" && *snapshotAt != 0 {
+			if cpu.Instret == *snapshotAt {
+				if err := saveSnapshot(m, *snapshot); err != nil {
+					return err
+				}
+			}
+			if cpu.Instret < *snapshotAt && *snapshotAt-cpu.Instret < n {
+				n = *snapshotAt - cpu.Instret
+			}
+		}
+		if err := cpu.StepN(n); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func saveSnapshot(m *runtime.Machine, name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err = m.SaveSnapshot(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func restoreSnapshot(m *runtime.Machine, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return m.RestoreSnapshot(f)
 }
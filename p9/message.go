@@ -0,0 +1,177 @@
+package p9
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Message types of 9P2000.L. Each reply is numbered one past its request.
+const (
+	Rlerror      = 7
+	Tstatfs      = 8
+	Tlopen       = 12
+	Tlcreate     = 14
+	Tsymlink     = 16
+	Tmknod       = 18
+	Trename      = 20
+	Treadlink    = 22
+	Tgetattr     = 24
+	Tsetattr     = 26
+	Txattrwalk   = 30
+	Txattrcreate = 32
+	Treaddir     = 40
+	Tfsync       = 50
+	Tlock        = 52
+	Tgetlock     = 54
+	Tlink        = 70
+	Tmkdir       = 72
+	Trenameat    = 74
+	Tunlinkat    = 76
+	Tversion     = 100
+	Tauth        = 102
+	Tattach      = 104
+	Tflush       = 108
+	Twalk        = 110
+	Tread        = 116
+	Twrite       = 118
+	Tclunk       = 120
+	Tremove      = 122
+
+	HeaderSize = 7 // size, type and tag
+	NoTag      = 0xFFFF
+	NoFid      = 0xFFFFFFFF
+	Version    = "9P2000.L"
+)
+
+// Qid types.
+const (
+	QtDir     = 0x80
+	QtSymlink = 0x02
+	QtFile    = 0x00
+)
+
+// Qid identifies a file on the server.
+type Qid struct {
+	Type    uint8
+	Version uint32
+	Path    uint64
+}
+
+const qidSize = 13
+
+var errShort = errors.New("message too short")
+
+// Message is a 9P message being built or parsed. Reading past the end of
+// the message yields zeroes and is reported by Err.
+type Message struct {
+	Type uint8
+	Tag  uint16
+
+	body []byte
+	off  int // read position in body
+	err  error
+}
+
+func NewMessage(typ uint8, tag uint16) *Message {
+	return &Message{Type: typ, Tag: tag}
+}
+
+func ParseMessage(data []byte) (*Message, error) {
+	if len(data) < HeaderSize {
+		return nil, errShort
+	}
+	size := binary.LittleEndian.Uint32(data)
+	if size < HeaderSize || size > uint32(len(data)) {
+		return nil, fmt.Errorf("invalid message size: %d", size)
+	}
+	return &Message{Type: data[4], Tag: binary.LittleEndian.Uint16(data[5:]), body: data[HeaderSize:size]}, nil
+}
+
+// Bytes returns the message as sent on the wire.
+func (m *Message) Bytes() []byte {
+	data := make([]byte, HeaderSize, HeaderSize+len(m.body))
+	binary.LittleEndian.PutUint32(data, uint32(HeaderSize+len(m.body)))
+	data[4] = m.Type
+	binary.LittleEndian.PutUint16(data[5:], m.Tag)
+	return append(data, m.body...)
+}
+
+func (m *Message) Err() error {
+	return m.err
+}
+
+// Len is the size of the message on the wire.
+func (m *Message) Len() int {
+	return HeaderSize + len(m.body)
+}
+
+func (m *Message) Put8(v uint8) {
+	m.body = append(m.body, v)
+}
+
+func (m *Message) Put16(v uint16) {
+	m.body = binary.LittleEndian.AppendUint16(m.body, v)
+}
+
+func (m *Message) Put32(v uint32) {
+	m.body = binary.LittleEndian.AppendUint32(m.body, v)
+}
+
+func (m *Message) Put64(v uint64) {
+	m.body = binary.LittleEndian.AppendUint64(m.body, v)
+}
+
+func (m *Message) PutString(s string) {
+	m.Put16(uint16(len(s)))
+	m.body = append(m.body, s...)
+}
+
+func (m *Message) PutBytes(b []byte) {
+	m.body = append(m.body, b...)
+}
+
+func (m *Message) PutQid(q Qid) {
+	m.Put8(q.Type)
+	m.Put32(q.Version)
+	m.Put64(q.Path)
+}
+
+// next returns the following n bytes of the body.
+func (m *Message) next(n int) []byte {
+	if m.err != nil || len(m.body)-m.off < n {
+		m.err = errShort
+		return make([]byte, n)
+	}
+	b := m.body[m.off : m.off+n]
+	m.off += n
+	return b
+}
+
+func (m *Message) Get8() uint8 {
+	return m.next(1)[0]
+}
+
+func (m *Message) Get16() uint16 {
+	return binary.LittleEndian.Uint16(m.next(2))
+}
+
+func (m *Message) Get32() uint32 {
+	return binary.LittleEndian.Uint32(m.next(4))
+}
+
+func (m *Message) Get64() uint64 {
+	return binary.LittleEndian.Uint64(m.next(8))
+}
+
+func (m *Message) GetString() string {
+	return string(m.next(int(m.Get16())))
+}
+
+func (m *Message) GetBytes(n int) []byte {
+	return m.next(n)
+}
+
+func (m *Message) GetQid() Qid {
+	return Qid{Type: m.Get8(), Version: m.Get32(), Path: m.Get64()}
+}
@@ -0,0 +1,6 @@
+//go:build !unix
+
+package p9
+
+// oNofollow is 0 on hosts without O_NOFOLLOW, where open follows symlinks.
+const oNofollow = 0
@@ -0,0 +1,7 @@
+//go:build unix
+
+package p9
+
+import "syscall"
+
+const oNofollow = syscall.O_NOFOLLOW
@@ -0,0 +1,951 @@
+package p9
+
+import (
+	"errors"
+	"goemu/hostfs"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Linux error numbers, which 9P2000.L reports errors in.
+const (
+	enoent     = 2
+	eio        = 5
+	ebadf      = 9
+	eacces     = 13
+	eexist     = 17
+	enotdir    = 20
+	eisdir     = 21
+	einval     = 22
+	erofs      = 30
+	eloop      = 40
+	eproto     = 71
+	eopnotsupp = 95
+)
+
+// Flags of Tlopen and Tlcreate, as in Linux open.
+const (
+	oAccmode   = 0o3
+	oWronly    = 0o1
+	oRdwr      = 0o2
+	oCreat     = 0o100
+	oExcl      = 0o200
+	oTrunc     = 0o1000
+	oDirectory = 0o200000
+)
+
+// File types in the mode of Rgetattr.
+const (
+	sIFDIR = 0o040000
+	sIFREG = 0o100000
+	sIFLNK = 0o120000
+)
+
+// Setattr valid bits.
+const (
+	setattrMode    = 0x1
+	setattrSize    = 0x8
+	setattrAtime   = 0x10
+	setattrMtime   = 0x20
+	setattrAtimeOn = 0x80 // the time is given rather than now
+	setattrMtimeOn = 0x100
+)
+
+const (
+	// MaxSize bounds the size of messages the server negotiates.
+	MaxSize = 512 * 1024
+
+	getattrBasic = 0x7FF
+	atRemoveDir  = 0x200
+	lockSuccess  = 0
+	lockUnlocked = 2
+	statfsMagic  = 0x01021997 // V9FS_MAGIC
+	readHeader   = HeaderSize + 4
+)
+
+// fsStat is what Rstatfs reports of the host file system.
+type fsStat struct {
+	bsize                               uint32
+	blocks, bfree, bavail, files, ffree uint64
+}
+
+type fid struct {
+	name    string   // guest path, / being the shared directory
+	file    *os.File // nil until opened
+	entries []dirent // listing of an open directory, from offset 0
+}
+
+type dirent struct {
+	qid  Qid
+	typ  uint8
+	name string
+}
+
+// Server serves a host directory over 9P2000.L. Guest paths are confined to
+// the directory: neither ".." nor symlinks lead out of it.
+type Server struct {
+	ReadOnly bool
+
+	root  string
+	msize uint32
+	fids  map[uint32]*fid
+	qids  map[string]uint64 // host paths the guest has seen, numbered
+}
+
+func NewServer(dir string, readOnly bool) (*Server, error) {
+	root, err := hostfs.Root(dir)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "share", Path: dir, Err: syscall.ENOTDIR}
+	}
+	return &Server{ReadOnly: readOnly, root: root, msize: MaxSize, fids: make(map[uint32]*fid), qids: make(map[string]uint64)}, nil
+}
+
+// Reset forgets every fid, as a new session does.
+func (s *Server) Reset() {
+	for n := range s.fids {
+		s.clunk(n)
+	}
+}
+
+// Handle serves one request and returns the reply.
+func (s *Server) Handle(req []byte) []byte {
+	m, err := ParseMessage(req)
+	if err != nil {
+		return lerror(NoTag, eproto)
+	}
+	r := NewMessage(m.Type+1, m.Tag)
+	e := s.handle(m, r)
+	if e == 0 && m.Err() != nil {
+		e = eproto
+	}
+	if e != 0 {
+		return lerror(m.Tag, e)
+	}
+	return r.Bytes()
+}
+
+func lerror(tag uint16, e uint32) []byte {
+	r := NewMessage(Rlerror, tag)
+	r.Put32(e)
+	return r.Bytes()
+}
+
+func (s *Server) handle(m, r *Message) uint32 {
+	switch m.Type {
+	case Tversion:
+		return s.version(m, r)
+	case Tattach:
+		return s.attach(m, r)
+	case Tflush:
+		return 0 // requests complete before the next one is read
+	case Twalk:
+		return s.walk(m, r)
+	case Tclunk:
+		s.clunk(m.Get32())
+		return 0
+	case Tstatfs:
+		return s.statfs(m, r)
+	case Tlopen:
+		return s.lopen(m, r)
+	case Tlcreate:
+		return s.lcreate(m, r)
+	case Tread:
+		return s.read(m, r)
+	case Twrite:
+		return s.write(m, r)
+	case Treaddir:
+		return s.readdir(m, r)
+	case Tgetattr:
+		return s.getattr(m, r)
+	case Tsetattr:
+		return s.setattr(m)
+	case Treadlink:
+		return s.readlink(m, r)
+	case Tmkdir:
+		return s.mkdir(m, r)
+	case Tsymlink:
+		return s.symlink(m, r)
+	case Tlink:
+		return s.link(m)
+	case Trename:
+		return s.rename(m)
+	case Trenameat:
+		return s.renameat(m)
+	case Tunlinkat:
+		return s.unlinkat(m)
+	case Tremove:
+		return s.remove(m)
+	case Tfsync:
+		return s.fsync(m)
+	case Tlock:
+		r.Put8(lockSuccess)
+		return 0
+	case Tgetlock:
+		return s.getlock(m, r)
+	}
+	return eopnotsupp // device nodes, authentication and extended attributes among others
+}
+
+func (s *Server) version(m, r *Message) uint32 {
+	msize, version := m.Get32(), m.GetString()
+	if msize < 4096 {
+		return einval
+	}
+	if msize > MaxSize {
+		msize = MaxSize
+	}
+	s.Reset()
+	s.msize = msize
+	if version != Version {
+		version = "unknown"
+	}
+	r.Put32(msize)
+	r.PutString(version)
+	return 0
+}
+
+func (s *Server) attach(m, r *Message) uint32 {
+	n := m.Get32()
+	m.Get32() // afid
+	m.GetString()
+	m.GetString() // aname
+	m.Get32()     // n_uname
+	if _, ok := s.fids[n]; ok {
+		return ebadf
+	}
+	qid, e := s.qid("/")
+	if e != 0 {
+		return e
+	}
+	s.fids[n] = &fid{name: "/"}
+	r.PutQid(qid)
+	return 0
+}
+
+func (s *Server) walk(m, r *Message) uint32 {
+	old := m.Get32()
+	f, e := s.fid(old)
+	if e != 0 {
+		return e
+	}
+	newfid, n := m.Get32(), int(m.Get16())
+	if n > 16 {
+		return einval
+	}
+	if _, ok := s.fids[newfid]; ok && newfid != old || f.file != nil {
+		return ebadf
+	}
+	name := f.name
+	var qids []Qid
+	for i := 0; i < n; i++ {
+		elem := m.GetString()
+		if strings.Contains(elem, "/") || elem == "" {
+			return einval
+		}
+		next := path.Join(name, elem)
+		qid, e := s.qid(next)
+		if e != 0 {
+			if i == 0 {
+				return e
+			}
+			break // a partial walk leaves newfid alone
+		}
+		qids = append(qids, qid)
+		name = next
+	}
+	if len(qids) == n {
+		s.fids[newfid] = &fid{name: name}
+	}
+	r.Put16(uint16(len(qids)))
+	for _, q := range qids {
+		r.PutQid(q)
+	}
+	return 0
+}
+
+func (s *Server) clunk(n uint32) {
+	if f, ok := s.fids[n]; ok {
+		if f.file != nil {
+			f.file.Close()
+		}
+		delete(s.fids, n)
+	}
+}
+
+func (s *Server) statfs(m, r *Message) uint32 {
+	f, e := s.fid(m.Get32())
+	if e != 0 {
+		return e
+	}
+	host, e := s.host(f.name)
+	if e != 0 {
+		return e
+	}
+	st, err := statfs(host)
+	if err != nil {
+		return errno(err)
+	}
+	r.Put32(statfsMagic)
+	r.Put32(st.bsize)
+	r.Put64(st.blocks)
+	r.Put64(st.bfree)
+	r.Put64(st.bavail)
+	r.Put64(st.files)
+	r.Put64(st.ffree)
+	r.Put64(0) // fsid
+	r.Put32(255)
+	return 0
+}
+
+func (s *Server) lopen(m, r *Message) uint32 {
+	f, e := s.fid(m.Get32())
+	if e != 0 {
+		return e
+	}
+	flags := m.Get32()
+	if f.file != nil {
+		return ebadf
+	}
+	host, e := s.host(f.name)
+	if e != 0 {
+		return e
+	}
+	info, err := os.Lstat(host)
+	if err != nil {
+		return errno(err)
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		return eloop // the guest follows symlinks itself
+	}
+	if e = s.open(f, host, flags&^(oCreat|oExcl), 0); e != 0 {
+		return e
+	}
+	if flags&oDirectory != 0 && !info.IsDir() {
+		s.close(f)
+		return enotdir
+	}
+	r.PutQid(s.qidOf(host, info))
+	r.Put32(s.msize - readHeader)
+	return 0
+}
+
+// open opens the file of f. Appending is left to the guest, which passes the
+// offsets to write at. Symlinks are never followed, the guest follows them
+// itself, and on the host they may point out of the root.
+func (s *Server) open(f *fid, host string, flags uint32, mode fs.FileMode) uint32 {
+	hostFlags := oNofollow
+	switch flags & oAccmode {
+	case oWronly:
+		hostFlags |= os.O_WRONLY
+	case oRdwr:
+		hostFlags |= os.O_RDWR
+	default:
+		hostFlags |= os.O_RDONLY
+	}
+	for _, fl := range []struct{ guest, host int }{
+		{oCreat, os.O_CREATE},
+		{oExcl, os.O_EXCL},
+		{oTrunc, os.O_TRUNC},
+	} {
+		if flags&uint32(fl.guest) != 0 {
+			hostFlags |= fl.host
+		}
+	}
+	if s.ReadOnly && hostFlags&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		return erofs
+	}
+	file, err := os.OpenFile(host, hostFlags, mode)
+	if err != nil {
+		return errno(err)
+	}
+	f.file = file
+	f.entries = nil
+	return 0
+}
+
+func (s *Server) close(f *fid) {
+	f.file.Close()
+	f.file = nil
+}
+
+func (s *Server) lcreate(m, r *Message) uint32 {
+	f, e := s.fid(m.Get32())
+	if e != 0 {
+		return e
+	}
+	name, flags, mode := m.GetString(), m.Get32(), m.Get32()
+	m.Get32() // gid
+	if s.ReadOnly {
+		return erofs
+	}
+	if f.file != nil {
+		return ebadf
+	}
+	child, host, e := s.child(f, name)
+	if e != 0 {
+		return e
+	}
+	if e = s.open(f, host, flags|oCreat, fs.FileMode(mode&0o777)); e != 0 {
+		return e
+	}
+	f.name = child
+	qid, e := s.qid(child)
+	if e != 0 {
+		return e
+	}
+	r.PutQid(qid)
+	r.Put32(s.msize - readHeader)
+	return 0
+}
+
+func (s *Server) read(m, r *Message) uint32 {
+	f, e := s.fid(m.Get32())
+	if e != 0 {
+		return e
+	}
+	offset, count := m.Get64(), m.Get32()
+	if f.file == nil {
+		return ebadf
+	}
+	if count > s.msize-readHeader {
+		count = s.msize - readHeader
+	}
+	data := make([]byte, count)
+	n, err := f.file.ReadAt(data, int64(offset))
+	if err != nil && err != io.EOF {
+		return errno(err)
+	}
+	r.Put32(uint32(n))
+	r.PutBytes(data[:n])
+	return 0
+}
+
+func (s *Server) write(m, r *Message) uint32 {
+	f, e := s.fid(m.Get32())
+	if e != 0 {
+		return e
+	}
+	offset, count := m.Get64(), m.Get32()
+	data := m.GetBytes(int(count))
+	if f.file == nil {
+		return ebadf
+	}
+	if s.ReadOnly {
+		return erofs
+	}
+	n, err := f.file.WriteAt(data, int64(offset))
+	if err != nil {
+		return errno(err)
+	}
+	r.Put32(uint32(n))
+	return 0
+}
+
+// readdir lists an open directory. The offset of an entry is the position
+// of the one after it, and the listing is taken afresh at offset 0.
+func (s *Server) readdir(m, r *Message) uint32 {
+	f, e := s.fid(m.Get32())
+	if e != 0 {
+		return e
+	}
+	offset, count := m.Get64(), m.Get32()
+	if f.file == nil {
+		return ebadf
+	}
+	if offset == 0 || f.entries == nil {
+		if e = s.list(f); e != 0 {
+			return e
+		}
+	}
+	if count > s.msize-readHeader {
+		count = s.msize - readHeader
+	}
+	entries := NewMessage(0, 0)
+	for i := offset; i < uint64(len(f.entries)); i++ {
+		d := f.entries[i]
+		if entries.Len()-HeaderSize+qidSize+8+1+2+len(d.name) > int(count) {
+			break
+		}
+		entries.PutQid(d.qid)
+		entries.Put64(i + 1)
+		entries.Put8(d.typ)
+		entries.PutString(d.name)
+	}
+	r.Put32(uint32(len(entries.body)))
+	r.PutBytes(entries.body)
+	return 0
+}
+
+// Directory entry types.
+const (
+	dtDir = 4
+	dtReg = 8
+	dtLnk = 10
+)
+
+func (s *Server) list(f *fid) uint32 {
+	host, e := s.host(f.name)
+	if e != 0 {
+		return e
+	}
+	entries, err := os.ReadDir(host)
+	if err != nil {
+		return errno(err)
+	}
+	names := []string{".", ".."}
+	for _, d := range entries {
+		names = append(names, d.Name())
+	}
+	f.entries = f.entries[:0]
+	for _, name := range names {
+		qid, e := s.qid(path.Join(f.name, name))
+		if e != 0 {
+			continue // removed since it was listed
+		}
+		typ := uint8(dtReg)
+		switch qid.Type {
+		case QtDir:
+			typ = dtDir
+		case QtSymlink:
+			typ = dtLnk
+		}
+		f.entries = append(f.entries, dirent{qid, typ, name})
+	}
+	return 0
+}
+
+func (s *Server) getattr(m, r *Message) uint32 {
+	f, e := s.fid(m.Get32())
+	if e != 0 {
+		return e
+	}
+	m.Get64() // request mask, everything basic is always returned
+	host, e := s.host(f.name)
+	if e != 0 {
+		return e
+	}
+	info, err := os.Lstat(host)
+	if err != nil {
+		return errno(err)
+	}
+	mode := uint32(info.Mode().Perm())
+	nlink := uint64(1)
+	switch {
+	case info.IsDir():
+		mode |= sIFDIR
+		nlink = 2
+	case info.Mode()&fs.ModeSymlink != 0:
+		mode |= sIFLNK
+	default:
+		mode |= sIFREG
+	}
+	size := uint64(info.Size())
+	t := info.ModTime()
+	r.Put64(getattrBasic)
+	r.PutQid(s.qidOf(host, info))
+	r.Put32(mode)
+	r.Put32(0) // uid, files belong to the guest's root
+	r.Put32(0) // gid
+	r.Put64(nlink)
+	r.Put64(0) // rdev
+	r.Put64(size)
+	r.Put64(4096)               // blksize
+	r.Put64((size + 511) / 512) // blocks
+	for i := 0; i < 4; i++ {    // atime, mtime, ctime and btime
+		r.Put64(uint64(t.Unix()))
+		r.Put64(uint64(t.Nanosecond()))
+	}
+	r.Put64(0) // gen
+	r.Put64(0) // data_version
+	return 0
+}
+
+func (s *Server) setattr(m *Message) uint32 {
+	f, e := s.fid(m.Get32())
+	if e != 0 {
+		return e
+	}
+	valid, mode := m.Get32(), m.Get32()
+	m.Get32() // uid
+	m.Get32() // gid
+	size := m.Get64()
+	atime := time.Unix(int64(m.Get64()), int64(m.Get64()))
+	mtime := time.Unix(int64(m.Get64()), int64(m.Get64()))
+	if m.Err() != nil {
+		return eproto
+	}
+	if s.ReadOnly {
+		return erofs
+	}
+	host, e := s.host(f.name)
+	if e != 0 {
+		return e
+	}
+	// os.Chmod, os.Truncate and os.Chtimes would follow a symlink
+	if info, err := os.Lstat(host); err != nil {
+		return errno(err)
+	} else if info.Mode()&fs.ModeSymlink != 0 && valid&(setattrMode|setattrSize|setattrAtime|setattrMtime) != 0 {
+		return eloop
+	}
+	if valid&setattrMode != 0 {
+		if err := os.Chmod(host, fs.FileMode(mode&0o777)); err != nil {
+			return errno(err)
+		}
+	}
+	if valid&setattrSize != 0 {
+		if err := os.Truncate(host, int64(size)); err != nil {
+			return errno(err)
+		}
+	}
+	if valid&(setattrAtime|setattrMtime) != 0 {
+		info, err := os.Stat(host)
+		if err != nil {
+			return errno(err)
+		}
+		now := time.Now()
+		if valid&setattrAtime == 0 {
+			atime = info.ModTime() // the host's atime is not portable to get
+		} else if valid&setattrAtimeOn == 0 {
+			atime = now
+		}
+		if valid&setattrMtime == 0 {
+			mtime = info.ModTime()
+		} else if valid&setattrMtimeOn == 0 {
+			mtime = now
+		}
+		if err = os.Chtimes(host, atime, mtime); err != nil {
+			return errno(err)
+		}
+	}
+	return 0 // ownership stays with the host user
+}
+
+func (s *Server) readlink(m, r *Message) uint32 {
+	f, e := s.fid(m.Get32())
+	if e != 0 {
+		return e
+	}
+	host, e := s.host(f.name)
+	if e != 0 {
+		return e
+	}
+	target, err := os.Readlink(host)
+	if err != nil {
+		return errno(err)
+	}
+	r.PutString(target)
+	return 0
+}
+
+func (s *Server) mkdir(m, r *Message) uint32 {
+	f, e := s.fid(m.Get32())
+	if e != 0 {
+		return e
+	}
+	name, mode := m.GetString(), m.Get32()
+	m.Get32() // gid
+	if s.ReadOnly {
+		return erofs
+	}
+	child, host, e := s.child(f, name)
+	if e != 0 {
+		return e
+	}
+	if err := os.Mkdir(host, fs.FileMode(mode&0o777)); err != nil {
+		return errno(err)
+	}
+	qid, e := s.qid(child)
+	if e != 0 {
+		return e
+	}
+	r.PutQid(qid)
+	return 0
+}
+
+func (s *Server) symlink(m, r *Message) uint32 {
+	f, e := s.fid(m.Get32())
+	if e != 0 {
+		return e
+	}
+	name, target := m.GetString(), m.GetString()
+	m.Get32() // gid
+	if s.ReadOnly {
+		return erofs
+	}
+	child, host, e := s.child(f, name)
+	if e != 0 {
+		return e
+	}
+	if err := os.Symlink(target, host); err != nil {
+		return errno(err)
+	}
+	qid, e := s.qid(child)
+	if e != 0 {
+		return e
+	}
+	r.PutQid(qid)
+	return 0
+}
+
+func (s *Server) link(m *Message) uint32 {
+	dir, e := s.fid(m.Get32())
+	if e != 0 {
+		return e
+	}
+	f, e := s.fid(m.Get32())
+	if e != 0 {
+		return e
+	}
+	name := m.GetString()
+	if s.ReadOnly {
+		return erofs
+	}
+	_, host, e := s.child(dir, name)
+	if e != 0 {
+		return e
+	}
+	old, e := s.host(f.name)
+	if e != 0 {
+		return e
+	}
+	if err := os.Link(old, host); err != nil {
+		return errno(err)
+	}
+	return 0
+}
+
+func (s *Server) rename(m *Message) uint32 {
+	f, e := s.fid(m.Get32())
+	if e != 0 {
+		return e
+	}
+	dir, e := s.fid(m.Get32())
+	if e != 0 {
+		return e
+	}
+	return s.move(f.name, dir, m.GetString())
+}
+
+func (s *Server) renameat(m *Message) uint32 {
+	olddir, e := s.fid(m.Get32())
+	if e != 0 {
+		return e
+	}
+	oldname := m.GetString()
+	newdir, e := s.fid(m.Get32())
+	if e != 0 {
+		return e
+	}
+	newname := m.GetString()
+	if !validName(oldname) {
+		return einval
+	}
+	return s.move(path.Join(olddir.name, oldname), newdir, newname)
+}
+
+// move renames the file at guest path old to name in dir, and moves the fids
+// within it along.
+func (s *Server) move(old string, dir *fid, name string) uint32 {
+	if s.ReadOnly {
+		return erofs
+	}
+	if old == "/" {
+		return eacces
+	}
+	child, host, e := s.child(dir, name)
+	if e != 0 {
+		return e
+	}
+	src, e := s.host(old)
+	if e != 0 {
+		return e
+	}
+	if err := os.Rename(src, host); err != nil {
+		return errno(err)
+	}
+	for _, f := range s.fids {
+		if f.name == old || strings.HasPrefix(f.name, old+"/") {
+			f.name = child + f.name[len(old):]
+		}
+	}
+	return 0
+}
+
+func (s *Server) unlinkat(m *Message) uint32 {
+	dir, e := s.fid(m.Get32())
+	if e != 0 {
+		return e
+	}
+	name, flags := m.GetString(), m.Get32()
+	if s.ReadOnly {
+		return erofs
+	}
+	_, host, e := s.child(dir, name)
+	if e != 0 {
+		return e
+	}
+	info, err := os.Lstat(host)
+	if err != nil {
+		return errno(err)
+	}
+	if info.IsDir() != (flags&atRemoveDir != 0) {
+		if info.IsDir() {
+			return eisdir
+		}
+		return enotdir
+	}
+	if err = os.Remove(host); err != nil {
+		return errno(err)
+	}
+	return 0
+}
+
+// remove deletes the file of a fid, and clunks it whether that works or not.
+func (s *Server) remove(m *Message) uint32 {
+	n := m.Get32()
+	f, e := s.fid(n)
+	if e != 0 {
+		return e
+	}
+	defer s.clunk(n)
+	if s.ReadOnly {
+		return erofs
+	}
+	if f.name == "/" {
+		return eacces
+	}
+	host, e := s.host(f.name)
+	if e != 0 {
+		return e
+	}
+	if err := os.Remove(host); err != nil {
+		return errno(err)
+	}
+	return 0
+}
+
+func (s *Server) fsync(m *Message) uint32 {
+	f, e := s.fid(m.Get32())
+	if e != 0 {
+		return e
+	}
+	if f.file == nil {
+		return ebadf
+	}
+	if s.ReadOnly {
+		return 0
+	}
+	if err := f.file.Sync(); err != nil {
+		return errno(err)
+	}
+	return 0
+}
+
+// getlock reports every range as unlocked, since locks always succeed.
+func (s *Server) getlock(m, r *Message) uint32 {
+	if _, e := s.fid(m.Get32()); e != 0 {
+		return e
+	}
+	m.Get8() // type
+	start, length, proc, client := m.Get64(), m.Get64(), m.Get32(), m.GetString()
+	r.Put8(lockUnlocked)
+	r.Put64(start)
+	r.Put64(length)
+	r.Put32(proc)
+	r.PutString(client)
+	return 0
+}
+
+func (s *Server) fid(n uint32) (*fid, uint32) {
+	f, ok := s.fids[n]
+	if !ok {
+		return nil, ebadf
+	}
+	return f, 0
+}
+
+// host maps a guest path onto the shared directory. Only the directory the
+// file is in is resolved, so that symlinks are seen as such.
+func (s *Server) host(name string) (string, uint32) {
+	if name == "/" {
+		return s.root, 0
+	}
+	dir, err := hostfs.Resolve(s.root, path.Dir(name))
+	if err != nil {
+		return "", errno(err)
+	}
+	return filepath.Join(dir, path.Base(name)), 0
+}
+
+// child returns the guest and host paths of a new file in the directory of f.
+func (s *Server) child(f *fid, name string) (string, string, uint32) {
+	if !validName(name) {
+		return "", "", einval
+	}
+	child := path.Join(f.name, name)
+	host, e := s.host(child)
+	return child, host, e
+}
+
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+func (s *Server) qid(name string) (Qid, uint32) {
+	host, e := s.host(name)
+	if e != 0 {
+		return Qid{}, e
+	}
+	info, err := os.Lstat(host)
+	if err != nil {
+		return Qid{}, errno(err)
+	}
+	return s.qidOf(host, info), 0
+}
+
+// qidOf numbers host paths in the order the guest comes across them.
+func (s *Server) qidOf(host string, info fs.FileInfo) Qid {
+	p, ok := s.qids[host]
+	if !ok {
+		p = uint64(len(s.qids)) + 1
+		s.qids[host] = p
+	}
+	q := Qid{Type: QtFile, Version: uint32(info.ModTime().UnixNano()), Path: p}
+	switch {
+	case info.IsDir():
+		q.Type = QtDir
+	case info.Mode()&fs.ModeSymlink != 0:
+		q.Type = QtSymlink
+	}
+	return q
+}
+
+// errno converts a host error into a Linux error number.
+func errno(err error) uint32 {
+	var e syscall.Errno
+	switch {
+	case errors.As(err, &e):
+		return uint32(e)
+	case errors.Is(err, fs.ErrNotExist):
+		return enoent
+	case errors.Is(err, fs.ErrPermission):
+		return eacces
+	case errors.Is(err, fs.ErrExist):
+		return eexist
+	default:
+		return eio
+	}
+}
@@ -0,0 +1,11 @@
+package p9
+
+import "syscall"
+
+func statfs(path string) (fsStat, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return fsStat{}, err
+	}
+	return fsStat{uint32(st.Bsize), st.Blocks, st.Bfree, st.Bavail, st.Files, st.Ffree}, nil
+}
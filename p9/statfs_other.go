@@ -0,0 +1,8 @@
+//go:build !linux
+
+package p9
+
+// statfs makes up figures where the host's are not portable to get.
+func statfs(path string) (fsStat, error) {
+	return fsStat{bsize: 4096, blocks: 1 << 20, bfree: 1 << 19, bavail: 1 << 19, files: 1 << 16, ffree: 1 << 15}, nil
+}
@@ -0,0 +1,254 @@
+package profile
+
+import (
+	"compress/gzip"
+	"debug/elf"
+	"encoding/binary"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MaxDepth is the most frames a sampled stack holds.
+const MaxDepth = 64
+
+// Sample is a stack seen Count times, leaf first. Only the leaf is a Pc, the
+// other addresses are return addresses.
+type Sample struct {
+	Hart  int
+	Stack []uint64
+	Count uint64
+}
+
+// Profiler collects the stacks the harts of a guest are sampled in, every
+// Period retired instructions, and writes them as a pprof profile.
+type Profiler struct {
+	Period uint64
+	Stacks bool // walk the frame pointer chain, not only take the Pc
+
+	mu      sync.Mutex // harts running in parallel add samples concurrently
+	samples map[string]*Sample
+	start   time.Time
+}
+
+func New(period uint64, stacks bool) *Profiler {
+	return &Profiler{Period: period, Stacks: stacks, samples: make(map[string]*Sample), start: time.Now()}
+}
+
+// Add counts one sample of a hart in stack, which it does not keep.
+func (p *Profiler) Add(hart int, stack []uint64) {
+	key := make([]byte, 8*(len(stack)+1))
+	binary.LittleEndian.PutUint64(key, uint64(hart))
+	for i, addr := range stack {
+		binary.LittleEndian.PutUint64(key[8*(i+1):], addr)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.samples[string(key)]
+	if s == nil {
+		s = &Sample{Hart: hart, Stack: append([]uint64(nil), stack...)}
+		p.samples[string(key)] = s
+	}
+	s.Count++
+}
+
+// Samples returns the stacks sampled so far, the most frequent first.
+func (p *Profiler) Samples() []Sample {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var samples []Sample
+	for _, s := range p.samples {
+		samples = append(samples, *s)
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		a, b := samples[i], samples[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.Hart != b.Hart {
+			return a.Hart < b.Hart
+		}
+		for k := 0; k < len(a.Stack) && k < len(b.Stack); k++ {
+			if a.Stack[k] != b.Stack[k] {
+				return a.Stack[k] < b.Stack[k]
+			}
+		}
+		return len(a.Stack) < len(b.Stack)
+	})
+	return samples
+}
+
+// Write writes the samples as a gzipped pprof profile of the program named
+// file, naming functions after the symbols. Addresses outside any function
+// symbol are left for pprof to show as they are.
+func (p *Profiler) Write(w io.Writer, file string, symbols []elf.Symbol) error {
+	funcs := functions(symbols)
+	var strs stringTable
+	var out message
+	out.message(1, valueType(&strs, "samples", "count"))
+	out.message(1, valueType(&strs, "instructions", "count"))
+
+	locations := make(map[uint64]uint64) // address to location id
+	functionIDs := make(map[string]uint64)
+	var locs, fns []message
+	for _, s := range p.Samples() {
+		var sample message
+		ids := make([]uint64, len(s.Stack))
+		for i, addr := range s.Stack {
+			id, ok := locations[addr]
+			if !ok {
+				id = uint64(len(locs) + 1)
+				locations[addr] = id
+				var loc message
+				loc.uint(1, id)
+				loc.uint(2, 1)
+				loc.uint(3, addr)
+				lookup := addr
+				if i > 0 {
+					lookup-- // a return address may be past the end of the call
+				}
+				if name, ok := funcs.find(lookup); ok {
+					fid, ok := functionIDs[name]
+					if !ok {
+						fid = uint64(len(fns) + 1)
+						functionIDs[name] = fid
+						var fn message
+						fn.uint(1, fid)
+						fn.uint(2, strs.index(name))
+						fn.uint(3, strs.index(name))
+						fn.uint(4, strs.index(file))
+						fns = append(fns, fn)
+					}
+					var line message
+					line.uint(1, fid)
+					loc.message(4, line)
+				}
+				locs = append(locs, loc)
+			}
+			ids[i] = id
+		}
+		sample.packed(1, ids)
+		sample.packed(2, []uint64{s.Count, s.Count * p.Period})
+		var label message
+		label.uint(1, strs.index("hart"))
+		label.uint(2, strs.index(strconv.Itoa(s.Hart)))
+		sample.message(3, label)
+		out.message(2, sample)
+	}
+
+	var mapping message
+	mapping.uint(1, 1)
+	mapping.uint(3, ^uint64(0))
+	mapping.uint(5, strs.index(file))
+	if len(funcs) > 0 {
+		mapping.uint(7, 1) // has_functions
+	}
+	out.message(3, mapping)
+	for _, loc := range locs {
+		out.message(4, loc)
+	}
+	for _, fn := range fns {
+		out.message(5, fn)
+	}
+	out.uint(9, uint64(p.start.UnixNano()))
+	out.uint(10, uint64(time.Since(p.start)))
+	out.message(11, valueType(&strs, "instructions", "count"))
+	out.uint(12, p.Period)
+	for _, s := range strs.table {
+		out.bytes(6, []byte(s))
+	}
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(out); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func valueType(strs *stringTable, typ, unit string) message {
+	var m message
+	m.uint(1, strs.index(typ))
+	m.uint(2, strs.index(unit))
+	return m
+}
+
+// symbolTable holds function symbols sorted by address.
+type symbolTable []elf.Symbol
+
+func functions(symbols []elf.Symbol) symbolTable {
+	var t symbolTable
+	for _, s := range symbols {
+		if elf.ST_TYPE(s.Info) == elf.STT_FUNC || elf.ST_TYPE(s.Info) == elf.STT_NOTYPE && s.Name != "" && s.Section != elf.SHN_UNDEF && s.Section != elf.SHN_ABS {
+			t = append(t, s)
+		}
+	}
+	sort.SliceStable(t, func(i, j int) bool { return t[i].Value < t[j].Value })
+	return t
+}
+
+// find returns the name of the function containing addr: the one whose range
+// holds it, or for symbols without a size, such as assembly labels, the
+// closest one below it.
+func (t symbolTable) find(addr uint64) (string, bool) {
+	i := sort.Search(len(t), func(i int) bool { return t[i].Value > addr }) - 1
+	if i < 0 {
+		return "", false
+	}
+	s := t[i]
+	if s.Size != 0 && addr >= s.Value+s.Size {
+		return "", false
+	}
+	return s.Name, true
+}
+
+// stringTable is the string table of a profile, which starts with "".
+type stringTable struct {
+	table []string
+	ids   map[string]uint64
+}
+
+func (s *stringTable) index(str string) uint64 {
+	if s.ids == nil {
+		s.table, s.ids = []string{""}, map[string]uint64{"": 0}
+	}
+	id, ok := s.ids[str]
+	if !ok {
+		id = uint64(len(s.table))
+		s.table = append(s.table, str)
+		s.ids[str] = id
+	}
+	return id
+}
+
+// message is an encoded protocol buffer message, which is all a pprof
+// profile needs: varints and length-delimited fields.
+type message []byte
+
+func (m *message) varint(v uint64) {
+	*m = binary.AppendUvarint(*m, v)
+}
+
+func (m *message) uint(field int, v uint64) {
+	m.varint(uint64(field) << 3)
+	m.varint(v)
+}
+
+func (m *message) bytes(field int, b []byte) {
+	m.varint(uint64(field)<<3 | 2)
+	m.varint(uint64(len(b)))
+	*m = append(*m, b...)
+}
+
+func (m *message) message(field int, sub message) {
+	m.bytes(field, sub)
+}
+
+func (m *message) packed(field int, vs []uint64) {
+	var b message
+	for _, v := range vs {
+		b.varint(v)
+	}
+	m.bytes(field, b)
+}
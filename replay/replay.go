@@ -0,0 +1,148 @@
+package replay
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Kind identifies the source of an asynchronous event.
+type Kind uint8
+
+const (
+	UartRx   Kind = iota + 1 // a byte arriving at a UART receiver, Data holds index<<8 | byte
+	Timer                    // a sample of the host clock
+	VirtioRx                 // bytes delivered to a virtio device, Data holds slot<<32 | port
+	RtcEpoch                 // the host time the RTC counts from, in nanoseconds
+)
+
+// hasPayload reports whether events of kind k carry bytes in Payload.
+func (k Kind) hasPayload() bool {
+	return k == VirtioRx
+}
+
+// Event is an asynchronous input tagged with the number of instructions
+// retired before it became visible to the guest.
+type Event struct {
+	Instret uint64
+	Kind    Kind
+	Data    uint64
+	Payload []byte
+}
+
+type header struct {
+	Instret uint64
+	Kind    Kind
+	Data    uint64
+}
+
+// A log file starts with Magic and a little-endian uint32 version,
+// followed by the events in the order they were delivered. Events with a
+// payload are followed by its uint32 length and the bytes.
+const (
+	Magic   = "GOEMUREC"
+	Version = 3
+)
+
+const maxPayload = 1 << 20
+
+type Recorder struct {
+	w io.Writer
+}
+
+func NewRecorder(w io.Writer) (*Recorder, error) {
+	if _, err := io.WriteString(w, Magic); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(Version)); err != nil {
+		return nil, err
+	}
+	return &Recorder{w: w}, nil
+}
+
+func (r *Recorder) Record(e Event) error {
+	if err := binary.Write(r.w, binary.LittleEndian, &header{e.Instret, e.Kind, e.Data}); err != nil {
+		return err
+	}
+	if !e.Kind.hasPayload() {
+		return nil
+	}
+	if err := binary.Write(r.w, binary.LittleEndian, uint32(len(e.Payload))); err != nil {
+		return err
+	}
+	_, err := r.w.Write(e.Payload)
+	return err
+}
+
+type Player struct {
+	End uint64 // the player stays active until this many instructions retired
+
+	events []Event
+	next   int
+}
+
+// NewPlayer reads a complete log written by a Recorder.
+func NewPlayer(r io.Reader) (*Player, error) {
+	magic := make([]byte, len(Magic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != Magic {
+		return nil, fmt.Errorf("invalid replay log magic: %q", magic)
+	}
+	var version uint32
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return nil, err
+	}
+	if version != Version {
+		return nil, fmt.Errorf("unsupported replay log version: %d", version)
+	}
+	p := new(Player)
+	for {
+		var h header
+		if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+			if errors.Is(err, io.EOF) {
+				return p, nil
+			}
+			return nil, err
+		}
+		e := Event{Instret: h.Instret, Kind: h.Kind, Data: h.Data}
+		if e.Kind.hasPayload() {
+			var n uint32
+			if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+				return nil, err
+			}
+			if n > maxPayload {
+				return nil, fmt.Errorf("invalid event payload size: %d", n)
+			}
+			e.Payload = make([]byte, n)
+			if _, err := io.ReadFull(r, e.Payload); err != nil {
+				return nil, err
+			}
+		}
+		p.events = append(p.events, e)
+	}
+}
+
+// Next returns the next event that is due once instret instructions have retired.
+func (p *Player) Next(instret uint64) (Event, bool) {
+	if p.next < len(p.events) && p.events[p.next].Instret <= instret {
+		p.next++
+		return p.events[p.next-1], true
+	}
+	return Event{}, false
+}
+
+// Skip drops the events that were due before instret.
+func (p *Player) Skip(instret uint64) {
+	for p.next < len(p.events) && p.events[p.next].Instret < instret {
+		p.next++
+	}
+}
+
+// Done reports whether every event in the log has been delivered
+// and End has been reached.
+func (p *Player) Done(instret uint64) bool {
+	return p.next >= len(p.events) && instret >= p.End
+}
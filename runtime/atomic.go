@@ -0,0 +1,157 @@
+package runtime
+
+// reservation is the reservation set of a hart: the word lr loaded and the
+// value it saw. An sc succeeds while the word still holds that value, so a
+// store by any hart in between makes it fail unless it wrote the same value.
+type reservation struct {
+	valid bool
+	addr  uint64
+	value uint64
+}
+
+// amo executes an instruction of the A extension. Word operations sign-extend
+// the value loaded into rd. In RAM the read-modify-write is a compare and swap,
+// atomic with respect to every other access of any hart. Devices are only
+// accessed under the device lock anyway.
+func (cpu *CPU) amo(inst uint64, rd, rs1, rs2, funct3 uint8) error {
+	var bytes uint64
+	switch funct3 {
+	case 0b010:
+		bytes = 4
+	case 0b011:
+		bytes = 8
+	default:
+		return NewIllegalInstErr(inst)
+	}
+	addr := cpu.Regs[rs1]
+	misaligned := addr%bytes != 0
+	extend := func(v uint64) uint64 {
+		if bytes == 4 {
+			return uint64(int32(v))
+		}
+		return v
+	}
+
+	funct5 := inst >> 27
+	switch funct5 {
+	case 0b00010: // lr
+		if misaligned {
+			return &Exception{Cause: LoadAddrMisaligned, Tval: addr}
+		}
+		v, err := cpu.Bus.Load(addr, bytes)
+		if err != nil {
+			return err
+		}
+		cpu.reservation = reservation{true, addr, v}
+		cpu.Regs[rd] = extend(v)
+		cpu.counters.events[EventLoads]++
+		return nil
+	case 0b00011: // sc
+		if misaligned {
+			return &Exception{Cause: StoreAddrMisaligned, Tval: addr}
+		}
+		r := cpu.reservation
+		cpu.reservation = reservation{}
+		ok := false
+		if r.valid && r.addr == addr {
+			var err error
+			if ok, err = cpu.compareAndSwap(addr, bytes, r.value, cpu.Regs[rs2]); err != nil {
+				return storeFault(err)
+			}
+		}
+		cpu.Regs[rd] = 1
+		if ok {
+			cpu.Regs[rd] = 0
+			cpu.counters.events[EventStores]++
+		}
+		return nil
+	}
+
+	y := extend(cpu.Regs[rs2])
+	var op func(x uint64) uint64
+	switch funct5 {
+	case 0b00001: // amoswap
+		op = func(x uint64) uint64 { return y }
+	case 0b00000: // amoadd
+		op = func(x uint64) uint64 { return x + y }
+	case 0b00100: // amoxor
+		op = func(x uint64) uint64 { return x ^ y }
+	case 0b01100: // amoand
+		op = func(x uint64) uint64 { return x & y }
+	case 0b01000: // amoor
+		op = func(x uint64) uint64 { return x | y }
+	case 0b10000: // amomin
+		op = func(x uint64) uint64 {
+			if int64(y) < int64(x) {
+				return y
+			}
+			return x
+		}
+	case 0b10100: // amomax
+		op = func(x uint64) uint64 {
+			if int64(y) > int64(x) {
+				return y
+			}
+			return x
+		}
+	case 0b11000: // amominu
+		op = func(x uint64) uint64 {
+			if y < x {
+				return y
+			}
+			return x
+		}
+	case 0b11100: // amomaxu
+		op = func(x uint64) uint64 {
+			if y > x {
+				return y
+			}
+			return x
+		}
+	default:
+		return NewIllegalInstErr(inst)
+	}
+	if misaligned {
+		return &Exception{Cause: StoreAddrMisaligned, Tval: addr}
+	}
+	for {
+		v, err := cpu.Bus.Load(addr, bytes)
+		if err != nil {
+			return storeFault(err)
+		}
+		ok, err := cpu.compareAndSwap(addr, bytes, v, op(extend(v)))
+		if err != nil {
+			return storeFault(err)
+		}
+		if ok {
+			cpu.Regs[rd] = extend(v)
+			cpu.counters.events[EventLoads]++
+			cpu.counters.events[EventStores]++
+			return nil
+		}
+	}
+}
+
+// storeFault turns an access fault of the read half of an sc or AMO into the
+// store/AMO access fault the instruction raises as a whole.
+func storeFault(err error) error {
+	if e, ok := err.(*Exception); ok && e.Cause == LoadAccessFault {
+		return &Exception{Cause: StoreAccessFault, Tval: e.Tval}
+	}
+	return err
+}
+
+// compareAndSwap stores next at addr if it still holds old.
+func (cpu *CPU) compareAndSwap(addr, bytes, old, next uint64) (bool, error) {
+	b := cpu.Bus
+	if b.Mem.Contains(addr) {
+		return b.Mem.CompareAndSwap(addr, bytes, old, next)
+	}
+	b.lock()
+	defer b.unlock()
+	v, err := b.load(addr, bytes)
+	if err != nil || v != old {
+		return false, err
+	}
+	return true, b.store(addr, bytes, next)
+}
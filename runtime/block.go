@@ -0,0 +1,235 @@
+package runtime
+
+import (
+	"goemu/config"
+	"io"
+)
+
+// MaxBlock is the most instructions a translated block holds.
+const MaxBlock = 64
+
+// block is a translated basic block: the decoded instructions from its first
+// Pc up to the first one that may jump or change the state of the hart in a
+// way the others cannot see, with common pairs fused into one operation. It
+// never crosses a page and is valid while the page keeps its generation.
+type block struct {
+	pc     uint64
+	end    uint64 // Pc following the last instruction
+	number uint64 // page number in memory
+	gen    uint32
+	epoch  uint64
+	ops    []decoded
+	next   [2]*block // blocks it was last followed by, falling through and jumping
+}
+
+// translate builds the block at pc, stopping before end.
+func (c *decodeCache) translate(m *Memory, pc, end uint64) (*block, error) {
+	p := c.page(m, (pc-m.Base)/PageSize)
+	b := &block{pc: pc, end: pc, number: p.number, gen: p.gen, epoch: c.epoch}
+	for len(b.ops) < MaxBlock && b.end < end && m.Contains(b.end) && (b.end-m.Base)/PageSize == p.number {
+		d, err := p.lookup(m, b.end)
+		if err != nil {
+			if len(b.ops) == 0 {
+				return nil, err
+			}
+			break
+		}
+		b.add(*d)
+		b.end += 4
+		if d.ends {
+			break
+		}
+	}
+	if c.blocks == nil {
+		c.blocks = make(map[uint64]*block)
+	}
+	c.blocks[pc] = b
+	return b, nil
+}
+
+// add appends an instruction, fusing it with the previous one where a pair
+// is common enough to be worth it: lui+addi and auipc+addi loading a
+// constant or an address, and auipc+jalr calling a function.
+func (b *block) add(d decoded) {
+	if len(b.ops) > 0 {
+		prev := &b.ops[len(b.ops)-1]
+		opcode, op := prev.inst&0x7F, d.inst&0x707F
+		if prev.n == 1 && prev.rd != 0 && d.rs1 == prev.rd {
+			switch {
+			case opcode == 0b0110111 && op == 0x13 && d.rd == prev.rd: // lui+addi
+				prev.exec, prev.imm = execLi, prev.imm+d.imm
+			case opcode == 0b0010111 && op == 0x13 && d.rd == prev.rd: // auipc+addi
+				prev.exec, prev.imm = execLa, prev.imm+d.imm
+			case opcode == 0b0010111 && op == 0x67: // auipc+jalr
+				prev.exec, prev.aux, prev.rs1, prev.rd, prev.ends = execCall, d.imm, prev.rd, d.rd, true
+			default:
+				b.ops = append(b.ops, d)
+				return
+			}
+			prev.n = 2
+			return
+		}
+	}
+	b.ops = append(b.ops, d)
+}
+
+func execLi(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = d.imm
+	return cpu.Pc + 8, nil
+}
+
+func execLa(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = cpu.Pc + d.imm
+	return cpu.Pc + 8, nil
+}
+
+func execCall(cpu *CPU, d *decoded) (uint64, error) {
+	t := cpu.Pc + d.imm
+	cpu.Regs[d.rs1] = t
+	cpu.Regs[d.rd] = cpu.Pc + 8
+	return (t + d.aux) &^ 1, nil
+}
+
+// valid reports whether the block still matches memory and the cache.
+func (b *block) valid(m *Memory, c *decodeCache) bool {
+	return b.epoch == c.epoch && m.generation(b.number) == b.gen
+}
+
+// successor returns the block chained to b at pc.
+func (b *block) successor(pc uint64) *block {
+	if b == nil {
+		return nil
+	}
+	if pc == b.end {
+		return b.next[0]
+	}
+	if b.next[1] != nil && b.next[1].pc == pc {
+		return b.next[1]
+	}
+	return nil
+}
+
+func (b *block) chain(next *block) {
+	if b == nil {
+		return
+	}
+	if next.pc == b.end {
+		b.next[0] = next
+	} else {
+		b.next[1] = next
+	}
+}
+
+// run executes at most limit instructions of the block and returns how many
+// it stepped through. A failing instruction is trapped, which counts as a
+// step like it does for Step, and ends the run.
+func (b *block) run(cpu *CPU, limit uint64) (uint64, error) {
+	var ran uint64
+	for i := range b.ops {
+		d := &b.ops[i]
+		if ran+uint64(d.n) > limit {
+			break
+		}
+		next, err := d.exec(cpu, d)
+		cpu.Regs[0] = 0 // x0 is hardwired to zero
+		if err != nil {
+			return ran + 1, cpu.trap(err)
+		}
+		if cpu.Coverage != nil {
+			cpu.cover(cpu.Pc, d.inst, d.n, next)
+		}
+		cpu.Pc = next
+		cpu.Instret += uint64(d.n)
+		ran += uint64(d.n)
+	}
+	return ran, nil
+}
+
+// StepN executes up to n instructions, fewer only when the Pc leaves the
+// image or an instruction fails. Unless Reference is set it runs translated
+// blocks, chained to each other, polling for input every PollInterval
+// instructions and sampling for the Profiler like Step, and checking for
+// interrupts between blocks.
+func (cpu *CPU) StepN(n uint64) error {
+	if cpu.Reference {
+		for ; n > 0; n-- {
+			if err := cpu.Step(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for n > 0 {
+		if err := cpu.poll(); err != nil {
+			return err
+		}
+		cpu.interrupt()
+		cpu.sample()
+		budget := PollInterval - cpu.Instret%PollInterval
+		if cpu.Profiler != nil && cpu.nextSample-cpu.Instret < budget {
+			budget = cpu.nextSample - cpu.Instret
+		}
+		if budget > n {
+			budget = n
+		}
+		ran, err := cpu.runBlocks(budget)
+		n -= ran
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runBlocks executes blocks until budget instructions have been stepped
+// through.
+func (cpu *CPU) runBlocks(budget uint64) (uint64, error) {
+	m, c := cpu.Bus.Mem, &cpu.icache
+	end := ^uint64(0)
+	if cpu.Size != 0 {
+		end = config.KernelBase + cpu.Size
+	}
+	var ran uint64
+	var prev *block
+	for ran < budget {
+		if cpu.ended() {
+			return ran, io.EOF
+		}
+		if cpu.Pc%4 != 0 || !m.Contains(cpu.Pc) {
+			// outside RAM, one instruction at a time
+			if err := cpu.step(); err != nil {
+				return ran, err
+			}
+			ran, prev = ran+1, nil
+			continue
+		}
+		b := prev.successor(cpu.Pc)
+		if b == nil || !b.valid(m, c) {
+			if b = c.blocks[cpu.Pc]; b == nil || !b.valid(m, c) {
+				var err error
+				if b, err = c.translate(m, cpu.Pc, end); err != nil {
+					return ran, err
+				}
+			}
+			prev.chain(b)
+		}
+		if uint64(b.ops[0].n) > budget-ran {
+			// a fused pair straddling the budget
+			if err := cpu.step(); err != nil {
+				return ran, err
+			}
+			ran, prev = ran+1, nil
+			continue
+		}
+		n, err := b.run(cpu, budget-ran)
+		ran += n
+		if err != nil {
+			return ran, err
+		}
+		prev = b
+		if cpu.Csr[Mip]&cpu.Csr[Mie] != 0 && cpu.interrupt() {
+			prev = nil
+		}
+	}
+	return ran, nil
+}
@@ -0,0 +1,75 @@
+package runtime
+
+// Events the performance-monitoring counters count, selected by writing them
+// to mhpmevent3 to mhpmevent31. Other values select no event.
+const (
+	EventLoads         = 1 // loads retired, lr and AMOs included
+	EventStores        = 2 // stores retired, successful sc and AMOs included
+	EventBranches      = 3 // conditional branches retired
+	EventBranchesTaken = 4 // conditional branches taken
+	EventTraps         = 5 // exceptions and interrupts taken
+	numEvents          = 6
+)
+
+// counters lets mcycle, minstret and mhpmcounter3 to mhpmcounter31 live in
+// the CSR array and catch up with Instret and the events lazily, whenever
+// they are accessed or what they count changes. Every instruction takes one
+// cycle.
+type counters struct {
+	instret uint64            // Instret when the counters were last updated
+	events  [numEvents]uint64 // events seen by the hart
+	seen    [numEvents]uint64 // events when the counters were last updated
+}
+
+// updateCounters adds what happened since the last update to the counters
+// that are not inhibited.
+func (cpu *CPU) updateCounters() {
+	c := &cpu.counters
+	c.events[EventTraps] = cpu.Traps
+	inhibit := cpu.Csr[Mcountinhibit]
+	if inhibit&(1<<0) == 0 {
+		cpu.Csr[Mcycle] += cpu.Instret - c.instret
+	}
+	if inhibit&(1<<2) == 0 {
+		cpu.Csr[Minstret] += cpu.Instret - c.instret
+	}
+	for i := uint64(3); i < 32; i++ {
+		if e := cpu.Csr[Mhpmevent3+i-3]; e != 0 && inhibit&(1<<i) == 0 {
+			cpu.Csr[Mhpmcounter3+i-3] += c.events[e] - c.seen[e]
+		}
+	}
+	c.instret, c.seen = cpu.Instret, c.events
+}
+
+// resetCounters makes the counters carry on from their values in the CSR
+// array, as after restoring a snapshot.
+func (cpu *CPU) resetCounters() {
+	cpu.counters.events[EventTraps] = cpu.Traps
+	cpu.counters.instret, cpu.counters.seen = cpu.Instret, cpu.counters.events
+}
+
+// counterEnabled reports whether the current level may read the unprivileged
+// counter i, 0 being cycle, 1 time and 2 instret: always in Machine level,
+// in Supervisor level when mcounteren allows it, and in User level when
+// scounteren does as well.
+func (cpu *CPU) counterEnabled(i uint64) bool {
+	bit := uint64(1) << i
+	switch cpu.Level {
+	case MachineMode:
+		return true
+	case SupervisorMode:
+		return cpu.Csr[Mcounteren]&bit != 0
+	default:
+		return cpu.Csr[Mcounteren]&bit != 0 && cpu.Csr[Scounteren]&bit != 0
+	}
+}
+
+// branch returns the Pc a conditional branch goes on to, counting it.
+func (cpu *CPU) branch(imm uint64, taken bool) uint64 {
+	cpu.counters.events[EventBranches]++
+	if taken {
+		cpu.counters.events[EventBranchesTaken]++
+		return cpu.Pc + imm
+	}
+	return cpu.Pc + 4
+}
@@ -0,0 +1,13 @@
+package runtime
+
+// cover hands the Coverage collector the n instructions that retired at pc,
+// the first of which is inst, and which way a conditional branch went.
+func (cpu *CPU) cover(pc, inst uint64, n uint8, next uint64) {
+	c := cpu.Coverage
+	for i := uint64(0); i < uint64(n); i++ {
+		c.Executed(pc + 4*i)
+	}
+	if inst&0x7F == 0b1100011 {
+		c.Branch(pc, next != pc+4)
+	}
+}
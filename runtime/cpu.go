@@ -3,77 +3,188 @@ package runtime
 import (
 	"fmt"
 	"goemu/config"
-	"goemu/hw/uart"
-	"goemu/util"
+	"goemu/coverage"
+	"goemu/profile"
+	"goemu/replay"
 	"io"
 	"strconv"
 	"strings"
 )
 
 type CPU struct {
-	Regs [32]uint64
-	Pc   uint64
-	Size uint64
-	Bus  Bus
-	Csr  CSR
+	Regs    [32]uint64
+	Pc      uint64
+	Size    uint64 // length of the raw image, execution ends when the Pc leaves it (0 disables)
+	Bus     *Bus   // shared by every hart of the machine
+	Csr     CSR
+	Instret uint64 // number of retired instructions
+	Traps   uint64 // number of exceptions and interrupts taken by the guest
 	Level
+
+	// Reference runs the simple interpreter, fetching and executing each
+	// instruction without decoding caches or translated blocks.
+	Reference bool
+
+	reservation reservation // set by lr, checked by sc
+	waiting     bool        // in wfi until an enabled interrupt is pending
+	counters    counters    // how far the counter CSRs are up to date
+	icache      decodeCache // instructions decoded from RAM
+	loads       hostPage    // RAM page of the last load
+	stores      hostPage    // RAM page of the last store
+	uncached    decoded     // the instruction fetched from elsewhere
+	nextSample  uint64      // Instret the Profiler samples at next
+	stack       []uint64    // reused to walk the frame pointer chain
+
+	Recorder *replay.Recorder    // logs asynchronous input when set
+	Player   *replay.Player      // replays a recorded log instead of live input
+	Handler  TrapHandler         // services exceptions on the host when set
+	Profiler *profile.Profiler   // samples where the guest spends its time when set
+	Coverage *coverage.Collector // records the instructions that retired when set
 }
 
+// NewCPU returns the only hart of a machine running code.
 func NewCPU(code []uint8) *CPU {
-	regs := [32]uint64{}
-	regs[2] = config.KernelEnd
-	mem := make(Memory, config.MemSize)
-	copy(mem, code)
-	u := uart.NewUart()
-
-	return &CPU{
-		Regs: regs,
-		Pc:   config.KernelBase,
-		Size: uint64(len(code)),
-		Bus: Bus{
-			Mem:  &mem,
-			Uart: u,
-		},
-		Level: Machine,
-	}
+	return NewMachine(code, 1).Harts[0]
 }
 
 // Run is a loop that fetches and executes instructions until an end-of-file error is encountered.
 // It returns an error if there is a problem executing an instruction.
 func (cpu *CPU) Run() error {
 	for {
-		inst, err := cpu.Fetch()
-		if err != nil {
+		if err := cpu.StepN(PollInterval); err != nil {
 			if err == io.EOF {
 				return nil
-			} else {
-				panic(err)
 			}
+			return err
 		}
-		err = cpu.Execute(inst)
+	}
+}
+
+// Step delivers pending input and takes a pending interrupt, then fetches and
+// executes a single instruction.
+// It returns io.EOF once the Pc leaves the loaded image.
+func (cpu *CPU) Step() error {
+	if err := cpu.poll(); err != nil {
+		return err
+	}
+	cpu.interrupt()
+	cpu.sample()
+	return cpu.step()
+}
+
+// step executes the instruction at the Pc.
+func (cpu *CPU) step() error {
+	if cpu.Reference {
+		inst, err := cpu.Fetch()
 		if err != nil {
-			util.ParseInst(inst)
-			panic(err)
+			return err
 		}
+		pc := cpu.Pc
+		if err = cpu.Execute(inst); err != nil {
+			return cpu.trap(err)
+		}
+		if cpu.Coverage != nil {
+			cpu.cover(pc, inst, 1, cpu.Pc)
+		}
+		cpu.Instret++
+		return nil
+	}
+	d, err := cpu.fetchDecoded()
+	if err != nil {
+		return err
+	}
+	next, err := d.exec(cpu, d)
+	cpu.Regs[0] = 0 // x0 is hardwired to zero
+	if err != nil {
+		return cpu.trap(err)
+	}
+	if cpu.Coverage != nil {
+		cpu.cover(cpu.Pc, d.inst, d.n, next)
 	}
+	cpu.Pc = next
+	cpu.Instret++
 	return nil
 }
 
 func (cpu *CPU) Fetch() (inst uint64, err error) {
-	if cpu.Pc < config.KernelBase || cpu.Pc >= config.KernelBase+cpu.Size {
+	if cpu.ended() {
 		return 0, io.EOF
 	}
-	return cpu.Bus.Load(cpu.Pc, 4)
+	inst, err = cpu.Bus.Load(cpu.Pc, 4)
+	if e, ok := err.(*Exception); ok {
+		e.Cause = InstAccessFault
+	}
+	return inst, err
+}
+
+// load reads from the bus, directly from host memory when addr is in the
+// page of the previous load.
+func (cpu *CPU) load(addr, bytes uint64) (uint64, error) {
+	if v, ok := cpu.loads.load(addr, bytes); ok {
+		cpu.counters.events[EventLoads]++
+		return v, nil
+	}
+	cpu.loads.fill(cpu.Bus.Mem, addr)
+	v, err := cpu.Bus.Load(addr, bytes)
+	if err == nil {
+		cpu.counters.events[EventLoads]++
+	}
+	return v, err
+}
+
+// store writes to the bus, directly to host memory when addr is in the page
+// of the previous store. Keeping it apart from the page of loads lets a copy
+// between two pages stay off the bus.
+func (cpu *CPU) store(addr, bytes, data uint64) error {
+	if cpu.stores.store(addr, bytes, data) {
+		cpu.counters.events[EventStores]++
+		return nil
+	}
+	cpu.stores.fill(cpu.Bus.Mem, addr)
+	err := cpu.Bus.Store(addr, bytes, data)
+	if err == nil {
+		cpu.counters.events[EventStores]++
+	}
+	return err
+}
+
+// ended reports whether the Pc has left the loaded image.
+func (cpu *CPU) ended() bool {
+	return cpu.Size != 0 && (cpu.Pc < config.KernelBase || cpu.Pc >= config.KernelBase+cpu.Size)
+}
+
+// fetchDecoded returns the instruction at the Pc, from the decode cache when
+// it is in RAM.
+func (cpu *CPU) fetchDecoded() (*decoded, error) {
+	if cpu.ended() {
+		return nil, io.EOF
+	}
+	m := cpu.Bus.Mem
+	if cpu.Pc%4 != 0 || !m.Contains(cpu.Pc) {
+		inst, err := cpu.Fetch()
+		if err != nil {
+			return nil, err
+		}
+		cpu.uncached = decode(inst)
+		return &cpu.uncached, nil
+	}
+	return cpu.icache.lookup(m, cpu.Pc)
 }
 
 func (cpu *CPU) UpdatePC(nextPc *uint64) {
 	cpu.Pc = *nextPc
 }
 
-// Execute function is part of the CPU struct and is responsible for executing a given instruction
-func (cpu *CPU) Execute(inst uint64) error {
+// Execute function is part of the CPU struct and is responsible for executing a given instruction.
+// The Pc is left on the instruction if it fails.
+func (cpu *CPU) Execute(inst uint64) (err error) {
 	nextPc := cpu.Pc + 4 // add 4 by default
-	defer cpu.UpdatePC(&nextPc)
+	defer func() {
+		cpu.Regs[0] = 0 // x0 is hardwired to zero
+		if err == nil {
+			cpu.UpdatePC(&nextPc)
+		}
+	}()
 
 	opcode := uint8(inst & 0x0000007F)
 	rs1 := uint8((inst & 0x000F8000) >> 15)
@@ -84,53 +195,54 @@ func (cpu *CPU) Execute(inst uint64) error {
 	csrAddr := (inst & 0xFFF00000) >> 20
 
 	immI := uint64(int32(inst&0xfff00000) >> 20)
-	immS := (inst&0xFE000000)>>20 | (inst & 0x00000F80 >> 7)
+	immS := uint64(int32(inst&0xFE000000)>>20) | (inst & 0x00000F80 >> 7)
+	shamt := (inst >> 20) & 0x3F
 	immB := uint64(int64(int32(inst&0x80000000)>>19)) | (inst & 0x80 << 4) | (inst >> 20 & 0x7E0) | (inst >> 7 & 0x1E)
 	immJ := uint64((int32(uint64(inst)&0x80000000))>>11) | (uint64(inst) & 0xFF000) | ((inst >> 9) & 0x800) | ((inst >> 20) & 0x7FE)
-	immU := inst & 0xFFFFF000
+	immU := uint64(int32(inst & 0xFFFFF000))
 
 	switch opcode {
 	case 0b0000011:
 		addr := cpu.Regs[rs1] + immI
 		switch funct3 {
 		case 0b000: // lb
-			val, err := cpu.Bus.Load(addr, 1)
+			val, err := cpu.load(addr, 1)
 			if err != nil {
 				return err
 			}
 			cpu.Regs[rd] = uint64(int8(val))
 		case 0b001: // lh
-			val, err := cpu.Bus.Load(addr, 2)
+			val, err := cpu.load(addr, 2)
 			if err != nil {
 				return err
 			}
 			cpu.Regs[rd] = uint64(int16(val))
 		case 0b010: // lw
-			val, err := cpu.Bus.Load(addr, 4)
+			val, err := cpu.load(addr, 4)
 			if err != nil {
 				return err
 			}
 			cpu.Regs[rd] = uint64(int32(val))
 		case 0b011: // ld
-			val, err := cpu.Bus.Load(addr, 8)
+			val, err := cpu.load(addr, 8)
 			if err != nil {
 				return err
 			}
 			cpu.Regs[rd] = val
 		case 0b100: // lbu
-			val, err := cpu.Bus.Load(addr, 1)
+			val, err := cpu.load(addr, 1)
 			if err != nil {
 				return err
 			}
 			cpu.Regs[rd] = val
 		case 0b101: // lhu
-			val, err := cpu.Bus.Load(addr, 2)
+			val, err := cpu.load(addr, 2)
 			if err != nil {
 				return err
 			}
 			cpu.Regs[rd] = val
 		case 0b110: // lwu
-			val, err := cpu.Bus.Load(addr, 4)
+			val, err := cpu.load(addr, 4)
 			if err != nil {
 				return err
 			}
@@ -138,12 +250,21 @@ func (cpu *CPU) Execute(inst uint64) error {
 		default:
 			return NewIllegalInstErr(inst)
 		}
+	case 0b0001111:
+		switch funct3 {
+		case 0b000: // fence
+			// every access to memory is already sequentially consistent
+		case 0b001: // fence.i
+			cpu.icache.flush()
+		default:
+			return NewIllegalInstErr(inst)
+		}
 	case 0b0010011:
 		switch funct3 {
 		case 0b000: // addi
 			cpu.Regs[rd] = cpu.Regs[rs1] + immI
 		case 0b001: // slli
-			cpu.Regs[rd] = cpu.Regs[rd] << uint64(rs2)
+			cpu.Regs[rd] = cpu.Regs[rs1] << shamt
 		case 0b010: // slti
 			if int64(cpu.Regs[rs1]) < int64(immI) {
 				cpu.Regs[rd] = 1
@@ -159,11 +280,11 @@ func (cpu *CPU) Execute(inst uint64) error {
 		case 0b100: // xori
 			cpu.Regs[rd] = cpu.Regs[rs1] ^ immI
 		case 0b101: // srli or srai
-			switch funct7 {
-			case 0b0000000: // srli
-				cpu.Regs[rd] = cpu.Regs[rs1] >> rs2
-			case 0b0100000: // srai
-				cpu.Regs[rd] = uint64(int64(cpu.Regs[rs1]) >> rs2)
+			switch funct7 >> 1 {
+			case 0b000000: // srli
+				cpu.Regs[rd] = cpu.Regs[rs1] >> shamt
+			case 0b010000: // srai
+				cpu.Regs[rd] = uint64(int64(cpu.Regs[rs1]) >> shamt)
 			default:
 				return NewIllegalInstErr(inst)
 			}
@@ -196,43 +317,50 @@ func (cpu *CPU) Execute(inst uint64) error {
 		addr := cpu.Regs[rs1] + immS
 		switch funct3 {
 		case 0b000: // sb
-			err := cpu.Bus.Store(addr, 1, cpu.Regs[rs2])
+			err := cpu.store(addr, 1, cpu.Regs[rs2])
 			if err != nil {
 				return err
 			}
 		case 0b001: // sh
-			err := cpu.Bus.Store(addr, 2, cpu.Regs[rs2])
+			err := cpu.store(addr, 2, cpu.Regs[rs2])
 			if err != nil {
 				return err
 			}
 		case 0b010: // sw
-			err := cpu.Bus.Store(addr, 4, cpu.Regs[rs2])
+			err := cpu.store(addr, 4, cpu.Regs[rs2])
 			if err != nil {
 				return err
 			}
 		case 0b011: // sd
-			err := cpu.Bus.Store(addr, 8, cpu.Regs[rs2])
+			err := cpu.store(addr, 8, cpu.Regs[rs2])
 			if err != nil {
 				return err
 			}
 		default:
 			return NewIllegalInstErr(inst)
 		}
+	case 0b0101111: // atomics
+		return cpu.amo(inst, rd, rs1, rs2, funct3)
 	case 0b0110011:
+		switch {
+		case funct7 == 0b0000001: // mul, mulh, mulhsu, mulhu, div, divu, rem, remu
+			cpu.Regs[rd] = muldiv(uint64(funct3), cpu.Regs[rs1], cpu.Regs[rs2])
+			return nil
+		case funct7 != 0 && funct3 != 0b000 && funct3 != 0b101:
+			return NewIllegalInstErr(inst)
+		}
 		switch funct3 {
 		case 0b000:
 			switch funct7 {
 			case 0b0000000: // add
 				cpu.Regs[rd] = cpu.Regs[rs1] + cpu.Regs[rs2]
-			case 0b0000001: // mul
-				cpu.Regs[rd] = cpu.Regs[rs1] * cpu.Regs[rs2]
 			case 0b0100000: // sub
 				cpu.Regs[rd] = cpu.Regs[rs1] - cpu.Regs[rs2]
 			default:
 				return NewIllegalInstErr(inst)
 			}
 		case 0b001: // sll
-			cpu.Regs[rd] = cpu.Regs[rs1] << rs2
+			cpu.Regs[rd] = cpu.Regs[rs1] << (cpu.Regs[rs2] & 0x3F)
 		case 0b010: // slt
 			if int64(cpu.Regs[rs1]) < int64(cpu.Regs[rs2]) {
 				cpu.Regs[rd] = 1
@@ -250,9 +378,9 @@ func (cpu *CPU) Execute(inst uint64) error {
 		case 0b101:
 			switch funct7 {
 			case 0b0000000: // srl
-				cpu.Regs[rd] = cpu.Regs[rs1] >> rs2
+				cpu.Regs[rd] = cpu.Regs[rs1] >> (cpu.Regs[rs2] & 0x3F)
 			case 0b0100000: // sra
-				cpu.Regs[rd] = uint64(int64(cpu.Regs[rs1]) >> rs2)
+				cpu.Regs[rd] = uint64(int64(cpu.Regs[rs1]) >> (cpu.Regs[rs2] & 0x3F))
 			default:
 				return NewIllegalInstErr(inst)
 			}
@@ -266,6 +394,14 @@ func (cpu *CPU) Execute(inst uint64) error {
 	case 0b0110111: // lui
 		cpu.Regs[rd] = immU
 	case 0b0111011:
+		if funct7 == 0b0000001 { // mulw, divw, divuw, remw, remuw
+			v, ok := muldivw(uint64(funct3), cpu.Regs[rs1], cpu.Regs[rs2])
+			if !ok {
+				return NewIllegalInstErr(inst)
+			}
+			cpu.Regs[rd] = v
+			return nil
+		}
 		switch funct3 {
 		case 0b000:
 			switch funct7 {
@@ -277,30 +413,13 @@ func (cpu *CPU) Execute(inst uint64) error {
 				return NewIllegalInstErr(inst)
 			}
 		case 0b001: // sllw
-			cpu.Regs[rd] = uint64(int32(uint32(cpu.Regs[rs1]) << rs2))
+			cpu.Regs[rd] = uint64(int32(uint32(cpu.Regs[rs1]) << (cpu.Regs[rs2] & 0x1F)))
 		case 0b101:
 			switch funct7 {
 			case 0b0000000: // srlw
-				cpu.Regs[rd] = uint64(int32(uint32(cpu.Regs[rs1]) >> rs2))
-			case 0b0000001: // divu
-				if cpu.Regs[rs2] == 0 { // divisor equals zero
-					cpu.Regs[rd] = 0xFFFFFFFFFFFFFFFF
-				} else {
-					cpu.Regs[rd] = cpu.Regs[rs1] / cpu.Regs[rs2]
-				}
+				cpu.Regs[rd] = uint64(int32(uint32(cpu.Regs[rs1]) >> (cpu.Regs[rs2] & 0x1F)))
 			case 0b0100000: // sraw
-				cpu.Regs[rd] = uint64(int32(cpu.Regs[rs1]) >> int32(rs2))
-			default:
-				return NewIllegalInstErr(inst)
-			}
-		case 0b111:
-			switch funct7 {
-			case 0b0000001: // remuw
-				if cpu.Regs[rs2] == 0 { // divisor equals zero
-					cpu.Regs[rd] = cpu.Regs[rs1]
-				} else {
-					cpu.Regs[rd] = uint64(int32(cpu.Regs[rs1] % cpu.Regs[rs2]))
-				}
+				cpu.Regs[rd] = uint64(int32(cpu.Regs[rs1]) >> (cpu.Regs[rs2] & 0x1F))
 			default:
 				return NewIllegalInstErr(inst)
 			}
@@ -308,34 +427,24 @@ func (cpu *CPU) Execute(inst uint64) error {
 			return NewIllegalInstErr(inst)
 		}
 	case 0b1100011:
+		var taken bool
 		switch funct3 {
 		case 0b000: // beq
-			if cpu.Regs[rs1] == cpu.Regs[rs2] {
-				nextPc = cpu.Pc + immB
-			}
+			taken = cpu.Regs[rs1] == cpu.Regs[rs2]
 		case 0b001: // bne
-			if cpu.Regs[rs1] != cpu.Regs[rs2] {
-				nextPc = cpu.Pc + immB
-			}
+			taken = cpu.Regs[rs1] != cpu.Regs[rs2]
 		case 0b100: // blt
-			if int64(cpu.Regs[rs1]) < int64(cpu.Regs[rs2]) {
-				nextPc = cpu.Pc + immB
-			}
+			taken = int64(cpu.Regs[rs1]) < int64(cpu.Regs[rs2])
 		case 0b101: // bge
-			if int64(cpu.Regs[rs1]) >= int64(cpu.Regs[rs2]) {
-				nextPc = cpu.Pc + immB
-			}
+			taken = int64(cpu.Regs[rs1]) >= int64(cpu.Regs[rs2])
 		case 0b110: // bltu
-			if cpu.Regs[rs1] < cpu.Regs[rs2] {
-				nextPc = cpu.Pc + immB
-			}
+			taken = cpu.Regs[rs1] < cpu.Regs[rs2]
 		case 0b111: // bgeu
-			if cpu.Regs[rs1] >= cpu.Regs[rs2] {
-				nextPc = cpu.Pc + immB
-			}
+			taken = cpu.Regs[rs1] >= cpu.Regs[rs2]
 		default:
 			return NewIllegalInstErr(inst)
 		}
+		nextPc = cpu.branch(immB, taken)
 	case 0b1100111: // jalr
 		t := cpu.Pc + 4
 		imm := uint64(int32(inst&0xFFF00000) >> 20)
@@ -347,8 +456,14 @@ func (cpu *CPU) Execute(inst uint64) error {
 	case 0b1110011:
 		switch funct3 {
 		case 0b000:
-			switch funct7 {
-			case 0b0001000: // sret
+			switch {
+			case funct7 == 0b0000000 && rs2 == 0b00000: // ecall
+				return &Exception{Cause: EcallFromU + uint64(cpu.Level)}
+			case funct7 == 0b0000000 && rs2 == 0b00001: // ebreak
+				return &Exception{Cause: Breakpoint, Tval: cpu.Pc}
+			case funct7 == 0b0001000 && rs2 == 0b00101: // wfi
+				cpu.wfi()
+			case funct7 == 0b0001000: // sret
 				sstatus, err := cpu.Csr.Load(Sstatus)
 				if err != nil {
 					return err
@@ -367,7 +482,7 @@ func (cpu *CPU) Execute(inst uint64) error {
 					return err
 				}
 				nextPc = sepc &^ uint64(0b11)
-			case 0b0011000: // mret
+			case funct7 == 0b0011000: // mret
 				mstatus, err := cpu.Csr.Load(Mstatus)
 				if err != nil {
 					return err
@@ -387,63 +502,71 @@ func (cpu *CPU) Execute(inst uint64) error {
 					return err
 				}
 				nextPc = mepc & ^uint64(0b11)
-			case 0b0001001: //sfence.vma
+			case funct7 == 0b0001001: //sfence.vma
 				return nil
 			default:
 				return NewIllegalInstErr(inst)
 			}
 		case 0b001: // csrrw
-			data, err := cpu.Csr.Load(csrAddr)
+			data, err := cpu.loadCsr(csrAddr, inst)
 			if err != nil {
 				return err
 			}
-			if err = cpu.Csr.Store(csrAddr, cpu.Regs[rs1]); err != nil {
+			if err = cpu.storeCsr(csrAddr, cpu.Regs[rs1], inst); err != nil {
 				return err
 			}
 			cpu.Regs[rd] = data
 		case 0b010: // csrrs
-			data, err := cpu.Csr.Load(csrAddr)
+			data, err := cpu.loadCsr(csrAddr, inst)
 			if err != nil {
 				return err
 			}
-			if err = cpu.Csr.Store(csrAddr, data|cpu.Regs[rs1]); err != nil {
-				return err
+			if rs1 != 0 {
+				if err = cpu.storeCsr(csrAddr, data|cpu.Regs[rs1], inst); err != nil {
+					return err
+				}
 			}
 			cpu.Regs[rd] = data
 		case 0b011: // csrrc
-			data, err := cpu.Csr.Load(csrAddr)
+			data, err := cpu.loadCsr(csrAddr, inst)
 			if err != nil {
 				return err
 			}
-			if err = cpu.Csr.Store(csrAddr, data&(^cpu.Regs[rs1])); err != nil {
-				return err
+			if rs1 != 0 {
+				if err = cpu.storeCsr(csrAddr, data&(^cpu.Regs[rs1]), inst); err != nil {
+					return err
+				}
 			}
 			cpu.Regs[rd] = data
 		case 0b101: // csrrwi
-			data, err := cpu.Csr.Load(csrAddr)
+			data, err := cpu.loadCsr(csrAddr, inst)
 			if err != nil {
 				return err
 			}
-			cpu.Regs[rd] = data
-			if err = cpu.Csr.Store(csrAddr, uint64(rs1)); err != nil {
+			if err = cpu.storeCsr(csrAddr, uint64(rs1), inst); err != nil {
 				return err
 			}
+			cpu.Regs[rd] = data
 		case 0b110: // csrrsi
-			data, err := cpu.Csr.Load(csrAddr)
+			data, err := cpu.loadCsr(csrAddr, inst)
 			if err != nil {
 				return err
 			}
-			if err = cpu.Csr.Store(csrAddr, data|uint64(rs1)); err != nil {
-				return err
+			if rs1 != 0 {
+				if err = cpu.storeCsr(csrAddr, data|uint64(rs1), inst); err != nil {
+					return err
+				}
 			}
 			cpu.Regs[rd] = data
 		case 0b111: // csrrci
-			data, err := cpu.Csr.Load(csrAddr)
+			data, err := cpu.loadCsr(csrAddr, inst)
 			if err != nil {
 				return err
 			}
-			if err = cpu.Csr.Store(csrAddr, data&(^uint64(rs1))); err != nil {
-				return err
+			if rs1 != 0 {
+				if err = cpu.storeCsr(csrAddr, data&(^uint64(rs1)), inst); err != nil {
+					return err
+				}
 			}
 			cpu.Regs[rd] = data
 		default:
@@ -491,6 +614,8 @@ func (cpu *CPU) debug(inst uint32) {
 	fmt.Printf("inst: %032b, Pc: %032b\n", inst, cpu.Pc)
 }
 
+// NewIllegalInstErr returns the illegal instruction exception for inst, which
+// the guest takes with the instruction bits in mtval.
 func NewIllegalInstErr(inst uint64) error {
-	return fmt.Errorf("unknown instruction format: %x", inst)
+	return &Exception{Cause: IllegalInst, Tval: inst}
 }
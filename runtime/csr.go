@@ -5,9 +5,9 @@ import "fmt"
 type Level uint8
 
 const (
-	User       Level = 0b00
-	Supervisor Level = 0b01
-	Machine    Level = 0b11
+	UserMode       Level = 0b00
+	SupervisorMode Level = 0b01
+	MachineMode    Level = 0b11
 )
 
 // Machine Level CSRs
@@ -37,6 +37,26 @@ const (
 	Mip      = 0x344 // Machine interrupt pending
 	Mtinst   = 0x34A // Machine trap instruction (transformed)
 	Mtval2   = 0x34B // Machine bad guest physical address
+
+	// Machine Counter/Timers
+	Mcycle        = 0xB00 // Machine cycle counter
+	Minstret      = 0xB02 // Machine instructions-retired counter
+	Mhpmcounter3  = 0xB03 // Machine performance-monitoring counter
+	Mhpmcounter31 = 0xB1F
+
+	// Machine Counter Setup
+	Mcountinhibit = 0x320 // Machine counter-inhibit register
+	Mhpmevent3    = 0x323 // Machine performance-monitoring event selector
+	Mhpmevent31   = 0x33F
+)
+
+// Unprivileged counters and timers
+const (
+	Cycle        = 0xC00 // Cycle counter for RDCYCLE instruction
+	Time         = 0xC01 // Timer for RDTIME instruction
+	Instret      = 0xC02 // Instructions-retired counter for RDINSTRET instruction
+	Hpmcounter3  = 0xC03 // Performance-monitoring counter
+	Hpmcounter31 = 0xC1F
 )
 
 // Supervisor Level CSRs
@@ -86,6 +106,16 @@ const (
 	SstatusMask uint64 = SieMask | SpieMask | UbeMask | SppMask | FsMask | XsMask | SumMask | MxrMask | UxlMask | SdMask
 )
 
+// Mip and Mie fields
+const (
+	SsipMask = 1 << 1
+	MsipMask = 1 << 3
+	StipMask = 1 << 5
+	MtipMask = 1 << 7
+	SeipMask = 1 << 9
+	MeipMask = 1 << 11
+)
+
 const CsrNum = 0xFFF + 1
 
 type CSR [CsrNum]uint64
@@ -119,8 +149,82 @@ func (c *CSR) Store(addr, data uint64) error {
 		(*c)[Mip] = ((*c)[Mip] & ^(*c)[Mideleg]) | (data & (*c)[Mideleg])
 	case Sstatus:
 		(*c)[Mstatus] = ((*c)[Mstatus] & ^SstatusMask) | (data & SstatusMask)
+	case Mhartid:
+		// read-only
 	default:
 		(*c)[addr] = data
 	}
 	return nil
 }
+
+// loadCsr reads a CSR on behalf of the hart executing inst, which may not read
+// the counters that are not enabled for its level.
+func (cpu *CPU) loadCsr(addr, inst uint64) (uint64, error) {
+	if addr >= Cycle && addr <= Hpmcounter31 && !cpu.counterEnabled(addr-Cycle) {
+		return 0, NewIllegalInstErr(inst)
+	}
+	return cpu.ReadCsr(addr)
+}
+
+// ReadCsr reads a CSR at any level, bringing the counters up to date first
+// and reading the time from the CLINT.
+func (cpu *CPU) ReadCsr(addr uint64) (uint64, error) {
+	switch {
+	case addr == Time:
+		cpu.Bus.lock()
+		defer cpu.Bus.unlock()
+		return cpu.Bus.Clint.Clock.Now(), nil
+	case addr >= Cycle && addr <= Hpmcounter31:
+		cpu.updateCounters()
+		return cpu.Csr[addr-Cycle+Mcycle], nil
+	case addr >= Mcycle && addr <= Mhpmcounter31:
+		cpu.updateCounters()
+	}
+	return cpu.Csr.Load(addr)
+}
+
+// WriteCsr writes a CSR from outside the hart, as a debugger does: no
+// instruction retires, so a counter holds exactly what is written.
+func (cpu *CPU) WriteCsr(addr, data uint64) error {
+	cpu.updateCounters()
+	if addr == Satp {
+		cpu.icache.flush()
+	}
+	return cpu.Csr.Store(addr, data)
+}
+
+// storeCsr writes a CSR on behalf of the hart. The CSRs whose top two address
+// bits are set, the user counters and mhartid among them, are read-only. A new
+// satp changes what the decoded instructions were fetched from. The counters
+// are brought up to date before they or what they count change.
+func (cpu *CPU) storeCsr(addr, data, inst uint64) error {
+	switch {
+	case addr>>10 == 3:
+		return NewIllegalInstErr(inst)
+	case addr == Satp:
+		cpu.icache.flush()
+	case addr == Mcycle, addr == Minstret:
+		cpu.updateCounters()
+		// the write takes effect after the writing instruction retires
+		if bit := uint64(1) << (addr - Mcycle); cpu.Csr[Mcountinhibit]&bit == 0 {
+			data--
+		}
+	case addr >= Mhpmcounter3 && addr <= Mhpmcounter31:
+		cpu.updateCounters()
+	case addr == Mcountinhibit:
+		cpu.updateCounters()
+		data &^= 1 << 1 // time cannot be inhibited
+	case addr >= Mhpmevent3 && addr <= Mhpmevent31:
+		cpu.updateCounters()
+		if data >= numEvents {
+			data = 0
+		}
+	case addr == Mcounteren, addr == Scounteren:
+		data &= 0xFFFFFFFF
+	}
+	return cpu.Csr.Store(addr, data)
+}
+
+func (cpu *CPU) hartid() int {
+	return int(cpu.Csr[Mhartid])
+}
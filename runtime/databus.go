@@ -1,34 +1,170 @@
 package runtime
 
 import (
-	"fmt"
-	"goemu/config"
+	"errors"
+	"goemu/hw/clint"
+	"goemu/hw/fb"
+	"goemu/hw/pci"
+	"goemu/hw/plic"
+	"goemu/hw/rtc"
 	"goemu/hw/uart"
+	"goemu/hw/virtio"
+	"sync"
 )
 
 type Bus struct {
-	Mem  *Memory
-	Uart *uart.Uart
+	Mem    *Memory
+	Uart   *uart.Uart   // the console, first of Uarts
+	Uarts  []*uart.Uart // in address order
+	Clint  *clint.Clint
+	Plic   *plic.Plic
+	Rtc    *rtc.Rtc
+	Virtio []*virtio.MMIO // in slot order
+
+	Framebuffer *fb.Framebuffer // nil without a display
+
+	Pci       *pci.Host     // nil without PCI devices
+	VirtioPCI []*virtio.PCI // in the order plugged
+
+	mu       sync.Mutex // serializes device accesses while harts run in parallel
+	parallel bool
+}
+
+// lock takes the device lock when harts run in parallel. RAM is not covered.
+func (b *Bus) lock() {
+	if b.parallel {
+		b.mu.Lock()
+	}
+}
+
+func (b *Bus) unlock() {
+	if b.parallel {
+		b.mu.Unlock()
+	}
+}
+
+// AddVirtio plugs dev into the next free virtio-mmio slot.
+func (b *Bus) AddVirtio(dev virtio.Device) (*virtio.MMIO, error) {
+	i := len(b.Virtio)
+	if i == virtio.Slots {
+		return nil, errors.New("no free virtio slot")
+	}
+	m := virtio.NewMMIO(virtio.Base+uint64(i)*virtio.Size, dev, b.Mem, func(high bool) {
+		b.Plic.SetLevel(virtio.Irq+i, high)
+	})
+	b.Virtio = append(b.Virtio, m)
+	return m, nil
+}
+
+// AddPCI returns the PCI host bridge, adding it first if there is none.
+// Its INTx interrupts go to the PLIC.
+func (b *Bus) AddPCI() *pci.Host {
+	if b.Pci == nil {
+		b.Pci = pci.NewHost(func(source int, high bool) {
+			b.Plic.SetLevel(source, high)
+		})
+	}
+	return b.Pci
+}
+
+// AddVirtioPCI plugs dev into the next free slot of the PCI bus.
+func (b *Bus) AddVirtioPCI(dev virtio.Device) (*virtio.PCI, error) {
+	p := virtio.NewPCI(dev, b.Mem)
+	if _, err := b.AddPCI().Plug(p.Function); err != nil {
+		return nil, err
+	}
+	b.VirtioPCI = append(b.VirtioPCI, p)
+	return p, nil
+}
+
+// VirtioDevices returns the virtio-mmio devices in slot order followed by
+// the virtio-pci ones, which is how recorded input refers to them.
+func (b *Bus) VirtioDevices() []virtio.Device {
+	var devs []virtio.Device
+	for _, v := range b.Virtio {
+		devs = append(devs, v.Device)
+	}
+	for _, v := range b.VirtioPCI {
+		devs = append(devs, v.Device)
+	}
+	return devs
+}
+
+// AddUart maps another UART after the last one.
+func (b *Bus) AddUart() (*uart.Uart, error) {
+	i := len(b.Uarts)
+	if i == uart.Max {
+		return nil, errors.New("no free uart")
+	}
+	u := uart.NewUart(uart.Base + uint64(i)*uart.Size)
+	u.In = nil
+	u.Irq = func(high bool) {
+		b.Plic.SetLevel(uart.IrqOf(i), high)
+	}
+	b.Uarts = append(b.Uarts, u)
+	return u, nil
 }
 
 func (b *Bus) Load(addr, bytes uint64) (uint64, error) {
+	if b.Mem.Contains(addr) {
+		return b.Mem.Load(addr, bytes)
+	}
+	b.lock()
+	defer b.unlock()
+	return b.load(addr, bytes)
+}
+
+func (b *Bus) Store(addr, bytes, data uint64) error {
+	if b.Mem.Contains(addr) {
+		return b.Mem.Store(addr, bytes, data)
+	}
+	b.lock()
+	defer b.unlock()
+	return b.store(addr, bytes, data)
+}
+
+func (b *Bus) load(addr, bytes uint64) (uint64, error) {
 	switch {
-	case addr >= config.KernelBase && addr <= config.KernelEnd:
+	case b.Mem.Contains(addr):
 		return b.Mem.Load(addr, bytes)
-	case addr >= uart.Base && addr < uart.End:
-		return b.Uart.Load(addr, bytes)
+	case addr >= uart.Base && addr < uart.Base+uint64(len(b.Uarts))*uart.Size:
+		return b.Uarts[(addr-uart.Base)/uart.Size].Load(addr, bytes)
+	case addr >= clint.Base && addr <= clint.End:
+		return b.Clint.Load(addr, bytes)
+	case addr >= plic.Base && addr <= plic.End:
+		return b.Plic.Load(addr, bytes)
+	case addr >= b.Rtc.Base && addr < b.Rtc.Base+rtc.Size:
+		return b.Rtc.Load(addr, bytes)
+	case addr >= virtio.Base && addr < virtio.Base+uint64(len(b.Virtio))*virtio.Size:
+		return b.Virtio[(addr-virtio.Base)/virtio.Size].Load(addr, bytes)
+	case b.Framebuffer != nil && b.Framebuffer.Contains(addr):
+		return b.Framebuffer.Load(addr, bytes)
+	case b.Pci != nil && b.Pci.Contains(addr):
+		return b.Pci.Load(addr, bytes)
 	default:
-		return 0, fmt.Errorf("invalid memory address: %x", addr)
+		return 0, &Exception{Cause: LoadAccessFault, Tval: addr}
 	}
 }
 
-func (b *Bus) Store(addr, bytes, data uint64) error {
+func (b *Bus) store(addr, bytes, data uint64) error {
 	switch {
-	case addr >= config.KernelBase && addr <= config.KernelEnd:
+	case b.Mem.Contains(addr):
 		return b.Mem.Store(addr, bytes, data)
-	case addr >= uart.Base && addr < uart.End:
-		return b.Uart.Store(addr, bytes, data)
+	case addr >= uart.Base && addr < uart.Base+uint64(len(b.Uarts))*uart.Size:
+		return b.Uarts[(addr-uart.Base)/uart.Size].Store(addr, bytes, data)
+	case addr >= clint.Base && addr <= clint.End:
+		return b.Clint.Store(addr, bytes, data)
+	case addr >= plic.Base && addr <= plic.End:
+		return b.Plic.Store(addr, bytes, data)
+	case addr >= b.Rtc.Base && addr < b.Rtc.Base+rtc.Size:
+		return b.Rtc.Store(addr, bytes, data)
+	case addr >= virtio.Base && addr < virtio.Base+uint64(len(b.Virtio))*virtio.Size:
+		return b.Virtio[(addr-virtio.Base)/virtio.Size].Store(addr, bytes, data)
+	case b.Framebuffer != nil && b.Framebuffer.Contains(addr):
+		return b.Framebuffer.Store(addr, bytes, data)
+	case b.Pci != nil && b.Pci.Contains(addr):
+		return b.Pci.Store(addr, bytes, data)
 	default:
-		return fmt.Errorf("invalid memory address: %x", addr)
+		return &Exception{Cause: StoreAccessFault, Tval: addr}
 	}
 }
@@ -0,0 +1,575 @@
+package runtime
+
+import "sync/atomic"
+
+// handler executes a decoded instruction at the Pc and returns the Pc of the
+// next one. The Pc is left on the instruction if it fails.
+type handler func(cpu *CPU, d *decoded) (uint64, error)
+
+// decoded is an instruction with its operands extracted once, so running it
+// again only calls its handler.
+type decoded struct {
+	exec handler
+	inst uint64
+	imm  uint64 // the immediate of the format, or the shift amount
+	aux  uint64 // the immediate of the second instruction of a fused pair
+	gen  uint32 // generation of the page it was decoded in
+	rd   uint8
+	rs1  uint8
+	rs2  uint8
+	n    uint8 // instructions covered, 2 for a fused pair
+	ends bool  // ends a basic block
+}
+
+// decodedPage holds the instructions decoded from one physical page, each
+// valid while its generation is that of the page.
+type decodedPage struct {
+	number uint64
+	gen    uint32
+	insts  [PageSize / 4]decoded
+}
+
+// decodeCache is the decoded instruction cache of a hart, filled as the
+// instructions are first executed. Stores to a page, by any hart or device,
+// invalidate the instructions decoded from it when they hit a line holding
+// one, so data next to code does not keep throwing the code away.
+type decodeCache struct {
+	pages  map[uint64]*decodedPage
+	last   *decodedPage      // page of the previous lookup
+	blocks map[uint64]*block // translated blocks by their first Pc
+	epoch  uint64            // number of flushes, blocks of an earlier one are stale
+}
+
+// flush drops every decoded instruction, as fence.i and a change of satp do.
+func (c *decodeCache) flush() {
+	c.pages = nil
+	c.last = nil
+	c.blocks = nil
+	c.epoch++
+}
+
+// page returns the decoded page of a page number in m, current with its
+// generation.
+func (c *decodeCache) page(m *Memory, number uint64) *decodedPage {
+	p := c.last
+	if p == nil || p.number != number {
+		if p = c.pages[number]; p == nil {
+			if c.pages == nil {
+				c.pages = make(map[uint64]*decodedPage)
+			}
+			p = &decodedPage{number: number}
+			c.pages[number] = p
+		}
+		c.last = p
+	}
+	p.gen = m.generation(number)
+	return p
+}
+
+// lookup returns the decoded instruction at the address pc in m, which must
+// be aligned.
+func (c *decodeCache) lookup(m *Memory, pc uint64) (*decoded, error) {
+	return c.page(m, (pc-m.Base)/PageSize).lookup(m, pc)
+}
+
+func (p *decodedPage) lookup(m *Memory, pc uint64) (*decoded, error) {
+	d := &p.insts[(pc-m.Base)%PageSize/4]
+	if d.exec == nil || d.gen != p.gen {
+		m.watch(pc - m.Base)
+		inst, err := m.Load(pc, 4)
+		if err != nil {
+			return nil, err
+		}
+		*d = decode(inst)
+		d.gen = p.gen
+	}
+	return d, nil
+}
+
+// codeLine is the granularity at which stores are checked against decoded
+// instructions, one bit of a page mask per line.
+const codeLine = PageSize / 64
+
+// watch marks the line at index as holding a decoded instruction, before the
+// instruction is read. The next store to the line advances the generation of
+// its page.
+func (m *Memory) watch(index uint64) {
+	p, bit := &m.code[index/PageSize], uint64(1)<<(index%PageSize/codeLine)
+	for {
+		old := atomic.LoadUint64(p)
+		if old&bit != 0 || atomic.CompareAndSwapUint64(p, old, old|bit) {
+			return
+		}
+	}
+}
+
+func (m *Memory) generation(number uint64) uint32 {
+	return atomic.LoadUint32(&m.gen[number])
+}
+
+// written advances the generation of the pages with watched lines in a range
+// that has just been stored to.
+func (m *Memory) written(index, bytes uint64) {
+	last := index + bytes - 1
+	for n := index / PageSize; n <= last/PageSize; n++ {
+		first, end := uint64(0), uint64(PageSize/codeLine-1)
+		if n == index/PageSize {
+			first = index % PageSize / codeLine
+		}
+		if n == last/PageSize {
+			end = last % PageSize / codeLine
+		}
+		lines := (^uint64(0) >> (63 - end)) &^ (1<<first - 1)
+		if atomic.LoadUint64(&m.code[n])&lines != 0 {
+			atomic.StoreUint64(&m.code[n], 0)
+			atomic.AddUint32(&m.gen[n], 1)
+		}
+	}
+}
+
+// decode extracts the operands of an instruction and picks its handler.
+// Instructions without a handler of their own go through Execute and end the
+// basic block, as they may change anything.
+func decode(inst uint64) decoded {
+	d := decoded{
+		inst: inst,
+		n:    1,
+		rd:   uint8((inst >> 7) & 0x1F),
+		rs1:  uint8((inst >> 15) & 0x1F),
+		rs2:  uint8((inst >> 20) & 0x1F),
+	}
+	opcode := inst & 0x7F
+	funct3 := (inst >> 12) & 0x7
+	funct7 := inst >> 25
+	immI := uint64(int32(inst&0xFFF00000) >> 20)
+	shamt := (inst >> 20) & 0x3F
+
+	switch opcode {
+	case 0b0000011:
+		d.imm = immI
+		switch funct3 {
+		case 0b000:
+			d.exec = execLb
+		case 0b001:
+			d.exec = execLh
+		case 0b010:
+			d.exec = execLw
+		case 0b011:
+			d.exec = execLd
+		case 0b100:
+			d.exec = execLbu
+		case 0b101:
+			d.exec = execLhu
+		case 0b110:
+			d.exec = execLwu
+		}
+	case 0b0010011:
+		d.imm = immI
+		switch {
+		case funct3 == 0b000:
+			d.exec = execAddi
+		case funct3 == 0b001 && funct7>>1 == 0:
+			d.imm, d.exec = shamt, execSlli
+		case funct3 == 0b010:
+			d.exec = execSlti
+		case funct3 == 0b011:
+			d.exec = execSltiu
+		case funct3 == 0b100:
+			d.exec = execXori
+		case funct3 == 0b101 && funct7>>1 == 0b000000:
+			d.imm, d.exec = shamt, execSrli
+		case funct3 == 0b101 && funct7>>1 == 0b010000:
+			d.imm, d.exec = shamt, execSrai
+		case funct3 == 0b110:
+			d.exec = execOri
+		case funct3 == 0b111:
+			d.exec = execAndi
+		}
+	case 0b0010111:
+		d.imm, d.exec = uint64(int32(inst&0xFFFFF000)), execAuipc
+	case 0b0011011:
+		d.imm = immI
+		switch {
+		case funct3 == 0b000:
+			d.exec = execAddiw
+		case funct3 == 0b001 && funct7 == 0:
+			d.imm, d.exec = shamt, execSlliw
+		case funct3 == 0b101 && funct7 == 0b0000000:
+			d.imm, d.exec = shamt, execSrliw
+		case funct3 == 0b101 && funct7 == 0b0100000:
+			d.imm, d.exec = shamt, execSraiw
+		}
+	case 0b0100011:
+		d.imm = (inst&0xFE000000)>>20 | (inst>>7)&0x1F
+		d.imm = uint64(int64(d.imm<<52) >> 52)
+		switch funct3 {
+		case 0b000:
+			d.exec = execSb
+		case 0b001:
+			d.exec = execSh
+		case 0b010:
+			d.exec = execSw
+		case 0b011:
+			d.exec = execSd
+		}
+	case 0b0110011:
+		switch funct7<<3 | funct3 {
+		case 0b0000000_000:
+			d.exec = execAdd
+		case 0b0100000_000:
+			d.exec = execSub
+		case 0b0000001_000:
+			d.exec = execMul
+		case 0b0000001_001, 0b0000001_010, 0b0000001_011, 0b0000001_100, 0b0000001_101, 0b0000001_110, 0b0000001_111:
+			d.imm, d.exec = funct3, execMulDiv
+		case 0b0000000_001:
+			d.exec = execSll
+		case 0b0000000_010:
+			d.exec = execSlt
+		case 0b0000000_011:
+			d.exec = execSltu
+		case 0b0000000_100:
+			d.exec = execXor
+		case 0b0000000_101:
+			d.exec = execSrl
+		case 0b0100000_101:
+			d.exec = execSra
+		case 0b0000000_110:
+			d.exec = execOr
+		case 0b0000000_111:
+			d.exec = execAnd
+		}
+	case 0b0110111:
+		d.imm, d.exec = uint64(int32(inst&0xFFFFF000)), execLui
+	case 0b0111011:
+		switch funct7<<3 | funct3 {
+		case 0b0000000_000:
+			d.exec = execAddw
+		case 0b0100000_000:
+			d.exec = execSubw
+		case 0b0000000_001:
+			d.exec = execSllw
+		case 0b0000000_101:
+			d.exec = execSrlw
+		case 0b0100000_101:
+			d.exec = execSraw
+		case 0b0000001_000, 0b0000001_100, 0b0000001_101, 0b0000001_110, 0b0000001_111:
+			d.imm, d.exec = funct3, execMulDivw
+		}
+	case 0b1100011:
+		d.imm = uint64(int64(int32(inst&0x80000000)>>19)) | (inst&0x80)<<4 | (inst>>20)&0x7E0 | (inst>>7)&0x1E
+		d.ends = true
+		switch funct3 {
+		case 0b000:
+			d.exec = execBeq
+		case 0b001:
+			d.exec = execBne
+		case 0b100:
+			d.exec = execBlt
+		case 0b101:
+			d.exec = execBge
+		case 0b110:
+			d.exec = execBltu
+		case 0b111:
+			d.exec = execBgeu
+		}
+	case 0b1100111:
+		if funct3 == 0 {
+			d.imm, d.exec, d.ends = immI, execJalr, true
+		}
+	case 0b1101111:
+		d.imm = uint64(int32(inst&0x80000000)>>11) | inst&0xFF000 | (inst>>9)&0x800 | (inst>>20)&0x7FE
+		d.exec, d.ends = execJal, true
+	}
+	if d.exec == nil {
+		d.exec, d.ends = execSlow, true
+	}
+	return d
+}
+
+func execSlow(cpu *CPU, d *decoded) (uint64, error) {
+	err := cpu.Execute(d.inst)
+	return cpu.Pc, err
+}
+
+func execLb(cpu *CPU, d *decoded) (uint64, error) {
+	v, err := cpu.load(cpu.Regs[d.rs1]+d.imm, 1)
+	if err != nil {
+		return cpu.Pc, err
+	}
+	cpu.Regs[d.rd] = uint64(int8(v))
+	return cpu.Pc + 4, nil
+}
+
+func execLh(cpu *CPU, d *decoded) (uint64, error) {
+	v, err := cpu.load(cpu.Regs[d.rs1]+d.imm, 2)
+	if err != nil {
+		return cpu.Pc, err
+	}
+	cpu.Regs[d.rd] = uint64(int16(v))
+	return cpu.Pc + 4, nil
+}
+
+func execLw(cpu *CPU, d *decoded) (uint64, error) {
+	v, err := cpu.load(cpu.Regs[d.rs1]+d.imm, 4)
+	if err != nil {
+		return cpu.Pc, err
+	}
+	cpu.Regs[d.rd] = uint64(int32(v))
+	return cpu.Pc + 4, nil
+}
+
+func execLd(cpu *CPU, d *decoded) (uint64, error) {
+	v, err := cpu.load(cpu.Regs[d.rs1]+d.imm, 8)
+	if err != nil {
+		return cpu.Pc, err
+	}
+	cpu.Regs[d.rd] = v
+	return cpu.Pc + 4, nil
+}
+
+func execLbu(cpu *CPU, d *decoded) (uint64, error) {
+	v, err := cpu.load(cpu.Regs[d.rs1]+d.imm, 1)
+	if err != nil {
+		return cpu.Pc, err
+	}
+	cpu.Regs[d.rd] = v
+	return cpu.Pc + 4, nil
+}
+
+func execLhu(cpu *CPU, d *decoded) (uint64, error) {
+	v, err := cpu.load(cpu.Regs[d.rs1]+d.imm, 2)
+	if err != nil {
+		return cpu.Pc, err
+	}
+	cpu.Regs[d.rd] = v
+	return cpu.Pc + 4, nil
+}
+
+func execLwu(cpu *CPU, d *decoded) (uint64, error) {
+	v, err := cpu.load(cpu.Regs[d.rs1]+d.imm, 4)
+	if err != nil {
+		return cpu.Pc, err
+	}
+	cpu.Regs[d.rd] = v
+	return cpu.Pc + 4, nil
+}
+
+func execStore(cpu *CPU, d *decoded, bytes uint64) (uint64, error) {
+	if err := cpu.store(cpu.Regs[d.rs1]+d.imm, bytes, cpu.Regs[d.rs2]); err != nil {
+		return cpu.Pc, err
+	}
+	return cpu.Pc + 4, nil
+}
+
+func execSb(cpu *CPU, d *decoded) (uint64, error) { return execStore(cpu, d, 1) }
+func execSh(cpu *CPU, d *decoded) (uint64, error) { return execStore(cpu, d, 2) }
+func execSw(cpu *CPU, d *decoded) (uint64, error) { return execStore(cpu, d, 4) }
+func execSd(cpu *CPU, d *decoded) (uint64, error) { return execStore(cpu, d, 8) }
+
+func b2u(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func execAddi(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = cpu.Regs[d.rs1] + d.imm
+	return cpu.Pc + 4, nil
+}
+
+func execSlli(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = cpu.Regs[d.rs1] << d.imm
+	return cpu.Pc + 4, nil
+}
+
+func execSlti(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = b2u(int64(cpu.Regs[d.rs1]) < int64(d.imm))
+	return cpu.Pc + 4, nil
+}
+
+func execSltiu(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = b2u(cpu.Regs[d.rs1] < d.imm)
+	return cpu.Pc + 4, nil
+}
+
+func execXori(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = cpu.Regs[d.rs1] ^ d.imm
+	return cpu.Pc + 4, nil
+}
+
+func execSrli(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = cpu.Regs[d.rs1] >> d.imm
+	return cpu.Pc + 4, nil
+}
+
+func execSrai(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = uint64(int64(cpu.Regs[d.rs1]) >> d.imm)
+	return cpu.Pc + 4, nil
+}
+
+func execOri(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = cpu.Regs[d.rs1] | d.imm
+	return cpu.Pc + 4, nil
+}
+
+func execAndi(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = cpu.Regs[d.rs1] & d.imm
+	return cpu.Pc + 4, nil
+}
+
+func execAuipc(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = cpu.Pc + d.imm
+	return cpu.Pc + 4, nil
+}
+
+func execLui(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = d.imm
+	return cpu.Pc + 4, nil
+}
+
+func execAddiw(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = uint64(int32(cpu.Regs[d.rs1] + d.imm))
+	return cpu.Pc + 4, nil
+}
+
+func execSlliw(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = uint64(int32(cpu.Regs[d.rs1] << d.imm))
+	return cpu.Pc + 4, nil
+}
+
+func execSrliw(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = uint64(int32(uint32(cpu.Regs[d.rs1]) >> d.imm))
+	return cpu.Pc + 4, nil
+}
+
+func execSraiw(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = uint64(int32(cpu.Regs[d.rs1]) >> d.imm)
+	return cpu.Pc + 4, nil
+}
+
+func execAdd(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = cpu.Regs[d.rs1] + cpu.Regs[d.rs2]
+	return cpu.Pc + 4, nil
+}
+
+func execSub(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = cpu.Regs[d.rs1] - cpu.Regs[d.rs2]
+	return cpu.Pc + 4, nil
+}
+
+func execMul(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = cpu.Regs[d.rs1] * cpu.Regs[d.rs2]
+	return cpu.Pc + 4, nil
+}
+
+func execMulDiv(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = muldiv(d.imm, cpu.Regs[d.rs1], cpu.Regs[d.rs2])
+	return cpu.Pc + 4, nil
+}
+
+func execSll(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = cpu.Regs[d.rs1] << (cpu.Regs[d.rs2] & 0x3F)
+	return cpu.Pc + 4, nil
+}
+
+func execSlt(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = b2u(int64(cpu.Regs[d.rs1]) < int64(cpu.Regs[d.rs2]))
+	return cpu.Pc + 4, nil
+}
+
+func execSltu(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = b2u(cpu.Regs[d.rs1] < cpu.Regs[d.rs2])
+	return cpu.Pc + 4, nil
+}
+
+func execXor(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = cpu.Regs[d.rs1] ^ cpu.Regs[d.rs2]
+	return cpu.Pc + 4, nil
+}
+
+func execSrl(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = cpu.Regs[d.rs1] >> (cpu.Regs[d.rs2] & 0x3F)
+	return cpu.Pc + 4, nil
+}
+
+func execSra(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = uint64(int64(cpu.Regs[d.rs1]) >> (cpu.Regs[d.rs2] & 0x3F))
+	return cpu.Pc + 4, nil
+}
+
+func execOr(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = cpu.Regs[d.rs1] | cpu.Regs[d.rs2]
+	return cpu.Pc + 4, nil
+}
+
+func execAnd(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = cpu.Regs[d.rs1] & cpu.Regs[d.rs2]
+	return cpu.Pc + 4, nil
+}
+
+func execAddw(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = uint64(int32(cpu.Regs[d.rs1] + cpu.Regs[d.rs2]))
+	return cpu.Pc + 4, nil
+}
+
+func execSubw(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = uint64(int32(cpu.Regs[d.rs1] - cpu.Regs[d.rs2]))
+	return cpu.Pc + 4, nil
+}
+
+func execMulDivw(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd], _ = muldivw(d.imm, cpu.Regs[d.rs1], cpu.Regs[d.rs2])
+	return cpu.Pc + 4, nil
+}
+
+func execSllw(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = uint64(int32(uint32(cpu.Regs[d.rs1]) << (cpu.Regs[d.rs2] & 0x1F)))
+	return cpu.Pc + 4, nil
+}
+
+func execSrlw(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = uint64(int32(uint32(cpu.Regs[d.rs1]) >> (cpu.Regs[d.rs2] & 0x1F)))
+	return cpu.Pc + 4, nil
+}
+
+func execSraw(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = uint64(int32(cpu.Regs[d.rs1]) >> (cpu.Regs[d.rs2] & 0x1F))
+	return cpu.Pc + 4, nil
+}
+
+func execBeq(cpu *CPU, d *decoded) (uint64, error) {
+	return cpu.branch(d.imm, cpu.Regs[d.rs1] == cpu.Regs[d.rs2]), nil
+}
+
+func execBne(cpu *CPU, d *decoded) (uint64, error) {
+	return cpu.branch(d.imm, cpu.Regs[d.rs1] != cpu.Regs[d.rs2]), nil
+}
+
+func execBlt(cpu *CPU, d *decoded) (uint64, error) {
+	return cpu.branch(d.imm, int64(cpu.Regs[d.rs1]) < int64(cpu.Regs[d.rs2])), nil
+}
+
+func execBge(cpu *CPU, d *decoded) (uint64, error) {
+	return cpu.branch(d.imm, int64(cpu.Regs[d.rs1]) >= int64(cpu.Regs[d.rs2])), nil
+}
+
+func execBltu(cpu *CPU, d *decoded) (uint64, error) {
+	return cpu.branch(d.imm, cpu.Regs[d.rs1] < cpu.Regs[d.rs2]), nil
+}
+
+func execBgeu(cpu *CPU, d *decoded) (uint64, error) {
+	return cpu.branch(d.imm, cpu.Regs[d.rs1] >= cpu.Regs[d.rs2]), nil
+}
+
+func execJal(cpu *CPU, d *decoded) (uint64, error) {
+	cpu.Regs[d.rd] = cpu.Pc + 4
+	return cpu.Pc + d.imm, nil
+}
+
+func execJalr(cpu *CPU, d *decoded) (uint64, error) {
+	next := (cpu.Regs[d.rs1] + d.imm) &^ 1
+	cpu.Regs[d.rd] = cpu.Pc + 4
+	return next, nil
+}
@@ -0,0 +1,197 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"goemu/clock"
+	"goemu/config"
+	"goemu/hw/clint"
+	"goemu/hw/fdt"
+	"goemu/hw/pci"
+	"goemu/hw/plic"
+	"goemu/hw/rtc"
+	"goemu/hw/uart"
+	"goemu/hw/virtio"
+)
+
+// Phandles of the interrupt controllers.
+const (
+	plicPhandle    = 1
+	cpuIntcPhandle = 2 // of hart 0, hart i has cpuIntcPhandle+i
+)
+
+// maxDeviceTree bounds the space reserved for the blob at the top of RAM.
+const maxDeviceTree = 64 * 1024
+
+// DeviceTree describes the machine, its harts and every device on the bus,
+// with bootargs as the kernel command line.
+func (cpu *CPU) DeviceTree(bootargs string) *fdt.Node {
+	root := fdt.NewNode("")
+	root.Cells("#address-cells", 2)
+	root.Cells("#size-cells", 2)
+	root.String("compatible", "goemu,virt", "riscv-virtio")
+	root.String("model", "goemu")
+
+	chosen := root.Add("chosen")
+	if bootargs != "" {
+		chosen.String("bootargs", bootargs)
+	}
+	chosen.String("stdout-path", fmt.Sprintf("/soc/serial@%x", uart.Base))
+
+	cpus := root.Add("cpus")
+	cpus.Cells("#address-cells", 1)
+	cpus.Cells("#size-cells", 0)
+	cpus.Cells("timebase-frequency", clock.Frequency)
+	harts := cpu.Bus.Clint.Harts()
+	var clintInts, plicInts []uint32
+	for i := 0; i < harts; i++ {
+		hart := cpus.Add(fmt.Sprintf("cpu@%d", i))
+		hart.String("device_type", "cpu")
+		hart.Cells("reg", uint32(i))
+		hart.String("status", "okay")
+		hart.String("compatible", "riscv")
+		hart.String("riscv,isa", "rv64ima_zicsr_zicntr_zihpm")
+		hart.String("mmu-type", "riscv,none")
+		intc := hart.Add("interrupt-controller")
+		intc.Cells("#interrupt-cells", 1)
+		intc.Flag("interrupt-controller")
+		intc.String("compatible", "riscv,cpu-intc")
+		phandle := uint32(cpuIntcPhandle + i)
+		intc.Cells("phandle", phandle)
+		clintInts = append(clintInts, phandle, MachineSoftInt, phandle, MachineTimerInt)
+		plicInts = append(plicInts, phandle, MachineExtInt, phandle, SupervisorExtInt)
+	}
+
+	mem := root.Add(fmt.Sprintf("memory@%x", cpu.Bus.Mem.Base))
+	mem.String("device_type", "memory")
+	mem.Reg(cpu.Bus.Mem.Base, uint64(len(cpu.Bus.Mem.Data)))
+
+	soc := root.Add("soc")
+	soc.Cells("#address-cells", 2)
+	soc.Cells("#size-cells", 2)
+	soc.String("compatible", "simple-bus")
+	soc.Flag("ranges")
+
+	c := soc.Add(fmt.Sprintf("clint@%x", clint.Base))
+	c.String("compatible", "sifive,clint0", "riscv,clint0")
+	c.Reg(clint.Base, clint.Size)
+	c.Cells("interrupts-extended", clintInts...)
+
+	p := soc.Add(fmt.Sprintf("plic@%x", plic.Base))
+	p.String("compatible", "sifive,plic-1.0.0", "riscv,plic0")
+	p.Reg(plic.Base, plic.Size)
+	p.Cells("#address-cells", 0)
+	p.Cells("#interrupt-cells", 1)
+	p.Flag("interrupt-controller")
+	p.Cells("riscv,ndev", plic.Sources-1)
+	p.Cells("interrupts-extended", plicInts...)
+	p.Cells("phandle", plicPhandle)
+
+	for i, u := range cpu.Bus.Uarts {
+		n := soc.Add(fmt.Sprintf("serial@%x", u.Base))
+		n.String("compatible", "ns16550a")
+		n.Reg(u.Base, uart.Size)
+		n.Cells("clock-frequency", 3686400)
+		n.Cells("interrupt-parent", plicPhandle)
+		n.Cells("interrupts", uint32(uart.IrqOf(i)))
+	}
+
+	r := soc.Add(fmt.Sprintf("rtc@%x", cpu.Bus.Rtc.Base))
+	r.String("compatible", "google,goldfish-rtc")
+	r.Reg(cpu.Bus.Rtc.Base, rtc.Size)
+	r.Cells("interrupt-parent", plicPhandle)
+	r.Cells("interrupts", rtc.Irq)
+
+	if f := cpu.Bus.Framebuffer; f != nil {
+		n := soc.Add(fmt.Sprintf("framebuffer@%x", f.Base))
+		n.String("compatible", "simple-framebuffer")
+		n.Reg(f.Base, f.Size())
+		n.Cells("width", uint32(f.Width))
+		n.Cells("height", uint32(f.Height))
+		n.Cells("stride", uint32(f.Stride))
+		n.String("format", string(f.Format))
+	}
+
+	for i, v := range cpu.Bus.Virtio {
+		n := soc.Add(fmt.Sprintf("virtio_mmio@%x", v.Base))
+		n.String("compatible", "virtio,mmio")
+		n.Reg(v.Base, virtio.Size)
+		n.Cells("interrupt-parent", plicPhandle)
+		n.Cells("interrupts", uint32(virtio.Irq+i))
+	}
+
+	if cpu.Bus.Pci != nil {
+		pciNode(soc)
+	}
+	return root
+}
+
+// pciNode describes the ECAM host bridge. PCI addresses take three cells, the
+// first of which holds the space and the device number.
+func pciNode(soc *fdt.Node) {
+	const (
+		spaceIO  = 0x01000000
+		spaceMem = 0x02000000
+	)
+	n := soc.Add(fmt.Sprintf("pci@%x", pci.EcamBase))
+	n.String("compatible", "pci-host-ecam-generic")
+	n.String("device_type", "pci")
+	n.Cells("#address-cells", 3)
+	n.Cells("#size-cells", 2)
+	n.Cells("#interrupt-cells", 1)
+	n.Reg(pci.EcamBase, pci.EcamSize)
+	n.Cells("bus-range", 0, 0)
+	n.Cells("linux,pci-domain", 0)
+	n.Flag("dma-coherent")
+	n.Cells("ranges",
+		spaceIO, 0, 0, 0, pci.IOBase, 0, pci.IOSize,
+		spaceMem, 0, pci.MemBase, 0, pci.MemBase, 0, pci.MemSize)
+
+	// the swizzle depends on the device number modulo the number of pins
+	n.Cells("interrupt-map-mask", 3<<11, 0, 0, 7)
+	var imap []uint32
+	for dev := 0; dev < pci.Pins; dev++ {
+		for pin := 1; pin <= pci.Pins; pin++ {
+			imap = append(imap, uint32(dev<<11), 0, 0, uint32(pin), plicPhandle, uint32(pci.IrqOf(dev, pin)))
+		}
+	}
+	n.Cells("interrupt-map", imap...)
+}
+
+// LoadDeviceTree places the device tree blob at the top of RAM and boots the
+// way firmware hands over to a kernel: PCI devices are assigned their BARs,
+// a0 holds the hart ID and a1 the address of the blob. The stack starts
+// below it.
+func (cpu *CPU) LoadDeviceTree(bootargs string) error {
+	if cpu.Bus.Pci != nil {
+		if err := cpu.Bus.Pci.Assign(); err != nil {
+			return err
+		}
+	}
+	blob := fdt.Marshal(cpu.DeviceTree(bootargs), 0)
+	if len(blob) > maxDeviceTree {
+		return errors.New("device tree too large")
+	}
+	addr := uint64(config.KernelBase + config.MemSize - maxDeviceTree)
+	if _, err := cpu.Bus.Mem.WriteAt(blob, int64(addr)); err != nil {
+		return err
+	}
+	cpu.Regs[10] = uint64(cpu.hartid())
+	cpu.Regs[11] = addr
+	cpu.Regs[2] = addr
+	return nil
+}
+
+// LoadDeviceTree loads the device tree and boots every hart the same way,
+// with its own hart ID in a0 and its stack HartStack below the previous one.
+func (m *Machine) LoadDeviceTree(bootargs string) error {
+	if err := m.Harts[0].LoadDeviceTree(bootargs); err != nil {
+		return err
+	}
+	for i, cpu := range m.Harts[1:] {
+		cpu.Regs[10] = uint64(i + 1)
+		cpu.Regs[11] = m.Harts[0].Regs[11]
+		cpu.Regs[2] = m.Harts[0].Regs[2] - uint64(i+1)*HartStack
+	}
+	return nil
+}
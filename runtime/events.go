@@ -0,0 +1,143 @@
+package runtime
+
+import (
+	"fmt"
+	"goemu/clock"
+	"goemu/hw/virtio"
+	"goemu/replay"
+)
+
+// PollInterval is the number of instructions retired between two polls of
+// host input. Input is only ever delivered at these boundaries, which is what
+// makes a recorded run reproducible.
+const PollInterval = 1024
+
+// poll delivers input and refreshes the interrupt lines of the hart. Only
+// hart 0 serves the host and the replay log, the others merely sample their
+// lines at the same interval.
+func (cpu *CPU) poll() error {
+	if cpu.hartid() != 0 {
+		if cpu.Instret%PollInterval == 0 {
+			cpu.Bus.lock()
+			cpu.updateTimer()
+			cpu.updateExternal()
+			cpu.Bus.unlock()
+		}
+		return nil
+	}
+	cpu.Bus.lock()
+	defer cpu.Bus.unlock()
+	if cpu.Player != nil {
+		for {
+			e, ok := cpu.Player.Next(cpu.Instret)
+			if !ok {
+				break
+			}
+			if err := cpu.deliver(e); err != nil {
+				return err
+			}
+		}
+		if cpu.Player.Done(cpu.Instret) {
+			cpu.Player = nil // the log is exhausted, carry on with live input
+		}
+	}
+
+	if cpu.Instret%PollInterval != 0 {
+		return nil
+	}
+	if cpu.Player == nil {
+		if err := cpu.pollHost(); err != nil {
+			return err
+		}
+	}
+	for _, u := range cpu.Bus.Uarts {
+		u.Flush()
+	}
+	cpu.updateTimer()
+	cpu.updateExternal()
+	return nil
+}
+
+// pollHost samples the host clock and input, recording what it delivered.
+func (cpu *CPU) pollHost() error {
+	if w, ok := cpu.Bus.Clint.Clock.(*clock.Wall); ok {
+		t := w.Sample()
+		if err := cpu.record(replay.Timer, t); err != nil {
+			return err
+		}
+	}
+	for i, u := range cpu.Bus.Uarts {
+		for {
+			b, ok := u.Poll()
+			if !ok {
+				break
+			}
+			if err := cpu.record(replay.UartRx, uint64(i)<<8|uint64(b)); err != nil {
+				return err
+			}
+		}
+	}
+	for slot, dev := range cpu.Bus.VirtioDevices() {
+		r, ok := dev.(virtio.Receiver)
+		if !ok {
+			continue
+		}
+		for {
+			port, data, ok := r.Poll()
+			if !ok {
+				break
+			}
+			if err := cpu.record(replay.VirtioRx, uint64(slot)<<32|uint64(port), data...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// StartRecording logs asynchronous input to r from now on, beginning with
+// the host state a replay cannot reconstruct by itself.
+func (cpu *CPU) StartRecording(r *replay.Recorder) error {
+	cpu.Recorder = r
+	return cpu.record(replay.RtcEpoch, cpu.Bus.Rtc.Epoch)
+}
+
+func (cpu *CPU) record(kind replay.Kind, data uint64, payload ...byte) error {
+	if cpu.Recorder == nil {
+		return nil
+	}
+	return cpu.Recorder.Record(replay.Event{Instret: cpu.Instret, Kind: kind, Data: data, Payload: payload})
+}
+
+func (cpu *CPU) deliver(e replay.Event) error {
+	switch e.Kind {
+	case replay.UartRx:
+		i := e.Data >> 8
+		if i >= uint64(len(cpu.Bus.Uarts)) {
+			return fmt.Errorf("input replayed to a missing uart: %d", i)
+		}
+		cpu.Bus.Uarts[i].Receive(uint8(e.Data))
+	case replay.Timer:
+		w, ok := cpu.Bus.Clint.Clock.(*clock.Wall)
+		if !ok {
+			return fmt.Errorf("timer event replayed without a wall clock")
+		}
+		w.Set(e.Data)
+	case replay.RtcEpoch:
+		cpu.Bus.Rtc.Epoch = e.Data
+	case replay.VirtioRx:
+		slot, port := e.Data>>32, int(uint32(e.Data))
+		devs := cpu.Bus.VirtioDevices()
+		if slot >= uint64(len(devs)) {
+			return fmt.Errorf("input replayed to a missing virtio device: %d", slot)
+		}
+		r, ok := devs[slot].(virtio.Receiver)
+		if !ok {
+			return fmt.Errorf("input replayed to a virtio device without input: %d", slot)
+		}
+		return r.Receive(port, e.Payload)
+	default:
+		return fmt.Errorf("unknown event kind: %d", e.Kind)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package runtime
+
+// Interrupt codes, as written to mcause and scause with the top bit set.
+const (
+	SupervisorSoftInt  = 1
+	MachineSoftInt     = 3
+	SupervisorTimerInt = 5
+	MachineTimerInt    = 7
+	SupervisorExtInt   = 9
+	MachineExtInt      = 11
+)
+
+// interruptOrder is the priority of simultaneous interrupts.
+var interruptOrder = []uint64{
+	MachineExtInt, MachineSoftInt, MachineTimerInt,
+	SupervisorExtInt, SupervisorSoftInt, SupervisorTimerInt,
+}
+
+// updateExternal reflects the PLIC contexts of the hart into mip.
+func (cpu *CPU) updateExternal() {
+	ctx := 2 * cpu.hartid()
+	cpu.Csr[Mip] &^= MeipMask | SeipMask
+	if cpu.Bus.Plic.Interrupting(ctx) {
+		cpu.Csr[Mip] |= MeipMask
+	}
+	if cpu.Bus.Plic.Interrupting(ctx + 1) {
+		cpu.Csr[Mip] |= SeipMask
+	}
+}
+
+// interrupt traps into the handler of the highest priority interrupt that is
+// both pending and enabled at the current privilege level. Harts running in
+// parallel only see the PLIC when they poll, a single one on every instruction.
+func (cpu *CPU) interrupt() bool {
+	if !cpu.Bus.parallel {
+		cpu.updateExternal()
+	}
+	pending := cpu.Csr[Mip] & cpu.Csr[Mie]
+	if pending == 0 {
+		return false
+	}
+	cpu.waiting = false
+	status := cpu.Csr[Mstatus]
+	mEnabled := cpu.Level < MachineMode || status&MieMask != 0
+	sEnabled := cpu.Level < SupervisorMode || cpu.Level == SupervisorMode && status&SieMask != 0
+	for _, code := range interruptOrder {
+		bit := uint64(1) << code
+		if pending&bit == 0 {
+			continue
+		}
+		if cpu.Csr[Mideleg]&bit != 0 && sEnabled || cpu.Csr[Mideleg]&bit == 0 && mEnabled {
+			cpu.takeTrap(code, 0, true)
+			return true
+		}
+	}
+	return false
+}
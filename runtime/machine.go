@@ -0,0 +1,164 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"goemu/clock"
+	"goemu/config"
+	"goemu/hw/clint"
+	"goemu/hw/plic"
+	"goemu/hw/rtc"
+	"goemu/hw/uart"
+	"goemu/safe"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MaxHarts       = 32      // most harts a machine may have
+	HartStack      = 0x10000 // each hart starts with its stack this far below the previous one
+	DefaultQuantum = 64
+)
+
+// Machine is a set of harts sharing one Bus. Hart 0 delivers host input and
+// replays recorded events, so those follow its instruction count.
+type Machine struct {
+	Harts []*CPU
+	Bus   *Bus
+
+	// Quantum is the number of instructions a hart executes before the next
+	// one takes over. Interleaving the harts on one goroutine this way keeps
+	// a run reproducible.
+	Quantum uint64
+	// Parallel runs every hart on a goroutine of its own instead, which is
+	// faster but not reproducible.
+	Parallel bool
+
+	halted []bool // harts whose Pc left the image
+}
+
+// NewMachine returns a machine of the given number of harts, all starting at
+// the beginning of code in Machine mode.
+func NewMachine(code []uint8, harts int) *Machine {
+	mem := NewMemory(config.KernelBase, config.MemSize)
+	copy(mem.Data, code)
+	u := uart.NewUart(uart.Base)
+	b := &Bus{
+		Mem:   mem,
+		Uart:  u,
+		Uarts: []*uart.Uart{u},
+		Clint: clint.NewClint(clock.NewWall(), harts),
+		Plic:  plic.NewPlic(harts),
+	}
+	u.Irq = func(high bool) {
+		b.Plic.SetLevel(uart.IrqOf(0), high)
+	}
+	b.Rtc = rtc.NewRtc(rtc.DefaultBase, uint64(time.Now().UnixNano()), func() uint64 {
+		return b.Clint.Clock.Now()
+	}, func(high bool) {
+		b.Plic.SetLevel(rtc.Irq, high)
+	})
+
+	m := &Machine{Bus: b, Quantum: DefaultQuantum, halted: make([]bool, harts)}
+	for i := 0; i < harts; i++ {
+		cpu := &CPU{
+			Pc:    config.KernelBase,
+			Size:  uint64(len(code)),
+			Bus:   b,
+			Level: MachineMode,
+		}
+		cpu.Regs[2] = config.KernelEnd - uint64(i)*HartStack
+		cpu.Csr[Mhartid] = uint64(i)
+		m.Harts = append(m.Harts, cpu)
+	}
+	return m
+}
+
+// Step gives every hart still running a quantum in turn. If they are all
+// waiting in wfi after it, a virtual clock skips to the next deadline. It
+// returns io.EOF once the Pc of every hart has left the image.
+func (m *Machine) Step() error {
+	quantum := m.Quantum
+	if quantum == 0 {
+		quantum = 1
+	}
+	var running []*CPU
+	idle := true
+	for i, cpu := range m.Harts {
+		if m.halted[i] {
+			continue
+		}
+		if err := cpu.StepN(quantum); err != nil {
+			if err != io.EOF {
+				return err
+			}
+			m.halted[i] = true
+			continue
+		}
+		running = append(running, cpu)
+		idle = idle && cpu.waiting
+	}
+	if len(running) == 0 {
+		return io.EOF
+	}
+	if idle {
+		skipIdle(running)
+	}
+	return nil
+}
+
+// Run executes the harts until they have all left the image, one of them
+// fails or stop returns true. Stop is checked between rounds of quanta, or
+// every PollInterval instructions of each hart when running in parallel.
+func (m *Machine) Run(stop func() bool) error {
+	if m.Parallel {
+		return m.runParallel(stop)
+	}
+	for !stop() {
+		if err := m.Step(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Machine) runParallel(stop func() bool) error {
+	if _, ok := m.Bus.Clint.Clock.(*clock.Virtual); ok {
+		return errors.New("parallel harts cannot share a virtual clock")
+	}
+	if m.Harts[0].Recorder != nil || m.Harts[0].Player != nil {
+		return errors.New("parallel harts cannot be recorded or replayed")
+	}
+	m.Bus.parallel = true
+	defer func() { m.Bus.parallel = false }()
+
+	var done atomic.Bool // set by the first hart to stop
+	g := safe.WithCancel(context.Background())
+	for i, cpu := range m.Harts {
+		if m.halted[i] {
+			continue
+		}
+		i, cpu := i, cpu
+		g.SafeGo(func() error {
+			for !done.Load() {
+				if err := cpu.StepN(PollInterval - cpu.Instret%PollInterval); err != nil {
+					if err == io.EOF {
+						m.halted[i] = true
+						return nil
+					}
+					done.Store(true)
+					return err
+				}
+				if stop() {
+					done.Store(true)
+				}
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
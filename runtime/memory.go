@@ -2,10 +2,51 @@ package runtime
 
 import (
 	"fmt"
-	"goemu/config"
+	"io"
+	"math/bits"
+	"sync/atomic"
+	"unsafe"
 )
 
-type Memory []uint8
+// Memory is a block of RAM mapped at Base.
+//
+// Harts running in parallel share it, so every access goes through
+// sync/atomic: aligned words and doublewords directly, bytes, halfwords and
+// misaligned accesses through the aligned words containing them. Go atomics
+// are sequentially consistent, which is stronger than RVWMO requires, and
+// aligned accesses are never torn.
+type Memory struct {
+	Base uint64
+	Data []uint8 // the bytes of words, in guest order
+
+	words []uint32
+	code  []uint64 // per page, the lines instructions decoded from it came from
+	gen   []uint32 // per page, advanced by stores to a line that holds code
+}
+
+// bigEndian is true on hosts storing the low byte of a word last, where words
+// are swapped to keep Data in guest order.
+var bigEndian = func() bool {
+	w := uint32(1)
+	return *(*uint8)(unsafe.Pointer(&w)) == 0
+}()
+
+func NewMemory(base, size uint64) *Memory {
+	words := make([]uint32, (size+7)/8*2) // 8-byte aligned
+	pages := (size + PageSize - 1) / PageSize
+	return &Memory{
+		Base:  base,
+		Data:  unsafe.Slice((*uint8)(unsafe.Pointer(&words[0])), size),
+		words: words,
+		code:  make([]uint64, pages),
+		gen:   make([]uint32, pages),
+	}
+}
+
+// Contains reports whether addr falls inside the memory.
+func (m *Memory) Contains(addr uint64) bool {
+	return addr >= m.Base && addr-m.Base < uint64(len(m.Data))
+}
 
 func (m *Memory) Check(bytes uint64) error {
 	switch bytes {
@@ -16,26 +57,229 @@ func (m *Memory) Check(bytes uint64) error {
 	}
 }
 
+// Load reads bytes at addr. An access outside the memory is an access fault.
 func (m *Memory) Load(addr, bytes uint64) (uint64, error) {
-	if err := m.Check(bytes); err != nil {
-		return 0, err
+	index := addr - m.Base
+	if index >= uint64(len(m.Data)) || bytes > uint64(len(m.Data))-index {
+		return 0, &Exception{Cause: LoadAccessFault, Tval: addr}
 	}
-	index := addr - config.KernelBase
-	data := uint64((*m)[index])
-	for i := uint64(1); i < bytes; i++ {
-		data |= uint64((*m)[index+i]) << (i * 8)
+	switch bytes {
+	case 1, 2, 4, 8:
+	default:
+		return 0, m.Check(bytes)
+	}
+	if index&(bytes-1) == 0 {
+		return loadWords(m.words, index, bytes), nil
+	}
+	var data uint64
+	for i := uint64(0); i < bytes; i++ {
+		data |= uint64(m.load8(index+i)) << (8 * i)
 	}
 	return data, nil
 }
 
+// Store writes bytes at addr. An access outside the memory is an access fault.
 func (m *Memory) Store(addr, bytes, data uint64) error {
-	if err := m.Check(bytes); err != nil {
-		return err
+	index := addr - m.Base
+	if index >= uint64(len(m.Data)) || bytes > uint64(len(m.Data))-index {
+		return &Exception{Cause: StoreAccessFault, Tval: addr}
 	}
-	index := addr - config.KernelBase
-	for i := uint64(0); i < bytes; i++ {
-		offset := 8 * i
-		(*m)[index+i] = uint8((data >> offset) & 0xFF)
+	switch bytes {
+	case 1, 2, 4, 8:
+	default:
+		return m.Check(bytes)
+	}
+	if index&(bytes-1) == 0 {
+		storeWords(m.words, index, bytes, data)
+	} else {
+		for i := uint64(0); i < bytes; i++ {
+			m.store8(index+i, uint8(data>>(8*i)))
+		}
 	}
+	m.written(index, bytes)
 	return nil
 }
+
+// CompareAndSwap atomically replaces the naturally aligned value at addr with
+// next if it holds old, and reports whether it did.
+func (m *Memory) CompareAndSwap(addr, bytes, old, next uint64) (bool, error) {
+	index := addr - m.Base
+	if index >= uint64(len(m.Data)) || bytes > uint64(len(m.Data))-index {
+		return false, &Exception{Cause: StoreAccessFault, Tval: addr}
+	}
+	if bytes != 4 && bytes != 8 || index%bytes != 0 {
+		return false, fmt.Errorf("invalid atomic access: %x", addr)
+	}
+	var ok bool
+	if bytes == 4 {
+		ok = atomic.CompareAndSwapUint32(&m.words[index/4], swap32(uint32(old)), swap32(uint32(next)))
+	} else {
+		p := (*uint64)(unsafe.Pointer(&m.words[index/4]))
+		ok = atomic.CompareAndSwapUint64(p, swap64(old), swap64(next))
+	}
+	if ok {
+		m.written(index, bytes)
+	}
+	return ok, nil
+}
+
+func swap32(v uint32) uint32 {
+	if bigEndian {
+		return bits.ReverseBytes32(v)
+	}
+	return v
+}
+
+func swap64(v uint64) uint64 {
+	if bigEndian {
+		return bits.ReverseBytes64(v)
+	}
+	return v
+}
+
+// loadWords reads a naturally aligned value at the byte index i of words.
+func loadWords(words []uint32, i, bytes uint64) uint64 {
+	switch bytes {
+	case 8:
+		return swap64(atomic.LoadUint64((*uint64)(unsafe.Pointer(&words[i/4]))))
+	case 4:
+		return uint64(swap32(atomic.LoadUint32(&words[i/4])))
+	default:
+		return uint64(swap32(atomic.LoadUint32(&words[i/4]))>>(8*(i&3))) & (1<<(8*bytes) - 1)
+	}
+}
+
+// storeWords writes a naturally aligned value at the byte index i of words.
+func storeWords(words []uint32, i, bytes, data uint64) {
+	switch bytes {
+	case 8:
+		atomic.StoreUint64((*uint64)(unsafe.Pointer(&words[i/4])), swap64(data))
+	case 4:
+		atomic.StoreUint32(&words[i/4], swap32(uint32(data)))
+	default:
+		shift := 8 * (i & 3)
+		merge32(&words[i/4], uint32(1<<(8*bytes)-1)<<shift, uint32(data)<<shift)
+	}
+}
+
+// merge32 replaces the bits in mask of a word, leaving the other bytes of the
+// word to concurrent stores.
+func merge32(p *uint32, mask, v uint32) {
+	for {
+		old := atomic.LoadUint32(p)
+		next := swap32(swap32(old)&^mask | v&mask)
+		if atomic.CompareAndSwapUint32(p, old, next) {
+			return
+		}
+	}
+}
+
+func (m *Memory) load32(index uint64) uint32 {
+	return swap32(atomic.LoadUint32(&m.words[index/4]))
+}
+
+func (m *Memory) store32(index uint64, v uint32) {
+	atomic.StoreUint32(&m.words[index/4], swap32(v))
+}
+
+func (m *Memory) load8(index uint64) uint8 {
+	return uint8(m.load32(index&^3) >> (8 * (index & 3)))
+}
+
+func (m *Memory) store8(index uint64, v uint8) {
+	shift := 8 * (index & 3)
+	merge32(&m.words[index/4], 0xFF<<shift, uint32(v)<<shift)
+}
+
+// ReadAt copies memory starting at the physical address off into p.
+func (m *Memory) ReadAt(p []byte, off int64) (int, error) {
+	if !m.Contains(uint64(off)) || uint64(len(p)) > uint64(len(m.Data))-(uint64(off)-m.Base) {
+		return 0, fmt.Errorf("invalid memory range: %x+%x", off, len(p))
+	}
+	index := uint64(off) - m.Base
+	for i := 0; i < len(p); {
+		if (index+uint64(i))%4 == 0 && len(p)-i >= 4 {
+			w := m.load32(index + uint64(i))
+			p[i], p[i+1], p[i+2], p[i+3] = uint8(w), uint8(w>>8), uint8(w>>16), uint8(w>>24)
+			i += 4
+			continue
+		}
+		p[i] = m.load8(index + uint64(i))
+		i++
+	}
+	return len(p), nil
+}
+
+// WriteAt copies p into memory starting at the physical address off.
+func (m *Memory) WriteAt(p []byte, off int64) (int, error) {
+	if !m.Contains(uint64(off)) || uint64(len(p)) > uint64(len(m.Data))-(uint64(off)-m.Base) {
+		return 0, fmt.Errorf("invalid memory range: %x+%x", off, len(p))
+	}
+	index := uint64(off) - m.Base
+	for i := 0; i < len(p); {
+		if (index+uint64(i))%4 == 0 && len(p)-i >= 4 {
+			m.store32(index+uint64(i), uint32(p[i])|uint32(p[i+1])<<8|uint32(p[i+2])<<16|uint32(p[i+3])<<24)
+			i += 4
+			continue
+		}
+		m.store8(index+uint64(i), p[i])
+		i++
+	}
+	if len(p) > 0 {
+		m.written(index, uint64(len(p)))
+	}
+	return len(p), nil
+}
+
+var (
+	_ io.ReaderAt = (*Memory)(nil)
+	_ io.WriterAt = (*Memory)(nil)
+)
+
+// hostPage caches where in host memory the RAM page a hart last loaded from,
+// or stored to, lies, so that naturally aligned accesses within it skip the
+// bus.
+type hostPage struct {
+	base  uint64 // guest address of the page
+	size  uint64 // 0 while empty
+	words []uint32
+	index uint64 // of the page in the memory
+	mem   *Memory
+}
+
+// fill caches the page of addr, if it is a whole page of m.
+func (p *hostPage) fill(m *Memory, addr uint64) {
+	index := (addr - m.Base) &^ (PageSize - 1)
+	if !m.Contains(addr) || index+PageSize > uint64(len(m.Data)) {
+		return
+	}
+	*p = hostPage{
+		base:  m.Base + index,
+		size:  PageSize,
+		words: m.words[index/4 : (index+PageSize)/4],
+		index: index,
+		mem:   m,
+	}
+}
+
+// load reads from RAM when addr is naturally aligned in the cached page and
+// reports whether it could.
+func (p *hostPage) load(addr, bytes uint64) (uint64, bool) {
+	offset := addr - p.base
+	if offset >= p.size || offset&(bytes-1) != 0 {
+		return 0, false
+	}
+	return loadWords(p.words, offset, bytes), true
+}
+
+// store writes to RAM when addr is naturally aligned in the cached page and
+// reports whether it could.
+func (p *hostPage) store(addr, bytes, data uint64) bool {
+	offset := addr - p.base
+	if offset >= p.size || offset&(bytes-1) != 0 {
+		return false
+	}
+	storeWords(p.words, offset, bytes, data)
+	p.mem.written(p.index+offset, bytes)
+	return true
+}
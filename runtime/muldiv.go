@@ -0,0 +1,98 @@
+package runtime
+
+import (
+	"math"
+	"math/bits"
+)
+
+// muldiv computes the M extension operation selected by funct3. Division by
+// zero and signed overflow do not trap but give the results the spec lists.
+func muldiv(funct3, a, b uint64) uint64 {
+	switch funct3 {
+	case 0b000: // mul
+		return a * b
+	case 0b001: // mulh
+		hi, _ := bits.Mul64(a, b)
+		if int64(a) < 0 {
+			hi -= b
+		}
+		if int64(b) < 0 {
+			hi -= a
+		}
+		return hi
+	case 0b010: // mulhsu
+		hi, _ := bits.Mul64(a, b)
+		if int64(a) < 0 {
+			hi -= b
+		}
+		return hi
+	case 0b011: // mulhu
+		hi, _ := bits.Mul64(a, b)
+		return hi
+	case 0b100: // div
+		switch {
+		case b == 0:
+			return math.MaxUint64
+		case int64(a) == math.MinInt64 && int64(b) == -1:
+			return a
+		}
+		return uint64(int64(a) / int64(b))
+	case 0b101: // divu
+		if b == 0 {
+			return math.MaxUint64
+		}
+		return a / b
+	case 0b110: // rem
+		switch {
+		case b == 0:
+			return a
+		case int64(a) == math.MinInt64 && int64(b) == -1:
+			return 0
+		}
+		return uint64(int64(a) % int64(b))
+	default: // remu
+		if b == 0 {
+			return a
+		}
+		return a % b
+	}
+}
+
+// muldivw computes the word form of the M extension operation selected by
+// funct3 on the low 32 bits of a and b, sign-extending the result. It reports
+// false for the operations without a word form.
+func muldivw(funct3, a, b uint64) (uint64, bool) {
+	x, y := int32(a), int32(b)
+	switch funct3 {
+	case 0b000: // mulw
+		return uint64(x * y), true
+	case 0b100: // divw
+		switch {
+		case y == 0:
+			return math.MaxUint64, true
+		case x == math.MinInt32 && y == -1:
+			return uint64(x), true
+		}
+		return uint64(x / y), true
+	case 0b101: // divuw
+		if y == 0 {
+			return math.MaxUint64, true
+		}
+		return uint64(int32(uint32(x) / uint32(y))), true
+	case 0b110: // remw
+		switch {
+		case y == 0:
+			return uint64(x), true
+		case x == math.MinInt32 && y == -1:
+			return 0, true
+		}
+		return uint64(x % y), true
+	case 0b111: // remuw
+		if y == 0 {
+			return uint64(x), true
+		}
+		return uint64(int32(uint32(x) % uint32(y))), true
+	default:
+		return 0, false
+	}
+}
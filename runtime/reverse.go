@@ -0,0 +1,192 @@
+package runtime
+
+import (
+	"bytes"
+	"errors"
+	"goemu/hw/virtio"
+	"goemu/replay"
+	"io"
+)
+
+// ErrHistoryStart is returned when execution is rewound to the oldest checkpoint.
+var ErrHistoryStart = errors.New("reached the start of the execution history")
+
+type checkpoint struct {
+	instret uint64
+	data    []byte
+}
+
+// Timeline lets a hart run backwards. It takes a snapshot every Interval
+// instructions and logs all asynchronous input, so that any earlier point can
+// be reached by restoring the closest checkpoint and executing forward again.
+// Guest output is suppressed while re-executing instructions that already ran.
+// Writes that reach a disk image cannot be taken back, so every disk must be
+// read-only or copy-on-write.
+type Timeline struct {
+	Interval uint64
+
+	cpu         *CPU
+	checkpoints []checkpoint
+	log         bytes.Buffer
+	high        uint64          // the furthest point reached so far
+	out         []io.Writer     // where each UART writes when not re-executing
+	senders     []virtio.Sender // devices muted while re-executing
+}
+
+func NewTimeline(cpu *CPU, interval uint64) (*Timeline, error) {
+	if cpu.Recorder != nil || cpu.Player != nil {
+		return nil, errors.New("reverse execution cannot be combined with record or replay")
+	}
+	t := &Timeline{Interval: interval, cpu: cpu, high: cpu.Instret}
+	for _, u := range cpu.Bus.Uarts {
+		t.out = append(t.out, u.Out)
+	}
+	for _, dev := range cpu.Bus.VirtioDevices() {
+		if b, ok := dev.(*virtio.Blk); ok && b.Persistent() {
+			return nil, errors.New("reverse execution needs read-only or copy-on-write disks")
+		}
+		if s, ok := dev.(virtio.Sender); ok {
+			t.senders = append(t.senders, s)
+		}
+	}
+	rec, err := replay.NewRecorder(&t.log)
+	if err != nil {
+		return nil, err
+	}
+	cpu.Recorder = rec
+	return t, t.checkpoint()
+}
+
+// Step executes one instruction, taking a checkpoint when one is due.
+func (t *Timeline) Step() error {
+	t.mute(t.cpu.Instret < t.high)
+	if err := t.cpu.Step(); err != nil {
+		return err
+	}
+	if t.cpu.Instret > t.high {
+		t.high = t.cpu.Instret
+	}
+	if t.cpu.Instret%t.Interval == 0 && t.cpu.Instret > t.checkpoints[len(t.checkpoints)-1].instret {
+		return t.checkpoint()
+	}
+	return nil
+}
+
+// Seek moves execution to the point where instret instructions have retired.
+func (t *Timeline) Seek(instret uint64) error {
+	if instret < t.cpu.Instret {
+		i := len(t.checkpoints) - 1
+		for i > 0 && t.checkpoints[i].instret > instret {
+			i--
+		}
+		if err := t.restore(t.checkpoints[i]); err != nil {
+			return err
+		}
+		if instret < t.checkpoints[i].instret {
+			return ErrHistoryStart
+		}
+	}
+	for t.cpu.Instret < instret {
+		if err := t.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StepBack undoes the most recently executed instruction.
+func (t *Timeline) StepBack() error {
+	if t.cpu.Instret == t.checkpoints[0].instret {
+		return ErrHistoryStart
+	}
+	return t.Seek(t.cpu.Instret - 1)
+}
+
+// ContinueBack rewinds to the latest earlier point at which stop reports true,
+// checked before each instruction executes, or to the start of the history.
+func (t *Timeline) ContinueBack(stop func(cpu *CPU) bool) error {
+	end := t.cpu.Instret
+	for i := len(t.checkpoints) - 1; i >= 0; i-- {
+		c := t.checkpoints[i]
+		if c.instret >= end {
+			continue
+		}
+		if err := t.restore(c); err != nil {
+			return err
+		}
+		var found uint64
+		hit := false
+		for t.cpu.Instret < end {
+			if stop(t.cpu) {
+				found, hit = t.cpu.Instret, true
+			}
+			if err := t.Step(); err != nil {
+				return err
+			}
+		}
+		if hit {
+			return t.Seek(found)
+		}
+		end = c.instret
+	}
+	if err := t.restore(t.checkpoints[0]); err != nil {
+		return err
+	}
+	return ErrHistoryStart
+}
+
+// Reset forgets the history, which re-executing can no longer reproduce once
+// the state was changed from outside, as by a debugger. Execution can then be
+// rewound to this point but not before it.
+func (t *Timeline) Reset() error {
+	t.log.Reset()
+	rec, err := replay.NewRecorder(&t.log)
+	if err != nil {
+		return err
+	}
+	t.cpu.Recorder = rec
+	t.cpu.Player = nil
+	t.checkpoints = nil
+	t.high = t.cpu.Instret
+	t.mute(false)
+	return t.checkpoint()
+}
+
+// mute silences guest output to the host, or lets it through again.
+func (t *Timeline) mute(muted bool) {
+	for i, u := range t.cpu.Bus.Uarts {
+		if muted {
+			u.Out = io.Discard
+		} else {
+			u.Out = t.out[i]
+		}
+	}
+	for _, s := range t.senders {
+		s.Mute(muted)
+	}
+}
+
+func (t *Timeline) checkpoint() error {
+	var buf bytes.Buffer
+	if err := t.cpu.SaveSnapshot(&buf); err != nil {
+		return err
+	}
+	t.checkpoints = append(t.checkpoints, checkpoint{instret: t.cpu.Instret, data: buf.Bytes()})
+	return nil
+}
+
+// restore rewinds to c and replays the logged input up to the furthest point
+// reached so far.
+func (t *Timeline) restore(c checkpoint) error {
+	if err := t.cpu.RestoreSnapshot(bytes.NewReader(c.data)); err != nil {
+		return err
+	}
+	player, err := replay.NewPlayer(bytes.NewReader(t.log.Bytes()))
+	if err != nil {
+		return err
+	}
+	player.Skip(c.instret)
+	player.End = t.high
+	t.cpu.Player = player
+	return nil
+}
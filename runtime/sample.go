@@ -0,0 +1,43 @@
+package runtime
+
+import "goemu/profile"
+
+// sample hands the Profiler the Pc, and the return addresses up the frame
+// pointer chain when it wants stacks, once Period instructions have retired
+// since the previous sample.
+func (cpu *CPU) sample() {
+	p := cpu.Profiler
+	if p == nil || cpu.Instret < cpu.nextSample {
+		return
+	}
+	cpu.nextSample = cpu.Instret + p.Period
+	cpu.stack = append(cpu.stack[:0], cpu.Pc)
+	if p.Stacks {
+		cpu.walk()
+	}
+	p.Add(cpu.hartid(), cpu.stack)
+}
+
+// walk follows the frame pointer chain from s0, with frames laid out as GCC
+// does with -fno-omit-frame-pointer: the return address right below the
+// frame pointer and the frame pointer of the caller below it. The walk stops
+// at a null, misaligned or unreadable frame pointer, or one that does not
+// move up the stack.
+func (cpu *CPU) walk() {
+	fp := cpu.Regs[8]
+	for len(cpu.stack) < profile.MaxDepth && fp != 0 && fp%8 == 0 && cpu.Bus.Mem.Contains(fp-16) {
+		ra, err := cpu.Bus.Mem.Load(fp-8, 8)
+		if err != nil || ra == 0 {
+			return
+		}
+		next, err := cpu.Bus.Mem.Load(fp-16, 8)
+		if err != nil {
+			return
+		}
+		cpu.stack = append(cpu.stack, ra)
+		if next <= fp {
+			return
+		}
+		fp = next
+	}
+}
@@ -0,0 +1,268 @@
+package runtime
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A snapshot file starts with SnapshotMagic and a little-endian uint32 version,
+// followed by a gzip stream holding the number of harts, the state of each
+// and one section per device.
+const (
+	SnapshotMagic   = "GOEMUSNP"
+	SnapshotVersion = 8
+
+	PageSize = 4096
+)
+
+// Snapshotter is implemented by every device attached to the Bus so that the
+// whole machine can be saved to and restored from a snapshot file.
+type Snapshotter interface {
+	Save(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+// SaveSnapshot writes the complete state of a single-hart machine to w.
+func (cpu *CPU) SaveSnapshot(w io.Writer) error {
+	return saveSnapshot(w, []*CPU{cpu})
+}
+
+// RestoreSnapshot replaces the state of a single-hart machine with the one
+// read from r.
+func (cpu *CPU) RestoreSnapshot(r io.Reader) error {
+	return restoreSnapshot(r, []*CPU{cpu})
+}
+
+// SaveSnapshot writes the state of every hart and device to w.
+func (m *Machine) SaveSnapshot(w io.Writer) error {
+	return saveSnapshot(w, m.Harts)
+}
+
+// RestoreSnapshot replaces the machine state with the one read from r, which
+// must have been saved from as many harts.
+func (m *Machine) RestoreSnapshot(r io.Reader) error {
+	return restoreSnapshot(r, m.Harts)
+}
+
+func saveSnapshot(w io.Writer, harts []*CPU) error {
+	if _, err := io.WriteString(w, SnapshotMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(SnapshotVersion)); err != nil {
+		return err
+	}
+	zw, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	if err != nil {
+		return err
+	}
+	if err = binary.Write(zw, binary.LittleEndian, uint32(len(harts))); err != nil {
+		return err
+	}
+	for _, cpu := range harts {
+		cpu.updateCounters()
+		for _, v := range cpu.state() {
+			if err = binary.Write(zw, binary.LittleEndian, v); err != nil {
+				return err
+			}
+		}
+	}
+	if err = harts[0].Bus.Save(zw); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func restoreSnapshot(r io.Reader, harts []*CPU) error {
+	magic := make([]byte, len(SnapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return err
+	}
+	if string(magic) != SnapshotMagic {
+		return fmt.Errorf("invalid snapshot magic: %q", magic)
+	}
+	var version uint32
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return err
+	}
+	if version != SnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version: %d", version)
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	var n uint32
+	if err = binary.Read(zr, binary.LittleEndian, &n); err != nil {
+		return err
+	}
+	if int(n) != len(harts) {
+		return fmt.Errorf("snapshot of %d harts restored to %d", n, len(harts))
+	}
+	for _, cpu := range harts {
+		for _, v := range cpu.state() {
+			if err = binary.Read(zr, binary.LittleEndian, v); err != nil {
+				return err
+			}
+		}
+		cpu.reservation = reservation{}
+		cpu.resetCounters()
+	}
+	return harts[0].Bus.Restore(zr)
+}
+
+func (cpu *CPU) state() []any {
+	return []any{&cpu.Regs, &cpu.Pc, &cpu.Size, &cpu.Level, &cpu.Csr, &cpu.Instret}
+}
+
+type section struct {
+	name string
+	dev  Snapshotter
+}
+
+func (b *Bus) sections() []section {
+	sections := []section{
+		{"mem", b.Mem},
+		{"uart", b.Uart},
+		{"clint", b.Clint},
+		{"plic", b.Plic},
+		{"rtc", b.Rtc},
+	}
+	for i, u := range b.Uarts[1:] {
+		sections = append(sections, section{fmt.Sprintf("uart%d", i+1), u})
+	}
+	if b.Framebuffer != nil {
+		sections = append(sections, section{"fb", b.Framebuffer})
+	}
+	for i, v := range b.Virtio {
+		sections = append(sections, section{fmt.Sprintf("virtio%d.%d", i, v.Device.ID()), v})
+	}
+	if b.Pci != nil {
+		sections = append(sections, section{"pci", b.Pci})
+	}
+	for i, v := range b.VirtioPCI {
+		sections = append(sections, section{fmt.Sprintf("virtio-pci%d.%d", i, v.Device.ID()), v})
+	}
+	return sections
+}
+
+// Save writes a named section for every device on the bus.
+func (b *Bus) Save(w io.Writer) error {
+	for _, s := range b.sections() {
+		if err := writeString(w, s.name); err != nil {
+			return err
+		}
+		if err := s.dev.Save(w); err != nil {
+			return fmt.Errorf("save %s: %w", s.name, err)
+		}
+	}
+	return nil
+}
+
+// Restore reads back the sections written by Save, in the same order.
+func (b *Bus) Restore(r io.Reader) error {
+	for _, s := range b.sections() {
+		name, err := readString(r)
+		if err != nil {
+			return err
+		}
+		if name != s.name {
+			return fmt.Errorf("unexpected snapshot section: %s, want %s", name, s.name)
+		}
+		if err = s.dev.Restore(r); err != nil {
+			return fmt.Errorf("restore %s: %w", s.name, err)
+		}
+	}
+	return nil
+}
+
+// Save writes the memory base and size followed by every page that is not
+// all zero, each tagged with its page number. The list ends with a 0xFFFFFFFF tag.
+func (m *Memory) Save(w io.Writer) error {
+	if err := binary.Write(w, binary.LittleEndian, m.Base); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint64(len(m.Data))); err != nil {
+		return err
+	}
+	var zero [PageSize]uint8
+	for i := 0; i < len(m.Data); i += PageSize {
+		page := m.Data[i:]
+		if len(page) > PageSize {
+			page = page[:PageSize]
+		}
+		if bytes.Equal(page, zero[:len(page)]) {
+			continue
+		}
+		if err := binary.Write(w, binary.LittleEndian, uint32(i/PageSize)); err != nil {
+			return err
+		}
+		if _, err := w.Write(page); err != nil {
+			return err
+		}
+	}
+	return binary.Write(w, binary.LittleEndian, uint32(0xFFFFFFFF))
+}
+
+func (m *Memory) Restore(r io.Reader) error {
+	var base, size uint64
+	if err := binary.Read(r, binary.LittleEndian, &base); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return err
+	}
+	if base != m.Base || size != uint64(len(m.Data)) {
+		return fmt.Errorf("memory layout mismatch: %x+%x, want %x+%x", base, size, m.Base, len(m.Data))
+	}
+	for i := range m.Data {
+		m.Data[i] = 0
+	}
+	m.written(0, size) // drop the instructions decoded from the old contents
+	for {
+		var index uint32
+		if err := binary.Read(r, binary.LittleEndian, &index); err != nil {
+			return err
+		}
+		if index == 0xFFFFFFFF {
+			return nil
+		}
+		offset := uint64(index) * PageSize
+		if offset >= size {
+			return fmt.Errorf("invalid page number: %d", index)
+		}
+		page := m.Data[offset:]
+		if len(page) > PageSize {
+			page = page[:PageSize]
+		}
+		if _, err := io.ReadFull(r, page); err != nil {
+			return err
+		}
+	}
+}
+
+func writeString(w io.Writer, s string) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(s))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+func readString(r io.Reader) (string, error) {
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return "", err
+	}
+	if n > 1<<20 {
+		return "", fmt.Errorf("invalid string length: %d", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
@@ -0,0 +1,56 @@
+package runtime
+
+import "goemu/clock"
+
+// updateTimer reflects the CLINT interrupt lines into mip and fires the RTC
+// alarm when it is due.
+func (cpu *CPU) updateTimer() {
+	cpu.Bus.Rtc.Update()
+	msip, mtip := cpu.Bus.Clint.Pending(cpu.hartid())
+	cpu.Csr[Mip] &^= MsipMask | MtipMask
+	if msip {
+		cpu.Csr[Mip] |= MsipMask
+	}
+	if mtip {
+		cpu.Csr[Mip] |= MtipMask
+	}
+}
+
+// wfi stalls the hart until an enabled interrupt is pending. The hart returns
+// immediately, which the spec allows, but counts as waiting until then, its
+// idle loop standing in for the stall. With a virtual clock, once every hart
+// waits the time jumps to the next deadline: a lone hart does that here, the
+// harts of a machine when its lockstep loop finds them all waiting. Harts
+// running in parallel never share a virtual clock.
+func (cpu *CPU) wfi() {
+	if cpu.Csr[Mip]&cpu.Csr[Mie] != 0 || cpu.Bus.parallel {
+		return
+	}
+	cpu.waiting = true
+	if cpu.Bus.Clint.Harts() == 1 {
+		skipIdle([]*CPU{cpu})
+	}
+}
+
+// skipIdle advances a virtual clock to the earliest timer deadline or RTC
+// alarm any of the waiting harts has enabled, and wakes them up.
+func skipIdle(harts []*CPU) {
+	deadline := ^uint64(0)
+	for _, cpu := range harts {
+		cpu.waiting = false
+		if cpu.Csr[Mie]&MtipMask != 0 && cpu.Bus.Clint.Deadline(cpu.hartid()) < deadline {
+			deadline = cpu.Bus.Clint.Deadline(cpu.hartid())
+		}
+		if cpu.Csr[Mie]&(MeipMask|SeipMask) != 0 && cpu.Bus.Rtc.Deadline() < deadline {
+			deadline = cpu.Bus.Rtc.Deadline()
+		}
+	}
+	v, ok := harts[0].Bus.Clint.Clock.(*clock.Virtual)
+	if !ok || deadline == ^uint64(0) {
+		return
+	}
+	v.Advance(deadline)
+	for _, cpu := range harts {
+		cpu.updateTimer()
+	}
+}
@@ -0,0 +1,112 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Exception codes, as written to mcause and scause.
+const (
+	InstAddrMisaligned  = 0
+	InstAccessFault     = 1
+	IllegalInst         = 2
+	Breakpoint          = 3
+	LoadAddrMisaligned  = 4
+	LoadAccessFault     = 5
+	StoreAddrMisaligned = 6
+	StoreAccessFault    = 7
+	EcallFromU          = 8
+	EcallFromS          = 9
+	EcallFromM          = 11
+	InstPageFault       = 12
+	LoadPageFault       = 13
+	StorePageFault      = 15
+)
+
+// Exception is returned by Execute for a synchronous trap. Step hands it to
+// the host TrapHandler first and otherwise delivers it to the guest.
+type Exception struct {
+	Cause uint64
+	Tval  uint64
+}
+
+func (e *Exception) Error() string {
+	return fmt.Sprintf("exception %d (tval %#x)", e.Cause, e.Tval)
+}
+
+// TrapHandler lets the host service an exception in place of the guest,
+// e.g. to emulate system calls. A handled exception resumes at the Pc the
+// handler left behind.
+type TrapHandler interface {
+	HandleTrap(cpu *CPU, e *Exception) (handled bool, err error)
+}
+
+// ExitError stops the machine on behalf of the guest.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+func (cpu *CPU) trap(err error) error {
+	e, ok := err.(*Exception) // the common case, without reflection
+	if !ok && !errors.As(err, &e) {
+		return err
+	}
+	if cpu.Handler != nil {
+		handled, err := cpu.Handler.HandleTrap(cpu, e)
+		if err != nil || handled {
+			return err
+		}
+	}
+	cpu.takeTrap(e.Cause, e.Tval, false)
+	return nil
+}
+
+// takeTrap enters the trap handler of the privilege level the trap is
+// delegated to, saving the Pc, cause and interrupt-enable state.
+func (cpu *CPU) takeTrap(cause, tval uint64, interrupt bool) {
+	cpu.Traps++
+	deleg := cpu.Csr[Medeleg]
+	if interrupt {
+		deleg = cpu.Csr[Mideleg]
+		cause |= 1 << 63
+	}
+	code := cause &^ (1 << 63)
+
+	if cpu.Level <= SupervisorMode && (deleg>>code)&1 == 1 {
+		tvec := cpu.Csr[Stvec]
+		cpu.Csr[Sepc] = cpu.Pc
+		cpu.Csr[Scause] = cause
+		cpu.Csr[Stval] = tval
+		status := cpu.Csr[Mstatus]
+		status = (status &^ SpieMask) | ((status & SieMask) << 4)
+		status = (status &^ SppMask) | (uint64(cpu.Level&1) << 8)
+		cpu.Csr[Mstatus] = status &^ SieMask
+		cpu.Level = SupervisorMode
+		cpu.Pc = trapTarget(tvec, code, interrupt)
+		return
+	}
+
+	tvec := cpu.Csr[Mtvec]
+	cpu.Csr[Mepc] = cpu.Pc
+	cpu.Csr[Mcause] = cause
+	cpu.Csr[Mtval] = tval
+	status := cpu.Csr[Mstatus]
+	status = (status &^ MpieMask) | ((status & MieMask) << 4)
+	status = (status &^ MppMask) | (uint64(cpu.Level) << 11)
+	cpu.Csr[Mstatus] = status &^ MieMask
+	cpu.Level = MachineMode
+	cpu.Pc = trapTarget(tvec, code, interrupt)
+}
+
+// trapTarget honors the vectored mode of xtvec for interrupts.
+func trapTarget(tvec, code uint64, interrupt bool) uint64 {
+	base := tvec &^ 0b11
+	if interrupt && tvec&0b11 == 1 {
+		return base + 4*code
+	}
+	return base
+}
@@ -0,0 +1,475 @@
+package semihost
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"goemu/clock"
+	"goemu/hostfs"
+	"goemu/runtime"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Semihosting operations, numbered as in the Arm specification the RISC-V
+// convention follows.
+const (
+	SysOpen         = 0x01
+	SysClose        = 0x02
+	SysWritec       = 0x03
+	SysWrite0       = 0x04
+	SysWrite        = 0x05
+	SysRead         = 0x06
+	SysReadc        = 0x07
+	SysIserror      = 0x08
+	SysIstty        = 0x09
+	SysSeek         = 0x0A
+	SysFlen         = 0x0C
+	SysTmpnam       = 0x0D
+	SysRemove       = 0x0E
+	SysRename       = 0x0F
+	SysClock        = 0x10
+	SysTime         = 0x11
+	SysSystem       = 0x12
+	SysErrno        = 0x13
+	SysGetCmdline   = 0x15
+	SysHeapinfo     = 0x16
+	SysExit         = 0x18
+	SysExitExtended = 0x20
+	SysElapsed      = 0x30
+	SysTickfreq     = 0x31
+)
+
+// The instructions around the ebreak that mark a semihosting call.
+const (
+	entryInst = 0x01f01013 // slli x0, x0, 0x1f
+	exitInst  = 0x40705013 // srai x0, x0, 7
+)
+
+const (
+	stoppedApplicationExit = 0x20026
+	ttyName                = ":tt"
+)
+
+// Host services semihosting calls made with ebreak. Files are confined to a
+// host directory, and the console is the standard streams of goemu.
+type Host struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	root    string
+	cmdline string
+	files   map[uint64]*os.File
+	errno   int64
+}
+
+// New serves files from the host directory root and passes cmdline to the
+// guest on request.
+func New(root, cmdline string) (*Host, error) {
+	root, err := hostfs.Root(root)
+	if err != nil {
+		return nil, err
+	}
+	return &Host{
+		Stdin:   os.Stdin,
+		Stdout:  os.Stdout,
+		Stderr:  os.Stderr,
+		root:    root,
+		cmdline: cmdline,
+		files:   make(map[uint64]*os.File),
+	}, nil
+}
+
+// HandleTrap takes breakpoints placed in the semihosting sequence, with the
+// operation in a0 and its parameter in a1. Other traps go to the guest.
+func (h *Host) HandleTrap(cpu *runtime.CPU, e *runtime.Exception) (bool, error) {
+	if e.Cause != runtime.Breakpoint || !isCall(cpu) {
+		return false, nil
+	}
+	ret, err := h.call(cpu, cpu.Regs[10], cpu.Regs[11])
+	if err != nil {
+		return true, err
+	}
+	cpu.Regs[10] = uint64(ret)
+	cpu.Pc += 4
+	return true, nil
+}
+
+func isCall(cpu *runtime.CPU) bool {
+	before, err1 := cpu.Bus.Load(cpu.Pc-4, 4)
+	after, err2 := cpu.Bus.Load(cpu.Pc+4, 4)
+	return err1 == nil && err2 == nil && before == entryInst && after == exitInst
+}
+
+func (h *Host) call(cpu *runtime.CPU, op, param uint64) (int64, error) {
+	c := &call{cpu: cpu, param: param}
+	switch op {
+	case SysOpen:
+		return h.open(c)
+	case SysClose:
+		fd := c.arg(0)
+		if c.err != nil {
+			return -1, nil
+		}
+		return h.close(fd), nil
+	case SysWritec:
+		b, err := cpu.Bus.Load(param, 1)
+		if err != nil {
+			return -1, nil
+		}
+		_, err = h.Stdout.Write([]byte{uint8(b)})
+		return 0, err
+	case SysWrite0:
+		s, ok := c.cstring(param)
+		if !ok {
+			return -1, nil
+		}
+		_, err := io.WriteString(h.Stdout, s)
+		return 0, err
+	case SysWrite:
+		return h.write(c)
+	case SysRead:
+		return h.read(c)
+	case SysReadc:
+		var b [1]byte
+		if _, err := io.ReadFull(h.Stdin, b[:]); err != nil {
+			return -1, nil
+		}
+		return int64(b[0]), nil
+	case SysIserror:
+		if int64(c.arg(0)) < 0 && c.err == nil {
+			return 1, nil
+		}
+		return 0, nil
+	case SysIstty:
+		fd := c.arg(0)
+		if c.err == nil && fd < 3 {
+			return 1, nil
+		}
+		return 0, nil
+	case SysSeek:
+		return h.seek(c)
+	case SysFlen:
+		return h.flen(c)
+	case SysTmpnam:
+		return h.tmpnam(c)
+	case SysRemove:
+		return h.remove(c)
+	case SysRename:
+		return h.rename(c)
+	case SysClock:
+		return int64(cpu.Bus.Clint.Clock.Now() * 100 / clock.Frequency), nil
+	case SysTime:
+		return time.Now().Unix(), nil
+	case SysSystem:
+		return -1, nil
+	case SysErrno:
+		return h.errno, nil
+	case SysGetCmdline:
+		return h.getCmdline(c)
+	case SysHeapinfo:
+		// zero fields leave the heap and stack layout to the C library
+		addr := c.arg(0)
+		if c.err != nil || !c.put(addr, make([]byte, 32)) {
+			return -1, nil
+		}
+		return 0, nil
+	case SysExit, SysExitExtended:
+		reason, code := c.arg(0), c.arg(1)
+		if c.err != nil {
+			return -1, nil
+		}
+		if reason != stoppedApplicationExit {
+			return 0, &runtime.ExitError{Code: 1}
+		}
+		return 0, &runtime.ExitError{Code: int(int32(code))}
+	case SysElapsed:
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], cpu.Bus.Clint.Clock.Now())
+		if !c.put(param, buf[:]) {
+			return -1, nil
+		}
+		return 0, nil
+	case SysTickfreq:
+		return clock.Frequency, nil
+	default:
+		fmt.Fprintf(os.Stderr, "goemu: unimplemented semihosting call %#x\n", op)
+		return -1, nil
+	}
+}
+
+// open follows fopen modes: 0-3 read, 4-7 write and 8-11 append, each with
+// the b and + variants. ":tt" names the console.
+func (h *Host) open(c *call) (int64, error) {
+	name, ok := c.string(c.arg(0), c.arg(2))
+	mode := c.arg(1)
+	if !ok || mode > 11 {
+		h.errno = int64(syscall.EINVAL)
+		return -1, nil
+	}
+	if name == ttyName {
+		return int64(mode / 4), nil
+	}
+	path, err := hostfs.Resolve(h.root, name)
+	if err != nil {
+		return h.fail(err), nil
+	}
+	flags := []int{
+		os.O_RDONLY,
+		os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+		os.O_WRONLY | os.O_CREATE | os.O_APPEND,
+	}[mode/4]
+	if mode&2 != 0 {
+		flags = flags&^os.O_WRONLY | os.O_RDWR
+	}
+	f, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		return h.fail(err), nil
+	}
+	fd := uint64(3)
+	for h.files[fd] != nil {
+		fd++
+	}
+	h.files[fd] = f
+	return int64(fd), nil
+}
+
+func (h *Host) close(fd uint64) int64 {
+	if fd < 3 {
+		return 0
+	}
+	f, ok := h.files[fd]
+	if !ok {
+		h.errno = int64(syscall.EBADF)
+		return -1
+	}
+	delete(h.files, fd)
+	if err := f.Close(); err != nil {
+		return h.fail(err)
+	}
+	return 0
+}
+
+// write returns the number of bytes that were not written.
+func (h *Host) write(c *call) (int64, error) {
+	fd, buf, length := c.arg(0), c.arg(1), c.arg(2)
+	if c.err != nil || length > uint64(len(c.cpu.Bus.Mem.Data)) {
+		return int64(length), nil
+	}
+	data := make([]byte, length)
+	if !c.get(buf, data) {
+		return int64(length), nil
+	}
+	w, ok := h.writer(fd)
+	if !ok {
+		h.errno = int64(syscall.EBADF)
+		return int64(length), nil
+	}
+	n, err := w.Write(data)
+	if err != nil {
+		h.fail(err)
+	}
+	return int64(length) - int64(n), nil
+}
+
+// read returns the number of bytes that were not read, so length at the end
+// of the file.
+func (h *Host) read(c *call) (int64, error) {
+	fd, buf, length := c.arg(0), c.arg(1), c.arg(2)
+	if c.err != nil || length > uint64(len(c.cpu.Bus.Mem.Data)) {
+		return int64(length), nil
+	}
+	r, ok := h.reader(fd)
+	if !ok {
+		h.errno = int64(syscall.EBADF)
+		return int64(length), nil
+	}
+	data := make([]byte, length)
+	n, err := r.Read(data)
+	if err != nil && !errors.Is(err, io.EOF) {
+		h.fail(err)
+		return int64(length), nil
+	}
+	if !c.put(buf, data[:n]) {
+		return int64(length), nil
+	}
+	return int64(length) - int64(n), nil
+}
+
+func (h *Host) seek(c *call) (int64, error) {
+	f, ok := h.files[c.arg(0)]
+	pos := c.arg(1)
+	if c.err != nil || !ok {
+		h.errno = int64(syscall.EBADF)
+		return -1, nil
+	}
+	if _, err := f.Seek(int64(pos), io.SeekStart); err != nil {
+		return h.fail(err), nil
+	}
+	return 0, nil
+}
+
+func (h *Host) flen(c *call) (int64, error) {
+	f, ok := h.files[c.arg(0)]
+	if c.err != nil || !ok {
+		h.errno = int64(syscall.EBADF)
+		return -1, nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return h.fail(err), nil
+	}
+	return info.Size(), nil
+}
+
+// tmpnam hands out names of files inside the directory, unique by id.
+func (h *Host) tmpnam(c *call) (int64, error) {
+	buf, id, length := c.arg(0), c.arg(1), c.arg(2)
+	name := fmt.Sprintf("tmp%03d\x00", id&0xFF)
+	if c.err != nil || uint64(len(name)) > length || !c.put(buf, []byte(name)) {
+		return -1, nil
+	}
+	return 0, nil
+}
+
+func (h *Host) remove(c *call) (int64, error) {
+	name, ok := c.string(c.arg(0), c.arg(1))
+	if !ok {
+		return -1, nil
+	}
+	path, err := hostfs.Resolve(h.root, name)
+	if err == nil {
+		err = os.Remove(path)
+	}
+	if err != nil {
+		return h.fail(err), nil
+	}
+	return 0, nil
+}
+
+func (h *Host) rename(c *call) (int64, error) {
+	from, ok1 := c.string(c.arg(0), c.arg(1))
+	to, ok2 := c.string(c.arg(2), c.arg(3))
+	if !ok1 || !ok2 {
+		return -1, nil
+	}
+	src, err := hostfs.Resolve(h.root, from)
+	if err != nil {
+		return h.fail(err), nil
+	}
+	dst, err := hostfs.Resolve(h.root, to)
+	if err != nil {
+		return h.fail(err), nil
+	}
+	if err = os.Rename(src, dst); err != nil {
+		return h.fail(err), nil
+	}
+	return 0, nil
+}
+
+// getCmdline copies the command line into the buffer and stores its length
+// in the second word of the parameter block.
+func (h *Host) getCmdline(c *call) (int64, error) {
+	buf, length := c.arg(0), c.arg(1)
+	data := append([]byte(h.cmdline), 0)
+	if c.err != nil || uint64(len(data)) > length || !c.put(buf, data) {
+		return -1, nil
+	}
+	var n [8]byte
+	binary.LittleEndian.PutUint64(n[:], uint64(len(data)-1))
+	if !c.put(c.param+8, n[:]) {
+		return -1, nil
+	}
+	return 0, nil
+}
+
+func (h *Host) reader(fd uint64) (io.Reader, bool) {
+	if fd == 0 {
+		return h.Stdin, true
+	}
+	f, ok := h.files[fd]
+	return f, ok
+}
+
+func (h *Host) writer(fd uint64) (io.Writer, bool) {
+	switch fd {
+	case 1:
+		return h.Stdout, true
+	case 2:
+		return h.Stderr, true
+	}
+	f, ok := h.files[fd]
+	return f, ok
+}
+
+// fail records the error number of err for SYS_ERRNO.
+func (h *Host) fail(err error) int64 {
+	var e syscall.Errno
+	switch {
+	case errors.As(err, &e):
+		h.errno = int64(e)
+	case errors.Is(err, fs.ErrNotExist):
+		h.errno = int64(syscall.ENOENT)
+	case errors.Is(err, fs.ErrPermission):
+		h.errno = int64(syscall.EACCES)
+	default:
+		h.errno = int64(syscall.EIO)
+	}
+	return -1
+}
+
+// call reads the parameter block of a semihosting call, a list of words in
+// guest memory. The first failed access is kept in err.
+type call struct {
+	cpu   *runtime.CPU
+	param uint64
+	err   error
+}
+
+func (c *call) arg(i uint64) uint64 {
+	v, err := c.cpu.Bus.Load(c.param+8*i, 8)
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return v
+}
+
+func (c *call) get(addr uint64, data []byte) bool {
+	_, err := c.cpu.Bus.Mem.ReadAt(data, int64(addr))
+	return err == nil
+}
+
+func (c *call) put(addr uint64, data []byte) bool {
+	_, err := c.cpu.Bus.Mem.WriteAt(data, int64(addr))
+	return err == nil
+}
+
+func (c *call) string(addr, length uint64) (string, bool) {
+	if c.err != nil || length > 4096 {
+		return "", false
+	}
+	data := make([]byte, length)
+	if !c.get(addr, data) {
+		return "", false
+	}
+	return string(data), true
+}
+
+func (c *call) cstring(addr uint64) (string, bool) {
+	var s []byte
+	for len(s) < 4096 {
+		b, err := c.cpu.Bus.Load(addr+uint64(len(s)), 1)
+		if err != nil {
+			return "", false
+		}
+		if b == 0 {
+			return string(s), true
+		}
+		s = append(s, uint8(b))
+	}
+	return "", false
+}
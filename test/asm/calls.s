@@ -0,0 +1,45 @@
+.text
+
+# Computes fib(12) recursively through call and ret, then fills a table of
+# squares, loading constants with lui+addi and addresses with la.
+main:
+    li a0, 12
+    call fib
+    mv s0, a0
+    la s1, table
+    li t0, 0
+    li t1, 16
+fill:
+    mul t2, t0, t0
+    sd t2, 0(s1)
+    addi s1, s1, 8
+    addi t0, t0, 1
+    bne t0, t1, fill
+    lui s2, 0x12345
+    addi s2, s2, 0x678
+    la s1, table
+    ld s3, 120(s1)
+    j end
+
+fib:
+    li t0, 2
+    blt a0, t0, 1f
+    addi sp, sp, -16
+    sd ra, 8(sp)
+    sd a0, 0(sp)
+    addi a0, a0, -1
+    call fib
+    ld t1, 0(sp)
+    sd a0, 0(sp)
+    addi a0, t1, -2
+    call fib
+    ld t1, 0(sp)
+    add a0, a0, t1
+    ld ra, 8(sp)
+    addi sp, sp, 16
+1:
+    ret
+
+    .align 12           # off the code's page, or every store retranslates it
+table: .zero 128
+end:
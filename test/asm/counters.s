@@ -0,0 +1,68 @@
+.text
+
+# Reads the counters after writing, inhibiting and selecting events for them,
+# then reads them from user mode, where only instret is enabled.
+main:
+    la t0, handler
+    csrw mtvec, t0
+    csrw minstret, zero
+    nop
+    nop
+    csrr s0, minstret         # 2
+
+    csrwi mcountinhibit, 5    # cycle and instret
+    csrr s1, minstret
+    nop
+    nop
+    csrr s2, minstret         # s1
+    csrwi mcountinhibit, 0
+
+    li t0, 1                  # loads
+    csrw mhpmevent3, t0
+    li t0, 3                  # branches
+    csrw mhpmevent4, t0
+    li t0, 4                  # branches taken
+    csrw mhpmevent5, t0
+    li t0, 5                  # traps
+    csrw mhpmevent6, t0
+    csrw mhpmcounter3, zero
+    csrw mhpmcounter4, zero
+    csrw mhpmcounter5, zero
+    csrw mhpmcounter6, zero
+    la a0, main
+    li t1, 10
+loop:
+    lw t2, 0(a0)
+    addi t1, t1, -1
+    bnez t1, loop
+    ecall
+    csrr s3, mhpmcounter3     # 10
+    csrr s4, mhpmcounter4     # 10
+    csrr s5, mhpmcounter5     # 9
+    csrr s6, mhpmcounter6     # 1
+    csrr s11, mcycle
+
+    li t0, 4                  # instret
+    csrw mcounteren, t0
+    csrw scounteren, t0
+    li t0, 0x1800             # mstatus.MPP
+    csrc mstatus, t0
+    la t0, user
+    csrw mepc, t0
+    mret
+
+user:
+    rdinstret s7
+    rdcycle s9                # illegal instruction
+    j end
+
+    .align 2
+handler:
+    csrr s8, mcause
+    csrr a1, mtval
+    csrr t0, mepc
+    addi t0, t0, 4
+    csrw mepc, t0
+    addi s10, s10, 1
+    mret
+end:
@@ -0,0 +1,41 @@
+.text
+
+# An integer workload in the spirit of Dhrystone: arithmetic, a divide,
+# branches, calls and short loads and stores, 100000 times round, summed
+# into s0.
+main:
+    li s1, 100000
+    li s0, 0
+    la s2, buf
+loop:
+    mv a0, s1
+    call mix
+    add s0, s0, a0
+    andi t0, s1, 7
+    slli t0, t0, 3
+    add t0, s2, t0
+    sd s0, 0(t0)
+    lw t1, 4(t0)
+    add s0, s0, t1
+    addi s1, s1, -1
+    bnez s1, loop
+    j end
+
+# mix scrambles a0 with shifts, a multiply and a remainder.
+mix:
+    slli t0, a0, 5
+    xor a0, a0, t0
+    srli t0, a0, 3
+    add a0, a0, t0
+    li t1, 40503
+    mul a0, a0, t1
+    li t1, 7
+    remu t2, a0, t1
+    beqz t2, 1f
+    addi a0, a0, 1
+1:
+    ret
+
+    .align 12           # off the code's page, or every store retranslates it
+buf: .zero 64
+end:
@@ -0,0 +1,28 @@
+.text
+
+# Copies the first 4 KiB of the image 1 MiB further up, a doubleword at a
+# time, 1000 times round.
+main:
+    li s1, 1000
+round:
+    la a1, main
+    li t0, 0x100000
+    add a0, a1, t0
+    li t0, 4096
+    add a2, a0, t0
+copy:
+    ld t0, 0(a1)
+    ld t1, 8(a1)
+    ld t2, 16(a1)
+    ld t3, 24(a1)
+    sd t0, 0(a0)
+    sd t1, 8(a0)
+    sd t2, 16(a0)
+    sd t3, 24(a0)
+    addi a1, a1, 32
+    addi a0, a0, 32
+    bltu a0, a2, copy
+    addi s1, s1, -1
+    bnez s1, round
+    j end
+end:
@@ -0,0 +1,33 @@
+.text
+.global	_start
+
+# The M extension at the edges: division by zero, signed overflow, the high
+# half of products and the word forms.
+_start:
+	li t0, -9223372036854775808	# INT64_MIN
+	li t1, -1
+	div s0, t0, t1
+	rem s1, t0, t1
+	li t2, 0
+	div s2, t1, t2
+	divu s3, t0, t2
+	rem s4, t0, t2
+	remu s5, t0, t2
+	li t2, 7
+	li t3, -20
+	div s6, t3, t2
+	rem s7, t3, t2
+	remu s8, t3, t2
+	divu s9, t3, t2
+	mulh s10, t0, t0
+	mulhu s11, t1, t1
+	mulhsu a0, t1, t1
+	li t4, -2147483648		# INT32_MIN
+	divw a1, t4, t1
+	remw a2, t4, t1
+	divuw a3, t3, t2
+	remuw a4, t3, t2
+	mulw a5, t4, t1
+	li t5, 0
+	divw a6, t3, t5
+	remuw a7, t4, t5
@@ -0,0 +1,9 @@
+# loads through a NULL pointer, which must kill the process, and otherwise
+# exits with 0
+.global _start
+_start:
+    li a0, 0
+    ld a1, 0(a0)
+    li a0, 0
+    li a7, 93                 # exit
+    ecall
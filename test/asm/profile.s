@@ -0,0 +1,54 @@
+.text
+
+# Calls hot, which loops nine times as long as cold, 1000 times round. Each
+# function sets up a frame the way GCC does with a frame pointer, and sits at
+# a fixed offset so the test knows its range.
+main:
+    andi sp, sp, -16
+    addi sp, sp, -16
+    sd ra, 8(sp)
+    sd s0, 0(sp)
+    addi s0, sp, 16
+    li s1, 1000
+1:
+    call hot
+    call cold
+    addi s1, s1, -1
+    bnez s1, 1b
+    ld ra, 8(sp)
+    ld s0, 0(sp)
+    addi sp, sp, 16
+    j end
+
+    .org 0x100
+hot:
+    addi sp, sp, -16
+    sd ra, 8(sp)
+    sd s0, 0(sp)
+    addi s0, sp, 16
+    li t0, 90
+1:
+    addi t0, t0, -1
+    bnez t0, 1b
+    ld ra, 8(sp)
+    ld s0, 0(sp)
+    addi sp, sp, 16
+    ret
+
+    .org 0x200
+cold:
+    addi sp, sp, -16
+    sd ra, 8(sp)
+    sd s0, 0(sp)
+    addi s0, sp, 16
+    li t0, 10
+1:
+    addi t0, t0, -1
+    bnez t0, 1b
+    ld ra, 8(sp)
+    ld s0, 0(sp)
+    addi sp, sp, 16
+    ret
+
+    .org 0x300
+end:
@@ -0,0 +1,48 @@
+# writes "hi\n" to out.txt through semihosting and exits with 3
+.text
+main:
+	addi sp, sp, -32
+	jal s1, 1f
+	.asciz "out.txt"
+	.balign 4
+1:
+	jal s2, 2f
+	.asciz "hi\n"
+	.balign 4
+2:
+	sd s1, 0(sp)
+	li t0, 4          # "w"
+	sd t0, 8(sp)
+	li t0, 7
+	sd t0, 16(sp)
+	li a0, 0x01       # SYS_OPEN
+	mv a1, sp
+	jal ra, semihost
+	mv s0, a0
+
+	sd s0, 0(sp)
+	sd s2, 8(sp)
+	li t0, 3
+	sd t0, 16(sp)
+	li a0, 0x05       # SYS_WRITE
+	mv a1, sp
+	jal ra, semihost
+
+	sd s0, 0(sp)
+	li a0, 0x02       # SYS_CLOSE
+	mv a1, sp
+	jal ra, semihost
+
+	li t0, 0x20026    # ADP_Stopped_ApplicationExit
+	sd t0, 0(sp)
+	li t0, 3
+	sd t0, 8(sp)
+	li a0, 0x18       # SYS_EXIT
+	mv a1, sp
+	jal ra, semihost
+
+semihost:
+	slli x0, x0, 0x1f
+	ebreak
+	srai x0, x0, 7
+	ret
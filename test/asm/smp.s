@@ -0,0 +1,47 @@
+.text
+
+# Every hart bumps a counter with amoadd and, under a spinlock taken with
+# lr/sc and fenced, a plain one. Hart 0 waits for the others and loads both totals.
+main:
+    csrr s0, mhartid
+    la s1, counter
+    la s2, lock
+    la s3, shared
+    la s4, done
+    li t0, 100
+loop:
+    li t1, 1
+    amoadd.w zero, t1, (s1)
+acquire:
+    lr.w t2, (s2)
+    bnez t2, acquire
+    li t2, 1
+    sc.w t3, t2, (s2)
+    bnez t3, acquire
+    fence r, rw
+    ld t4, 0(s3)
+    addi t4, t4, 1
+    sd t4, 0(s3)
+    fence rw, w
+    amoswap.w zero, zero, (s2)
+    addi t0, t0, -1
+    bnez t0, loop
+    li t1, 1
+    amoadd.w zero, t1, (s4)
+    fence.i
+    bnez s0, end
+wait:
+    lw t5, 0(s4)
+    li t6, 4
+    bne t5, t6, wait
+    lw a0, 0(s1)
+    ld a1, 0(s3)
+    mv a2, s0
+    j end
+
+    .align 3
+counter: .dword 0
+lock:    .dword 0
+shared:  .dword 0
+done:    .dword 0
+end:
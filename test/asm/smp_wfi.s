@@ -0,0 +1,38 @@
+.text
+
+# Hart 1 reads the time, lets hart 0 go and stays busy while hart 0 waits in
+# wfi for a distant timer. The time only skips ahead once hart 1 is done.
+main:
+    csrr s0, mhartid
+    la s1, started
+    bnez s0, busy
+wait:
+    ld t0, 0(s1)
+    beqz t0, wait
+    li t0, 0x2004000    # mtimecmp of hart 0
+    li t1, 1000000
+    sd t1, 0(t0)
+    li t1, 0x80         # MTIE
+    csrs mie, t1
+idle:
+    wfi
+    csrr t2, mip
+    andi t2, t2, 0x80
+    beqz t2, idle
+    rdtime a0
+    j end
+busy:
+    rdtime s2
+    li t0, 1
+    sd t0, 0(s1)
+    li t0, 10000
+spin:
+    addi t0, t0, -1
+    bnez t0, spin
+    rdtime s3
+    sub a1, s3, s2
+    j end
+
+    .align 3
+started: .dword 0
+end:
@@ -0,0 +1,39 @@
+# makes system calls with sizes that do not fit in guest memory, keeping the
+# results in s0 to s4, and exits with 0
+.global _start
+_start:
+    li a0, 0
+    li a1, 0x1000
+    li a2, 0x4000000000000000
+    li a7, 63                 # read
+    ecall
+    mv s0, a0
+    li a0, 0x1000
+    li a1, -1
+    li a2, 0
+    li a7, 278                # getrandom
+    ecall
+    mv s1, a0
+    li a0, 0
+    li a1, -4096
+    li a2, 3                  # PROT_READ|PROT_WRITE
+    li a3, 0x22               # MAP_PRIVATE|MAP_ANONYMOUS
+    li a4, -1
+    li a5, 0
+    li a7, 222                # mmap
+    ecall
+    mv s2, a0
+    li a0, 0x10000000
+    li a1, -4096
+    li a3, 0x32               # MAP_PRIVATE|MAP_ANONYMOUS|MAP_FIXED
+    li a7, 222                # mmap
+    ecall
+    mv s3, a0
+    li a0, 0x10000000
+    li a1, -4096
+    li a7, 215                # munmap
+    ecall
+    mv s4, a0
+    li a0, 0
+    li a7, 94                 # exit_group
+    ecall
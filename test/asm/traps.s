@@ -0,0 +1,23 @@
+.text
+
+# Takes 100000 environment calls, each returning from a machine mode handler
+# that counts them in s0.
+main:
+    la t0, handler
+    csrw mtvec, t0
+    li s0, 0
+    li s1, 100000
+loop:
+    ecall
+    addi s1, s1, -1
+    bnez s1, loop
+    j end
+
+    .align 2
+handler:
+    csrr t0, mepc
+    addi t0, t0, 4
+    csrw mepc, t0
+    addi s0, s0, 1
+    mret
+end:
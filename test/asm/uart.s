@@ -0,0 +1,9 @@
+.text
+
+main:
+    li t0, 0x10000000
+wait:
+    lb t1, 5(t0)        # LSR
+    andi t1, t1, 1      # data ready
+    beq t1, zero, wait
+    lb t2, 0(t0)        # RHR
@@ -0,0 +1,25 @@
+# writes "hi\n" to out.txt in the sandbox and exits with 7
+.global _start
+_start:
+    addi sp, sp, -16
+    li t0, 0x7478742e74756f   # "out.txt"
+    sd t0, 0(sp)
+    li t0, 0x0a6968           # "hi\n"
+    sd t0, 8(sp)
+    li a0, -100               # AT_FDCWD
+    mv a1, sp
+    li a2, 0x241              # O_WRONLY|O_CREAT|O_TRUNC
+    li a3, 0644
+    li a7, 56                 # openat
+    ecall
+    mv s0, a0
+    addi a1, sp, 8
+    li a2, 3
+    li a7, 64                 # write
+    ecall
+    mv a0, s0
+    li a7, 57                 # close
+    ecall
+    li a0, 7
+    li a7, 94                 # exit_group
+    ecall
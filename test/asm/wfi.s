@@ -0,0 +1,11 @@
+.text
+
+main:
+    li t0, 0x2004000    # mtimecmp
+    li t1, 1000
+    sd t1, 0(t0)
+    li t1, 0x80         # MTIE
+    csrrs zero, mie, t1
+    wfi
+    csrr t2, mip
+    rdtime t3
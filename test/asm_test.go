@@ -1,6 +1,7 @@
 package test
 
 import (
+	"goemu/clock"
 	"goemu/runtime"
 	"goemu/util"
 	"os"
@@ -8,6 +9,11 @@ import (
 )
 
 func newAsmRuntime(name string) *runtime.CPU {
+	return runtime.NewCPU(asmImage(name))
+}
+
+// asmImage assembles asm/name.s into a raw image.
+func asmImage(name string) []byte {
 	pwd, _ := os.Getwd()
 	filepath := pwd + "/asm/"
 	util.Compile(filepath+name+".s", filepath+name+".elf")
@@ -16,7 +22,7 @@ func newAsmRuntime(name string) *runtime.CPU {
 	if err != nil {
 		panic(err)
 	}
-	return runtime.NewCPU(bits)
+	return bits
 }
 
 func TestAddi(t *testing.T) {
@@ -163,6 +169,36 @@ func TestNot(t *testing.T) {
 	assertEq(t, cpu.Regs[7], cpu.Regs[5])
 }
 
+func TestMulDiv(t *testing.T) {
+	for _, reference := range []bool{false, true} {
+		cpu := newAsmRuntime("muldiv")
+		cpu.Reference = reference
+		if err := cpu.Run(); err != nil {
+			t.Fatal(err)
+		}
+		assertEq(t, 0x8000000000000000, cpu.Regs[8])  // s0
+		assertEq(t, 0x0, cpu.Regs[9])                 // s1
+		assertEq(t, 0xffffffffffffffff, cpu.Regs[18]) // s2
+		assertEq(t, 0xffffffffffffffff, cpu.Regs[19]) // s3
+		assertEq(t, 0x8000000000000000, cpu.Regs[20]) // s4
+		assertEq(t, 0x8000000000000000, cpu.Regs[21]) // s5
+		assertEq(t, 0xfffffffffffffffe, cpu.Regs[22]) // s6
+		assertEq(t, 0xfffffffffffffffa, cpu.Regs[23]) // s7
+		assertEq(t, 0x3, cpu.Regs[24])                // s8
+		assertEq(t, 0x249249249249248f, cpu.Regs[25]) // s9
+		assertEq(t, 0x4000000000000000, cpu.Regs[26]) // s10
+		assertEq(t, 0xfffffffffffffffe, cpu.Regs[27]) // s11
+		assertEq(t, 0xffffffffffffffff, cpu.Regs[10]) // a0
+		assertEq(t, 0xffffffff80000000, cpu.Regs[11]) // a1
+		assertEq(t, 0x0, cpu.Regs[12])                // a2
+		assertEq(t, 0x24924921, cpu.Regs[13])         // a3
+		assertEq(t, 0x5, cpu.Regs[14])                // a4
+		assertEq(t, 0xffffffff80000000, cpu.Regs[15]) // a5
+		assertEq(t, 0xffffffffffffffff, cpu.Regs[16]) // a6
+		assertEq(t, 0xffffffff80000000, cpu.Regs[17]) // a7
+	}
+}
+
 func TestCsr(t *testing.T) {
 	cpu := newAsmRuntime("csr")
 	if err := cpu.Run(); err != nil {
@@ -176,6 +212,18 @@ func TestCsr(t *testing.T) {
 	assertEq(t, 5, cpu.Csr[runtime.Sepc])
 }
 
+func TestWfi(t *testing.T) {
+	cpu := newAsmRuntime("wfi")
+	cpu.Bus.Clint.Clock = clock.NewVirtual(1, func() uint64 { return cpu.Instret })
+	if err := cpu.Run(); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, runtime.MtipMask, cpu.Regs[7]&runtime.MtipMask)
+	if cpu.Regs[28] < 1000 {
+		t.Errorf("time did not reach the deadline: %d", cpu.Regs[28])
+	}
+}
+
 //func TestSb(t *testing.T) {
 //	cpu := newAsmRuntime("sb")
 //	if err := cpu.Run(); err != nil {
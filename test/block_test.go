@@ -0,0 +1,86 @@
+package test
+
+import (
+	"goemu/runtime"
+	"testing"
+)
+
+func TestBlocks(t *testing.T) {
+	cpu := newAsmRuntime("calls")
+	if err := cpu.Run(); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, 144, cpu.Regs[8])
+	assertEq(t, 0x12345678, cpu.Regs[18])
+	assertEq(t, 225, cpu.Regs[19])
+}
+
+// TestBlocksMatchReference runs programs both in translated blocks and in
+// the reference interpreter.
+func TestBlocksMatchReference(t *testing.T) {
+	for _, name := range []string{"calls", "fib", "la", "li", "jalr", "sb", "user"} {
+		image := asmImage(name)
+		run := func(reference bool) *runtime.CPU {
+			cpu := runtime.NewCPU(image)
+			cpu.Reference = reference
+			if err := cpu.Run(); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			return cpu
+		}
+		a, b := run(false), run(true)
+		if a.Regs != b.Regs || a.Pc != b.Pc || a.Instret != b.Instret {
+			t.Errorf("%s: blocks ended with %x at pc %x after %d, reference with %x at pc %x after %d",
+				name, a.Regs, a.Pc, a.Instret, b.Regs, b.Pc, b.Instret)
+		}
+	}
+
+	run := func(reference bool) []uint64 {
+		m := runtime.NewMachine(asmImage("smp"), 4)
+		m.Quantum = 5
+		for _, h := range m.Harts {
+			h.Reference = reference
+		}
+		if err := m.Run(func() bool { return false }); err != nil {
+			t.Fatal(err)
+		}
+		var instret []uint64
+		for _, h := range m.Harts {
+			instret = append(instret, h.Instret)
+		}
+		return instret
+	}
+	a, b := run(false), run(true)
+	for i := range a {
+		assertEq(t, b[i], a[i])
+	}
+}
+
+func TestBlocksBudget(t *testing.T) {
+	cpu := runtime.NewCPU(nil)
+	store(t, cpu, 0x80000000, 4, 0x123452B7) // lui t0, 0x12345
+	store(t, cpu, 0x80000004, 4, 0x67828293) // addi t0, t0, 0x678
+	store(t, cpu, 0x80000008, 4, 0x00150513) // addi a0, a0, 1
+	store(t, cpu, 0x8000000C, 4, 0xFF5FF06F) // j -12
+
+	// the fused pair is split at the end of the budget
+	if err := cpu.StepN(1); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, 1, cpu.Instret)
+	assertEq(t, 0x80000004, cpu.Pc)
+	assertEq(t, 0x12345000, cpu.Regs[5])
+	if err := cpu.StepN(10); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, 11, cpu.Instret)
+	assertEq(t, 0x12345678, cpu.Regs[5])
+	assertEq(t, 3, cpu.Regs[10])
+
+	// a store to the loop replaces its blocks
+	store(t, cpu, 0x80000008, 4, 0x00A50513) // addi a0, a0, 10
+	if err := cpu.StepN(8); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, 23, cpu.Regs[10])
+}
@@ -0,0 +1,362 @@
+/*
+ * A benchmark workload after CoreMark: its linked list search, reversal and
+ * merge sort, its small matrix operations, its number scanning state machine
+ * and its CRC-16, run ITERATIONS times with the CRC of each result feeding the
+ * next. The image is only the .text section of a program without a C runtime,
+ * so everything lives on the stack, the input is generated instead of being
+ * initialized data, and the state machine branches instead of switching. It
+ * leaves the final CRC in a0, which is not a CoreMark score.
+ */
+
+#define ITERATIONS 60
+#define LIST_SIZE 64
+#define MATRIX_N 8
+#define STATE_SIZE 256
+
+typedef unsigned char u8;
+typedef unsigned short u16;
+typedef short s16;
+typedef int s32;
+typedef unsigned int u32;
+
+unsigned long bench(void);
+
+#ifdef __riscv
+/* aligns the stack and returns from bench to address 0, out of the image */
+__attribute__((naked, section(".text.startup"))) void _start(void) {
+    asm volatile("andi sp, sp, -16\n\tj bench");
+}
+#endif
+
+static u16 crcu8(u8 data, u16 crc) {
+    int i;
+    for (i = 0; i < 8; i++) {
+        u8 x16 = (u8)((data & 1) ^ ((u8)crc & 1));
+        data >>= 1;
+        if (x16 == 1) {
+            crc ^= 0x4002;
+            crc = (u16)((crc >> 1) | 0x8000);
+        } else {
+            crc >>= 1;
+        }
+    }
+    return crc;
+}
+
+static u16 crcu16(u16 v, u16 crc) {
+    crc = crcu8((u8)v, crc);
+    return crcu8((u8)(v >> 8), crc);
+}
+
+static u16 crcu32(u32 v, u16 crc) {
+    crc = crcu16((u16)v, crc);
+    return crcu16((u16)(v >> 16), crc);
+}
+
+/* list */
+
+typedef struct Node {
+    struct Node *next;
+    s16 data;
+    s16 idx;
+} Node;
+
+static int cmp_data(Node *a, Node *b) {
+    return a->data - b->data;
+}
+
+static int cmp_idx(Node *a, Node *b) {
+    return a->idx - b->idx;
+}
+
+static Node *list_init(Node *nodes, u16 seed) {
+    int i;
+    for (i = 0; i < LIST_SIZE; i++) {
+        nodes[i].next = i + 1 < LIST_SIZE ? &nodes[i + 1] : 0;
+        nodes[i].idx = (s16)i;
+        nodes[i].data = (s16)(((u32)(i * 0x3579) ^ seed) & 0x7fff);
+    }
+    return nodes;
+}
+
+static Node *list_find(Node *list, s16 data) {
+    while (list != 0 && list->data != data)
+        list = list->next;
+    return list;
+}
+
+static Node *list_reverse(Node *list) {
+    Node *prev = 0;
+    while (list != 0) {
+        Node *next = list->next;
+        list->next = prev;
+        prev = list;
+        list = next;
+    }
+    return prev;
+}
+
+/* list_mergesort is the bottom up merge sort of CoreMark's core_list_mergesort. */
+static Node *list_mergesort(Node *list, int (*cmp)(Node *, Node *)) {
+    int insize = 1;
+    for (;;) {
+        Node *p = list, *tail = 0;
+        int nmerges = 0;
+        list = 0;
+        while (p != 0) {
+            Node *q = p, *e;
+            int psize = 0, qsize = insize, i;
+            nmerges++;
+            for (i = 0; i < insize && q != 0; i++) {
+                psize++;
+                q = q->next;
+            }
+            while (psize > 0 || (qsize > 0 && q != 0)) {
+                if (psize == 0) {
+                    e = q;
+                    q = q->next;
+                    qsize--;
+                } else if (qsize == 0 || q == 0 || cmp(p, q) <= 0) {
+                    e = p;
+                    p = p->next;
+                    psize--;
+                } else {
+                    e = q;
+                    q = q->next;
+                    qsize--;
+                }
+                if (tail != 0)
+                    tail->next = e;
+                else
+                    list = e;
+                tail = e;
+            }
+            p = q;
+        }
+        tail->next = 0;
+        if (nmerges <= 1)
+            return list;
+        insize *= 2;
+    }
+}
+
+static u16 bench_list(Node *nodes, u16 seed, u16 crc) {
+    Node *list = list_init(nodes, seed), *n;
+    int i;
+
+    for (i = 0; i < 8; i++) {
+        n = list_find(list, nodes[(i * 7 + seed) % LIST_SIZE].data);
+        crc = crcu16((u16)(n != 0 ? n->idx : -1), crc);
+        n = list_find(list, (s16)(i * 0x111));
+        crc = crcu16((u16)(n != 0 ? n->idx : -1), crc);
+        list = list_reverse(list);
+    }
+    list = list_mergesort(list, cmp_data);
+    for (n = list; n != 0; n = n->next)
+        crc = crcu16((u16)n->data, crc);
+    list = list_mergesort(list, cmp_idx);
+    for (n = list; n != 0; n = n->next)
+        crc = crcu16((u16)n->idx, crc);
+    return crc;
+}
+
+/* matrix */
+
+static u16 matrix_crc(s32 c[MATRIX_N][MATRIX_N], u16 crc) {
+    int i, j;
+    for (i = 0; i < MATRIX_N; i++)
+        for (j = 0; j < MATRIX_N; j++)
+            crc = crcu32((u32)c[i][j], crc);
+    return crc;
+}
+
+static u16 bench_matrix(u16 seed, u16 crc) {
+    s16 a[MATRIX_N][MATRIX_N], b[MATRIX_N][MATRIX_N];
+    s32 c[MATRIX_N][MATRIX_N], v[MATRIX_N];
+    s16 val = (s16)(seed & 0xff);
+    int i, j, k;
+
+    for (i = 0; i < MATRIX_N; i++) {
+        for (j = 0; j < MATRIX_N; j++) {
+            a[i][j] = (s16)((i * j + seed) % 100 - 50);
+            b[i][j] = (s16)((i + j * seed) % 64 - 32);
+        }
+    }
+
+    /* add and multiply by a constant */
+    for (i = 0; i < MATRIX_N; i++)
+        for (j = 0; j < MATRIX_N; j++)
+            a[i][j] = (s16)(a[i][j] + val);
+    for (i = 0; i < MATRIX_N; i++)
+        for (j = 0; j < MATRIX_N; j++)
+            c[i][j] = (s32)a[i][j] * val;
+    crc = matrix_crc(c, crc);
+
+    /* multiply by a vector */
+    for (i = 0; i < MATRIX_N; i++) {
+        v[i] = 0;
+        for (j = 0; j < MATRIX_N; j++)
+            v[i] += (s32)a[i][j] * b[j][0];
+        crc = crcu32((u32)v[i], crc);
+    }
+
+    /* multiply by a matrix, then again keeping bit fields of the products */
+    for (i = 0; i < MATRIX_N; i++) {
+        for (j = 0; j < MATRIX_N; j++) {
+            c[i][j] = 0;
+            for (k = 0; k < MATRIX_N; k++)
+                c[i][j] += (s32)a[i][k] * b[k][j];
+        }
+    }
+    crc = matrix_crc(c, crc);
+    for (i = 0; i < MATRIX_N; i++) {
+        for (j = 0; j < MATRIX_N; j++) {
+            c[i][j] = 0;
+            for (k = 0; k < MATRIX_N; k++) {
+                s32 t = (s32)a[i][k] * b[k][j];
+                c[i][j] += ((t >> 2) & 0xf) * ((t >> 5) & 0x7f);
+            }
+        }
+    }
+    return matrix_crc(c, crc);
+}
+
+/* state machine */
+
+enum { START, INVALID, S1, S2, INT, FLOAT, EXPONENT, SCIENTIFIC, NUM_STATES };
+
+static int is_digit(u8 c) {
+    return c >= '0' && c <= '9';
+}
+
+/* state_transition scans one comma separated token and returns the state it
+ * ends in, counting every transition. */
+static int state_transition(u8 **instr, u32 *transitions) {
+    u8 *str = *instr;
+    int state = START;
+
+    for (; *str != 0 && state != INVALID; str++) {
+        u8 c = *str;
+        if (c == ',') {
+            str++;
+            break;
+        }
+        if (state == START) {
+            if (is_digit(c))
+                state = INT;
+            else if (c == '+' || c == '-')
+                state = S1;
+            else if (c == '.')
+                state = FLOAT;
+            else
+                state = INVALID;
+        } else if (state == S1) {
+            if (is_digit(c))
+                state = INT;
+            else if (c == '.')
+                state = FLOAT;
+            else
+                state = INVALID;
+        } else if (state == INT) {
+            if (c == '.')
+                state = FLOAT;
+            else if (!is_digit(c))
+                state = INVALID;
+        } else if (state == FLOAT) {
+            if (c == 'E' || c == 'e')
+                state = S2;
+            else if (!is_digit(c))
+                state = INVALID;
+        } else if (state == S2) {
+            if (c == '+' || c == '-')
+                state = EXPONENT;
+            else
+                state = INVALID;
+        } else if (state == EXPONENT) {
+            if (is_digit(c))
+                state = SCIENTIFIC;
+            else
+                state = INVALID;
+        } else if (state == SCIENTIFIC) {
+            if (!is_digit(c))
+                state = INVALID;
+        }
+        transitions[state]++;
+    }
+    *instr = str;
+    return state;
+}
+
+/* state_input writes comma separated tokens that are integers, decimals,
+ * numbers in scientific notation or invalid. */
+static void state_input(u8 *s, u16 seed) {
+    u32 r = seed;
+    int n = 0, i, len;
+
+    while (n < STATE_SIZE - 16) {
+        r = r * 1103515245 + 12345;
+        len = 1 + (r >> 16) % 4;
+        if ((r >> 8) % 4 == 1)
+            s[n++] = '-';
+        for (i = 0; i < len; i++)
+            s[n++] = '0' + (r >> (i * 3)) % 10;
+        if ((r >> 12) % 3 == 1) {
+            s[n++] = '.';
+            s[n++] = '0' + (r >> 20) % 10;
+            if ((r >> 24) % 2 == 1) {
+                s[n++] = 'e';
+                s[n++] = '+';
+                s[n++] = '0' + (r >> 25) % 10;
+            }
+        } else if ((r >> 12) % 3 == 2 && (r >> 26) % 4 == 0) {
+            s[n++] = 'x';
+        }
+        s[n++] = ',';
+    }
+    /* zeroes the rest too, where bench_state's stride of 5 may stop */
+    while (n < STATE_SIZE)
+        s[n++] = 0;
+}
+
+static u16 bench_state(u8 *s, u16 seed, u16 crc) {
+    u32 final[NUM_STATES], transitions[NUM_STATES];
+    u8 *p;
+    int i;
+
+    state_input(s, seed);
+    for (i = 0; i < NUM_STATES; i++) {
+        final[i] = 0;
+        transitions[i] = 0;
+    }
+    for (p = s; *p != 0;)
+        final[state_transition(&p, transitions)]++;
+
+    /* corrupt the input and scan it again */
+    for (i = 0; s[i] != 0; i += 5) {
+        if (s[i] != ',')
+            s[i] ^= (u8)(seed & 0x7);
+    }
+    for (p = s; *p != 0;)
+        final[state_transition(&p, transitions)]++;
+
+    for (i = 0; i < NUM_STATES; i++) {
+        crc = crcu32(final[i], crc);
+        crc = crcu32(transitions[i], crc);
+    }
+    return crc;
+}
+
+unsigned long bench(void) {
+    Node nodes[LIST_SIZE];
+    u8 state[STATE_SIZE];
+    u16 crc = 0, seed = 0x66;
+    int i;
+
+    for (i = 0; i < ITERATIONS; i++) {
+        crc = bench_list(nodes, seed, crc);
+        crc = bench_matrix(seed, crc);
+        crc = bench_state(state, seed, crc);
+        seed = (u16)(crc | 1);
+    }
+    return crc;
+}
@@ -0,0 +1,267 @@
+/*
+ * A benchmark workload after Dhrystone 2.1: its procedures, records, string
+ * copies and comparisons and array accesses, run LOOPS times. The image is
+ * only the .text section of a program without a C runtime, so the globals
+ * live in a struct on the stack, the strings are generated instead of being
+ * literals, and no switch may compile to a jump table. It leaves a checksum
+ * of its final state in a0, which is not a Dhrystone score.
+ */
+
+#define LOOPS 20000
+
+typedef enum { Ident_1, Ident_2, Ident_3, Ident_4, Ident_5 } Enumeration;
+
+typedef struct Record {
+    struct Record *Ptr_Comp;
+    Enumeration Discr;
+    Enumeration Enum_Comp;
+    int Int_Comp;
+    char Str_Comp[31];
+} Rec_Type, *Rec_Pointer;
+
+typedef struct {
+    Rec_Pointer Ptr_Glob;
+    Rec_Pointer Next_Ptr_Glob;
+    int Int_Glob;
+    int Bool_Glob;
+    unsigned char Ch_1_Glob;
+    unsigned char Ch_2_Glob;
+    int Arr_1_Glob[50];
+    int Arr_2_Glob[50][50];
+} Globals;
+
+unsigned long bench(void);
+
+#ifdef __riscv
+/* aligns the stack and returns from bench to address 0, out of the image */
+__attribute__((naked, section(".text.startup"))) void _start(void) {
+    asm volatile("andi sp, sp, -16\n\tj bench");
+}
+#endif
+
+/* fill makes the 30 character strings the benchmark compares, which differ
+ * only in their 21st character. */
+static void fill(unsigned char *s, unsigned char variant) {
+    int i;
+    for (i = 0; i < 30; i++)
+        s[i] = 'A' + i % 26;
+    s[20] = variant;
+    s[30] = 0;
+}
+
+static void str_cpy(unsigned char *d, const unsigned char *s) {
+    while ((*d++ = *s++) != 0)
+        ;
+}
+
+static int str_cmp(const unsigned char *a, const unsigned char *b) {
+    while (*a != 0 && *a == *b) {
+        a++;
+        b++;
+    }
+    return *a - *b;
+}
+
+static void copy_rec(Rec_Pointer d, Rec_Pointer s) {
+    d->Ptr_Comp = s->Ptr_Comp;
+    d->Discr = s->Discr;
+    d->Enum_Comp = s->Enum_Comp;
+    d->Int_Comp = s->Int_Comp;
+    str_cpy((unsigned char *)d->Str_Comp, (unsigned char *)s->Str_Comp);
+}
+
+static void Proc_7(int Int_1_Par_Val, int Int_2_Par_Val, int *Int_Par_Ref) {
+    int Int_Loc = Int_1_Par_Val + 2;
+    *Int_Par_Ref = Int_2_Par_Val + Int_Loc;
+}
+
+static int Func_3(Enumeration Enum_Par_Val) {
+    return Enum_Par_Val == Ident_3;
+}
+
+static void Proc_6(Enumeration Enum_Val_Par, Enumeration *Enum_Ref_Par, Globals *g) {
+    *Enum_Ref_Par = Enum_Val_Par;
+    if (!Func_3(Enum_Val_Par))
+        *Enum_Ref_Par = Ident_4;
+    if (Enum_Val_Par == Ident_1)
+        *Enum_Ref_Par = Ident_1;
+    else if (Enum_Val_Par == Ident_2)
+        *Enum_Ref_Par = g->Int_Glob > 100 ? Ident_1 : Ident_4;
+    else if (Enum_Val_Par == Ident_3)
+        *Enum_Ref_Par = Ident_2;
+    else if (Enum_Val_Par == Ident_5)
+        *Enum_Ref_Par = Ident_3;
+}
+
+static void Proc_3(Rec_Pointer *Ptr_Ref_Par, Globals *g) {
+    if (g->Ptr_Glob != 0)
+        *Ptr_Ref_Par = g->Ptr_Glob->Ptr_Comp;
+    Proc_7(10, g->Int_Glob, &g->Ptr_Glob->Int_Comp);
+}
+
+static void Proc_1(Rec_Pointer Ptr_Val_Par, Globals *g) {
+    Rec_Pointer Next_Record = Ptr_Val_Par->Ptr_Comp;
+
+    copy_rec(Ptr_Val_Par->Ptr_Comp, g->Ptr_Glob);
+    Ptr_Val_Par->Int_Comp = 5;
+    Next_Record->Int_Comp = Ptr_Val_Par->Int_Comp;
+    Next_Record->Ptr_Comp = Ptr_Val_Par->Ptr_Comp;
+    Proc_3(&Next_Record->Ptr_Comp, g);
+    if (Next_Record->Discr == Ident_1) {
+        Next_Record->Int_Comp = 6;
+        Proc_6(Ptr_Val_Par->Enum_Comp, &Next_Record->Enum_Comp, g);
+        Next_Record->Ptr_Comp = g->Ptr_Glob->Ptr_Comp;
+        Proc_7(Next_Record->Int_Comp, 10, &Next_Record->Int_Comp);
+    } else {
+        copy_rec(Ptr_Val_Par, Ptr_Val_Par->Ptr_Comp);
+    }
+}
+
+static void Proc_2(int *Int_Par_Ref, Globals *g) {
+    int Int_Loc = *Int_Par_Ref + 10;
+    Enumeration Enum_Loc = Ident_2;
+
+    do {
+        if (g->Ch_1_Glob == 'A') {
+            Int_Loc -= 1;
+            *Int_Par_Ref = Int_Loc - g->Int_Glob;
+            Enum_Loc = Ident_1;
+        }
+    } while (Enum_Loc != Ident_1);
+}
+
+static void Proc_4(Globals *g) {
+    int Bool_Loc = g->Ch_1_Glob == 'A';
+    g->Bool_Glob = Bool_Loc | g->Bool_Glob;
+    g->Ch_2_Glob = 'B';
+}
+
+static void Proc_5(Globals *g) {
+    g->Ch_1_Glob = 'A';
+    g->Bool_Glob = 0;
+}
+
+static void Proc_8(int Arr_1_Par_Ref[50], int Arr_2_Par_Ref[50][50], int Int_1_Par_Val, int Int_2_Par_Val, Globals *g) {
+    int Int_Index;
+    int Int_Loc = Int_1_Par_Val + 5;
+
+    Arr_1_Par_Ref[Int_Loc] = Int_2_Par_Val;
+    Arr_1_Par_Ref[Int_Loc + 1] = Arr_1_Par_Ref[Int_Loc];
+    Arr_1_Par_Ref[Int_Loc + 30] = Int_Loc;
+    for (Int_Index = Int_Loc; Int_Index <= Int_Loc + 1; ++Int_Index)
+        Arr_2_Par_Ref[Int_Loc][Int_Index] = Int_Loc;
+    Arr_2_Par_Ref[Int_Loc][Int_Loc - 1] += 1;
+    Arr_2_Par_Ref[Int_Loc + 20][Int_Loc] = Arr_1_Par_Ref[Int_Loc];
+    g->Int_Glob = 5;
+}
+
+static Enumeration Func_1(unsigned char Ch_1_Par_Val, unsigned char Ch_2_Par_Val, Globals *g) {
+    unsigned char Ch_1_Loc = Ch_1_Par_Val;
+    unsigned char Ch_2_Loc = Ch_1_Loc;
+
+    if (Ch_2_Loc != Ch_2_Par_Val)
+        return Ident_1;
+    g->Ch_1_Glob = Ch_1_Loc;
+    return Ident_2;
+}
+
+static int Func_2(unsigned char *Str_1_Par_Ref, unsigned char *Str_2_Par_Ref, Globals *g) {
+    int Int_Loc = 2;
+    unsigned char Ch_Loc = 0;
+
+    while (Int_Loc <= 2) {
+        if (Func_1(Str_1_Par_Ref[Int_Loc], Str_2_Par_Ref[Int_Loc + 1], g) == Ident_1) {
+            Ch_Loc = 'A';
+            Int_Loc += 1;
+        }
+    }
+    if (Ch_Loc >= 'W' && Ch_Loc < 'Z')
+        Int_Loc = 7;
+    if (Ch_Loc == 'R')
+        return 1;
+    if (str_cmp(Str_1_Par_Ref, Str_2_Par_Ref) > 0) {
+        Int_Loc += 7;
+        g->Int_Glob = Int_Loc;
+        return 1;
+    }
+    return 0;
+}
+
+unsigned long bench(void) {
+    Globals g;
+    Rec_Type Glob, Next_Glob;
+    unsigned char Str_1_Loc[31], Str_2_Loc[31];
+    int Int_1_Loc = 0, Int_2_Loc = 0, Int_3_Loc = 0;
+    unsigned char Ch_Index;
+    Enumeration Enum_Loc = Ident_1;
+    int Run_Index, i, j;
+    unsigned long sum;
+
+    for (i = 0; i < 50; i++) {
+        g.Arr_1_Glob[i] = 0;
+        for (j = 0; j < 50; j++)
+            g.Arr_2_Glob[i][j] = 0;
+    }
+    g.Int_Glob = 0;
+    g.Bool_Glob = 0;
+    g.Ch_1_Glob = 0;
+    g.Ch_2_Glob = 0;
+    g.Next_Ptr_Glob = &Next_Glob;
+    g.Ptr_Glob = &Glob;
+    Glob.Ptr_Comp = g.Next_Ptr_Glob;
+    Glob.Discr = Ident_1;
+    Glob.Enum_Comp = Ident_3;
+    Glob.Int_Comp = 40;
+    fill((unsigned char *)Glob.Str_Comp, 'S');
+    fill(Str_1_Loc, '1');
+    g.Arr_2_Glob[8][7] = 10;
+
+    for (Run_Index = 1; Run_Index <= LOOPS; ++Run_Index) {
+        Proc_5(&g);
+        Proc_4(&g);
+        Int_1_Loc = 2;
+        Int_2_Loc = 3;
+        fill(Str_2_Loc, '2');
+        Enum_Loc = Ident_2;
+        g.Bool_Glob = !Func_2(Str_1_Loc, Str_2_Loc, &g);
+        while (Int_1_Loc < Int_2_Loc) {
+            Int_3_Loc = 5 * Int_1_Loc - Int_2_Loc;
+            Proc_7(Int_1_Loc, Int_2_Loc, &Int_3_Loc);
+            Int_1_Loc += 1;
+        }
+        Proc_8(g.Arr_1_Glob, g.Arr_2_Glob, Int_1_Loc, Int_3_Loc, &g);
+        Proc_1(g.Ptr_Glob, &g);
+        for (Ch_Index = 'A'; Ch_Index <= g.Ch_2_Glob; ++Ch_Index) {
+            if (Enum_Loc == Func_1(Ch_Index, 'C', &g)) {
+                Proc_6(Ident_1, &Enum_Loc, &g);
+                fill(Str_2_Loc, '3');
+                Int_2_Loc = Run_Index;
+                g.Int_Glob = Run_Index;
+            }
+        }
+        Int_2_Loc = Int_2_Loc * Int_1_Loc;
+        Int_1_Loc = Int_2_Loc / Int_3_Loc;
+        Int_2_Loc = 7 * (Int_2_Loc - Int_3_Loc) - Int_1_Loc;
+        Proc_2(&Int_1_Loc, &g);
+    }
+
+    sum = 0;
+    sum = sum * 31 + (unsigned)g.Int_Glob;
+    sum = sum * 31 + (unsigned)g.Bool_Glob;
+    sum = sum * 31 + g.Ch_1_Glob;
+    sum = sum * 31 + g.Ch_2_Glob;
+    sum = sum * 31 + (unsigned)g.Arr_1_Glob[8];
+    sum = sum * 31 + (unsigned)g.Arr_2_Glob[8][7];
+    sum = sum * 31 + Glob.Discr;
+    sum = sum * 31 + Glob.Enum_Comp;
+    sum = sum * 31 + (unsigned)Glob.Int_Comp;
+    sum = sum * 31 + Next_Glob.Discr;
+    sum = sum * 31 + Next_Glob.Enum_Comp;
+    sum = sum * 31 + (unsigned)Next_Glob.Int_Comp;
+    sum = sum * 31 + (unsigned)Int_1_Loc;
+    sum = sum * 31 + (unsigned)Int_2_Loc;
+    sum = sum * 31 + (unsigned)Int_3_Loc;
+    sum = sum * 31 + Enum_Loc;
+    sum = sum * 31 + (unsigned)str_cmp(Str_1_Loc, Str_2_Loc);
+    return sum;
+}
@@ -8,6 +8,11 @@ import (
 )
 
 func newCRuntime(name string) *runtime.CPU {
+	return runtime.NewCPU(cImage(name))
+}
+
+// cImage compiles c/name.c and returns its .text section.
+func cImage(name string) []byte {
 	pwd, _ := os.Getwd()
 	filepath := pwd + "/c/"
 	util.Compile(filepath+name+".c", filepath+name+".elf")
@@ -16,7 +21,7 @@ func newCRuntime(name string) *runtime.CPU {
 	if err != nil {
 		panic(err)
 	}
-	return runtime.NewCPU(bits)
+	return bits
 }
 
 func TestHello(t *testing.T) {
@@ -32,3 +37,31 @@ func TestInput(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestDhrystone(t *testing.T) {
+	testChecksum(t, "dhrystone", 0xebba0c2e7eec9afb) // worked out on the host
+}
+
+func TestCoreMark(t *testing.T) {
+	testChecksum(t, "coremark", 0x7944) // worked out on the host
+}
+
+// testChecksum runs the checked-in image of a C workload and, given a
+// toolchain, a fresh build of it, checking the checksum each leaves in a0.
+func testChecksum(t *testing.T, name string, sum uint64) {
+	for _, build := range []struct {
+		name  string
+		image func(t *testing.T) []byte
+	}{
+		{"testdata", func(t *testing.T) []byte { return testdataImage(t, name) }},
+		{"source", func(t *testing.T) []byte { needToolchain(t); return cImage(name) }},
+	} {
+		t.Run(build.name, func(t *testing.T) {
+			cpu := runtime.NewCPU(build.image(t))
+			if err := cpu.Run(); err != nil {
+				t.Fatal(err)
+			}
+			assertEq(t, sum, cpu.Regs[10])
+		})
+	}
+}
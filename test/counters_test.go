@@ -0,0 +1,38 @@
+package test
+
+import (
+	"goemu/runtime"
+	"testing"
+)
+
+func TestCounters(t *testing.T) {
+	for _, reference := range []bool{false, true} {
+		cpu := newAsmRuntime("counters")
+		cpu.Reference = reference
+		if err := cpu.Run(); err != nil {
+			t.Fatal(err)
+		}
+		assertEq(t, 2, cpu.Regs[8])
+		assertEq(t, cpu.Regs[9], cpu.Regs[18])
+		assertEq(t, 10, cpu.Regs[19])
+		assertEq(t, 10, cpu.Regs[20])
+		assertEq(t, 9, cpu.Regs[21])
+		assertEq(t, 1, cpu.Regs[22])
+		if cpu.Regs[27] == 0 || cpu.Regs[23] <= cpu.Regs[8] {
+			t.Errorf("mcycle %d, instret %d in user mode", cpu.Regs[27], cpu.Regs[23])
+		}
+		assertEq(t, 0, cpu.Regs[25])
+		assertEq(t, runtime.IllegalInst, cpu.Regs[24])
+		assertEq(t, 0xc0002cf3, cpu.Regs[11]) // rdcycle s9
+		assertEq(t, 2, cpu.Regs[26])
+
+		// a debugger reads the counters whatever the level, and up to date
+		cycle, err := cpu.ReadCsr(runtime.Cycle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cycle <= cpu.Regs[27] {
+			t.Errorf("cycle %d read after mcycle %d", cycle, cpu.Regs[27])
+		}
+	}
+}
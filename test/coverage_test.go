@@ -0,0 +1,111 @@
+package test
+
+import (
+	"bytes"
+	"debug/elf"
+	"goemu/coverage"
+	"goemu/disasm"
+	"goemu/runtime"
+	"strings"
+	"testing"
+)
+
+func TestCoverage(t *testing.T) {
+	image := asmImage("profile")
+	code := []coverage.Region{{Addr: 0x80000000, Data: image}}
+	run := func(reference bool) *coverage.Collector {
+		cpu := runtime.NewCPU(image)
+		cpu.Reference = reference
+		cpu.Coverage = coverage.New()
+		if err := cpu.Run(); err != nil {
+			t.Fatal(err)
+		}
+		return cpu.Coverage
+	}
+	c, ref := run(false), run(true)
+	for addr := uint64(0x80000000); addr < 0x80000000+uint64(len(image)); addr += 4 {
+		hits, taken := c.Count(addr)
+		refHits, refTaken := ref.Count(addr)
+		if hits != refHits || taken != refTaken {
+			t.Errorf("%x: %d hits, %d taken in blocks, %d hits, %d taken in the reference", addr, hits, taken, refHits, refTaken)
+		}
+	}
+	hits, taken := c.Count(0x80000118) // the loop branch of hot
+	assertEq(t, 90000, hits)
+	assertEq(t, 89000, taken)
+	hits, _ = c.Count(0x80000100)
+	assertEq(t, 1000, hits)
+	hits, _ = c.Count(0x800000FC) // padding
+	assertEq(t, 0, hits)
+
+	merged := coverage.New()
+	merged.Merge(c)
+	merged.Merge(ref)
+	hits, taken = merged.Count(0x80000118)
+	assertEq(t, 180000, hits)
+	assertEq(t, 178000, taken)
+
+	var bitmap bytes.Buffer
+	if err := c.WriteBitmap(&bitmap, code); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, uint64(len(image)/32), uint64(bitmap.Len()))
+	assertEq(t, 0xFF, uint64(bitmap.Bytes()[0x100/32]))
+	assertEq(t, 0, uint64(bitmap.Bytes()[0xE0/32]))
+
+	var report bytes.Buffer
+	symbols := []elf.Symbol{{Name: "hot", Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC), Section: 1, Value: 0x80000100}}
+	if err := c.WriteReport(&report, code, symbols); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"hot:\n        1000  80000100:  ff010113  addi sp, sp, -16\n",
+		"       90000  80000118:  fe029ee3  bne t0, zero, 0x80000114  (taken 89000, not taken 1000)\n",
+		"           -  800000fc:  00000000  .word 0x00000000\n",
+		"branch directions taken\n",
+	} {
+		if !strings.Contains(report.String(), want) {
+			t.Errorf("no %q in the report", want)
+		}
+	}
+
+	var lcov bytes.Buffer
+	lines := []coverage.Line{
+		{Addr: 0x80000100, End: 0x80000114, File: "hot.c", Line: 1},
+		{Addr: 0x80000114, End: 0x8000011C, File: "hot.c", Line: 2},
+		{Addr: 0x800000F8, End: 0x80000100, File: "hot.c", Line: 9},
+	}
+	if err := c.WriteLcov(&lcov, lines, code); err != nil {
+		t.Fatal(err)
+	}
+	want := "TN:\nSF:hot.c\nBRDA:2,0,0,89000\nBRDA:2,0,1,1000\nDA:1,1000\nDA:2,90000\nDA:9,0\nLF:3\nLH:2\nBRF:2\nBRH:2\nend_of_record\n"
+	if lcov.String() != want {
+		t.Errorf("lcov is %q, want %q", lcov.String(), want)
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	for _, c := range []struct {
+		inst uint64
+		want string
+	}{
+		{0xFF010113, "addi sp, sp, -16"},
+		{0x00113423, "sd ra, 8(sp)"},
+		{0x03F59513, "slli a0, a1, 63"},
+		{0x4035D513, "srai a0, a1, 3"},
+		{0x02C5A533, "mulhsu a0, a1, a2"},
+		{0x80000537, "lui a0, 0x80000"},
+		{0xFEB508E3, "beq a0, a1, 0x7ffffff0"},
+		{0x010000EF, "jal ra, 0x80000010"},
+		{0x1405B52F, "lr.d.aq a0, (a1)"},
+		{0x06C5B52F, "amoadd.d.aqrl a0, a2, (a1)"},
+		{0x30059573, "csrrw a0, 0x300, a1"},
+		{0x30200073, "mret"},
+		{0x0310000F, "fence rw, w"},
+		{0x00000000, ".word 0x00000000"},
+	} {
+		if got := disasm.Disassemble(0x80000000, c.inst); got != c.want {
+			t.Errorf("%08x: got %q, want %q", c.inst, got, c.want)
+		}
+	}
+}
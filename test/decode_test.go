@@ -0,0 +1,123 @@
+package test
+
+import (
+	"goemu/runtime"
+	"testing"
+)
+
+func TestDecodeCacheInvalidation(t *testing.T) {
+	cpu := runtime.NewCPU(nil)
+	step := func() {
+		cpu.Pc = 0x80000000
+		if err := cpu.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store(t, cpu, 0x80000000, 4, 0x00150513) // addi a0, a0, 1
+	step()
+	step()
+	assertEq(t, 2, cpu.Regs[10])
+
+	// a store to the code page
+	store(t, cpu, 0x80000000, 4, 0x00550513) // addi a0, a0, 5
+	step()
+	assertEq(t, 7, cpu.Regs[10])
+
+	// a device writing memory
+	cpu.Bus.Mem.WriteAt([]byte{0x13, 0x05, 0xF5, 0xFF}, 0x80000000) // addi a0, a0, -1
+	step()
+	assertEq(t, 6, cpu.Regs[10])
+
+	// a store by another hart
+	m := runtime.NewMachine(nil, 2)
+	cpu = m.Harts[0]
+	store(t, cpu, 0x80000000, 4, 0x00150513)
+	step()
+	store(t, m.Harts[1], 0x80000000, 4, 0x00A50513) // addi a0, a0, 10
+	step()
+	assertEq(t, 11, cpu.Regs[10])
+
+	// fence.i and a write to satp flush the whole cache
+	store(t, cpu, 0x80000004, 4, 0x0000100F) // fence.i
+	cpu.Pc = 0x80000004
+	if err := cpu.Step(); err != nil {
+		t.Fatal(err)
+	}
+	store(t, cpu, 0x80000004, 4, 0x18001073) // csrw satp, zero
+	cpu.Pc = 0x80000004
+	if err := cpu.Step(); err != nil {
+		t.Fatal(err)
+	}
+	step()
+	assertEq(t, 21, cpu.Regs[10])
+}
+
+// TestDecodeMatchesExecute runs each instruction once from the decode cache
+// and once through Execute.
+func TestIllegalInst(t *testing.T) {
+	cpu := runtime.NewCPU(nil)
+	cpu.Csr[runtime.Mtvec] = 0x80000100
+	for _, inst := range []uint64{
+		0x00000000, // defined to be illegal
+		0x00C5852F, // amoadd.b a0, a2, (a1), a reserved width
+	} {
+		store(t, cpu, 0x80000000, 4, inst)
+		for _, reference := range []bool{false, true} {
+			cpu.Pc, cpu.Reference = 0x80000000, reference
+			if err := cpu.StepN(1); err != nil {
+				t.Fatal(err)
+			}
+			assertEq(t, 0x80000100, cpu.Pc)
+			assertEq(t, runtime.IllegalInst, cpu.Csr[runtime.Mcause])
+			assertEq(t, inst, cpu.Csr[runtime.Mtval])
+		}
+	}
+}
+
+func TestDecodeMatchesExecute(t *testing.T) {
+	for _, inst := range []uint64{
+		0x00150513, // addi a0, a0, 1
+		0x03F61593, // slli a1, a2, 63
+		0x40165593, // srai a1, a2, 1
+		0x02165593, // srli a1, a2, 33
+		0x005615B3, // sll a1, a2, t0
+		0x405655B3, // sra a1, a2, t0
+		0x005615BB, // sllw a1, a2, t0
+		0x405655BB, // sraw a1, a2, t0
+		0x02C585B3, // mul a1, a1, a2
+		0x0016059B, // addiw a1, a2, 1
+		0xFEA13C23, // sd a0, -8(sp)
+		0xFF813583, // ld a1, -8(sp)
+		0xFF814583, // lbu a1, -8(sp)
+		0xFE0608E3, // beqz a2, -16
+		0x00C59463, // bne a1, a2, 8
+		0x008000EF, // jal ra, 8
+		0x004600E7, // jalr ra, 4(a2)
+		0x123452B7, // lui t0, 0x12345
+		0x00001297, // auipc t0, 1
+		0xF1402573, // csrr a0, mhartid
+	} {
+		run := func(decoded bool) *runtime.CPU {
+			cpu := runtime.NewCPU(nil)
+			cpu.Regs[2] = 0x80010000
+			cpu.Regs[5] = 35
+			cpu.Regs[10] = 0xFEDCBA9876543210
+			cpu.Regs[12] = 0x80000000F0000001
+			store(t, cpu, 0x80000000, 4, inst)
+			var err error
+			if decoded {
+				err = cpu.Step()
+			} else {
+				err = cpu.Execute(inst)
+			}
+			if err != nil {
+				t.Fatalf("%08x: %v", inst, err)
+			}
+			return cpu
+		}
+		a, b := run(true), run(false)
+		if a.Regs != b.Regs || a.Pc != b.Pc {
+			t.Errorf("%08x: decoded to %x, pc %x, executed to %x, pc %x", inst, a.Regs, a.Pc, b.Regs, b.Pc)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package test
+
+import (
+	"encoding/binary"
+	"goemu/hw/fdt"
+	"goemu/hw/virtio"
+	"goemu/runtime"
+	"strings"
+	"testing"
+)
+
+// dtNodes walks a device tree blob and returns the path of every node with
+// the value of its compatible property.
+func dtNodes(t *testing.T, blob []byte) map[string]string {
+	be := binary.BigEndian
+	assertEq(t, fdt.Magic, uint64(be.Uint32(blob)))
+	assertEq(t, uint64(len(blob)), uint64(be.Uint32(blob[4:])))
+	structure := blob[be.Uint32(blob[8:]):]
+	strs := blob[be.Uint32(blob[12:]):]
+	nodes := make(map[string]string)
+	var path []string
+	for off := 0; ; {
+		token := be.Uint32(structure[off:])
+		off += 4
+		switch token {
+		case 1:
+			end := off + strings.IndexByte(string(structure[off:]), 0)
+			path = append(path, string(structure[off:end]))
+			nodes[strings.Join(path, "/")] = ""
+			off = (end + 4) &^ 3
+		case 2:
+			path = path[:len(path)-1]
+		case 3:
+			size, nameoff := be.Uint32(structure[off:]), be.Uint32(structure[off+4:])
+			name := string(strs[nameoff : int(nameoff)+strings.IndexByte(string(strs[nameoff:]), 0)])
+			if name == "compatible" {
+				nodes[strings.Join(path, "/")] = strings.TrimRight(string(structure[off+8:off+8+int(size)]), "\x00")
+			}
+			off = (off + 8 + int(size) + 3) &^ 3
+		case 9:
+			if len(path) != 0 {
+				t.Fatalf("unterminated node %v", path)
+			}
+			return nodes
+		default:
+			t.Fatalf("invalid token %d at %d", token, off-4)
+		}
+	}
+}
+
+func TestDeviceTree(t *testing.T) {
+	cpu := runtime.NewCPU(nil)
+	if _, err := cpu.Bus.AddVirtio(virtio.NewRng()); err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.LoadDeviceTree("console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+	blob := make([]byte, 64*1024)
+	cpu.Bus.Mem.ReadAt(blob, int64(cpu.Regs[11]))
+	nodes := dtNodes(t, blob[:binary.BigEndian.Uint32(blob[4:])])
+	for path, compatible := range map[string]string{
+		"/soc/clint@2000000":               "sifive,clint0\x00riscv,clint0",
+		"/soc/serial@10000000":             "ns16550a",
+		"/soc/rtc@101000":                  "google,goldfish-rtc",
+		"/soc/virtio_mmio@10001000":        "virtio,mmio",
+		"/cpus/cpu@0/interrupt-controller": "riscv,cpu-intc",
+	} {
+		if got, ok := nodes[path]; !ok || got != compatible {
+			t.Errorf("node %s: got %q, ok %v", path, got, ok)
+		}
+	}
+	if _, ok := nodes["/memory@80000000"]; !ok {
+		t.Error("no memory node")
+	}
+}
@@ -0,0 +1,96 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"goemu/ether"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func receiveFrame(t *testing.T, b ether.Backend) []byte {
+	select {
+	case frame := <-b.Frames():
+		return frame
+	case <-time.After(5 * time.Second):
+		t.Fatal("no frame received")
+		return nil
+	}
+}
+
+func TestEtherSwitch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "switch.sock")
+	local, err := ether.JoinSwitch(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	remote, err := ether.JoinSwitch(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	a := ether.Addr{0x52, 0x54, 0, 0, 0, 1}
+	b := ether.Addr{0x52, 0x54, 0, 0, 0, 2}
+	// the remote instance is connected once its first frame has been flooded
+	hello := ether.NewFrame(ether.Broadcast, b, 0x88B5, []byte("hello"))
+	if err = remote.Send(hello); err != nil {
+		t.Fatal(err)
+	}
+	if got := receiveFrame(t, local); !bytes.Equal(got, hello) {
+		t.Fatalf("unexpected frame %x", got)
+	}
+
+	// the switch has learned where b is
+	reply := ether.NewFrame(b, a, 0x88B5, []byte("world"))
+	if err = local.Send(reply); err != nil {
+		t.Fatal(err)
+	}
+	if got := receiveFrame(t, remote); !bytes.Equal(got, reply) {
+		t.Fatalf("unexpected frame %x", got)
+	}
+}
+
+func TestEtherLoopback(t *testing.T) {
+	l := ether.NewLoopback()
+	defer l.Close()
+	mac := ether.Addr{0x52, 0x54, 0, 0, 0, 1}
+
+	// DHCPDISCOVER from 0.0.0.0:68 to 255.255.255.255:67
+	dhcp := make([]byte, 240)
+	dhcp[0], dhcp[1], dhcp[2] = 1, 1, 6
+	copy(dhcp[4:], []byte{0xDE, 0xAD, 0xBE, 0xEF})
+	copy(dhcp[28:], mac[:])
+	copy(dhcp[236:], []byte{99, 130, 83, 99})
+	dhcp = append(dhcp, 53, 1, 1, 255)
+	udp := append([]byte{0, 68, 0, 67, 0, 0, 0, 0}, dhcp...)
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	ip := []byte{0x45, 0, 0, 0, 0, 0, 0, 0, 64, 17, 0, 0, 0, 0, 0, 0, 255, 255, 255, 255}
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(ip)+len(udp)))
+	if err := l.Send(ether.NewFrame(ether.Broadcast, mac, ether.TypeIPv4, append(ip, udp...))); err != nil {
+		t.Fatal(err)
+	}
+	offer := receiveFrame(t, l)[ether.HeaderSize+28:]
+	assertEq(t, 2, uint64(offer[0]))
+	if !bytes.Equal(offer[4:8], []byte{0xDE, 0xAD, 0xBE, 0xEF}) || !bytes.Equal(offer[16:20], ether.GuestIP[:]) {
+		t.Fatalf("unexpected offer %x", offer[:20])
+	}
+	assertEq(t, 2, uint64(offer[242])) // DHCPOFFER
+
+	// a ping of the gateway
+	icmp := []byte{8, 0, 0xF7, 0xFE, 0, 1, 0, 0} // checksummed echo request
+	ip = []byte{0x45, 0, 0, 28, 0, 0, 0, 0, 64, 1, 0, 0, 10, 0, 2, 15, 10, 0, 2, 2}
+	if err := l.Send(ether.NewFrame(ether.GatewayAddr, mac, ether.TypeIPv4, append(ip, icmp...))); err != nil {
+		t.Fatal(err)
+	}
+	echo := receiveFrame(t, l)
+	if ether.Dst(echo) != mac {
+		t.Fatalf("unexpected echo reply %x", echo)
+	}
+	packet := echo[ether.HeaderSize:]
+	if !bytes.Equal(packet[16:20], ether.GuestIP[:]) || packet[20] != 0 || !bytes.Equal(packet[22:24], []byte{0xFF, 0xFE}) {
+		t.Fatalf("unexpected echo reply %x", packet)
+	}
+}
@@ -0,0 +1,134 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"goemu/hw/fb"
+	"goemu/runtime"
+	"goemu/vnc"
+	"image/png"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func newFbRuntime(t *testing.T) *runtime.CPU {
+	f, err := fb.NewFramebuffer(fb.DefaultBase, 4, 2, fb.X8R8G8B8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := runtime.NewCPU(nil)
+	cpu.Bus.Framebuffer = f
+	return cpu
+}
+
+func TestFramebuffer(t *testing.T) {
+	cpu := newFbRuntime(t)
+	// pixel (1, 1) is pure red, pixel (2, 0) pure blue
+	cpu.Bus.Store(fb.DefaultBase+16+4, 4, 0x00FF0000)
+	cpu.Bus.Store(fb.DefaultBase+8, 4, 0x000000FF)
+	v, _ := cpu.Bus.Load(fb.DefaultBase+20, 4)
+	assertEq(t, 0x00FF0000, v)
+
+	var out bytes.Buffer
+	if err := cpu.Bus.Framebuffer.WritePNG(&out); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, g, b, _ := img.At(1, 1).RGBA()
+	assertEq(t, 0xFFFF<<32, uint64(r)<<32|uint64(g)<<16|uint64(b))
+	r, g, b, _ = img.At(2, 0).RGBA()
+	assertEq(t, 0xFFFF, uint64(r)<<32|uint64(g)<<16|uint64(b))
+
+	if err = cpu.LoadDeviceTree(""); err != nil {
+		t.Fatal(err)
+	}
+	blob := make([]byte, 64*1024)
+	cpu.Bus.Mem.ReadAt(blob, int64(cpu.Regs[11]))
+	nodes := dtNodes(t, blob[:binary.BigEndian.Uint32(blob[4:])])
+	if nodes["/soc/framebuffer@28000000"] != "simple-framebuffer" {
+		t.Fatalf("no framebuffer node in %v", nodes)
+	}
+}
+
+func TestVnc(t *testing.T) {
+	cpu := newFbRuntime(t)
+	cpu.Bus.Store(fb.DefaultBase+4, 4, 0x00123456)
+	s := vnc.NewServer("test", cpu.Bus.Framebuffer)
+	pressed := make(chan uint32, 1)
+	s.Input = keyFunc(func(k uint32) { pressed <- k })
+	addr, err := s.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	read := func(n int) []byte {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+
+	if string(read(12)) != "RFB 003.008\n" {
+		t.Fatal("unexpected server version")
+	}
+	conn.Write([]byte("RFB 003.008\n"))
+	if !bytes.Equal(read(2), []byte{1, 1}) {
+		t.Fatal("unexpected security types")
+	}
+	conn.Write([]byte{1})
+	assertEq(t, 0, uint64(binary.BigEndian.Uint32(read(4))))
+	conn.Write([]byte{1})
+	init := read(24)
+	assertEq(t, 4, uint64(binary.BigEndian.Uint16(init[0:])))
+	assertEq(t, 2, uint64(binary.BigEndian.Uint16(init[2:])))
+	if string(read(int(binary.BigEndian.Uint32(init[20:])))) != "test" {
+		t.Fatal("unexpected desktop name")
+	}
+
+	// a full update of the screen, in the default 32 bit little-endian format
+	conn.Write([]byte{3, 0, 0, 0, 0, 0, 0, 4, 0, 2})
+	update := read(16)
+	assertEq(t, 1, uint64(binary.BigEndian.Uint16(update[2:])))
+	pixels := read(4 * 4 * 2)
+	assertEq(t, 0x00123456, uint64(binary.LittleEndian.Uint32(pixels[4:])))
+
+	// an incremental update only covers what changed
+	conn.Write([]byte{3, 1, 0, 0, 0, 0, 0, 4, 0, 2})
+	cpu.Bus.Store(fb.DefaultBase+16+12, 4, 0x00ABCDEF)
+	update = read(16)
+	assertEq(t, 3<<16|1, uint64(binary.BigEndian.Uint32(update[4:])))
+	assertEq(t, 1<<16|1, uint64(binary.BigEndian.Uint32(update[8:])))
+	assertEq(t, 0x00ABCDEF, uint64(binary.LittleEndian.Uint32(read(4))))
+
+	conn.Write([]byte{4, 1, 0, 0, 0, 0, 0, 'a'})
+	select {
+	case k := <-pressed:
+		assertEq(t, 'a', uint64(k))
+	case <-time.After(5 * time.Second):
+		t.Fatal("key event not delivered")
+	}
+}
+
+type keyFunc func(keysym uint32)
+
+func (f keyFunc) Key(down bool, keysym uint32) {
+	if down {
+		f(keysym)
+	}
+}
+
+func (f keyFunc) Pointer(buttons uint8, x, y int) {}
@@ -0,0 +1,35 @@
+package test
+
+import (
+	"errors"
+	"goemu/hostfs"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveDanglingSymlink(t *testing.T) {
+	root, err := hostfs.Root(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside := t.TempDir()
+	os.Symlink(filepath.Join(outside, "x"), filepath.Join(root, "out"))
+	os.Symlink("../escape", filepath.Join(root, "up"))
+	os.Symlink("new", filepath.Join(root, "in"))
+	os.Symlink("out", filepath.Join(root, "chain"))
+
+	for _, name := range []string{"out", "up", "chain"} {
+		if _, err = hostfs.Resolve(root, name); !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("%s: expected a permission error, got %v", name, err)
+		}
+	}
+	real, err := hostfs.Resolve(root, "in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if real != filepath.Join(root, "new") {
+		t.Errorf("in resolved to %s", real)
+	}
+}
@@ -0,0 +1,125 @@
+package test
+
+import (
+	"goemu/hw/virtio"
+	"goemu/input"
+	"goemu/runtime"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestScriptedInput(t *testing.T) {
+	script, err := input.ParseScript(strings.NewReader(`
+# log in
+10 type Hi
+20 key leftctrl c
+30 move 99 0
+30 click
+`), 100, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shift, h, i, ctrl, c := input.Keys["leftshift"], input.Keys["h"], input.Keys["i"], input.Keys["leftctrl"], input.Keys["c"]
+	expected := input.Script{
+		{At: 10, Kind: input.Keyboard, Events: input.Press(shift, true)},
+		{At: 10, Kind: input.Keyboard, Events: input.Press(h, true)},
+		{At: 10, Kind: input.Keyboard, Events: input.Press(h, false)},
+		{At: 10, Kind: input.Keyboard, Events: input.Press(shift, false)},
+		{At: 10, Kind: input.Keyboard, Events: input.Press(i, true)},
+		{At: 10, Kind: input.Keyboard, Events: input.Press(i, false)},
+		{At: 20, Kind: input.Keyboard, Events: input.Press(ctrl, true)},
+		{At: 20, Kind: input.Keyboard, Events: input.Press(c, true)},
+		{At: 20, Kind: input.Keyboard, Events: input.Press(c, false)},
+		{At: 20, Kind: input.Keyboard, Events: input.Press(ctrl, false)},
+		{At: 30, Kind: input.Tablet, Events: []input.Event{{Type: input.EvAbs, Code: input.AbsX, Value: input.AbsMax}, {Type: input.EvAbs, Code: input.AbsY, Value: 0}, input.Sync()}},
+		{At: 30, Kind: input.Tablet, Events: input.Press(input.BtnLeft, true)},
+		{At: 30, Kind: input.Tablet, Events: input.Press(input.BtnLeft, false)},
+	}
+	if !reflect.DeepEqual(expected, script) {
+		t.Fatalf("expected %v, got %v", expected, script)
+	}
+	assertEq(t, 3, uint64(len(script.For(input.Tablet))))
+
+	for _, bad := range []string{"20 key a\n10 key b", "10 key nosuchkey", "10 move 100 0", "10 jump"} {
+		if _, err = input.ParseScript(strings.NewReader(bad), 100, 50); err == nil {
+			t.Fatalf("script %q parsed", bad)
+		}
+	}
+}
+
+func TestVirtioInput(t *testing.T) {
+	var now uint64
+	script := input.Script{{At: 100, Kind: input.Keyboard, Events: input.Press(input.Keys["a"], true)}}
+	host := input.NewHost(100, 50)
+	dev := virtio.NewInput(input.Keyboard, host.Keyboard, script, func() uint64 { return now })
+	cpu := runtime.NewCPU(nil)
+	if _, err := cpu.Bus.AddVirtio(dev); err != nil {
+		t.Fatal(err)
+	}
+	d := newDriver(t, cpu, 0, 2)
+	assertEq(t, virtio.InputID, d.load(virtio.DeviceID))
+
+	// the driver selects what the configuration space shows
+	cpu.Bus.Store(d.base+virtio.Config, 1, 1)
+	size, _ := cpu.Bus.Load(d.base+virtio.Config+2, 1)
+	name := make([]byte, size)
+	for i := range name {
+		v, _ := cpu.Bus.Load(d.base+virtio.Config+8+uint64(i), 1)
+		name[i] = byte(v)
+	}
+	if string(name) != "goemu keyboard" {
+		t.Fatalf("unexpected name %q", name)
+	}
+	cpu.Bus.Store(d.base+virtio.Config, 2, 0x11|input.EvKey<<8)
+	bits, _ := cpu.Bus.Load(d.base+virtio.Config+8+uint64(input.Keys["a"]/8), 1)
+	assertEq(t, 1, bits>>(input.Keys["a"]%8)&1)
+
+	if _, _, ok := dev.Poll(); ok {
+		t.Fatal("input before the guest posted buffers")
+	}
+	d.submit(0, buffer{bufBase, 8, true})
+	if _, _, ok := dev.Poll(); ok {
+		t.Fatal("script delivered early")
+	}
+	now = 100
+	if _, _, ok := dev.Poll(); ok {
+		t.Fatal("batch delivered without room for all of it")
+	}
+	d.submit(0, buffer{bufBase + 0x1000, 8, true})
+	if _, data, ok := dev.Poll(); !ok || len(data) != 2*input.EventSize {
+		t.Fatal("script not delivered")
+	}
+	assertEq(t, 2, d.used(0))
+	events, _ := input.Unmarshal(append(d.read(bufBase, 8), d.read(bufBase+0x1000, 8)...))
+	if !reflect.DeepEqual(input.Press(input.Keys["a"], true), events) {
+		t.Fatalf("unexpected events %v", events)
+	}
+
+	// the keysym of Return, as a VNC client sends it
+	host.Key(true, 0xFF0D)
+	d.submit(0, buffer{bufBase, 8, true})
+	d.submit(0, buffer{bufBase + 0x1000, 8, true})
+	if _, _, ok := dev.Poll(); !ok {
+		t.Fatal("host input not delivered")
+	}
+	events, _ = input.Unmarshal(append(d.read(bufBase, 8), d.read(bufBase+0x1000, 8)...))
+	if !reflect.DeepEqual(input.Press(input.Keys["enter"], true), events) {
+		t.Fatalf("unexpected events %v", events)
+	}
+}
+
+func TestHostPointerInput(t *testing.T) {
+	host := input.NewHost(101, 11)
+	host.Pointer(1, 50, 10)
+	host.Pointer(1|8, 50, 10)
+	expected := [][]input.Event{
+		{{Type: input.EvAbs, Code: input.AbsX, Value: input.AbsMax / 2}, {Type: input.EvAbs, Code: input.AbsY, Value: input.AbsMax}, {Type: input.EvKey, Code: input.BtnLeft, Value: 1}, input.Sync()},
+		{{Type: input.EvAbs, Code: input.AbsX, Value: input.AbsMax / 2}, {Type: input.EvAbs, Code: input.AbsY, Value: input.AbsMax}, {Type: input.EvRel, Code: input.RelWheel, Value: 1}, input.Sync()},
+	}
+	for _, e := range expected {
+		if got := <-host.Tablet; !reflect.DeepEqual(e, got) {
+			t.Fatalf("expected %v, got %v", e, got)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package test
+
+import (
+	"errors"
+	"goemu/linux"
+	"goemu/util"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUserProcess(t *testing.T) {
+	pwd, _ := os.Getwd()
+	elf := filepath.Join(pwd, "asm", "user.elf")
+	util.CompileUser(filepath.Join(pwd, "asm", "user.s"), elf)
+	root := t.TempDir()
+	p, err := linux.New(elf, nil, nil, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := p.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, uint64(7), uint64(code))
+	data, err := os.ReadFile(filepath.Join(root, "out.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hi\n" {
+		t.Fatalf("unexpected output %q", data)
+	}
+}
+
+func TestUserSyscallRanges(t *testing.T) {
+	pwd, _ := os.Getwd()
+	elf := filepath.Join(pwd, "asm", "syscalls.elf")
+	util.CompileUser(filepath.Join(pwd, "asm", "syscalls.s"), elf)
+	p, err := linux.New(elf, nil, nil, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.CPU.Bus.Uart.In != nil {
+		t.Fatal("the console reads stdin away from the program")
+	}
+	if _, err = p.Run(); err != nil {
+		t.Fatal(err)
+	}
+	efault, enomem, einval := uint64(1<<64-14), uint64(1<<64-12), uint64(1<<64-22)
+	assertEq(t, efault, p.CPU.Regs[8])
+	assertEq(t, efault, p.CPU.Regs[9])
+	assertEq(t, enomem, p.CPU.Regs[18])
+	assertEq(t, enomem, p.CPU.Regs[19])
+	assertEq(t, einval, p.CPU.Regs[20])
+}
+
+func TestUserNullPointer(t *testing.T) {
+	pwd, _ := os.Getwd()
+	elf := filepath.Join(pwd, "asm", "null.elf")
+	util.CompileUser(filepath.Join(pwd, "asm", "null.s"), elf)
+	p, err := linux.New(elf, nil, nil, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.Run()
+	var sig *linux.SignalError
+	if !errors.As(err, &sig) {
+		t.Fatalf("not killed by a signal: %v", err)
+	}
+	assertEq(t, linux.SIGSEGV, uint64(sig.Signal))
+	assertEq(t, 0, sig.Addr)
+}
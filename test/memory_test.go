@@ -0,0 +1,96 @@
+package test
+
+import (
+	"errors"
+	"goemu/config"
+	"goemu/runtime"
+	"testing"
+)
+
+func TestAccessFault(t *testing.T) {
+	mem := runtime.NewMemory(0x80000000, 0x1000)
+	for _, addr := range []uint64{0x7FFFFFFF, 0x80000FFE, 0x80001000, 0} {
+		var e *runtime.Exception
+		if _, err := mem.Load(addr, 4); !errors.As(err, &e) || e.Cause != runtime.LoadAccessFault || e.Tval != addr {
+			t.Errorf("load at %x: %v", addr, err)
+		}
+		if err := mem.Store(addr, 4, 0); !errors.As(err, &e) || e.Cause != runtime.StoreAccessFault || e.Tval != addr {
+			t.Errorf("store at %x: %v", addr, err)
+		}
+	}
+
+	// the guest takes the fault
+	cpu := runtime.NewCPU(nil)
+	cpu.Csr[runtime.Mtvec] = 0x80000100
+	cpu.Regs[11] = 0x1000
+	store(t, cpu, 0x80000000, 4, 0x0005B503) // ld a0, 0(a1)
+	store(t, cpu, 0x80000004, 4, 0x00A5B023) // sd a0, 0(a1)
+	for _, reference := range []bool{false, true} {
+		cpu.Pc, cpu.Reference = 0x80000000, reference
+		if err := cpu.StepN(1); err != nil {
+			t.Fatal(err)
+		}
+		assertEq(t, 0x80000100, cpu.Pc)
+		assertEq(t, runtime.LoadAccessFault, cpu.Csr[runtime.Mcause])
+		assertEq(t, 0x1000, cpu.Csr[runtime.Mtval])
+		cpu.Pc = 0x80000004
+		if err := cpu.Step(); err != nil {
+			t.Fatal(err)
+		}
+		assertEq(t, runtime.StoreAccessFault, cpu.Csr[runtime.Mcause])
+	}
+}
+
+func TestAtomicFaults(t *testing.T) {
+	cpu := runtime.NewCPU(nil)
+	cpu.Csr[runtime.Mtvec] = 0x80000100
+	store(t, cpu, 0x80000000, 4, 0x1005A52F) // lr.w a0, (a1)
+	store(t, cpu, 0x80000004, 4, 0x18C5A52F) // sc.w a0, a2, (a1)
+	store(t, cpu, 0x80000008, 4, 0x00C5A52F) // amoadd.w a0, a2, (a1)
+	for _, tc := range []struct {
+		pc, addr, cause uint64
+	}{
+		{0x80000000, 0x80000802, runtime.LoadAddrMisaligned},
+		{0x80000004, 0x80000802, runtime.StoreAddrMisaligned},
+		{0x80000008, 0x80000802, runtime.StoreAddrMisaligned},
+		{0x80000000, 0x1000, runtime.LoadAccessFault},
+		{0x80000008, 0x1000, runtime.StoreAccessFault},
+	} {
+		for _, reference := range []bool{false, true} {
+			cpu.Pc, cpu.Reference, cpu.Regs[11] = tc.pc, reference, tc.addr
+			if err := cpu.StepN(1); err != nil {
+				t.Fatal(err)
+			}
+			assertEq(t, 0x80000100, cpu.Pc)
+			assertEq(t, tc.cause, cpu.Csr[runtime.Mcause])
+			assertEq(t, tc.addr, cpu.Csr[runtime.Mtval])
+		}
+	}
+}
+
+func TestHostPage(t *testing.T) {
+	cpu := runtime.NewCPU(nil)
+	top := uint64(config.KernelBase + config.MemSize)
+	cpu.Regs[11] = top - 8
+	store(t, cpu, 0x80000000, 4, 0x00A5B023) // sd a0, 0(a1)
+	store(t, cpu, 0x80000004, 4, 0x0045A603) // lw a2, 4(a1)
+	cpu.Regs[10] = 0x1122334455667788
+	for i := 0; i < 2; i++ {
+		cpu.Pc = 0x80000000
+		if err := cpu.StepN(2); err != nil {
+			t.Fatal(err)
+		}
+		assertEq(t, 0x11223344, cpu.Regs[12])
+	}
+	assertEq(t, 0x1122334455667788, load(t, cpu, top-8, 8))
+
+	// the access past the end of the page and the memory faults
+	cpu.Csr[runtime.Mtvec] = 0x80000100
+	cpu.Regs[11] = top - 4
+	cpu.Pc = 0x80000004
+	if err := cpu.StepN(1); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, runtime.LoadAccessFault, cpu.Csr[runtime.Mcause])
+	assertEq(t, top, cpu.Csr[runtime.Mtval])
+}
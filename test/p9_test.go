@@ -0,0 +1,237 @@
+package test
+
+import (
+	"goemu/hw/virtio"
+	"goemu/p9"
+	"goemu/runtime"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type p9Client struct {
+	t *testing.T
+	s *p9.Server
+}
+
+// call sends a request built by args and returns the reply, which must be of
+// the matching type.
+func (c *p9Client) call(typ uint8, args ...any) *p9.Message {
+	r := c.try(typ, args...)
+	if r.Type == p9.Rlerror {
+		c.t.Fatalf("request %d failed with error %d", typ, r.Get32())
+	}
+	if r.Type != typ+1 {
+		c.t.Fatalf("unexpected reply type %d", r.Type)
+	}
+	return r
+}
+
+func (c *p9Client) try(typ uint8, args ...any) *p9.Message {
+	m := p9.NewMessage(typ, 1)
+	for _, a := range args {
+		switch v := a.(type) {
+		case uint8:
+			m.Put8(v)
+		case uint16:
+			m.Put16(v)
+		case uint32:
+			m.Put32(v)
+		case uint64:
+			m.Put64(v)
+		case string:
+			m.PutString(v)
+		case []byte:
+			m.PutBytes(v)
+		}
+	}
+	r, err := p9.ParseMessage(c.s.Handle(m.Bytes()))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return r
+}
+
+// fail expects the request to fail with error number e.
+func (c *p9Client) fail(e uint32, typ uint8, args ...any) {
+	r := c.try(typ, args...)
+	if r.Type != p9.Rlerror {
+		c.t.Fatalf("request %d succeeded", typ)
+	}
+	assertEq(c.t, uint64(e), uint64(r.Get32()))
+}
+
+func newP9Client(t *testing.T, dir string, readOnly bool) *p9Client {
+	s, err := p9.NewServer(dir, readOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &p9Client{t, s}
+	r := c.call(p9.Tversion, uint32(8192), p9.Version)
+	assertEq(t, 8192, uint64(r.Get32()))
+	c.call(p9.Tattach, uint32(0), uint32(p9.NoFid), "root", "", uint32(0))
+	return c
+}
+
+func TestP9(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	os.MkdirAll(filepath.Join(root, "sub"), 0o755)
+	os.WriteFile(filepath.Join(root, "sub", "hello.txt"), []byte("hello, world"), 0o644)
+	c := newP9Client(t, root, false)
+
+	r := c.call(p9.Twalk, uint32(0), uint32(1), uint16(2), "sub", "hello.txt")
+	assertEq(t, 2, uint64(r.Get16()))
+	assertEq(t, p9.QtDir, uint64(r.GetQid().Type))
+	assertEq(t, p9.QtFile, uint64(r.GetQid().Type))
+	c.call(p9.Tlopen, uint32(1), uint32(0))
+	r = c.call(p9.Tread, uint32(1), uint64(7), uint32(100))
+	if data := r.GetBytes(int(r.Get32())); string(data) != "world" {
+		t.Fatalf("unexpected data %q", data)
+	}
+	r = c.call(p9.Tgetattr, uint32(1), uint64(0x7FF))
+	r.Get64()
+	r.GetQid()
+	assertEq(t, 0o100644, uint64(r.Get32()))
+	r.GetBytes(4 + 4 + 8 + 8)
+	assertEq(t, 12, r.Get64())
+	c.call(p9.Tclunk, uint32(1))
+
+	// create and write a file next to the existing one
+	c.call(p9.Twalk, uint32(0), uint32(2), uint16(1), "sub")
+	c.call(p9.Tlcreate, uint32(2), "new.txt", uint32(0o2), uint32(0o600), uint32(0))
+	r = c.call(p9.Twrite, uint32(2), uint64(0), uint32(3), []byte("abc"))
+	assertEq(t, 3, uint64(r.Get32()))
+	c.call(p9.Tclunk, uint32(2))
+	if data, _ := os.ReadFile(filepath.Join(root, "sub", "new.txt")); string(data) != "abc" {
+		t.Fatalf("unexpected file contents %q", data)
+	}
+
+	c.call(p9.Twalk, uint32(0), uint32(3), uint16(1), "sub")
+	c.call(p9.Tlopen, uint32(3), uint32(0o200000))
+	r = c.call(p9.Treaddir, uint32(3), uint64(0), uint32(4096))
+	r.Get32()
+	var names []string
+	for {
+		r.GetQid()
+		r.Get64()
+		r.Get8()
+		name := r.GetString()
+		if r.Err() != nil {
+			break
+		}
+		names = append(names, name)
+	}
+	if len(names) != 4 || names[2] != "hello.txt" || names[3] != "new.txt" {
+		t.Fatalf("unexpected directory listing %v", names)
+	}
+
+	c.call(p9.Twalk, uint32(0), uint32(4), uint16(1), "sub")
+	c.call(p9.Trenameat, uint32(4), "new.txt", uint32(0), "moved.txt")
+	c.call(p9.Tunlinkat, uint32(0), "moved.txt", uint32(0))
+	if _, err := os.Stat(filepath.Join(root, "moved.txt")); !os.IsNotExist(err) {
+		t.Fatal("file not removed")
+	}
+}
+
+func TestP9Confinement(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	os.Mkdir(root, 0o755)
+	os.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0o644)
+	os.Symlink(dir, filepath.Join(root, "out"))
+	os.Symlink("../secret", filepath.Join(root, "link"))
+	c := newP9Client(t, root, false)
+
+	// .. stops at the root
+	r := c.call(p9.Twalk, uint32(0), uint32(1), uint16(2), "..", "..")
+	assertEq(t, 2, uint64(r.Get16()))
+	c.fail(2, p9.Twalk, uint32(1), uint32(2), uint16(1), "secret")
+
+	// symlinks are seen as such, but neither followed out of the root
+	r = c.call(p9.Twalk, uint32(0), uint32(3), uint16(1), "link")
+	r.Get16()
+	assertEq(t, p9.QtSymlink, uint64(r.GetQid().Type))
+	c.fail(40, p9.Tlopen, uint32(3), uint32(0))
+	r = c.call(p9.Treadlink, uint32(3))
+	if target := r.GetString(); target != "../secret" {
+		t.Fatalf("unexpected link target %q", target)
+	}
+	r = c.call(p9.Twalk, uint32(0), uint32(4), uint16(2), "out", "secret")
+	assertEq(t, 1, uint64(r.Get16())) // the walk stops at the link
+	c.call(p9.Twalk, uint32(0), uint32(5), uint16(1), "out")
+	c.fail(13, p9.Tlcreate, uint32(5), "x", uint32(0o2), uint32(0o600), uint32(0))
+	c.fail(22, p9.Tlcreate, uint32(0), "out/x", uint32(0o2), uint32(0o600), uint32(0))
+	c.fail(22, p9.Tmkdir, uint32(0), "..", uint32(0o755), uint32(0))
+}
+
+func TestP9SymlinkEscape(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	os.Mkdir(root, 0o755)
+	os.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0o644)
+	c := newP9Client(t, root, false)
+
+	// a guest-made link to a host file that does not exist yet
+	c.call(p9.Tsymlink, uint32(0), "a", filepath.Join(dir, "x"), uint32(0))
+	c.call(p9.Twalk, uint32(0), uint32(1), uint16(0))
+	c.fail(40, p9.Tlcreate, uint32(1), "a", uint32(0o1|0o100), uint32(0o644), uint32(0))
+	if _, err := os.Lstat(filepath.Join(dir, "x")); !os.IsNotExist(err) {
+		t.Fatal("file created outside the root")
+	}
+
+	// and one to a host file that does
+	c.call(p9.Tsymlink, uint32(0), "b", filepath.Join(dir, "secret"), uint32(0))
+	c.call(p9.Twalk, uint32(0), uint32(2), uint16(1), "b")
+	c.fail(40, p9.Tsetattr, uint32(2), uint32(0x1|0x8), uint32(0o777), uint32(0), uint32(0),
+		uint64(0), uint64(0), uint64(0), uint64(0), uint64(0))
+	info, err := os.Stat(filepath.Join(dir, "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 6 || info.Mode().Perm() != 0o644 {
+		t.Fatalf("file outside the root changed: %d bytes, mode %v", info.Size(), info.Mode())
+	}
+}
+
+func TestP9ReadOnly(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "file"), []byte("data"), 0o644)
+	c := newP9Client(t, root, true)
+	c.fail(30, p9.Tlcreate, uint32(0), "new", uint32(0o2), uint32(0o600), uint32(0))
+	c.call(p9.Twalk, uint32(0), uint32(1), uint16(1), "file")
+	c.fail(30, p9.Tlopen, uint32(1), uint32(0o2))
+	c.call(p9.Tlopen, uint32(1), uint32(0))
+	c.fail(30, p9.Twrite, uint32(1), uint64(0), uint32(1), []byte("x"))
+	c.fail(30, p9.Tunlinkat, uint32(0), "file", uint32(0))
+}
+
+func TestVirtioP9(t *testing.T) {
+	s, err := p9.NewServer(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := runtime.NewCPU(nil)
+	if _, err = cpu.Bus.AddVirtio(virtio.NewP9("host", s)); err != nil {
+		t.Fatal(err)
+	}
+	d := newDriver(t, cpu, 0, 1)
+	assertEq(t, virtio.P9ID, d.load(virtio.DeviceID))
+	assertEq(t, 4|'h'<<16|'o'<<24, d.load(virtio.Config))
+
+	req := p9.NewMessage(p9.Tversion, p9.NoTag)
+	req.Put32(8192)
+	req.PutString(p9.Version)
+	cpu.Bus.Mem.WriteAt(req.Bytes(), bufBase)
+	d.submit(0, buffer{bufBase, uint32(req.Len()), false}, buffer{bufBase + 0x1000, 64, true})
+	assertEq(t, 1, d.used(0))
+	r, err := p9.ParseMessage(d.read(bufBase+0x1000, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, p9.Tversion+1, uint64(r.Type))
+	assertEq(t, 8192, uint64(r.Get32()))
+	if v := r.GetString(); v != p9.Version {
+		t.Fatalf("unexpected version %q", v)
+	}
+}
@@ -0,0 +1,140 @@
+package test
+
+import (
+	"encoding/binary"
+	"goemu/hw/pci"
+	"goemu/hw/plic"
+	"goemu/hw/virtio"
+	"goemu/runtime"
+	"testing"
+)
+
+func ecam(dev int, reg uint64) uint64 {
+	return pci.EcamBase + uint64(dev)<<15 + reg
+}
+
+func load(t *testing.T, cpu *runtime.CPU, addr, bytes uint64) uint64 {
+	v, err := cpu.Bus.Load(addr, bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func store(t *testing.T, cpu *runtime.CPU, addr, bytes, v uint64) {
+	if err := cpu.Bus.Store(addr, bytes, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// capabilities walks the capability list of a device and returns the offset
+// of each capability.
+func capabilities(t *testing.T, cpu *runtime.CPU, dev int) []uint64 {
+	var caps []uint64
+	for next := load(t, cpu, ecam(dev, pci.CapabilityList), 1); next != 0; next = load(t, cpu, ecam(dev, next+1), 1) {
+		caps = append(caps, next)
+	}
+	return caps
+}
+
+func newPCIRuntime(t *testing.T) (*runtime.CPU, *virtio.PCI) {
+	cpu := runtime.NewCPU(nil)
+	p, err := cpu.Bus.AddVirtioPCI(virtio.NewSeededRng(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cpu, p
+}
+
+func TestPCIConfigSpace(t *testing.T) {
+	cpu, _ := newPCIRuntime(t)
+	assertEq(t, 0x00081B36, load(t, cpu, ecam(0, pci.VendorID), 4))
+	assertEq(t, (virtio.PCIDeviceBase+virtio.RngID)<<16|virtio.PCIVendor, load(t, cpu, ecam(1, pci.VendorID), 4))
+	assertEq(t, 0xFFFFFFFF, load(t, cpu, ecam(2, pci.VendorID), 4))
+	assertEq(t, 1, load(t, cpu, ecam(1, pci.InterruptPin), 1))
+
+	// sizing a BAR
+	store(t, cpu, ecam(1, pci.Bar0), 4, 0xFFFFFFFF)
+	assertEq(t, 0xFFFFC000, load(t, cpu, ecam(1, pci.Bar0), 4))
+	store(t, cpu, ecam(1, pci.Bar0), 4, 0)
+
+	if err := cpu.LoadDeviceTree(""); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, pci.MemBase, load(t, cpu, ecam(1, pci.Bar0), 4))
+	assertEq(t, pci.CommandIO|pci.CommandMemory|pci.CommandMaster, load(t, cpu, ecam(1, pci.Command), 2))
+	assertEq(t, uint64(pci.IrqOf(1, 1)), load(t, cpu, ecam(1, pci.InterruptLine), 1))
+
+	// the virtio structures are found through vendor capabilities, and there
+	// is no MSI or MSI-X one: interrupts are INTx only
+	caps := capabilities(t, cpu, 1)
+	assertEq(t, 4, uint64(len(caps)))
+	offsets := map[uint64]uint64{1: virtio.PCICommon, 2: virtio.PCINotify, 3: virtio.PCIISR, 4: virtio.PCIDevice}
+	for _, c := range caps {
+		assertEq(t, pci.CapVendor, load(t, cpu, ecam(1, c), 1))
+		assertEq(t, 0, load(t, cpu, ecam(1, c+4), 1)) // BAR 0
+		typ := load(t, cpu, ecam(1, c+3), 1)
+		assertEq(t, offsets[typ], load(t, cpu, ecam(1, c+8), 4))
+	}
+
+	blob := make([]byte, 64*1024)
+	cpu.Bus.Mem.ReadAt(blob, int64(cpu.Regs[11]))
+	if c := dtNodes(t, blob[:binary.BigEndian.Uint32(blob[4:])])["/soc/pci@30000000"]; c != "pci-host-ecam-generic" {
+		t.Fatalf("unexpected pci node compatible %q", c)
+	}
+}
+
+func TestVirtioPCI(t *testing.T) {
+	cpu, _ := newPCIRuntime(t)
+	if err := cpu.LoadDeviceTree(""); err != nil {
+		t.Fatal(err)
+	}
+	common := func(reg uint64) uint64 { return pci.MemBase + virtio.PCICommon + reg }
+	irq := pci.IrqOf(1, 1)
+	cpu.Bus.Store(plic.Base+plic.Priority+4*uint64(irq), 4, 1)
+	cpu.Bus.Store(plic.Base+plic.Enable+plic.EnableStride+4, 4, 1<<(irq-32))
+
+	store(t, cpu, common(virtio.CommonDeviceStatus), 1, virtio.StatusAcknowledge|virtio.StatusDriver)
+	store(t, cpu, common(virtio.CommonDeviceFeatureSel), 4, 1)
+	assertEq(t, 1, load(t, cpu, common(virtio.CommonDeviceFeature), 4)) // VERSION_1
+	store(t, cpu, common(virtio.CommonDriverFeatureSel), 4, 1)
+	store(t, cpu, common(virtio.CommonDriverFeature), 4, 1)
+	assertEq(t, 1, load(t, cpu, common(virtio.CommonNumQueues), 2))
+	store(t, cpu, common(virtio.CommonQueueSelect), 2, 0)
+	assertEq(t, virtio.MaxNum, load(t, cpu, common(virtio.CommonQueueSize), 2))
+	store(t, cpu, common(virtio.CommonQueueSize), 2, queueNum)
+	store(t, cpu, common(virtio.CommonQueueDesc), 8, queueBase)
+	store(t, cpu, common(virtio.CommonQueueDriver), 4, queueBase+0x1000)
+	store(t, cpu, common(virtio.CommonQueueDevice), 4, queueBase+0x2000)
+	store(t, cpu, common(virtio.CommonQueueEnable), 2, 1)
+	assertEq(t, queueBase+0x1000, load(t, cpu, common(virtio.CommonQueueDriver), 8))
+	notifyOff := load(t, cpu, common(virtio.CommonQueueNotifyOff), 2)
+	store(t, cpu, common(virtio.CommonDeviceStatus), 1,
+		virtio.StatusAcknowledge|virtio.StatusDriver|virtio.StatusFeaturesOK|virtio.StatusDriverOK)
+
+	// one writable buffer for entropy
+	desc := make([]byte, 16)
+	binary.LittleEndian.PutUint64(desc, bufBase)
+	binary.LittleEndian.PutUint32(desc[8:], 16)
+	binary.LittleEndian.PutUint16(desc[12:], 2)
+	cpu.Bus.Mem.WriteAt(desc, queueBase)
+	store(t, cpu, queueBase+0x1000+4, 2, 0)
+	store(t, cpu, queueBase+0x1000+2, 2, 1)
+	store(t, cpu, pci.MemBase+virtio.PCINotify+notifyOff*virtio.PCINotifyMultiplier, 2, 0)
+	assertEq(t, 1, load(t, cpu, queueBase+0x2000+2, 2))
+	assertEq(t, 16, load(t, cpu, queueBase+0x2000+8, 4))
+
+	if !cpu.Bus.Plic.Interrupting(1) {
+		t.Fatal("no interrupt for the used buffer")
+	}
+	assertEq(t, pci.StatusIntx, load(t, cpu, ecam(1, pci.Status), 2)&pci.StatusIntx)
+	assertEq(t, virtio.InterruptUsedBuffer, load(t, cpu, pci.MemBase+virtio.PCIISR, 1))
+	assertEq(t, 0, load(t, cpu, pci.MemBase+virtio.PCIISR, 1))
+	assertEq(t, 0, load(t, cpu, ecam(1, pci.Status), 2)&pci.StatusIntx)
+	claim := load(t, cpu, plic.Base+plic.Claim+plic.ContextStride, 4)
+	assertEq(t, uint64(irq), claim)
+	store(t, cpu, plic.Base+plic.Claim+plic.ContextStride, 4, claim)
+	if cpu.Bus.Plic.Interrupting(1) {
+		t.Fatal("interrupt still pending after completion")
+	}
+}
@@ -0,0 +1,76 @@
+package test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"debug/elf"
+	"goemu/profile"
+	"io"
+	"testing"
+)
+
+func TestProfile(t *testing.T) {
+	in := func(addr, offset uint64) bool {
+		return addr >= 0x80000000+offset && addr < 0x80000100+offset
+	}
+	for _, reference := range []bool{false, true} {
+		cpu := newAsmRuntime("profile")
+		cpu.Reference = reference
+		cpu.Profiler = profile.New(97, true)
+		if err := cpu.Run(); err != nil {
+			t.Fatal(err)
+		}
+		var total, hot, cold, called uint64
+		for _, s := range cpu.Profiler.Samples() {
+			total += s.Count
+			switch {
+			case in(s.Stack[0], 0x100):
+				hot += s.Count
+			case in(s.Stack[0], 0x200):
+				cold += s.Count
+			}
+			if (in(s.Stack[0], 0x100) || in(s.Stack[0], 0x200)) && len(s.Stack) == 2 {
+				called += s.Count
+				if !in(s.Stack[1], 0) {
+					t.Errorf("%#x called from outside main", s.Stack)
+				}
+			}
+		}
+		// one sample at the start and one every period after it
+		assertEq(t, (cpu.Instret-1)/97+1, total)
+		if hot < 5*cold || hot+cold < total*9/10 {
+			t.Errorf("%d samples in hot, %d in cold out of %d", hot, cold, total)
+		}
+		if called < (hot+cold)*3/4 {
+			t.Errorf("%d of %d samples in hot and cold have their caller", called, hot+cold)
+		}
+	}
+
+	cpu := newAsmRuntime("profile")
+	cpu.Profiler = profile.New(97, true)
+	if err := cpu.Run(); err != nil {
+		t.Fatal(err)
+	}
+	symbols := []elf.Symbol{
+		{Name: "main", Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC), Value: 0x80000000, Size: 0x100},
+		{Name: "hot", Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC), Value: 0x80000100, Size: 0x100},
+		{Name: "cold", Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC), Value: 0x80000200, Size: 0x100},
+	}
+	var buf bytes.Buffer
+	if err := cpu.Profiler.Write(&buf, "profile.elf", symbols); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"main", "hot", "cold", "profile.elf", "instructions"} {
+		if !bytes.Contains(data, []byte(name)) {
+			t.Errorf("no %q in the profile", name)
+		}
+	}
+}
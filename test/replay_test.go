@@ -0,0 +1,32 @@
+package test
+
+import (
+	"bytes"
+	"goemu/replay"
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	var log bytes.Buffer
+	rec, err := replay.NewRecorder(&log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rec.Record(replay.Event{Instret: 100, Kind: replay.UartRx, Data: 'x'}); err != nil {
+		t.Fatal(err)
+	}
+
+	var instret []uint64
+	for i := 0; i < 2; i++ {
+		cpu := newAsmRuntime("uart")
+		if cpu.Player, err = replay.NewPlayer(bytes.NewReader(log.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		if err = cpu.Run(); err != nil {
+			t.Fatal(err)
+		}
+		assertEq(t, 'x', cpu.Regs[7])
+		instret = append(instret, cpu.Instret)
+	}
+	assertEq(t, instret[0], instret[1])
+}
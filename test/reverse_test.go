@@ -0,0 +1,96 @@
+package test
+
+import (
+	"errors"
+	"goemu/hw/virtio"
+	"goemu/runtime"
+	"io"
+	"testing"
+)
+
+func TestReverse(t *testing.T) {
+	cpu := newAsmRuntime("bne")
+	tl, err := runtime.NewTimeline(cpu, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var history [][32]uint64
+	for {
+		history = append(history, cpu.Regs)
+		if err = tl.Step(); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			t.Fatal(err)
+		}
+	}
+	assertEq(t, 6, cpu.Regs[5])
+
+	for i := len(history) - 2; i >= 0; i-- {
+		if err = tl.StepBack(); err != nil {
+			t.Fatal(err)
+		}
+		assertEq(t, uint64(i), cpu.Instret)
+		if cpu.Regs != history[i] {
+			t.Fatalf("registers at instret %d: %v, want %v", i, cpu.Regs, history[i])
+		}
+	}
+	if err = tl.StepBack(); !errors.Is(err, runtime.ErrHistoryStart) {
+		t.Fatalf("step back at the start: %v", err)
+	}
+
+	// run to the end, then back to the last time the loop body was entered
+	if err = tl.Seek(uint64(len(history) - 1)); err != nil {
+		t.Fatal(err)
+	}
+	loop := cpu.Pc - 8
+	if err = tl.ContinueBack(func(cpu *runtime.CPU) bool { return cpu.Pc == loop }); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, 5, cpu.Regs[5])
+	assertEq(t, loop, cpu.Pc)
+}
+
+func TestReverseReset(t *testing.T) {
+	cpu := newAsmRuntime("bne")
+	tl, err := runtime.NewTimeline(cpu, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		if err = tl.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tl.StepBack(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a debugger write starts the history over
+	cpu.Regs[5] = 100
+	if err = tl.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	start := cpu.Instret
+	if err = tl.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if err = tl.StepBack(); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, start, cpu.Instret)
+	assertEq(t, 100, cpu.Regs[5])
+	if err = tl.StepBack(); !errors.Is(err, runtime.ErrHistoryStart) {
+		t.Fatalf("step back past the write: %v", err)
+	}
+}
+
+func TestReverseDisks(t *testing.T) {
+	for _, opts := range []virtio.BlkOptions{{}, {CopyOnWrite: true}, {ReadOnly: true}} {
+		cpu, _ := newBlkRuntime(t, opts)
+		_, err := runtime.NewTimeline(cpu, 4)
+		if writable := !opts.CopyOnWrite && !opts.ReadOnly; writable != (err != nil) {
+			t.Errorf("%+v: %v", opts, err)
+		}
+	}
+}
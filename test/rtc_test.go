@@ -0,0 +1,57 @@
+package test
+
+import (
+	"goemu/clock"
+	"goemu/hw/plic"
+	"goemu/hw/rtc"
+	"goemu/runtime"
+	"testing"
+)
+
+func TestRtc(t *testing.T) {
+	cpu := runtime.NewCPU(nil)
+	virt := clock.NewVirtual(1, func() uint64 { return cpu.Instret })
+	cpu.Bus.Clint.Clock = virt
+	cpu.Bus.Rtc.Epoch = 1_000_000_000_000
+	base := cpu.Bus.Rtc.Base
+
+	// the time advances with mtime, 100ns per tick
+	cpu.Instret = 10
+	low, _ := cpu.Bus.Load(base+rtc.TimeLow, 4)
+	high, _ := cpu.Bus.Load(base+rtc.TimeHigh, 4)
+	assertEq(t, 1_000_000_001_000, high<<32|low)
+
+	// setting the time moves the epoch
+	cpu.Bus.Store(base+rtc.TimeHigh, 4, 0)
+	cpu.Bus.Store(base+rtc.TimeLow, 4, 5000)
+	assertEq(t, 5000, cpu.Bus.Rtc.Now())
+
+	// an alarm 1us ahead fires after 10 ticks and raises its PLIC line
+	cpu.Bus.Store(plic.Base+plic.Priority+4*rtc.Irq, 4, 1)
+	cpu.Bus.Store(plic.Base+plic.Enable+plic.EnableStride, 4, 1<<rtc.Irq)
+	cpu.Bus.Store(base+rtc.IrqEnabled, 4, 1)
+	cpu.Bus.Store(base+rtc.AlarmHigh, 4, 0)
+	cpu.Bus.Store(base+rtc.AlarmLow, 4, 6000)
+	status, _ := cpu.Bus.Load(base+rtc.AlarmStatus, 4)
+	assertEq(t, 1, status)
+	assertEq(t, 20, cpu.Bus.Rtc.Deadline())
+	cpu.Instret = 19
+	cpu.Bus.Rtc.Update()
+	if cpu.Bus.Plic.Interrupting(1) {
+		t.Fatal("alarm fired early")
+	}
+	cpu.Instret = 20
+	cpu.Bus.Rtc.Update()
+	if !cpu.Bus.Plic.Interrupting(1) {
+		t.Fatal("alarm did not fire")
+	}
+	status, _ = cpu.Bus.Load(base+rtc.AlarmStatus, 4)
+	assertEq(t, 0, status)
+	cpu.Bus.Store(base+rtc.ClearInterrupt, 4, 1)
+	claim, _ := cpu.Bus.Load(plic.Base+plic.Claim+plic.ContextStride, 4)
+	assertEq(t, rtc.Irq, claim)
+	cpu.Bus.Store(plic.Base+plic.Claim+plic.ContextStride, 4, claim)
+	if cpu.Bus.Plic.Interrupting(1) {
+		t.Fatal("interrupt still pending after it was cleared")
+	}
+}
@@ -0,0 +1,32 @@
+package test
+
+import (
+	"errors"
+	"goemu/runtime"
+	"goemu/semihost"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSemihost(t *testing.T) {
+	cpu := newAsmRuntime("semihost")
+	root := t.TempDir()
+	h, err := semihost.New(root, "semihost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu.Handler = h
+	var exit *runtime.ExitError
+	if err = cpu.Run(); !errors.As(err, &exit) {
+		t.Fatalf("expected an exit, got %v", err)
+	}
+	assertEq(t, 3, uint64(exit.Code))
+	data, err := os.ReadFile(filepath.Join(root, "out.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hi\n" {
+		t.Fatalf("unexpected output %q", data)
+	}
+}
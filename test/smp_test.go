@@ -0,0 +1,173 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"goemu/clock"
+	"goemu/hw/clint"
+	"goemu/runtime"
+	"sync"
+	"testing"
+)
+
+func TestSmp(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		quantum  uint64
+		parallel bool
+	}{
+		{"lockstep", 1, false},
+		{"quantum", 7, false},
+		{"parallel", 0, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := runtime.NewMachine(asmImage("smp"), 4)
+			m.Quantum, m.Parallel = tc.quantum, tc.parallel
+			if err := m.Run(func() bool { return false }); err != nil {
+				t.Fatal(err)
+			}
+			cpu := m.Harts[0]
+			assertEq(t, 400, cpu.Regs[10])
+			assertEq(t, 400, cpu.Regs[11])
+			assertEq(t, 0, cpu.Regs[12])
+			for i, h := range m.Harts {
+				assertEq(t, uint64(i), h.Csr[runtime.Mhartid])
+			}
+		})
+	}
+}
+
+func TestSmpDeterministic(t *testing.T) {
+	run := func() []uint64 {
+		m := runtime.NewMachine(asmImage("smp"), 4)
+		m.Quantum = 3
+		if err := m.Run(func() bool { return false }); err != nil {
+			t.Fatal(err)
+		}
+		var instret []uint64
+		for _, h := range m.Harts {
+			instret = append(instret, h.Instret)
+		}
+		return instret
+	}
+	first, second := run(), run()
+	for i := range first {
+		assertEq(t, first[i], second[i])
+	}
+}
+
+func TestSmpWfi(t *testing.T) {
+	for _, quantum := range []uint64{1, runtime.DefaultQuantum} {
+		m := runtime.NewMachine(asmImage("smp_wfi"), 2)
+		m.Quantum = quantum
+		m.Bus.Clint.Clock = clock.NewVirtual(1, func() uint64 { return m.Harts[0].Instret })
+		if err := m.Run(func() bool { return false }); err != nil {
+			t.Fatal(err)
+		}
+		if d := m.Harts[1].Regs[11]; d > 100000 {
+			t.Errorf("quantum %d: time jumped by %d while hart 1 was busy", quantum, d)
+		}
+		if now := m.Harts[0].Regs[10]; now < 1000000 {
+			t.Errorf("quantum %d: time did not reach the deadline: %d", quantum, now)
+		}
+	}
+}
+
+func TestSmpPerHartState(t *testing.T) {
+	m := runtime.NewMachine(nil, 4)
+	if err := m.LoadDeviceTree(""); err != nil {
+		t.Fatal(err)
+	}
+	for i, h := range m.Harts {
+		assertEq(t, uint64(i), h.Regs[10])
+		assertEq(t, m.Harts[0].Regs[11], h.Regs[11])
+		assertEq(t, m.Harts[0].Regs[2]-uint64(i)*runtime.HartStack, h.Regs[2])
+	}
+
+	// writing mhartid is an illegal instruction, which leaves rd alone
+	cpu := m.Harts[2]
+	cpu.Bus.Store(0x80000000, 4, 0xF1405573) // csrrwi a0, mhartid, 0
+	cpu.Pc, cpu.Csr[runtime.Mtvec], cpu.Regs[10] = 0x80000000, 0x80000100, 0x55
+	if err := cpu.Step(); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, 0x80000100, cpu.Pc)
+	assertEq(t, runtime.IllegalInst, cpu.Csr[runtime.Mcause])
+	assertEq(t, 0xF1405573, cpu.Csr[runtime.Mtval])
+	assertEq(t, 0x55, cpu.Regs[10])
+	assertEq(t, 2, cpu.Csr[runtime.Mhartid])
+
+	// each hart has its own software interrupt and timer
+	m.Bus.Store(clint.Base+clint.Msip+4*3, 4, 1)
+	m.Bus.Store(clint.Base+clint.Mtimecmp+8*1, 8, 0)
+	for i := 0; i < 4; i++ {
+		msip, mtip := m.Bus.Clint.Pending(i)
+		assertEq(t, b2u(i == 3), b2u(msip))
+		assertEq(t, b2u(i == 1), b2u(mtip))
+	}
+
+	blob := make([]byte, 64*1024)
+	m.Bus.Mem.ReadAt(blob, int64(m.Harts[0].Regs[11]))
+	nodes := dtNodes(t, blob[:binary.BigEndian.Uint32(blob[4:])])
+	for i := 0; i < 4; i++ {
+		if _, ok := nodes[fmt.Sprintf("/cpus/cpu@%d", i)]; !ok {
+			t.Errorf("no node for hart %d", i)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := m.SaveSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := runtime.NewCPU(nil).RestoreSnapshot(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Error("snapshot of 4 harts restored to a single one")
+	}
+	other := runtime.NewMachine(nil, 4)
+	if err := other.RestoreSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, uint64(3), other.Harts[3].Regs[10])
+}
+
+func TestMemoryAtomic(t *testing.T) {
+	mem := runtime.NewMemory(0x80000000, 0x1000)
+
+	// stores to neighbouring bytes of one word do not lose each other
+	var wg sync.WaitGroup
+	for i := uint64(0); i < 8; i++ {
+		wg.Add(1)
+		go func(i uint64) {
+			defer wg.Done()
+			for n := 0; n < 1000; n++ {
+				mem.Store(0x80000000+i, 1, i+1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	v, _ := mem.Load(0x80000000, 8)
+	assertEq(t, 0x0807060504030201, v)
+	assertEq(t, 0x01, uint64(mem.Data[0]))
+
+	// misaligned accesses span words
+	mem.Store(0x80000003, 4, 0xAABBCCDD)
+	v, _ = mem.Load(0x80000003, 4)
+	assertEq(t, 0xAABBCCDD, v)
+
+	ok, _ := mem.CompareAndSwap(0x80000008, 4, 0, 7)
+	assertEq(t, 1, b2u(ok))
+	ok, _ = mem.CompareAndSwap(0x80000008, 4, 0, 9)
+	assertEq(t, 0, b2u(ok))
+	v, _ = mem.Load(0x80000008, 4)
+	assertEq(t, 7, v)
+	if _, err := mem.CompareAndSwap(0x8000000A, 4, 0, 1); err == nil {
+		t.Error("misaligned compare and swap succeeded")
+	}
+}
+
+func b2u(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,35 @@
+package test
+
+import (
+	"bytes"
+	"goemu/runtime"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	cpu := newAsmRuntime("lb")
+	if err := cpu.Run(); err != nil {
+		t.Fatal(err)
+	}
+	cpu.Csr[runtime.Mscratch] = 0x1234
+	var buf bytes.Buffer
+	if err := cpu.SaveSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := runtime.NewCPU(nil)
+	if err := restored.RestoreSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Regs != cpu.Regs {
+		t.Errorf("registers mismatch: %v, want %v", restored.Regs, cpu.Regs)
+	}
+	assertEq(t, cpu.Pc, restored.Pc)
+	assertEq(t, cpu.Size, restored.Size)
+	assertEq(t, 0x1234, restored.Csr[runtime.Mscratch])
+	val, err := restored.Bus.Load(cpu.Regs[8]+0x100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, 0x34, val)
+}
@@ -0,0 +1,178 @@
+package test
+
+import (
+	"bytes"
+	"goemu/hostio"
+	"goemu/hw/uart"
+	"goemu/replay"
+	"goemu/runtime"
+	"io"
+	"os"
+	"testing"
+)
+
+// newUartRuntime returns accessors for the UART registers, and the state of
+// its interrupt line.
+func newUartRuntime() (*runtime.CPU, *bytes.Buffer, func(reg uint64) uint64, func(reg, v uint64), *bool) {
+	cpu := runtime.NewCPU(nil)
+	var out bytes.Buffer
+	var line bool
+	cpu.Bus.Uart.Out = &out
+	cpu.Bus.Uart.In = nil
+	cpu.Bus.Uart.Irq = func(high bool) { line = high }
+	load := func(reg uint64) uint64 {
+		v, _ := cpu.Bus.Load(uart.Base+reg, 1)
+		return v
+	}
+	store := func(reg, v uint64) {
+		cpu.Bus.Store(uart.Base+reg, 1, v)
+	}
+	return cpu, &out, load, store, &line
+}
+
+func TestUartRegisters(t *testing.T) {
+	_, out, load, store, _ := newUartRuntime()
+	assertEq(t, uart.IsrNone, load(uart.Isr))
+	assertEq(t, uart.LsrTxIdle|uart.LsrTxEmpty, load(uart.Lsr))
+
+	// the divisor latch shadows RBR/THR and IER
+	store(uart.Lcr, uart.LcrBaudLatch|uart.LcrEightBits)
+	store(uart.Dll, 0x0C)
+	store(uart.Dlm, 0x01)
+	assertEq(t, 0x0C, load(uart.Dll))
+	assertEq(t, 0x01, load(uart.Dlm))
+	store(uart.Lcr, uart.LcrEightBits)
+	assertEq(t, 0, load(uart.Ier))
+	assertEq(t, 0, uint64(out.Len()))
+
+	store(uart.Scr, 0x5A)
+	assertEq(t, 0x5A, load(uart.Scr))
+
+	// the 8250 driver tells a 16550A by the FIFO bits in IIR
+	store(uart.Fcr, uart.FcrFifoEnable)
+	assertEq(t, uart.IsrFifo|uart.IsrNone, load(uart.Isr))
+
+	store(uart.Thr, 'o')
+	store(uart.Thr, 'k')
+	store(uart.Thr, '\n')
+	if out.String() != "ok\n" {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+}
+
+func TestUartFifo(t *testing.T) {
+	cpu, _, load, store, line := newUartRuntime()
+	store(uart.Fcr, uart.FcrFifoEnable|1<<6) // trigger at 4 bytes
+	store(uart.Ier, uart.IerRxEnable|uart.IerLineStatus)
+
+	for _, b := range []byte("abc") {
+		cpu.Bus.Uart.Receive(b)
+	}
+	assertEq(t, uart.IsrFifo|uart.IsrTimeout, load(uart.Isr))
+	cpu.Bus.Uart.Receive('d')
+	assertEq(t, uart.IsrFifo|uart.IsrRxData, load(uart.Isr))
+	if !*line {
+		t.Fatal("receive interrupt not raised")
+	}
+
+	// overflowing the 16 byte FIFO is a line status interrupt
+	for i := 0; i < uart.FifoSize-3; i++ {
+		cpu.Bus.Uart.Receive('x')
+	}
+	assertEq(t, uart.IsrFifo|uart.IsrLineStatus, load(uart.Isr))
+	lsr := load(uart.Lsr)
+	assertEq(t, uart.LsrOverrun|uart.LsrFifoError, lsr&(uart.LsrOverrun|uart.LsrFifoError))
+	assertEq(t, 0, load(uart.Lsr)&uart.LsrOverrun)
+
+	for _, want := range []byte("abcd") {
+		assertEq(t, uint64(want), load(uart.Rhr))
+	}
+	for i := 0; i < uart.FifoSize-4; i++ {
+		load(uart.Rhr)
+	}
+	assertEq(t, 0, load(uart.Lsr)&uart.LsrRxReady)
+	assertEq(t, uart.IsrFifo|uart.IsrNone, load(uart.Isr))
+	if *line {
+		t.Fatal("interrupt still raised")
+	}
+}
+
+func TestUartTxEmptyAndLoopback(t *testing.T) {
+	_, out, load, store, line := newUartRuntime()
+	// enabling the THR empty interrupt raises it right away, reading IIR clears it
+	store(uart.Ier, uart.IerTxEnable)
+	if !*line {
+		t.Fatal("THR empty interrupt not raised")
+	}
+	assertEq(t, uart.IsrTxEmpty, load(uart.Isr))
+	assertEq(t, uart.IsrNone, load(uart.Isr))
+	if *line {
+		t.Fatal("THR empty interrupt still raised")
+	}
+
+	// in loopback mode output comes back as input and the modem lines follow MCR
+	store(uart.Mcr, uart.McrLoop|uart.McrRts|uart.McrOut2)
+	assertEq(t, uart.MsrCts|uart.MsrDcd|uart.MsrDeltaDsr, load(uart.Msr))
+	store(uart.Ier, uart.IerRxEnable)
+	store(uart.Thr, 'z')
+	assertEq(t, 0, uint64(out.Len()))
+	assertEq(t, uart.IsrRxData, load(uart.Isr))
+	assertEq(t, 'z', load(uart.Rhr))
+	store(uart.Mcr, 0)
+	assertEq(t, uart.MsrCts|uart.MsrDsr|uart.MsrDcd|uart.MsrDeltaDsr, load(uart.Msr))
+}
+
+func TestUartMultiple(t *testing.T) {
+	cpu := runtime.NewCPU(nil)
+	second, err := cpu.Bus.AddUart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, uart.Base+uart.Size, second.Base)
+	var out bytes.Buffer
+	second.Out = &out
+	cpu.Bus.Store(second.Base+uart.Thr, 1, 'A')
+	cpu.Bus.Uart.Flush()
+	second.Flush()
+	if out.String() != "A" {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+
+	// recorded input names the UART it arrived at
+	var log bytes.Buffer
+	rec, _ := replay.NewRecorder(&log)
+	rec.Record(replay.Event{Kind: replay.UartRx, Data: 1<<8 | 'b'})
+	if cpu.Player, err = replay.NewPlayer(&log); err != nil {
+		t.Fatal(err)
+	}
+	cpu.Bus.Store(0x80000000, 4, 0x00000013) // nop
+	if err = cpu.Step(); err != nil {
+		t.Fatal(err)
+	}
+	v, _ := cpu.Bus.Load(second.Base+uart.Rhr, 1)
+	assertEq(t, 'b', v)
+	v, _ = cpu.Bus.Load(uart.Base+uart.Lsr, 1)
+	assertEq(t, 0, v&uart.LsrRxReady)
+}
+
+func TestUartPty(t *testing.T) {
+	p, err := hostio.OpenPty()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer p.Close()
+	term, err := os.OpenFile(p.Name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer term.Close()
+	p.Write([]byte("out"))
+	buf := make([]byte, 3)
+	if _, err = io.ReadFull(term, buf); err != nil || string(buf) != "out" {
+		t.Fatalf("unexpected terminal output %q, %v", buf, err)
+	}
+	term.Write([]byte("in"))
+	if _, err = io.ReadFull(p, buf[:2]); err != nil || string(buf[:2]) != "in" {
+		t.Fatalf("unexpected terminal input %q, %v", buf[:2], err)
+	}
+}
@@ -0,0 +1,460 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"goemu/ether"
+	"goemu/hw/plic"
+	"goemu/hw/virtio"
+	"goemu/runtime"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Guest memory used by the driver below.
+const (
+	descAddr   = 0x80001000
+	availAddr  = 0x80002000
+	usedAddr   = 0x80003000
+	headerAddr = 0x80004000
+	dataAddr   = 0x80005000
+	statusAddr = 0x80006000
+)
+
+// newBlkRuntime attaches a disk of four sectors, sector i filled with i+1,
+// and brings the device up the way a driver does.
+func newBlkRuntime(t *testing.T, opts virtio.BlkOptions) (*runtime.CPU, string) {
+	disk := filepath.Join(t.TempDir(), "disk.img")
+	image := make([]byte, 4*virtio.SectorSize)
+	for i := range image {
+		image[i] = uint8(i/virtio.SectorSize + 1)
+	}
+	if err := os.WriteFile(disk, image, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	blk, err := virtio.NewBlk(disk, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := runtime.NewCPU(nil)
+	if _, err = cpu.Bus.AddVirtio(blk); err != nil {
+		t.Fatal(err)
+	}
+
+	mmioStore(t, cpu, virtio.Status, virtio.StatusAcknowledge|virtio.StatusDriver)
+	mmioStore(t, cpu, virtio.DriverFeatures, 0)
+	mmioStore(t, cpu, virtio.QueueSel, 0)
+	mmioStore(t, cpu, virtio.QueueNum, 8)
+	mmioStore(t, cpu, virtio.QueueDescLow, descAddr)
+	mmioStore(t, cpu, virtio.QueueDriverLow, availAddr)
+	mmioStore(t, cpu, virtio.QueueDeviceLow, usedAddr)
+	mmioStore(t, cpu, virtio.QueueReady, 1)
+	mmioStore(t, cpu, virtio.Status, virtio.StatusAcknowledge|virtio.StatusDriver|virtio.StatusFeaturesOK|virtio.StatusDriverOK)
+
+	// route the device interrupt to the Supervisor context of hart 0
+	cpu.Bus.Store(plic.Base+plic.Priority+4*virtio.Irq, 4, 1)
+	cpu.Bus.Store(plic.Base+plic.Enable+plic.EnableStride, 4, 1<<virtio.Irq)
+	return cpu, disk
+}
+
+func mmioStore(t *testing.T, cpu *runtime.CPU, reg, v uint64) {
+	if err := cpu.Bus.Store(virtio.Base+reg, 4, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// blkRequest submits a single request in descriptors 0-2 and waits for it.
+func blkRequest(t *testing.T, cpu *runtime.CPU, typ uint32, sector uint64, data []byte, n uint16) uint8 {
+	mem := cpu.Bus.Mem
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint32(header, typ)
+	binary.LittleEndian.PutUint64(header[8:], sector)
+	mem.WriteAt(header, headerAddr)
+	dataFlags := uint16(virtio.DescNext)
+	if typ == 0 {
+		dataFlags |= virtio.DescWrite
+	} else {
+		mem.WriteAt(data, dataAddr)
+	}
+	descs := []struct {
+		addr  uint64
+		len   uint32
+		flags uint16
+		next  uint16
+	}{
+		{headerAddr, 16, virtio.DescNext, 1},
+		{dataAddr, uint32(len(data)), dataFlags, 2},
+		{statusAddr, 1, virtio.DescWrite, 0},
+	}
+	for i, d := range descs {
+		buf := make([]byte, 16)
+		binary.LittleEndian.PutUint64(buf, d.addr)
+		binary.LittleEndian.PutUint32(buf[8:], d.len)
+		binary.LittleEndian.PutUint16(buf[12:], d.flags)
+		binary.LittleEndian.PutUint16(buf[14:], d.next)
+		mem.WriteAt(buf, int64(descAddr+16*i))
+	}
+	ring := make([]byte, 2)
+	binary.LittleEndian.PutUint16(ring, 0)
+	mem.WriteAt(ring, int64(availAddr+4+2*((uint64(n)-1)%8)))
+	binary.LittleEndian.PutUint16(ring, n)
+	mem.WriteAt(ring, availAddr+2)
+	mmioStore(t, cpu, virtio.QueueNotify, 0)
+
+	used, _ := cpu.Bus.Load(usedAddr+2, 2)
+	assertEq(t, uint64(n), used)
+	status, _ := cpu.Bus.Load(statusAddr, 1)
+	return uint8(status)
+}
+
+func TestVirtioBlk(t *testing.T) {
+	cpu, _ := newBlkRuntime(t, virtio.BlkOptions{})
+	magic, _ := cpu.Bus.Load(virtio.Base+virtio.MagicValue, 4)
+	assertEq(t, virtio.Magic, magic)
+	id, _ := cpu.Bus.Load(virtio.Base+virtio.DeviceID, 4)
+	assertEq(t, virtio.BlkID, id)
+	capacity, _ := cpu.Bus.Load(virtio.Base+virtio.Config, 8)
+	assertEq(t, 4, capacity)
+
+	data := make([]byte, virtio.SectorSize)
+	assertEq(t, 0, uint64(blkRequest(t, cpu, 0, 2, data, 1)))
+	got := make([]byte, virtio.SectorSize)
+	cpu.Bus.Mem.ReadAt(got, dataAddr)
+	if !bytes.Equal(got, bytes.Repeat([]byte{3}, virtio.SectorSize)) {
+		t.Fatalf("unexpected sector data %v", got[:8])
+	}
+
+	// the hart takes the interrupt, claims it from the PLIC and acknowledges
+	// it at the device
+	cpu.Csr[runtime.Mtvec] = 0x80000100
+	cpu.Bus.Store(0x80000100, 4, 0x00000013) // nop
+	cpu.Csr[runtime.Mie] = runtime.SeipMask
+	cpu.Csr[runtime.Mstatus] |= runtime.MieMask
+	if err := cpu.Step(); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, 1<<63|runtime.SupervisorExtInt, cpu.Csr[runtime.Mcause])
+	assertEq(t, 0x80000104, cpu.Pc)
+	claim, _ := cpu.Bus.Load(plic.Base+plic.Claim+plic.ContextStride, 4)
+	assertEq(t, virtio.Irq, claim)
+	isr, _ := cpu.Bus.Load(virtio.Base+virtio.InterruptStatus, 4)
+	assertEq(t, virtio.InterruptUsedBuffer, isr)
+	mmioStore(t, cpu, virtio.InterruptACK, isr)
+	cpu.Bus.Store(plic.Base+plic.Claim+plic.ContextStride, 4, claim)
+	if cpu.Bus.Plic.Interrupting(1) {
+		t.Fatal("interrupt still pending after completion")
+	}
+}
+
+func TestVirtioBlkCopyOnWrite(t *testing.T) {
+	cpu, disk := newBlkRuntime(t, virtio.BlkOptions{CopyOnWrite: true})
+	data := bytes.Repeat([]byte{0xAA}, virtio.SectorSize)
+	assertEq(t, 0, uint64(blkRequest(t, cpu, 1, 1, data, 1)))
+	assertEq(t, 0, uint64(blkRequest(t, cpu, 0, 1, make([]byte, virtio.SectorSize), 2)))
+	got := make([]byte, virtio.SectorSize)
+	cpu.Bus.Mem.ReadAt(got, dataAddr)
+	if !bytes.Equal(got, data) {
+		t.Fatalf("write not visible to the guest: %v", got[:8])
+	}
+	image, _ := os.ReadFile(disk)
+	if image[virtio.SectorSize] != 2 {
+		t.Fatal("copy-on-write disk image was modified")
+	}
+}
+
+func TestVirtioBlkReadOnly(t *testing.T) {
+	cpu, _ := newBlkRuntime(t, virtio.BlkOptions{ReadOnly: true})
+	features, _ := cpu.Bus.Load(virtio.Base+virtio.DeviceFeatures, 4)
+	assertEq(t, virtio.BlkFeatureRO, features&virtio.BlkFeatureRO)
+	assertEq(t, 1, uint64(blkRequest(t, cpu, 1, 0, make([]byte, virtio.SectorSize), 1)))
+}
+
+func TestVirtioBlkBeyondCapacity(t *testing.T) {
+	cpu, disk := newBlkRuntime(t, virtio.BlkOptions{})
+	// sector*SectorSize wraps around to sector 0
+	assertEq(t, 1, uint64(blkRequest(t, cpu, 0, 1<<55, make([]byte, virtio.SectorSize), 1)))
+	assertEq(t, 1, uint64(blkRequest(t, cpu, 1, 1<<55, make([]byte, virtio.SectorSize), 2)))
+	// a write running past the last sector is not done in part
+	assertEq(t, 1, uint64(blkRequest(t, cpu, 1, 3, make([]byte, 2*virtio.SectorSize), 3)))
+	image, _ := os.ReadFile(disk)
+	assertEq(t, 4, uint64(image[3*virtio.SectorSize]))
+}
+
+func TestVirtioBlkPartialSector(t *testing.T) {
+	for _, opts := range []virtio.BlkOptions{{}, {CopyOnWrite: true}} {
+		cpu, _ := newBlkRuntime(t, opts)
+		assertEq(t, 1, uint64(blkRequest(t, cpu, 1, 1, bytes.Repeat([]byte{0xAA}, 100), 1)))
+		assertEq(t, 0, uint64(blkRequest(t, cpu, 0, 1, make([]byte, virtio.SectorSize), 2)))
+		got := make([]byte, virtio.SectorSize)
+		cpu.Bus.Mem.ReadAt(got, dataAddr)
+		if !bytes.Equal(got, bytes.Repeat([]byte{2}, virtio.SectorSize)) {
+			t.Fatalf("partial sector written (copy-on-write %v): %v", opts.CopyOnWrite, got[:8])
+		}
+	}
+}
+
+func TestVirtioBlkNeedsReset(t *testing.T) {
+	cpu, _ := newBlkRuntime(t, virtio.BlkOptions{})
+	// a descriptor chaining to itself
+	desc := make([]byte, 16)
+	binary.LittleEndian.PutUint64(desc, headerAddr)
+	binary.LittleEndian.PutUint32(desc[8:], 16)
+	binary.LittleEndian.PutUint16(desc[12:], virtio.DescNext)
+	cpu.Bus.Mem.WriteAt(desc, descAddr)
+	ring := make([]byte, 2)
+	binary.LittleEndian.PutUint16(ring, 1)
+	cpu.Bus.Mem.WriteAt(ring, availAddr+2)
+	mmioStore(t, cpu, virtio.QueueNotify, 0)
+
+	status, _ := cpu.Bus.Load(virtio.Base+virtio.Status, 4)
+	assertEq(t, virtio.StatusNeedsReset, status&virtio.StatusNeedsReset)
+	isr, _ := cpu.Bus.Load(virtio.Base+virtio.InterruptStatus, 4)
+	assertEq(t, virtio.InterruptConfigChange, isr)
+	used, _ := cpu.Bus.Load(usedAddr+2, 2)
+	assertEq(t, 0, used)
+}
+
+// driver plays the part of a guest virtio driver for the device in one slot.
+// Queue i lives in guest memory at queueBase+i*0x10000.
+type driver struct {
+	t    *testing.T
+	cpu  *runtime.CPU
+	base uint64
+	next map[int]uint16 // next driver ring index per queue
+}
+
+const (
+	queueBase = 0x80100000
+	queueNum  = 8
+	bufBase   = 0x80200000 // buffers handed to the device, 0x1000 bytes apart
+)
+
+type buffer struct {
+	addr  uint64
+	len   uint32
+	write bool
+}
+
+func newDriver(t *testing.T, cpu *runtime.CPU, slot int, queues int) *driver {
+	d := &driver{t: t, cpu: cpu, base: virtio.Base + uint64(slot)*virtio.Size, next: make(map[int]uint16)}
+	d.store(virtio.Status, virtio.StatusAcknowledge|virtio.StatusDriver)
+	features := d.load(virtio.DeviceFeatures)
+	d.store(virtio.DriverFeatures, features)
+	for q := 0; q < queues; q++ {
+		addr := uint64(queueBase + q*0x10000)
+		d.store(virtio.QueueSel, uint64(q))
+		d.store(virtio.QueueNum, queueNum)
+		d.store(virtio.QueueDescLow, addr)
+		d.store(virtio.QueueDriverLow, addr+0x1000)
+		d.store(virtio.QueueDeviceLow, addr+0x2000)
+		d.store(virtio.QueueReady, 1)
+	}
+	d.store(virtio.Status, virtio.StatusAcknowledge|virtio.StatusDriver|virtio.StatusFeaturesOK|virtio.StatusDriverOK)
+	return d
+}
+
+func (d *driver) load(reg uint64) uint64 {
+	v, err := d.cpu.Bus.Load(d.base+reg, 4)
+	if err != nil {
+		d.t.Fatal(err)
+	}
+	return v
+}
+
+func (d *driver) store(reg, v uint64) {
+	if err := d.cpu.Bus.Store(d.base+reg, 4, v); err != nil {
+		d.t.Fatal(err)
+	}
+}
+
+// submit makes a chain of bufs available on queue q and notifies the device.
+// Each submission uses its own range of descriptors.
+func (d *driver) submit(q int, bufs ...buffer) {
+	addr := uint64(queueBase + q*0x10000)
+	idx := d.next[q]
+	first := (int(idx) * 3) % queueNum
+	for i, b := range bufs {
+		desc := make([]byte, 16)
+		binary.LittleEndian.PutUint64(desc, b.addr)
+		binary.LittleEndian.PutUint32(desc[8:], b.len)
+		flags := uint16(0)
+		if b.write {
+			flags |= virtio.DescWrite
+		}
+		if i < len(bufs)-1 {
+			flags |= virtio.DescNext
+		}
+		binary.LittleEndian.PutUint16(desc[12:], flags)
+		binary.LittleEndian.PutUint16(desc[14:], uint16((first+i+1)%queueNum))
+		d.cpu.Bus.Mem.WriteAt(desc, int64(addr+uint64((first+i)%queueNum)*16))
+	}
+	ring := make([]byte, 2)
+	binary.LittleEndian.PutUint16(ring, uint16(first))
+	d.cpu.Bus.Mem.WriteAt(ring, int64(addr+0x1000+4+2*uint64(idx%queueNum)))
+	binary.LittleEndian.PutUint16(ring, idx+1)
+	d.cpu.Bus.Mem.WriteAt(ring, int64(addr+0x1000+2))
+	d.next[q] = idx + 1
+	d.store(virtio.QueueNotify, uint64(q))
+}
+
+// used returns the number of chains the device has returned on queue q.
+func (d *driver) used(q int) uint64 {
+	v, _ := d.cpu.Bus.Load(uint64(queueBase+q*0x10000+0x2000+2), 2)
+	return v
+}
+
+func (d *driver) read(addr uint64, n int) []byte {
+	data := make([]byte, n)
+	d.cpu.Bus.Mem.ReadAt(data, int64(addr))
+	return data
+}
+
+func TestVirtioConsole(t *testing.T) {
+	var log bytes.Buffer
+	console, err := virtio.NewConsole([]*virtio.Port{
+		virtio.NewPort("console", true, strings.NewReader("hi"), nil),
+		virtio.NewPort("log", false, nil, &log),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := runtime.NewCPU(nil)
+	if _, err = cpu.Bus.AddVirtio(console); err != nil {
+		t.Fatal(err)
+	}
+	d := newDriver(t, cpu, 0, 6)
+	assertEq(t, virtio.ConsoleFeatureMultiport, d.load(virtio.DeviceFeatures)&virtio.ConsoleFeatureMultiport)
+
+	// DEVICE_READY is answered with a DEVICE_ADD for each port
+	d.submit(2, buffer{bufBase, 64, true})
+	d.submit(2, buffer{bufBase + 0x1000, 64, true})
+	cpu.Bus.Mem.WriteAt([]byte{0, 0, 0, 0, 0, 0, 1, 0}, bufBase+0x2000)
+	d.submit(3, buffer{bufBase + 0x2000, 8, false})
+	assertEq(t, 2, d.used(2))
+	assertEq(t, 1, uint64(d.read(bufBase+0x1000, 8)[0])) // port id
+
+	// output on port 1 goes to its host writer
+	cpu.Bus.Mem.WriteAt([]byte("hello"), bufBase+0x3000)
+	d.submit(5, buffer{bufBase + 0x3000, 5, false})
+	if log.String() != "hello" {
+		t.Fatalf("unexpected port output %q", log.String())
+	}
+
+	// but not while muted
+	console.Mute(true)
+	d.submit(5, buffer{bufBase + 0x3000, 5, false})
+	console.Mute(false)
+	if log.String() != "hello" {
+		t.Fatalf("output while muted %q", log.String())
+	}
+
+	// input on port 0 is delivered when the device is polled
+	d.submit(0, buffer{bufBase + 0x4000, 64, true})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		port, data, ok := console.Poll()
+		if ok {
+			assertEq(t, 0, uint64(port))
+			if string(data) != "hi" {
+				t.Fatalf("unexpected input %q", data)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no input delivered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assertEq(t, 1, d.used(0))
+	if got := string(d.read(bufBase+0x4000, 2)); got != "hi" {
+		t.Fatalf("unexpected guest buffer %q", got)
+	}
+}
+
+// pollNet waits for the device to deliver a frame from its backend.
+func pollNet(t *testing.T, n *virtio.Net) []byte {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, data, ok := n.Poll(); ok {
+			return data
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no frame delivered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestVirtioNet(t *testing.T) {
+	var capture bytes.Buffer
+	pcap, err := ether.NewPcap(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := ether.Addr{0x52, 0x54, 0, 0x12, 0x34, 0x56}
+	n := virtio.NewNet(mac, ether.NewLoopback(), pcap)
+	cpu := runtime.NewCPU(nil)
+	if _, err = cpu.Bus.AddVirtio(n); err != nil {
+		t.Fatal(err)
+	}
+	d := newDriver(t, cpu, 0, 2)
+	assertEq(t, virtio.NetID, d.load(virtio.DeviceID))
+	config, _ := cpu.Bus.Load(virtio.Base+virtio.Config, 8)
+	assertEq(t, 0x0001_5634_1200_5452, config)
+
+	// an ARP request for the gateway, behind an empty virtio_net_hdr
+	arp := []byte{0, 1, 8, 0, 6, 4, 0, 1}
+	arp = append(arp, mac[:]...)
+	arp = append(arp, 10, 0, 2, 15, 0, 0, 0, 0, 0, 0, 10, 0, 2, 2)
+	frame := ether.NewFrame(ether.Broadcast, mac, ether.TypeARP, arp)
+	cpu.Bus.Mem.WriteAt(append(make([]byte, 12), frame...), bufBase)
+	d.submit(0, buffer{bufBase + 0x1000, 2048, true})
+	d.submit(1, buffer{bufBase, uint32(12 + len(frame)), false})
+	assertEq(t, 1, d.used(1))
+
+	reply := pollNet(t, n)
+	assertEq(t, 1, d.used(0))
+	if got := d.read(bufBase+0x1000+12, len(reply)); !bytes.Equal(got, reply) {
+		t.Fatalf("unexpected guest buffer %x", got)
+	}
+	if ether.Dst(reply) != mac || ether.Type(reply) != ether.TypeARP {
+		t.Fatalf("unexpected reply %x", reply)
+	}
+	if !bytes.Equal(reply[ether.HeaderSize+8:ether.HeaderSize+18], append(ether.GatewayAddr[:], ether.GatewayIP[:]...)) {
+		t.Fatalf("unexpected ARP sender %x", reply[ether.HeaderSize+8:ether.HeaderSize+18])
+	}
+
+	// both frames were captured after the 24 byte file header
+	assertEq(t, uint64(24+2*16+len(frame)+len(reply)), uint64(capture.Len()))
+
+	// a muted device returns the buffer but neither sends nor captures
+	n.Mute(true)
+	d.submit(1, buffer{bufBase, uint32(12 + len(frame)), false})
+	n.Mute(false)
+	assertEq(t, 2, d.used(1))
+	assertEq(t, uint64(24+2*16+len(frame)+len(reply)), uint64(capture.Len()))
+}
+
+func TestVirtioRng(t *testing.T) {
+	entropy := func(seed uint64) []byte {
+		cpu := runtime.NewCPU(nil)
+		if _, err := cpu.Bus.AddVirtio(virtio.NewSeededRng(seed)); err != nil {
+			t.Fatal(err)
+		}
+		d := newDriver(t, cpu, 0, 1)
+		assertEq(t, virtio.RngID, d.load(virtio.DeviceID))
+		d.submit(0, buffer{bufBase, 20, true})
+		assertEq(t, 1, d.used(0))
+		return d.read(bufBase, 20)
+	}
+	a, b := entropy(1), entropy(1)
+	if !bytes.Equal(a, b) {
+		t.Fatalf("seeded runs differ: %x, %x", a, b)
+	}
+	if bytes.Equal(a, entropy(2)) || bytes.Equal(a, make([]byte, 20)) {
+		t.Fatalf("unexpected entropy %x", a)
+	}
+}
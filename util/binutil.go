@@ -6,12 +6,23 @@ var (
 	//crossCompile = "riscv64-linux-gnu-"
 	crossCompile = "riscv64-unknown-elf-"
 	cflags       = []string{"-nostdlib", "-fno-builtin", "-march=rv64g", "-mabi=lp64", "-O1", "-Wall", "-Ttext=0x80000000"}
+	userCflags   = []string{"-nostdlib", "-static", "-march=rv64g", "-mabi=lp64"} // the linker's default layout, from 0x10000
 	cc           = crossCompile + "gcc"
 
 	objcopy = "llvm-objcopy"
 	objdump = "llvm-objdump"
 )
 
+// Toolchain returns why Compile and Objcopy cannot run here, or nil.
+func Toolchain() error {
+	for _, tool := range []string{cc, objcopy} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func Compile(infile, outfile string) {
 	cmd := exec.Command(cc, append(cflags, "-o", outfile, infile)...)
 	if err := cmd.Run(); err != nil {
@@ -19,6 +30,14 @@ func Compile(infile, outfile string) {
 	}
 }
 
+// CompileUser links a freestanding program to run as a Linux process.
+func CompileUser(infile, outfile string) {
+	cmd := exec.Command(cc, append(userCflags, "-o", outfile, infile)...)
+	if err := cmd.Run(); err != nil {
+		panic(err)
+	}
+}
+
 func Objcopy(infile, outfile string) {
 	cmd := exec.Command(objcopy, "-j", ".text", "-O", "binary", infile, outfile)
 	if err := cmd.Run(); err != nil {
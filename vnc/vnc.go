@@ -0,0 +1,350 @@
+package vnc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"net"
+	"time"
+)
+
+// Display is the screen served to clients.
+type Display interface {
+	Image() *image.RGBA
+}
+
+// Input receives the keyboard and pointer events of clients. Keys are X11
+// keysyms, buttons a mask with bit 0 for the left button.
+type Input interface {
+	Key(down bool, keysym uint32)
+	Pointer(buttons uint8, x, y int)
+}
+
+// Client to server message types.
+const (
+	setPixelFormat           = 0
+	setEncodings             = 2
+	framebufferUpdateRequest = 3
+	keyEvent                 = 4
+	pointerEvent             = 5
+	clientCutText            = 6
+
+	framebufferUpdate = 0
+	encodingRaw       = 0
+	securityNone      = 1
+	maxCutText        = 1 << 20
+)
+
+// Server is an RFB (VNC) server without authentication, for local use.
+type Server struct {
+	Name     string
+	Display  Display
+	Input    Input         // clients are view-only if nil
+	Interval time.Duration // how often the display is checked for changes
+
+	l net.Listener
+}
+
+func NewServer(name string, d Display) *Server {
+	return &Server{Name: name, Display: d, Interval: 30 * time.Millisecond}
+}
+
+// Listen accepts clients on addr in the background, and returns the address
+// it listens on.
+func (s *Server) Listen(addr string) (net.Addr, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s.l = l
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return l.Addr(), nil
+}
+
+func (s *Server) Close() error {
+	if s.l == nil {
+		return nil
+	}
+	return s.l.Close()
+}
+
+// pixelFormat is the layout of a pixel on the wire.
+type pixelFormat struct {
+	BitsPerPixel uint8
+	Depth        uint8
+	BigEndian    uint8
+	TrueColour   uint8
+	RedMax       uint16
+	GreenMax     uint16
+	BlueMax      uint16
+	RedShift     uint8
+	GreenShift   uint8
+	BlueShift    uint8
+	_            [3]byte
+}
+
+var defaultFormat = pixelFormat{
+	BitsPerPixel: 32, Depth: 24, TrueColour: 1,
+	RedMax: 255, GreenMax: 255, BlueMax: 255,
+	RedShift: 16, GreenShift: 8, BlueShift: 0,
+}
+
+type request struct {
+	incremental bool
+	rect        image.Rectangle
+}
+
+type client struct {
+	s        *Server
+	conn     net.Conn
+	r        *bufio.Reader
+	format   chan pixelFormat
+	requests chan request
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	c := &client{s: s, conn: conn, r: bufio.NewReader(conn), format: make(chan pixelFormat, 1), requests: make(chan request, 16)}
+	if err := c.handshake(); err != nil {
+		return
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go c.update(done)
+	c.read()
+}
+
+func (c *client) handshake() error {
+	if _, err := io.WriteString(c.conn, "RFB 003.008\n"); err != nil {
+		return err
+	}
+	version := make([]byte, 12)
+	if _, err := io.ReadFull(c.r, version); err != nil {
+		return err
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(string(version), "RFB %03d.%03d\n", &major, &minor); err != nil || major != 3 {
+		return fmt.Errorf("invalid protocol version: %q", version)
+	}
+	if minor < 7 {
+		// the server picks the security type
+		if err := binary.Write(c.conn, binary.BigEndian, uint32(securityNone)); err != nil {
+			return err
+		}
+	} else {
+		if _, err := c.conn.Write([]byte{1, securityNone}); err != nil {
+			return err
+		}
+		choice, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if choice != securityNone {
+			return fmt.Errorf("invalid security type: %d", choice)
+		}
+		if minor >= 8 {
+			if err = binary.Write(c.conn, binary.BigEndian, uint32(0)); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := c.r.ReadByte(); err != nil { // shared flag, every client shares
+		return err
+	}
+	b := c.s.Display.Image().Bounds()
+	init := []any{uint16(b.Dx()), uint16(b.Dy()), defaultFormat, uint32(len(c.s.Name))}
+	for _, v := range init {
+		if err := binary.Write(c.conn, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(c.conn, c.s.Name)
+	return err
+}
+
+// read handles client messages until the connection fails.
+func (c *client) read() {
+	for {
+		typ, err := c.r.ReadByte()
+		if err != nil {
+			return
+		}
+		switch typ {
+		case setPixelFormat:
+			var msg struct {
+				_      [3]byte
+				Format pixelFormat
+			}
+			if binary.Read(c.r, binary.BigEndian, &msg) != nil {
+				return
+			}
+			if msg.Format.TrueColour == 0 || msg.Format.BitsPerPixel%8 != 0 || msg.Format.BitsPerPixel == 0 || msg.Format.BitsPerPixel > 32 {
+				return // colour maps are not supported
+			}
+			select {
+			case <-c.format:
+			default:
+			}
+			c.format <- msg.Format
+		case setEncodings:
+			var msg struct {
+				_ byte
+				N uint16
+			}
+			if binary.Read(c.r, binary.BigEndian, &msg) != nil {
+				return
+			}
+			if _, err = c.r.Discard(4 * int(msg.N)); err != nil {
+				return // only raw encoding is used, which every client supports
+			}
+		case framebufferUpdateRequest:
+			var msg struct {
+				Incremental uint8
+				X, Y, W, H  uint16
+			}
+			if binary.Read(c.r, binary.BigEndian, &msg) != nil {
+				return
+			}
+			rect := image.Rect(int(msg.X), int(msg.Y), int(msg.X)+int(msg.W), int(msg.Y)+int(msg.H))
+			select {
+			case c.requests <- request{msg.Incremental != 0, rect}:
+			default: // the previous requests cover this one
+			}
+		case keyEvent:
+			var msg struct {
+				Down uint8
+				_    [2]byte
+				Key  uint32
+			}
+			if binary.Read(c.r, binary.BigEndian, &msg) != nil {
+				return
+			}
+			if c.s.Input != nil {
+				c.s.Input.Key(msg.Down != 0, msg.Key)
+			}
+		case pointerEvent:
+			var msg struct {
+				Buttons uint8
+				X, Y    uint16
+			}
+			if binary.Read(c.r, binary.BigEndian, &msg) != nil {
+				return
+			}
+			if c.s.Input != nil {
+				c.s.Input.Pointer(msg.Buttons, int(msg.X), int(msg.Y))
+			}
+		case clientCutText:
+			var msg struct {
+				_   [3]byte
+				Len uint32
+			}
+			if binary.Read(c.r, binary.BigEndian, &msg) != nil || msg.Len > maxCutText {
+				return
+			}
+			if _, err = c.r.Discard(int(msg.Len)); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// update answers update requests, holding back incremental ones until the
+// requested area changes.
+func (c *client) update(done chan struct{}) {
+	format := defaultFormat
+	var last *image.RGBA
+	for {
+		var req request
+		select {
+		case req = <-c.requests:
+		case <-done:
+			return
+		}
+		for {
+			select {
+			case format = <-c.format:
+				last = nil // redraw everything in the new format
+			default:
+			}
+			img := c.s.Display.Image()
+			rect := req.rect.Intersect(img.Bounds())
+			if req.incremental && last != nil {
+				rect = changed(last, img, rect)
+			}
+			if !rect.Empty() || !req.incremental {
+				if last == nil {
+					last = img
+				} else {
+					draw.Draw(last, rect, img, rect.Min, draw.Src) // what the client has now
+				}
+				if c.send(img, rect, format) != nil {
+					c.conn.Close()
+					return
+				}
+				break
+			}
+			select {
+			case <-time.After(c.s.Interval):
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+// changed returns the smallest rectangle within r holding every pixel that
+// differs between a and b.
+func changed(a, b *image.RGBA, r image.Rectangle) image.Rectangle {
+	var dirty image.Rectangle
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			i := a.PixOffset(x, y)
+			if a.Pix[i] != b.Pix[i] || a.Pix[i+1] != b.Pix[i+1] || a.Pix[i+2] != b.Pix[i+2] {
+				dirty = dirty.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return dirty
+}
+
+func (c *client) send(img *image.RGBA, r image.Rectangle, f pixelFormat) error {
+	bpp := int(f.BitsPerPixel / 8)
+	msg := make([]byte, 16, 16+r.Dx()*r.Dy()*bpp)
+	msg[0] = framebufferUpdate
+	binary.BigEndian.PutUint16(msg[2:], 1)
+	binary.BigEndian.PutUint16(msg[4:], uint16(r.Min.X))
+	binary.BigEndian.PutUint16(msg[6:], uint16(r.Min.Y))
+	binary.BigEndian.PutUint16(msg[8:], uint16(r.Dx()))
+	binary.BigEndian.PutUint16(msg[10:], uint16(r.Dy()))
+	binary.BigEndian.PutUint32(msg[12:], encodingRaw)
+	var pixel [4]byte
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			i := img.PixOffset(x, y)
+			v := uint32(img.Pix[i])*uint32(f.RedMax)/255<<f.RedShift |
+				uint32(img.Pix[i+1])*uint32(f.GreenMax)/255<<f.GreenShift |
+				uint32(img.Pix[i+2])*uint32(f.BlueMax)/255<<f.BlueShift
+			if f.BigEndian != 0 {
+				binary.BigEndian.PutUint32(pixel[:], v<<(32-8*bpp))
+			} else {
+				binary.LittleEndian.PutUint32(pixel[:], v)
+			}
+			msg = append(msg, pixel[:bpp]...)
+		}
+	}
+	_, err := c.conn.Write(msg)
+	return err
+}